@@ -68,24 +68,49 @@ const (
 type ExprType string
 
 const (
-	Simple     string = "simple"
-	JavaScript        = "javascript"
-	N1QL              = "n1ql"
+	Simple     ExprType = "simple"
+	JavaScript ExprType = "javascript"
+	N1QL       ExprType = "n1ql"
 )
 
 // Every index ever created and maintained by this package will have an
 // associated index-info structure.
 type IndexInfo struct {
-	Name       string    `json:"name,omitempty"`       // Name of the index
-	Uuid       string    `json:"uuid,omitempty"`       // unique id for every index
-	Using      IndexType `json:"using,omitempty"`      // indexing algorithm
-	OnExprList []string  `json:"onExprList,omitempty"` // expression list
-	Bucket     string    `json:"bucket,omitempty"`     // bucket name
-	IsPrimary  bool      `json:"isPrimary,omitempty"`
-	Exprtype   ExprType  `json:"exprType,omitempty"`
+	Name       string     `json:"name,omitempty"`       // Name of the index
+	Uuid       string     `json:"uuid,omitempty"`       // unique id for every index
+	Using      IndexType  `json:"using,omitempty"`      // indexing algorithm
+	OnExprList []string   `json:"onExprList,omitempty"` // expression list
+	Bucket     string     `json:"bucket,omitempty"`     // bucket name
+	IsPrimary  bool       `json:"isPrimary,omitempty"`
+	Exprtype   ExprType   `json:"exprType,omitempty"`
+	DeferBuild bool       `json:"deferBuild,omitempty"` // wait for a BUILD request
+	State      IndexState `json:"state,omitempty"`      // build state, maintained by the indexer
+	StateMsg   string     `json:"stateMsg,omitempty"`   // reason for INDEX_ERROR
+	Workers    int        `json:"workers,omitempty"`    // mutation workers of its own, 0 to share workers
 	//  Engine     Finder    `json:"engine,omitempty"` // instance of index algorithm.
 }
 
+// IndexState is the build state of an index. An index is created empty, is
+// building while it is backfilled from the bucket and becomes ready once it
+// has caught up with the bucket's high seqnos at the time the build started.
+// Indexes created with DeferBuild stay deferred until a BUILD request, which
+// backfills a set of deferred indexes together.
+type IndexState string
+
+const (
+	INDEX_DEFERRED IndexState = "deferred"
+	INDEX_CREATED  IndexState = "created"
+	INDEX_BUILDING IndexState = "building"
+	INDEX_READY    IndexState = "ready"
+	INDEX_ERROR    IndexState = "error"
+)
+
+// IsReady tells whether the index can be scanned. Indexes created before
+// index states were introduced have no state and are ready.
+func (info *IndexInfo) IsReady() bool {
+	return info.State == INDEX_READY || info.State == ""
+}
+
 // Accuracy characterizes if the results of the index is subject to probabilistic errors.
 // When an algorithm that is not Perfect is used, the caller must verify the results.
 type Accuracy float64
@@ -222,6 +247,41 @@ type RangeCounter interface {
 	CountRange(low Key, high Key, inclusion Inclusion) (uint64, error)
 }
 
+// Sizer is a class of algorithms that can report their on-disk footprint
+type Sizer interface {
+	Finder
+	DiskSize() (uint64, error)
+}
+
+// Estimator is a class of algorithms that can return approximate counts
+// without scanning the index, so that a planner can choose between indexes
+// cheaply. Every estimate is returned with its Accuracy.
+type Estimator interface {
+	Finder
+	EstimateRange(low Key, high Key, inclusion Inclusion) (uint64, Accuracy, error)
+	EstimateDistinct() (uint64, Accuracy, error)
+}
+
+// Snapshotter is a class of algorithms that can keep point in time copies
+// of their contents and go back to them, so that an index can be rolled
+// back when the data source rolls back.
+type Snapshotter interface {
+	Finder
+	// Snapshot takes a point in time view of the index. It must be cheap,
+	// mutations are held back while it is taken.
+	Snapshot() (Snapshot, error)
+	// Restore replaces the contents of the index with a snapshot saved at
+	// `path`, an empty path empties the index.
+	Restore(path string) error
+}
+
+// Snapshot is a point in time view of an index.
+type Snapshot interface {
+	// Save writes the view to `path`, which must not exist.
+	Save(path string) error
+	Release()
+}
+
 // Mutations from projector to indexer.
 type Mutation struct {
 	Type         UprEventName
@@ -230,6 +290,7 @@ type Mutation struct {
 	Docid        string
 	Vbucket      uint16
 	Seqno        uint64
+	Vbuuid       uint64 // history branch of the vbucket, from its failover log
 }
 
 //list of index UUIDs
@@ -240,3 +301,25 @@ type SequenceVector []uint64
 
 //map of <Index, SequenceVector>
 type IndexSequenceMap map[string]SequenceVector // indexed with index-uuid
+
+//vbucket UUID for each of 1024 vbuckets, the failover log entry of the
+//history branch the seqno of the same vbucket in a SequenceVector is on.
+//0 if unknown.
+type VbuuidVector []uint64
+
+//map of <Index, VbuuidVector>
+type IndexVbuuidMap map[string]VbuuidVector // indexed with index-uuid
+
+// IndexVectors are the seqnos applied to indexes along with the vbucket
+// history branches they are on.
+type IndexVectors struct {
+	Seqnos  IndexSequenceMap
+	Vbuuids IndexVbuuidMap
+}
+
+// RollbackRequest asks the indexer to roll Indexes back so that none of
+// their vbuckets is past Target, after the data source rolled back.
+type RollbackRequest struct {
+	Indexes IndexList
+	Target  SequenceVector
+}
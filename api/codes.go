@@ -7,17 +7,123 @@
 //  either express or implied. See the License for the specific language governing permissions
 //  and limitations under the License.
 
+// Error codes returned in IndexError.Code. Codes are part of the wire
+// format and must not change, clients branch on them,
+//
+//   if api.CodeOf(err) == api.ERR_INDEX_NOT_FOUND {
+//       ...
+//   }
+//
+// Errors without a code are reported as ERR_INTERNAL, which is the code
+// older servers used for every error.
+
 package api
 
-import "errors"
+import "fmt"
+
+type ErrorCode string
+
+const (
+	ERR_INDEX_NOT_FOUND    ErrorCode = "index_not_found"
+	ERR_DUPLICATE_INDEX    ErrorCode = "duplicate_index"
+	ERR_SCAN_NOT_SUPPORTED ErrorCode = "scan_not_supported" // by the index engine
+	ERR_ENGINE             ErrorCode = "engine_failure"
+	ERR_NOT_READY          ErrorCode = "index_not_ready"
+	ERR_TIMEOUT            ErrorCode = "timeout"
+	ERR_BAD_REQUEST        ErrorCode = "bad_request"
+	ERR_UNAUTHENTICATED    ErrorCode = "unauthenticated"
+	ERR_FORBIDDEN          ErrorCode = "forbidden" // missing role
+	ERR_QUEUE_FULL         ErrorCode = "queue_full"
+	ERR_STREAM_FAILED      ErrorCode = "stream_failed" // handshake to restart the stream
+	ERR_INTERNAL           ErrorCode = ErrorCode(ERROR)
+)
+
+// Retryable tells whether a request failing with `code` may succeed if
+// sent again later, unchanged.
+func (code ErrorCode) Retryable() bool {
+	return code == ERR_QUEUE_FULL || code == ERR_NOT_READY
+}
+
+// Error is an error with a code.
+type Error struct {
+	Code ErrorCode
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func (e *Error) ErrorCode() ErrorCode {
+	return e.Code
+}
+
+// Coder is implemented by errors that carry a code.
+type Coder interface {
+	ErrorCode() ErrorCode
+}
+
+func NewError(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+// EngineError wraps an error returned by an index engine, errors that
+// already carry a code are returned as is.
+func EngineError(err error) error {
+	if _, ok := err.(Coder); ok || err == nil {
+		return err
+	}
+	return &Error{Code: ERR_ENGINE, Msg: err.Error()}
+}
 
 var (
-	DuplicateIndex   = errors.New("Index by the specified name already exists")
-	NoSuchIndex      = errors.New("Index by the specified name does not exist")
-	NoSuchType       = errors.New("The specified index type is not defined")
-	DDocChanged      = errors.New("The design doc has been changed externally")
-	DDocCreateFailed = errors.New("Unable to create design doc for index")
-	ExprNotSupported = errors.New("Expression type is not supported")
+	DuplicateIndex   = &Error{ERR_DUPLICATE_INDEX, "Index by the specified name already exists"}
+	NoSuchIndex      = &Error{ERR_INDEX_NOT_FOUND, "Index by the specified name does not exist"}
+	NoSuchType       = &Error{ERR_BAD_REQUEST, "The specified index type is not defined"}
+	DDocChanged      = &Error{ERR_ENGINE, "The design doc has been changed externally"}
+	DDocCreateFailed = &Error{ERR_ENGINE, "Unable to create design doc for index"}
+	ExprNotSupported = &Error{ERR_BAD_REQUEST, "Expression type is not supported"}
 )
 
-var DebugLog bool
+// sentinels are decoded back to the same value, so that comparisons like
+// `err == api.NoSuchIndex` hold on the client side.
+var sentinels = []*Error{
+	DuplicateIndex, NoSuchIndex, NoSuchType, DDocChanged, DDocCreateFailed,
+	ExprNotSupported,
+}
+
+// CodeOf returns the code of `err`, ERR_INTERNAL if it has none.
+func CodeOf(err error) ErrorCode {
+	if e, ok := err.(Coder); ok {
+		return e.ErrorCode()
+	}
+	return ERR_INTERNAL
+}
+
+// IndexErrorOf converts `err` for a response.
+func IndexErrorOf(err error) IndexError {
+	return IndexError{Code: string(CodeOf(err)), Msg: err.Error()}
+}
+
+// Err converts a response error back to a Go error.
+func (ie IndexError) Err() error {
+	code := ErrorCode(ie.Code)
+	if code == "" {
+		code = ERR_INTERNAL
+	}
+	for _, e := range sentinels {
+		if e.Code == code && e.Msg == ie.Msg {
+			return e
+		}
+	}
+	return &Error{Code: code, Msg: ie.Msg}
+}
+
+// ResponseError returns the first of `errs`, responses with status ERROR
+// are expected to carry at least one.
+func ResponseError(errs []IndexError) error {
+	if len(errs) == 0 {
+		return &Error{Code: ERR_INTERNAL, Msg: "Unknown error"}
+	}
+	return errs[0].Err()
+}
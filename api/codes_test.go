@@ -0,0 +1,54 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func roundTrip(t *testing.T, err error) error {
+	var res IndexMetaResponse
+	buf, _ := json.Marshal(IndexMetaResponse{Status: ERROR, Errors: []IndexError{IndexErrorOf(err)}})
+	if e := json.Unmarshal(buf, &res); e != nil {
+		t.Fatal(e)
+	}
+	return ResponseError(res.Errors)
+}
+
+func TestErrorCodes(t *testing.T) {
+	if err := roundTrip(t, NoSuchIndex); err != NoSuchIndex {
+		t.Errorf("Expected NoSuchIndex, got %v", err)
+	}
+
+	err := roundTrip(t, NewError(ERR_NOT_READY, "Index %v is not ready", "age"))
+	if CodeOf(err) != ERR_NOT_READY || err.Error() != "Index age is not ready" {
+		t.Errorf("Unexpected error %v %v", CodeOf(err), err)
+	}
+
+	//errors without a code, and responses from older servers
+	if err := roundTrip(t, errors.New("x")); CodeOf(err) != ERR_INTERNAL {
+		t.Errorf("Expected internal error, got %v", CodeOf(err))
+	}
+	if err := ResponseError([]IndexError{{Msg: "x"}}); CodeOf(err) != ERR_INTERNAL {
+		t.Errorf("Expected internal error, got %v", CodeOf(err))
+	}
+	if err := ResponseError(nil); CodeOf(err) != ERR_INTERNAL {
+		t.Errorf("Expected internal error, got %v", CodeOf(err))
+	}
+
+	if err := EngineError(errors.New("IO error")); CodeOf(err) != ERR_ENGINE {
+		t.Errorf("Expected engine error, got %v", CodeOf(err))
+	}
+	if EngineError(NoSuchIndex) != NoSuchIndex || EngineError(nil) != nil {
+		t.Error("EngineError must keep coded errors and nil")
+	}
+}
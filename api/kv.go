@@ -104,6 +104,16 @@ func (k *Key) EncodedBytes() []byte {
 	return k.encoded
 }
 
+// EncodedSecondaryBytes returns the encoded secondary key without the
+// trailing docid.
+func (k *Key) EncodedSecondaryBytes() []byte {
+
+	if i := bytes.LastIndex(k.encoded, KEY_SEPARATOR); i >= 0 {
+		return k.encoded[0:i]
+	}
+	return k.encoded
+}
+
 func (k *Key) String() string {
 	var buf bytes.Buffer
 	buf.WriteString("Key:[")
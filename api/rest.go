@@ -9,7 +9,6 @@
 
 // REST API to access indexing.
 
-// TODO: Implement STATS command.
 // TODO: Change the server implementation URL to follow REST philosphy.
 
 package api
@@ -24,6 +23,12 @@ const (
 	NODES  RequestType = "nodes"
 	SCAN   RequestType = "scan"
 	STATS  RequestType = "stats"
+	// key distribution statistics of an index
+	KEYSTATS RequestType = "keystats"
+	// build progress of an index
+	PROGRESS RequestType = "progress"
+	// start building a set of deferred indexes
+	BUILD RequestType = "build"
 )
 
 // All API accept IndexRequest structure and returns IndexResponse structure.
@@ -32,6 +37,7 @@ const (
 type IndexRequest struct {
 	Type       RequestType `json:"type,omitempty"`
 	Index      IndexInfo   `json:"index,omitempty"`
+	Indexes    []IndexInfo `json:"indexes,omitempty"` // for BUILD
 	ServerUuid string      `json:"serverUuid,omitempty"`
 	Params     QueryParams `json:"params,omitempty"`
 }
@@ -43,6 +49,13 @@ type QueryParams struct {
 	High      [][]byte  `json:"high,omitempty"`
 	Inclusion Inclusion `json:"inclusion,omitempty"`
 	Limit     int64     `json:"limit,omitempty"`
+	Refresh   bool      `json:"refresh,omitempty"` // recompute key statistics
+	// scan indexes that are not ready, response is flagged Stale
+	AllowStale bool `json:"allowStale,omitempty"`
+	// milliseconds, the indexer's scan timeout applies if zero
+	Timeout int64 `json:"timeout,omitempty"`
+	// unix time in milliseconds, the earlier of Timeout and Deadline applies
+	Deadline int64 `json:"deadline,omitempty"`
 }
 
 type ScanType string
@@ -54,6 +67,9 @@ const (
 	RANGESCAN  ScanType = "rangeScan"
 	FULLSCAN   ScanType = "fullScan"
 	RANGECOUNT ScanType = "rangeCount"
+	// approximate counts, response carries the Accuracy of the estimate.
+	ESTIMATERANGE    ScanType = "estimateRange"
+	ESTIMATEDISTINCT ScanType = "estimateDistinct"
 )
 
 //RESPONSE DATA FORMATS
@@ -86,10 +102,135 @@ type IndexMetaResponse struct {
 type IndexScanResponse struct {
 	Status    ResponseStatus `json:"status,omitempty"`
 	TotalRows uint64         `json:"totalrows,omitempty"`
+	Accuracy  Accuracy       `json:"accuracy,omitempty"`
+	Stale     bool           `json:"stale,omitempty"` // index was not ready
 	Rows      []IndexRow     `json:"rows,omitempty"`
 	Errors    []IndexError   `json:"errors,omitempty"`
 }
 
+// Bucket of an equi-depth histogram over the leading key component. Every
+// bucket holds roughly the same number of rows, keys are JSON encoded.
+type HistogramBucket struct {
+	LowKey   []byte `json:"lowKey,omitempty"`
+	HighKey  []byte `json:"highKey,omitempty"`
+	Count    uint64 `json:"count"`
+	Distinct uint64 `json:"distinct"`
+}
+
+// Key distribution statistics of an index, used for cost based planning.
+type IndexKeyStats struct {
+	Indexid      string            `json:"indexid,omitempty"`
+	Rows         uint64            `json:"rows"`
+	DistinctKeys uint64            `json:"distinctKeys"`
+	NullCount    uint64            `json:"nullCount"`    // leading key is null
+	MissingCount uint64            `json:"missingCount"` // leading key is missing
+	AvgKeySize   float64           `json:"avgKeySize"`
+	AvgValueSize float64           `json:"avgValueSize"`
+	DocsPerKey   float64           `json:"docsPerKey"`
+	Histogram    []HistogramBucket `json:"histogram,omitempty"`
+	Timestamp    int64             `json:"timestamp"` // unix time of last refresh
+	Mutations    uint64            `json:"mutations"` // applied since last refresh
+}
+
+type IndexKeyStatsResponse struct {
+	Status ResponseStatus  `json:"status,omitempty"`
+	Stats  []IndexKeyStats `json:"stats,omitempty"`
+	Errors []IndexError    `json:"errors,omitempty"`
+}
+
+// Scan latency percentiles, in milliseconds.
+type LatencyStats struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+}
+
+// Operational statistics of an index on an indexer node.
+type IndexStats struct {
+	Indexid            string       `json:"indexid,omitempty"`
+	Items              uint64       `json:"items"`
+	DiskSize           uint64       `json:"diskSize"`
+	MutationsProcessed uint64       `json:"mutationsProcessed"`
+	MutationsSkipped   uint64       `json:"mutationsSkipped"`   // key or value could not be generated
+	MutationsFailed    uint64       `json:"mutationsFailed"`    // engine returned an error
+	MutationsDuplicate uint64       `json:"mutationsDuplicate"` // seqno already applied
+	MutationsStale     uint64       `json:"mutationsStale"`     // seqno older than the last applied
+	SeqnoGaps          uint64       `json:"seqnoGaps"`          // seqnos skipped, UPR deduplication
+	Scans              uint64       `json:"scans"`
+	ScanErrors         uint64       `json:"scanErrors"`
+	ScanLatency        LatencyStats `json:"scanLatency"`
+	SequenceLag        uint64       `json:"sequenceLag"` // seqnos received but not yet applied
+	Paused             bool         `json:"paused,omitempty"`
+	RateLimit          float64      `json:"rateLimit,omitempty"`
+	DeadLetters        int          `json:"deadLetters,omitempty"`
+}
+
+// Length of an indexer queue. HighWater is the longest the queue has been
+// since the indexer started.
+type QueueStats struct {
+	Name      string `json:"name"`
+	Length    int    `json:"length"`
+	Capacity  int    `json:"capacity"`
+	HighWater int    `json:"highWater,omitempty"`
+}
+
+// Mutation worker group, of an index or shared by indexes without workers
+// of their own if Index is empty.
+type WorkerGroup struct {
+	Index   string `json:"index,omitempty"`
+	Workers int    `json:"workers"`
+	Queued  int    `json:"queued"` // mutations waiting to be distributed on workers
+}
+
+// Ingestion settings of an index, see /admin/ingest.
+type IngestState struct {
+	Index  string  `json:"index"`
+	Paused bool    `json:"paused,omitempty"`
+	Rate   float64 `json:"rate,omitempty"` // mutations admitted per second at most, 0 for no limit
+}
+
+// Mutation that could not be applied to an index, kept until it is retried
+// or purged, see /admin/deadletters.
+type DeadLetter struct {
+	Id           uint64       `json:"id"`
+	Index        string       `json:"index"`
+	Type         UprEventName `json:"type"`
+	Docid        string       `json:"docid"`
+	Vbucket      uint16       `json:"vbucket"`
+	Seqno        uint64       `json:"seqno"`
+	Vbuuid       uint64       `json:"vbuuid,omitempty"`
+	SecondaryKey [][]byte     `json:"secondaryKey,omitempty"` // raw key, as received
+	Reason       string       `json:"reason"`                 // key, value or engine
+	Error        string       `json:"error"`
+	// unix time in milliseconds of the last failure
+	Failed   int64 `json:"failed"`
+	Attempts int   `json:"attempts"`
+}
+
+type IndexStatsResponse struct {
+	Status  ResponseStatus `json:"status,omitempty"`
+	Queues  []QueueStats   `json:"queues,omitempty"`
+	Indexes []IndexStats   `json:"indexes,omitempty"`
+	Errors  []IndexError   `json:"errors,omitempty"`
+}
+
+// Build progress of an index. Progress counts seqnos applied towards the
+// build target, the bucket's high seqnos when the build started.
+type IndexProgress struct {
+	Indexid  string     `json:"indexid,omitempty"`
+	State    IndexState `json:"state,omitempty"`
+	StateMsg string     `json:"stateMsg,omitempty"`
+	Applied  uint64     `json:"applied"` // seqnos applied, up to target
+	Target   uint64     `json:"target"`  // sum of target seqnos
+	Percent  float64    `json:"percent"`
+}
+
+type IndexProgressResponse struct {
+	Status   ResponseStatus  `json:"status,omitempty"`
+	Progress []IndexProgress `json:"progress,omitempty"`
+	Errors   []IndexError    `json:"errors,omitempty"`
+}
+
 //Indexer Node Info
 type NodeInfo struct {
 	IndexerURL string `json:"indexerURL,omitempty"`
@@ -0,0 +1,361 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// TLS and authentication for index manager, indexer and projector, set up
+// from the `security` config section. Both are off by default.
+//
+// With `security.tls` servers listen with TLS using certFile and keyFile,
+// and clients verify servers against caFile. With `security.clientAuth`
+// servers also require a client certificate signed by caFile (mutual TLS),
+// clients present certFile. For local testing a self-signed certificate
+// can be used as its own CA,
+//
+//   openssl req -x509 -newkey rsa:2048 -nodes -days 365 -subj /CN=localhost \
+//       -keyout key.pem -out cert.pem
+//
+// With `security.usersFile` servers authenticate every request, either by
+// HTTP basic auth or by a verified client certificate whose common name is
+// a user, and check the user's roles. The users file is JSON,
+//
+//   {
+//     "admin":     {"password": "...", "roles": ["admin", "ddl", "scan"]},
+//     "projector": {"roles": ["ingest", "scan"]}
+//   }
+//
+// Users without a password can only authenticate with a certificate.
+// Clients send `security.user` and `security.password` with every request.
+//
+// Mutation RPC connections start with a handshake before JSON-RPC, the
+// client sends one JSON object with its credentials and the server replies
+// with one JSON object carrying an error or nothing. The handshake is only
+// exchanged if the server has a users file and the client has a user, both
+// ends must be configured alike.
+
+package auth
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/config"
+	"github.com/couchbaselabs/indexing/rest"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+type Role string
+
+const (
+	ROLE_ADMIN  Role = "admin"  // /config and /admin endpoints
+	ROLE_DDL    Role = "ddl"    // create, drop and build indexes
+	ROLE_SCAN   Role = "scan"   // scans, statistics and index metadata
+	ROLE_INGEST Role = "ingest" // mutation RPC
+)
+
+const HANDSHAKE_TIMEOUT = 10 * time.Second
+
+type User struct {
+	Password string `json:"password,omitempty"`
+	Roles    []Role `json:"roles"`
+}
+
+type Security struct {
+	users     map[string]*User // nil if authentication is off
+	serverTLS *tls.Config      // nil if TLS is off
+	clientTLS *tls.Config
+	user      string
+	password  string
+}
+
+// handshake objects of mutation RPC connections.
+type credentials struct {
+	User     string `json:"user"`
+	Password string `json:"password,omitempty"`
+}
+
+type handshakeReply struct {
+	Error *api.IndexError `json:"error,omitempty"`
+}
+
+// New loads certificates and users named by `cfg`.
+func New(cfg config.SecurityConfig) (*Security, error) {
+	var err error
+
+	s := &Security{user: cfg.User, password: cfg.Password}
+	if cfg.UsersFile != "" {
+		if s.users, err = LoadUsers(cfg.UsersFile); err != nil {
+			return nil, err
+		}
+	}
+	if !cfg.TLS {
+		return s, nil
+	}
+
+	var certs []tls.Certificate
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", cfg.CertFile, err)
+		}
+		certs = []tls.Certificate{cert}
+	}
+	var pool *x509.CertPool
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%v: no certificates found", cfg.CAFile)
+		}
+	}
+
+	//processes that only connect, like the projector, need no certificate
+	if certs != nil {
+		s.serverTLS = &tls.Config{Certificates: certs, ClientCAs: pool}
+		if cfg.ClientAuth {
+			s.serverTLS.ClientAuth = tls.RequireAndVerifyClientCert
+		} else if pool != nil {
+			s.serverTLS.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	s.clientTLS = &tls.Config{Certificates: certs, RootCAs: pool}
+	return s, nil
+}
+
+// LoadUsers reads a users file.
+func LoadUsers(path string) (map[string]*User, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]*User)
+	if err = json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return users, nil
+}
+
+// TLS tells whether connections use TLS.
+func (s *Security) TLS() bool {
+	return s.clientTLS != nil
+}
+
+// Scheme returns the URL scheme for HTTP requests.
+func (s *Security) Scheme() string {
+	if s.TLS() {
+		return "https"
+	}
+	return "http"
+}
+
+// Listen listens on `addr`, with TLS if configured.
+func (s *Security) Listen(addr string) (net.Listener, error) {
+	if s.TLS() && s.serverTLS == nil {
+		return nil, errors.New("TLS is enabled but security.certFile is not set")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil || s.serverTLS == nil {
+		return l, err
+	}
+	return tls.NewListener(l, s.serverTLS), nil
+}
+
+// Authenticate checks the credentials of `user`, `state` is the TLS state
+// of the connection, if any.
+func (s *Security) Authenticate(user, password string, state *tls.ConnectionState) error {
+	if s.users == nil {
+		return nil
+	}
+	u, ok := s.users[user]
+	if !ok {
+		return api.NewError(api.ERR_UNAUTHENTICATED, "Authentication failed")
+	}
+	if state != nil && len(state.VerifiedChains) > 0 &&
+		state.PeerCertificates[0].Subject.CommonName == user {
+		return nil
+	}
+	if u.Password == "" ||
+		subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) != 1 {
+		return api.NewError(api.ERR_UNAUTHENTICATED, "Authentication failed")
+	}
+	return nil
+}
+
+// Authorize checks that `user` has one of `roles`.
+func (s *Security) Authorize(user string, roles ...Role) error {
+	if s.users == nil {
+		return nil
+	}
+	if u, ok := s.users[user]; ok {
+		for _, have := range u.Roles {
+			for _, want := range roles {
+				if have == want {
+					return nil
+				}
+			}
+		}
+	}
+	return api.NewError(api.ERR_FORBIDDEN, "User %v is not allowed to do this", user)
+}
+
+// Check authenticates and authorizes a HTTP request.
+func (s *Security) Check(r *http.Request, roles ...Role) error {
+	if s.users == nil {
+		return nil
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		user = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if err := s.Authenticate(user, password, r.TLS); err != nil {
+		return err
+	}
+	return s.Authorize(user, roles...)
+}
+
+// Require wraps a handler that needs one of `roles`.
+func (s *Security) Require(h http.HandlerFunc, roles ...Role) http.HandlerFunc {
+	if s.users == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Check(r, roles...); err != nil {
+			if api.CodeOf(err) == api.ERR_UNAUTHENTICATED {
+				w.Header()["Www-Authenticate"] = []string{`Basic realm="indexing"`}
+			}
+			rest.SendError(w, err)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// RequireREST is Require() for v2 routes.
+func (s *Security) RequireREST(h rest.HandlerFunc, roles ...Role) rest.HandlerFunc {
+	if s.users == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		s.Require(func(w http.ResponseWriter, r *http.Request) {
+			h(w, r, params)
+		}, roles...)(w, r)
+	}
+}
+
+// HTTPClient returns a client that connects with TLS if configured and
+// sends the configured credentials.
+func (s *Security) HTTPClient() *http.Client {
+	if !s.TLS() && s.user == "" {
+		return http.DefaultClient
+	}
+	transport := &http.Transport{TLSClientConfig: s.clientTLS}
+	return &http.Client{Transport: &basicAuth{transport, s.user, s.password}}
+}
+
+type basicAuth struct {
+	base     http.RoundTripper
+	user     string
+	password string
+}
+
+func (t *basicAuth) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.user == "" {
+		return t.base.RoundTrip(r)
+	}
+	clone := new(http.Request)
+	*clone = *r
+	clone.Header = make(http.Header)
+	for k, v := range r.Header {
+		clone.Header[k] = v
+	}
+	clone.SetBasicAuth(t.user, t.password)
+	return t.base.RoundTrip(clone)
+}
+
+// Dial connects to the mutation RPC server at `addr`, with TLS if configured,
+// and sends the handshake if a user is configured.
+func (s *Security) Dial(addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+
+	if s.TLS() {
+		conf := s.clientTLS.Clone()
+		if conf.ServerName == "" {
+			conf.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		conn, err = tls.Dial("tcp", addr, conf)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil || s.user == "" {
+		return conn, err
+	}
+
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	var reply handshakeReply
+	err = json.NewEncoder(conn).Encode(credentials{s.user, s.password})
+	if err == nil {
+		err = json.NewDecoder(conn).Decode(&reply)
+	}
+	if err == nil && reply.Error != nil {
+		err = reply.Error.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Accept runs the server side of the handshake on a mutation RPC
+// connection. The connection must be closed if it fails.
+func (s *Security) Accept(conn net.Conn, roles ...Role) error {
+	var state *tls.ConnectionState
+
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	if tlsconn, ok := conn.(*tls.Conn); ok {
+		if err := tlsconn.Handshake(); err != nil {
+			return err
+		}
+		cs := tlsconn.ConnectionState()
+		state = &cs
+	}
+	if s.users == nil {
+		return nil
+	}
+
+	var cred credentials
+	if err := json.NewDecoder(conn).Decode(&cred); err != nil {
+		return err
+	}
+	err := s.Authenticate(cred.User, cred.Password, state)
+	if err == nil {
+		err = s.Authorize(cred.User, roles...)
+	}
+	var reply handshakeReply
+	if err != nil {
+		indexerr := api.IndexErrorOf(err)
+		reply.Error = &indexerr
+	}
+	if werr := json.NewEncoder(conn).Encode(reply); werr != nil && err == nil {
+		err = werr
+	}
+	return err
+}
@@ -0,0 +1,211 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/config"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testUsers = `{
+  "admin":     {"password": "secret", "roles": ["admin", "ddl", "scan"]},
+  "reader":    {"password": "reader", "roles": ["scan"]},
+  "projector": {"roles": ["ingest"]}
+}`
+
+// selfSigned writes a self-signed certificate for `cn`, usable as its own
+// CA, and returns the cert and key file names.
+func selfSigned(t *testing.T, dir, cn string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, cn+".pem")
+	keyFile := filepath.Join(dir, cn+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder}), 0600)
+	return certFile, keyFile
+}
+
+func testSecurity(t *testing.T, cfg config.SecurityConfig) *Security {
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func serveHTTP(t *testing.T, s *Security) string {
+	l, err := s.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/create", s.Require(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}, ROLE_DDL))
+	mux.HandleFunc("/scan", s.Require(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}, ROLE_SCAN))
+	go http.Serve(l, mux)
+	return l.Addr().String()
+}
+
+func TestHTTP(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "auth")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := selfSigned(t, dir, "localhost")
+	usersFile := filepath.Join(dir, "users.json")
+	ioutil.WriteFile(usersFile, []byte(testUsers), 0600)
+
+	server := testSecurity(t, config.SecurityConfig{
+		TLS: true, CertFile: certFile, KeyFile: keyFile, CAFile: certFile, UsersFile: usersFile,
+	})
+	addr := serveHTTP(t, server)
+
+	client := func(user, password string) *http.Client {
+		return testSecurity(t, config.SecurityConfig{
+			TLS: true, CAFile: certFile, User: user, Password: password,
+		}).HTTPClient()
+	}
+	expect := func(httpc *http.Client, path string, status int) {
+		resp, err := httpc.Get("https://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("%v: expected status %v, got %v", path, status, resp.StatusCode)
+		}
+	}
+	expect(client("admin", "secret"), "/create", http.StatusOK)
+	expect(client("reader", "reader"), "/scan", http.StatusOK)
+	expect(client("reader", "reader"), "/create", http.StatusForbidden)
+	expect(client("reader", "wrong"), "/scan", http.StatusUnauthorized)
+	expect(client("", ""), "/scan", http.StatusUnauthorized)
+	//passwordless users must present a certificate
+	expect(client("projector", ""), "/scan", http.StatusUnauthorized)
+
+	//server certificate is not trusted without the CA
+	insecure := testSecurity(t, config.SecurityConfig{TLS: true, User: "admin", Password: "secret"})
+	if _, err := insecure.HTTPClient().Get("https://" + addr + "/scan"); err == nil {
+		t.Error("Expected certificate verification to fail")
+	}
+}
+
+func TestRPCHandshake(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "auth")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := selfSigned(t, dir, "localhost")
+	projCert, projKey := selfSigned(t, dir, "projector")
+	usersFile := filepath.Join(dir, "users.json")
+	ioutil.WriteFile(usersFile, []byte(testUsers), 0600)
+
+	//clients are verified against the projector's self-signed certificate
+	server := testSecurity(t, config.SecurityConfig{
+		TLS: true, CertFile: certFile, KeyFile: keyFile, CAFile: projCert,
+		ClientAuth: true, UsersFile: usersFile,
+	})
+	l, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				if server.Accept(conn, ROLE_INGEST) == nil {
+					conn.Write([]byte("ok"))
+				}
+				conn.Close()
+			}(conn)
+		}
+	}()
+
+	dial := func(cfg config.SecurityConfig) error {
+		cfg.TLS, cfg.CAFile = true, certFile
+		conn, err := testSecurity(t, cfg).Dial(l.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		buf := make([]byte, 2)
+		if _, err = conn.Read(buf); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	//mutual TLS, the certificate identifies the user
+	err = dial(config.SecurityConfig{CertFile: projCert, KeyFile: projKey, User: "projector"})
+	if err != nil {
+		t.Errorf("Expected handshake to succeed, got %v", err)
+	}
+	//valid certificate, user without the ingest role
+	err = dial(config.SecurityConfig{
+		CertFile: projCert, KeyFile: projKey, User: "reader", Password: "reader",
+	})
+	if api.CodeOf(err) != api.ERR_FORBIDDEN {
+		t.Errorf("Expected forbidden, got %v", err)
+	}
+	//no client certificate
+	if err = dial(config.SecurityConfig{User: "projector"}); err == nil {
+		t.Error("Expected handshake without client certificate to fail")
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	s := testSecurity(t, config.Default().Security)
+	if s.TLS() || s.Scheme() != "http" || s.HTTPClient() != http.DefaultClient {
+		t.Error("Security must be off by default")
+	}
+	r, _ := http.NewRequest("GET", "/create", nil)
+	if err := s.Check(r, ROLE_DDL); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
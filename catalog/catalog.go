@@ -56,6 +56,12 @@ type IndexCatalog interface {
 	// Gets a specific instance
 	Index(uuid string) (api.IndexInfo, error)
 
+	// Change the build state of an index, `msg` explains an error state
+	SetState(uuid string, state api.IndexState, msg string) (string, error)
+
+	// Change the number of mutation workers of an index, 0 to share workers
+	SetWorkers(uuid string, workers int) (string, error)
+
 	// Get Uuid
 	GetUuid() string
 
@@ -147,7 +153,40 @@ func (c *catalog) Drop(uuid string) (string, error) {
 		delete(c.indexes, uuid)
 		err = c.saveCatalog()
 	} else {
-		err = errors.New("uuid not found in index catalog")
+		err = api.NewError(api.ERR_INDEX_NOT_FOUND, "uuid not found in index catalog")
+	}
+	return c.uuid, err
+}
+
+func (c *catalog) SetState(uuid string, state api.IndexState, msg string) (string, error) {
+	var err error
+
+	//Write Lock
+	c.Lock()
+	defer c.Unlock()
+
+	if index, ok := c.indexes[uuid]; ok {
+		index.State = state
+		index.StateMsg = msg
+		err = c.saveCatalog()
+	} else {
+		err = api.NewError(api.ERR_INDEX_NOT_FOUND, "uuid not found in index catalog")
+	}
+	return c.uuid, err
+}
+
+func (c *catalog) SetWorkers(uuid string, workers int) (string, error) {
+	var err error
+
+	//Write Lock
+	c.Lock()
+	defer c.Unlock()
+
+	if index, ok := c.indexes[uuid]; ok {
+		index.Workers = workers
+		err = c.saveCatalog()
+	} else {
+		err = api.NewError(api.ERR_INDEX_NOT_FOUND, "uuid not found in index catalog")
 	}
 	return c.uuid, err
 }
@@ -176,7 +215,7 @@ func (c *catalog) Index(uuid string) (api.IndexInfo, error) {
 			return *index, nil
 		}
 	}
-	return api.IndexInfo{}, errors.New("Invalid uuid")
+	return api.IndexInfo{}, api.NewError(api.ERR_INDEX_NOT_FOUND, "Invalid uuid")
 }
 
 func (c *catalog) Exists(name string, bucket string) error {
@@ -184,7 +223,7 @@ func (c *catalog) Exists(name string, bucket string) error {
 	for _, indexinfo := range c.indexes {
 
 		if name == indexinfo.Name && bucket == indexinfo.Bucket {
-			return errors.New(fmt.Sprintf("Index %s already exists with UUID %s", name, indexinfo.Uuid))
+			return api.NewError(api.ERR_DUPLICATE_INDEX, "Index %s already exists with UUID %s", name, indexinfo.Uuid)
 		}
 	}
 
@@ -197,34 +236,42 @@ func (c *catalog) Exists(name string, bucket string) error {
 func (c *catalog) saveCatalog() (err error) {
 	var fd *os.File
 
-	// Open the catalog file
-	if fd, err = os.OpenFile(c.file, os.O_WRONLY, 0660); err != nil {
+	// A new uuid for every change, clients compare it to detect changes
+	uvalue, err := uuid.NewV4()
+	if err != nil {
 		return err
 	}
-	defer fd.Close()
+	newUuid := fmt.Sprintf("%v", uvalue)
 
 	// gob-encoder
 	buf := new(bytes.Buffer)
 	genc := gob.NewEncoder(buf)
 
-	// Write the count
-	genc.Encode(int32(len(c.indexes)))
-
-	// Write the uuid
-	if uvalue, err := uuid.NewV4(); err == nil {
-		c.uuid = fmt.Sprintf("%v", uvalue)
-		genc.Encode(c.uuid)
+	// Write the count and the uuid
+	if err = genc.Encode(int32(len(c.indexes))); err != nil {
+		return err
+	}
+	if err = genc.Encode(newUuid); err != nil {
+		return err
 	}
 
 	// Write IndexInfo
 	for _, index := range c.indexes {
 		indexClone := *index // Copy
-		genc.Encode(indexClone)
+		if err = genc.Encode(indexClone); err != nil {
+			return err
+		}
 	}
+
+	// Open the catalog file, truncated as the catalog may have shrunk
+	if fd, err = os.OpenFile(c.file, os.O_WRONLY|os.O_TRUNC, 0660); err != nil {
+		return err
+	}
+	defer fd.Close()
 	if _, err = fd.Write(buf.Bytes()); err != nil {
 		return err
 	}
-
+	c.uuid = newUuid
 	return nil
 }
 
@@ -42,7 +42,7 @@ func TestCodec(t *testing.T) {
 	datadir := "./"
 	os.Remove(filepath.Join(datadir, CATALOGFILE))
 
-	if c, err = NewIndexCatalog(datadir); err != nil {
+	if c, err = NewIndexCatalog(datadir, ""); err != nil {
 		t.Error("Cannot create index catalog file")
 	}
 	if len(c.indexes) != 0 {
@@ -65,7 +65,7 @@ func TestCatalog(t *testing.T) {
 
 	datadir := "./"
 	os.Remove(filepath.Join(datadir, CATALOGFILE))
-	if c_, err := NewIndexCatalog(datadir); err != nil {
+	if c_, err := NewIndexCatalog(datadir, ""); err != nil {
 		t.Fatal("Cannot open index catalog file")
 	} else {
 		c = c_
@@ -73,6 +73,7 @@ func TestCatalog(t *testing.T) {
 
 	indexinfo = api.IndexInfo{
 		Name:       "test",
+		Uuid:       "d3ab9e3b-5a33-4a4b-9c0a-1f3e2d5b7c01",
 		Using:      api.Llrb,
 		OnExprList: []string{`{"type":"property","path":"age"}`},
 		Bucket:     "users",
@@ -93,7 +94,7 @@ func TestCatalog(t *testing.T) {
 		t.Error("Duplicate Index should not be allowed")
 	}
 	// Reload the indexes from catalog
-	if c_, err = NewIndexCatalog(datadir); err != nil {
+	if c_, err = NewIndexCatalog(datadir, ""); err != nil {
 		t.Fatal("Cannot re-open index catalog file", err)
 	} else if len(c_.indexes) != 1 {
 		t.Error("Indexes must have one index")
@@ -110,12 +111,22 @@ func TestCatalog(t *testing.T) {
 		t.Error("Index() api fails", indexinfo)
 	}
 
+	// Test SetState()
+	if _, err = c.SetState(indexinfo.Uuid, api.INDEX_READY, ""); err != nil {
+		t.Error("SetState() returned", err)
+	} else if indexinfo, err = c.Index(indexinfo.Uuid); indexinfo.State != api.INDEX_READY {
+		t.Error("SetState() did not change the state", indexinfo.State)
+	}
+	if _, err = c.SetState("nosuch", api.INDEX_READY, ""); err == nil {
+		t.Error("SetState() must fail for unknown uuid")
+	}
+
 	// Test List()
 	if _, ls, err := c.List(""); err != nil {
 		t.Error(err)
 	} else {
 		if len(ls) != 1 {
-			t.Error("List returns", len(ls))
+			t.Fatal("List returns", len(ls))
 		}
 		if !reflect.DeepEqual(ls[0].OnExprList, indexinfo.OnExprList) {
 			t.Error("List returns create statement", ls[0].OnExprList)
@@ -127,7 +138,7 @@ func TestCatalog(t *testing.T) {
 		t.Error("Drop() returned", err)
 	}
 	// Reload the indexes from catalog
-	if c_, err := NewIndexCatalog(datadir); err != nil {
+	if c_, err := NewIndexCatalog(datadir, ""); err != nil {
 		t.Fatal("Cannot re-open index catalog file")
 	} else if len(c_.indexes) != 0 {
 		t.Error("Indexes must have one index")
@@ -0,0 +1,382 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Configuration shared by indexer, index manager and projector. A single
+// JSON file holds a section per process, settings are applied in order,
+//
+//   defaults < config file < environment < command line
+//
+// Every setting is addressed by a key made of its section and field name,
+// like "indexer.httpAddr". The environment variable for a key is its
+// upper-cased form prefixed with INDEXING_, like INDEXING_INDEXER_HTTPADDR.
+// On the command line, `-set key=value` may be repeated.
+//
+// Settings tagged `reload:"true"` can be changed while the process is
+// running, either by reloading the config file or through Handler(),
+// which processes mount at /config. Changes to other settings are refused
+// at reload and need a restart.
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/couchbaselabs/indexing/logging"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const ENV_PREFIX = "INDEXING_"
+
+var UnknownSetting = errors.New("Unknown configuration setting")
+var NotReloadable = errors.New("Configuration setting cannot be changed without restart")
+
+type Config struct {
+	LogLevel  string          `json:"logLevel" reload:"true"`
+	Indexer   IndexerConfig   `json:"indexer"`
+	Manager   ManagerConfig   `json:"manager"`
+	Projector ProjectorConfig `json:"projector"`
+	LevelDB   LevelDBConfig   `json:"leveldb"`
+	Security  SecurityConfig  `json:"security"`
+}
+
+type IndexerConfig struct {
+	HttpAddr          string `json:"httpAddr"`
+	RpcAddr           string `json:"rpcAddr"`
+	DataDir           string `json:"dataDir"`
+	CatalogFile       string `json:"catalogFile"`
+	MutationQueueSize int    `json:"mutationQueueSize"` //incoming mutations
+	MutationWorkers   int    `json:"mutationWorkers" reload:"true"`
+	WorkerQueueSize   int    `json:"workerQueueSize"`   //mutations per worker
+	SequenceQueueSize int    `json:"sequenceQueueSize"` //seqno notifications
+	ScanWorkers       int    `json:"scanWorkers"`       //concurrent scans
+	ScanQueueSize     int    `json:"scanQueueSize"`     //scans waiting per priority
+	ScanTimeoutMs     int    `json:"scanTimeoutMs" reload:"true"`
+	SnapshotInterval  int    `json:"snapshotInterval"` //seconds between index snapshots, 0 disables
+	SnapshotsKept     int    `json:"snapshotsKept"`    //snapshots kept per index
+	WalEnabled        bool   `json:"walEnabled"`       //log mutations under <dataDir>/wal before acknowledging them
+	WalSync           bool   `json:"walSync"`          //fsync the log before acknowledging
+	WalSegmentMB      int    `json:"walSegmentMB"`     //size of log segment files
+}
+
+type ManagerConfig struct {
+	HttpAddr    string `json:"httpAddr"`
+	DataDir     string `json:"dataDir"`
+	CatalogFile string `json:"catalogFile"`
+	IndexerURL  string `json:"indexerURL"`
+}
+
+type ProjectorConfig struct {
+	KVHost           string `json:"kvhost"`
+	IMHost           string `json:"imhost"`
+	INHost           string `json:"inhost"`
+	NConn            int    `json:"nconn"`
+	Proto            string `json:"proto"`
+	MutationProtocol string `json:"mutationProtocol"` //binary or jsonrpc
+	MetricsAddr      string `json:"metricsAddr"`
+}
+
+// LevelDB settings apply to engines created or opened after a change.
+type LevelDBConfig struct {
+	BloomBits    int  `json:"bloomBits" reload:"true"`
+	MaxOpenFiles int  `json:"maxOpenFiles" reload:"true"`
+	Compression  bool `json:"compression" reload:"true"`
+}
+
+// Security settings, see package auth. Processes of a cluster are expected
+// to agree on `tls` and on whether `user` is set, settings like the
+// certificate can differ per process through environment or command line.
+type SecurityConfig struct {
+	TLS        bool   `json:"tls"`      // serve and connect with TLS
+	CertFile   string `json:"certFile"` // own certificate, also presented to servers
+	KeyFile    string `json:"keyFile"`
+	CAFile     string `json:"caFile"`     // verifies peers, system roots if empty
+	ClientAuth bool   `json:"clientAuth"` // require client certificates
+	UsersFile  string `json:"usersFile"`  // enables authentication of requests
+	User       string `json:"user"`       // credentials for outgoing requests
+	Password   string `json:"password"`
+}
+
+// Default returns the settings used when nothing is configured.
+func Default() Config {
+	return Config{
+		LogLevel: "info",
+		Indexer: IndexerConfig{
+			HttpAddr:          ":8095",
+			RpcAddr:           ":8096",
+			DataDir:           "./",
+			CatalogFile:       "icatalog.dat",
+			MutationQueueSize: 50000,
+			MutationWorkers:   8,
+			WorkerQueueSize:   1000,
+			SequenceQueueSize: 50000,
+			ScanWorkers:       8,
+			ScanQueueSize:     100,
+			ScanTimeoutMs:     60000,
+			SnapshotInterval:  600,
+			SnapshotsKept:     3,
+			WalEnabled:        false,
+			WalSync:           true,
+			WalSegmentMB:      64,
+		},
+		Manager: ManagerConfig{
+			HttpAddr:    ":8094",
+			DataDir:     "./",
+			CatalogFile: "im_catalog.dat",
+			IndexerURL:  "http://localhost:8095",
+		},
+		Projector: ProjectorConfig{
+			KVHost:           "localhost:11211",
+			IMHost:           "localhost:8094",
+			INHost:           "localhost:8096",
+			NConn:            8,
+			Proto:            "upr",
+			MutationProtocol: "binary",
+			MetricsAddr:      "localhost:8097",
+		},
+		LevelDB: LevelDBConfig{
+			BloomBits:    10,
+			MaxOpenFiles: 500,
+			Compression:  true,
+		},
+	}
+}
+
+// LoadFile overlays settings from a JSON file, settings missing in the file
+// are left unchanged.
+func (c *Config) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	return nil
+}
+
+// LoadEnv overlays settings from environment variables, `environ` is in the
+// form returned by os.Environ().
+func (c *Config) LoadEnv(environ []string) error {
+	envkeys := make(map[string]string)
+	for _, key := range Keys() {
+		envkeys[EnvName(key)] = key
+	}
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, ENV_PREFIX) {
+			continue
+		}
+		pair := strings.SplitN(kv, "=", 2)
+		key, ok := envkeys[pair[0]]
+		if !ok || len(pair) != 2 {
+			continue
+		}
+		if err := c.Set(key, pair[1]); err != nil {
+			return fmt.Errorf("%v: %v", pair[0], err)
+		}
+	}
+	return nil
+}
+
+// Set parses `value` into the setting named by `key`.
+func (c *Config) Set(key, value string) error {
+	field, _, ok := lookup(c, key)
+	if !ok {
+		return UnknownSetting
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		return UnknownSetting
+	}
+	return nil
+}
+
+// Get returns the value of setting `key`.
+func (c *Config) Get(key string) (interface{}, error) {
+	field, _, ok := lookup(c, key)
+	if !ok {
+		return nil, UnknownSetting
+	}
+	return field.Interface(), nil
+}
+
+// Validate checks settings for values that would fail at runtime.
+func (c *Config) Validate() error {
+	var errs []string
+	nonEmpty := func(key, value string) {
+		if value == "" {
+			errs = append(errs, key+" must not be empty")
+		}
+	}
+	positive := func(key string, value int) {
+		if value <= 0 {
+			errs = append(errs, key+" must be positive")
+		}
+	}
+
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, "logLevel must be one of error, warn, info, debug, trace")
+	}
+	nonEmpty("indexer.httpAddr", c.Indexer.HttpAddr)
+	nonEmpty("indexer.rpcAddr", c.Indexer.RpcAddr)
+	nonEmpty("indexer.catalogFile", c.Indexer.CatalogFile)
+	positive("indexer.mutationQueueSize", c.Indexer.MutationQueueSize)
+	positive("indexer.mutationWorkers", c.Indexer.MutationWorkers)
+	positive("indexer.workerQueueSize", c.Indexer.WorkerQueueSize)
+	positive("indexer.sequenceQueueSize", c.Indexer.SequenceQueueSize)
+	positive("indexer.scanWorkers", c.Indexer.ScanWorkers)
+	positive("indexer.scanQueueSize", c.Indexer.ScanQueueSize)
+	positive("indexer.scanTimeoutMs", c.Indexer.ScanTimeoutMs)
+	if c.Indexer.SnapshotInterval < 0 {
+		errs = append(errs, "indexer.snapshotInterval must not be negative")
+	}
+	positive("indexer.snapshotsKept", c.Indexer.SnapshotsKept)
+	positive("indexer.walSegmentMB", c.Indexer.WalSegmentMB)
+	nonEmpty("manager.httpAddr", c.Manager.HttpAddr)
+	nonEmpty("manager.catalogFile", c.Manager.CatalogFile)
+	nonEmpty("manager.indexerURL", c.Manager.IndexerURL)
+	nonEmpty("projector.kvhost", c.Projector.KVHost)
+	nonEmpty("projector.imhost", c.Projector.IMHost)
+	nonEmpty("projector.inhost", c.Projector.INHost)
+	positive("projector.nconn", c.Projector.NConn)
+	if c.Projector.Proto != "upr" && c.Projector.Proto != "tap" {
+		errs = append(errs, "projector.proto must be `upr` or `tap`")
+	}
+	if c.Projector.MutationProtocol != "binary" && c.Projector.MutationProtocol != "jsonrpc" {
+		errs = append(errs, "projector.mutationProtocol must be `binary` or `jsonrpc`")
+	}
+	if c.LevelDB.BloomBits < 0 {
+		errs = append(errs, "leveldb.bloomBits must not be negative")
+	}
+	positive("leveldb.maxOpenFiles", c.LevelDB.MaxOpenFiles)
+	if (c.Security.CertFile == "") != (c.Security.KeyFile == "") {
+		errs = append(errs, "security.certFile and security.keyFile must be set together")
+	}
+	if c.Security.ClientAuth && !c.Security.TLS {
+		errs = append(errs, "security.clientAuth needs security.tls")
+	}
+
+	if len(errs) > 0 {
+		return errors.New("Invalid configuration: " + strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// Diff returns keys of settings that differ between two configs.
+func Diff(a, b *Config) []string {
+	keys := make([]string, 0)
+	for _, key := range Keys() {
+		av, _ := a.Get(key)
+		bv, _ := b.Get(key)
+		if av != bv {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Reloadable tells whether setting `key` can change without restart.
+func Reloadable(key string) bool {
+	c := Default()
+	_, tag, ok := lookup(&c, key)
+	return ok && tag.Get("reload") == "true"
+}
+
+// Keys returns the sorted key of every setting.
+func Keys() []string {
+	keys := make([]string, 0)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := jsonName(f)
+		if f.Type.Kind() != reflect.Struct {
+			keys = append(keys, name)
+			continue
+		}
+		for j := 0; j < f.Type.NumField(); j++ {
+			keys = append(keys, name+"."+jsonName(f.Type.Field(j)))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// EnvName returns the environment variable overriding setting `key`.
+func EnvName(key string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// Load builds the effective configuration from defaults, the config file
+// if `path` is not empty, the process environment and `overrides` from
+// the command line, then validates it.
+func Load(path string, overrides map[string]string) (Config, error) {
+	c := Default()
+	if path != "" {
+		if err := c.LoadFile(path); err != nil {
+			return c, err
+		}
+	}
+	if err := c.LoadEnv(os.Environ()); err != nil {
+		return c, err
+	}
+	for key, value := range overrides {
+		if err := c.Set(key, value); err != nil {
+			return c, fmt.Errorf("%v: %v", key, err)
+		}
+	}
+	return c, c.Validate()
+}
+
+func lookup(c *Config, key string) (reflect.Value, reflect.StructTag, bool) {
+	v := reflect.ValueOf(c).Elem()
+	var tag reflect.StructTag
+	for _, part := range strings.Split(key, ".") {
+		if v.Kind() != reflect.Struct {
+			return v, tag, false
+		}
+		found := false
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if jsonName(f) == part {
+				v, tag, found = v.Field(i), f.Tag, true
+				break
+			}
+		}
+		if !found {
+			return v, tag, false
+		}
+	}
+	return v, tag, v.Kind() != reflect.Struct
+}
+
+func jsonName(f reflect.StructField) string {
+	if name := strings.Split(f.Tag.Get("json"), ",")[0]; name != "" {
+		return name
+	}
+	return f.Name
+}
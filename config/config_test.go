@@ -0,0 +1,160 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, dir, content string) string {
+	path := filepath.Join(dir, "indexing.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPrecedence(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(dir)
+
+	path := writeConfig(t, dir, `{
+		"indexer": {"httpAddr": ":9095", "rpcAddr": ":9096", "mutationWorkers": 4},
+		"leveldb": {"bloomBits": 12}
+	}`)
+
+	os.Setenv("INDEXING_INDEXER_RPCADDR", ":10096")
+	defer os.Unsetenv("INDEXING_INDEXER_RPCADDR")
+
+	c, err := Load(path, map[string]string{"indexer.mutationWorkers": "16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Indexer.HttpAddr != ":9095" {
+		t.Errorf("Expected file setting, got %v", c.Indexer.HttpAddr)
+	}
+	if c.Indexer.RpcAddr != ":10096" {
+		t.Errorf("Expected environment setting, got %v", c.Indexer.RpcAddr)
+	}
+	if c.Indexer.MutationWorkers != 16 {
+		t.Errorf("Expected command line setting, got %v", c.Indexer.MutationWorkers)
+	}
+	if c.LevelDB.BloomBits != 12 || c.LevelDB.MaxOpenFiles != 500 {
+		t.Errorf("Expected file setting over defaults, got %v", c.LevelDB)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := Default()
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c.Indexer.MutationWorkers = 0
+	c.LogLevel = "verbose"
+	if err := c.Validate(); err == nil {
+		t.Error("Expected validation error")
+	}
+	if err := c.Set("indexer.nosuch", "1"); err != UnknownSetting {
+		t.Errorf("Expected UnknownSetting, got %v", err)
+	}
+	if err := c.Set("indexer.mutationWorkers", "many"); err == nil {
+		t.Error("Expected parse error")
+	}
+}
+
+func TestFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	path, overrides := Flags(fs)
+	kvhost := fs.String("kvhost", "localhost:11211", "")
+	err := fs.Parse([]string{"-config", "x.json", "-set", "projector.nconn=2",
+		"-kvhost", "kv:11211"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	overrides.Alias(fs, map[string]string{"kvhost": "projector.kvhost", "nosuch": "x"})
+	if *path != "x.json" || *kvhost != "kv:11211" {
+		t.Errorf("Unexpected flags %v %v", *path, *kvhost)
+	}
+	if overrides["projector.nconn"] != "2" || overrides["projector.kvhost"] != "kv:11211" {
+		t.Errorf("Unexpected overrides %v", overrides)
+	}
+	if _, ok := overrides["x"]; ok {
+		t.Error("Flags not given must not override")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(dir)
+
+	path := writeConfig(t, dir, `{"logLevel": "info"}`)
+	m, err := NewManager(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var notified Config
+	m.OnChange(func(c Config) { notified = c })
+
+	writeConfig(t, dir, `{"logLevel": "debug", "leveldb": {"maxOpenFiles": 100}}`)
+	changed, err := m.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 2 || notified.LogLevel != "debug" {
+		t.Errorf("Unexpected reload %v %v", changed, notified.LogLevel)
+	}
+
+	writeConfig(t, dir, `{"indexer": {"httpAddr": ":1"}}`)
+	if _, err = m.Reload(); err == nil {
+		t.Error("Expected reload of indexer.httpAddr to be refused")
+	}
+	if m.Config().Indexer.HttpAddr != ":8095" {
+		t.Error("Refused reload must not be applied")
+	}
+
+	if err = m.Update("indexer.httpAddr", ":1"); err != NotReloadable {
+		t.Errorf("Expected NotReloadable, got %v", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	m, err := NewManager("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("POST", "/config?key=logLevel&value=trace", nil)
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %v %v", w.Code, w.Body.String())
+	}
+	var c Config
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.LogLevel != "trace" {
+		t.Errorf("Expected trace, got %v", c.LogLevel)
+	}
+
+	req, _ = http.NewRequest("POST", "/config?key=manager.httpAddr&value=:1", nil)
+	w = httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected bad request, got %v", w.Code)
+	}
+}
@@ -0,0 +1,189 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Manager holds the effective configuration of a process and applies hot
+// reloads to it.
+type Manager struct {
+	sync.RWMutex
+	path      string
+	overrides map[string]string
+	config    Config
+	watchers  []func(Config)
+}
+
+// NewManager loads and validates the configuration, see Load().
+func NewManager(path string, overrides map[string]string) (*Manager, error) {
+	c, err := Load(path, overrides)
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{path: path, overrides: overrides, config: c}, nil
+}
+
+// Config returns a copy of the effective configuration.
+func (m *Manager) Config() Config {
+	m.RLock()
+	defer m.RUnlock()
+	return m.config
+}
+
+// OnChange registers a callback invoked with the new configuration after
+// every successful reload or update.
+func (m *Manager) OnChange(fn func(Config)) {
+	m.Lock()
+	defer m.Unlock()
+	m.watchers = append(m.watchers, fn)
+}
+
+// Reload reads the config file and the environment again. The reload is
+// refused if a setting that is not reloadable has changed. Command line
+// overrides keep precedence.
+func (m *Manager) Reload() ([]string, error) {
+	c, err := Load(m.path, m.overrides)
+	if err != nil {
+		return nil, err
+	}
+	return m.apply(c)
+}
+
+// Update changes a single reloadable setting.
+func (m *Manager) Update(key, value string) error {
+	if !Reloadable(key) {
+		if _, err := m.Get(key); err != nil {
+			return err
+		}
+		return NotReloadable
+	}
+	c := m.Config()
+	if err := c.Set(key, value); err != nil {
+		return err
+	}
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	_, err := m.apply(c)
+	return err
+}
+
+// Get returns the effective value of setting `key`.
+func (m *Manager) Get(key string) (interface{}, error) {
+	c := m.Config()
+	return c.Get(key)
+}
+
+func (m *Manager) apply(c Config) ([]string, error) {
+	m.Lock()
+	changed := Diff(&m.config, &c)
+	for _, key := range changed {
+		if !Reloadable(key) {
+			m.Unlock()
+			return nil, fmt.Errorf("%v: %v", key, NotReloadable)
+		}
+	}
+	m.config = c
+	watchers := m.watchers
+	m.Unlock()
+
+	if len(changed) > 0 {
+		for _, fn := range watchers {
+			fn(c)
+		}
+	}
+	return changed, nil
+}
+
+// Handler serves the effective configuration at /config.
+//
+//	GET                 returns the configuration as JSON
+//	POST                reloads the config file
+//	POST ?key=&value=   changes a single reloadable setting
+//
+// security.password is masked in responses.
+func (m *Manager) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "POST", "PUT":
+			var err error
+			if key := r.FormValue("key"); key != "" {
+				err = m.Update(key, r.FormValue("value"))
+			} else {
+				_, err = m.Reload()
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		cfg := m.Config()
+		if cfg.Security.Password != "" {
+			cfg.Security.Password = "*****"
+		}
+		buf, err := json.MarshalIndent(cfg, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header()["Content-Type"] = []string{"application/json"}
+		w.Write(buf)
+	})
+}
+
+// Overrides collects repeated `-set key=value` command line flags.
+type Overrides map[string]string
+
+func (o Overrides) String() string {
+	pairs := make([]string, 0, len(o))
+	for key, value := range o {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (o Overrides) Set(s string) error {
+	pair := strings.SplitN(s, "=", 2)
+	if len(pair) != 2 {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+	o[pair[0]] = pair[1]
+	return nil
+}
+
+// Flags registers the -config and -set flags on `fs`.
+func Flags(fs *flag.FlagSet) (*string, Overrides) {
+	overrides := make(Overrides)
+	path := fs.String("config", "", "Configuration file, JSON")
+	fs.Var(overrides, "set", "Override a configuration setting, key=value, may be repeated")
+	return path, overrides
+}
+
+// Alias maps command line flags to settings, so that flags predating the
+// config file keep working. Only flags given on the command line are
+// applied.
+func (o Overrides) Alias(fs *flag.FlagSet, aliases map[string]string) {
+	fs.Visit(func(f *flag.Flag) {
+		if key, ok := aliases[f.Name]; ok {
+			o[key] = f.Value.String()
+		}
+	})
+}
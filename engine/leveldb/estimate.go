@@ -0,0 +1,227 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// api.Estimator implementation. Range estimates are derived from leveldb's
+// approximate on-disk size of the key range, divided by an average entry
+// size sampled from the start of the range. Distinct key estimates come
+// from a HyperLogLog sketch maintained on every insert and persisted in
+// the back index. Deletes are not removed from the sketch, so the distinct
+// estimate drifts upwards until the sketch is rebuilt.
+
+package leveldb
+
+import (
+	"bytes"
+	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/hyperloglog"
+	"github.com/jmhodges/levigo"
+)
+
+const HLL_META_ID = "\xffhll"       //back index key for the persisted sketch, outside the UTF-8 docids
+const HLL_PERSIST_INTERVAL = 10000  //number of inserts after which sketch is persisted
+const ESTIMATE_SAMPLE_SIZE = 100    //entries sampled to compute average entry size
+const RANGE_ESTIMATE_ACCURACY = 0.5 //leveldb sizes are only block granular
+
+// back index key the sketch was persisted at before, shared with docids
+const LEGACY_HLL_META_ID = ".hll"
+
+// api.Estimator interface
+func (ldb *LevelDBEngine) EstimateRange(low api.Key, high api.Key, inclusion api.Inclusion) (
+	uint64, api.Accuracy, error) {
+
+	snap := ldb.c.NewSnapshot()
+	defer ldb.c.ReleaseSnapshot(snap)
+
+	ro := levigo.NewReadOptions()
+	ro.SetSnapshot(snap)
+	ro.SetFillCache(false)
+
+	it := ldb.c.NewIterator(ro)
+	defer it.Close()
+
+	start, limit := estimateBounds(low, high, inclusion)
+	if start == nil {
+		it.SeekToFirst()
+	} else {
+		it.Seek(start)
+	}
+
+	//sample entries from the start of the range
+	var sampled, sampleBytes uint64
+	for ; it.Valid() && sampled < ESTIMATE_SAMPLE_SIZE; it.Next() {
+		if bytes.Compare(it.Key(), limit) >= 0 {
+			break
+		}
+		sampled++
+		sampleBytes += uint64(len(it.Key()) + len(it.Value()))
+	}
+
+	//the whole range fit in the sample, an exact count is just as cheap
+	if sampled < ESTIMATE_SAMPLE_SIZE || !it.Valid() {
+		count, err := ldb.CountRange(low, high, inclusion)
+		return count, api.Perfect, err
+	}
+
+	sizes := ldb.c.GetApproximateSizes([]levigo.Range{{Start: start, Limit: limit}})
+	if len(sizes) == 0 || sizes[0] == 0 {
+		//range is still in the memtable, leveldb cannot size it
+		count, err := ldb.CountRange(low, high, inclusion)
+		return count, api.Perfect, err
+	}
+
+	avgEntrySize := sampleBytes / sampled
+	if avgEntrySize == 0 {
+		avgEntrySize = 1
+	}
+	estimate := sizes[0] / avgEntrySize
+	if estimate < sampled {
+		estimate = sampled
+	}
+	ldb.logger.Debugf("Estimated %v rows in %v bytes for range %s - %s", estimate, sizes[0], low.String(), high.String())
+	return estimate, RANGE_ESTIMATE_ACCURACY, nil
+}
+
+func (ldb *LevelDBEngine) EstimateDistinct() (uint64, api.Accuracy, error) {
+
+	ldb.hllMutex.Lock()
+	defer ldb.hllMutex.Unlock()
+
+	if ldb.hll == nil {
+		if err := ldb.rebuildSketch(); err != nil {
+			return 0, api.Useless, err
+		}
+	}
+	return ldb.hll.Estimate(), api.Accuracy(ldb.hll.Accuracy()), nil
+}
+
+// estimateBounds converts the scan keys to a [start, limit) byte range of
+// the main index. Index entries are suffixed with the docid, a bound is
+// extended past every docid of its key to leave the entries of the key out
+// of the range, for an excluded low key, or in, for an included high key.
+func estimateBounds(low, high api.Key, inclusion api.Inclusion) ([]byte, []byte) {
+
+	start := low.EncodedBytes()
+	if start != nil && inclusion != api.Low && inclusion != api.Both {
+		start = append(append([]byte{}, start...), 0xff, 0xff)
+	}
+
+	var limit []byte
+	if high.EncodedBytes() == nil {
+		limit = bytes.Repeat([]byte{0xff}, 16)
+	} else if inclusion == api.High || inclusion == api.Both {
+		limit = append(append([]byte{}, high.EncodedBytes()...), 0xff, 0xff)
+	} else {
+		limit = high.EncodedBytes()
+	}
+	return start, limit
+}
+
+func (ldb *LevelDBEngine) addToSketch(k api.Key) {
+
+	ldb.hllMutex.Lock()
+	defer ldb.hllMutex.Unlock()
+
+	if ldb.hll == nil {
+		return //will be rebuilt from the index when needed
+	}
+	ldb.hll.Add(k.EncodedSecondaryBytes())
+	ldb.hllDirty++
+	if ldb.hllDirty >= HLL_PERSIST_INTERVAL {
+		if err := ldb.b.Put(ldb.wo, []byte(HLL_META_ID), ldb.hll.Bytes()); err != nil {
+			ldb.logger.Errorf("Error persisting HyperLogLog sketch %v", err)
+			return
+		}
+		ldb.hllDirty = 0
+	}
+}
+
+func (ldb *LevelDBEngine) loadSketch() {
+
+	ldb.hllMutex.Lock()
+	defer ldb.hllMutex.Unlock()
+
+	b, err := ldb.b.Get(ldb.ro, []byte(HLL_META_ID))
+	if err == nil && b == nil {
+		b, err = ldb.loadLegacySketch()
+	}
+	if err != nil || b == nil {
+		ldb.hll = nil
+		return
+	}
+	if ldb.hll, err = hyperloglog.NewSketchFromBytes(b); err != nil {
+		ldb.logger.Errorf("Error loading HyperLogLog sketch %v. Will rebuild.", err)
+		ldb.hll = nil
+	}
+}
+
+// loadLegacySketch moves a sketch persisted at LEGACY_HLL_META_ID to
+// HLL_META_ID. The entry is left alone unless it holds a sketch, it is then
+// the back index entry of a document named like it.
+func (ldb *LevelDBEngine) loadLegacySketch() ([]byte, error) {
+
+	b, err := ldb.b.Get(ldb.ro, []byte(LEGACY_HLL_META_ID))
+	if err != nil || b == nil {
+		return nil, err
+	}
+	if _, err = hyperloglog.NewSketchFromBytes(b); err != nil {
+		return nil, nil
+	}
+	if err = ldb.b.Put(ldb.wo, []byte(HLL_META_ID), b); err == nil {
+		err = ldb.b.Delete(ldb.wo, []byte(LEGACY_HLL_META_ID))
+	}
+	return b, err
+}
+
+func (ldb *LevelDBEngine) persistSketch() error {
+
+	ldb.hllMutex.Lock()
+	defer ldb.hllMutex.Unlock()
+
+	if ldb.hll == nil || ldb.hllDirty == 0 {
+		return nil
+	}
+	if err := ldb.b.Put(ldb.wo, []byte(HLL_META_ID), ldb.hll.Bytes()); err != nil {
+		return err
+	}
+	ldb.hllDirty = 0
+	return nil
+}
+
+// rebuildSketch scans the main index to recreate the sketch. Caller must
+// hold hllMutex.
+func (ldb *LevelDBEngine) rebuildSketch() error {
+
+	hll, err := hyperloglog.NewSketch(hyperloglog.DEFAULT_PRECISION)
+	if err != nil {
+		return err
+	}
+
+	snap := ldb.c.NewSnapshot()
+	defer ldb.c.ReleaseSnapshot(snap)
+
+	ro := levigo.NewReadOptions()
+	ro.SetSnapshot(snap)
+	ro.SetFillCache(false)
+
+	it := ldb.c.NewIterator(ro)
+	defer it.Close()
+
+	var key api.Key
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if key, err = api.NewKeyFromEncodedBytes(it.Key()); err != nil {
+			continue
+		}
+		hll.Add(key.EncodedSecondaryBytes())
+	}
+	ldb.logger.Infof("Rebuilt HyperLogLog sketch for %v", ldb.name)
+
+	ldb.hll = hll
+	ldb.hllDirty = 1 //persist on close
+	return nil
+}
@@ -11,10 +11,14 @@ package leveldb
 
 import (
 	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/hyperloglog"
+	"github.com/couchbaselabs/indexing/logging"
 	"github.com/jmhodges/levigo"
-	"log"
+	"sync"
 )
 
+var logger = logging.NewLogger("engine")
+
 //FIXME try to use single leveldb object, rather than all the elements here
 type LevelDBEngine struct {
 	name    string
@@ -24,21 +28,42 @@ type LevelDBEngine struct {
 	c       *levigo.DB
 	b       *levigo.DB
 	trait   api.TraitInfo
+	logger  *logging.Logger
+
+	// distinct key estimation, see estimate.go
+	hllMutex sync.Mutex
+	hll      *hyperloglog.Sketch // nil if it has to be rebuilt from the index
+	hllDirty int                 // inserts since the sketch was persisted
+}
+
+// Options used when creating or opening an engine.
+type Options struct {
+	BloomBits    int  //bits per key of the bloom filter, 0 disables the filter
+	MaxOpenFiles int  //files leveldb may keep open, per database
+	Compression  bool //snappy compress blocks
+}
+
+func DefaultOptions() Options {
+	return Options{
+		BloomBits:    10,
+		MaxOpenFiles: 500,
+		Compression:  true,
+	}
 }
 
-func NewIndexEngine(name string) (engine api.Finder) {
+func NewIndexEngine(name string, opts Options) (engine api.Finder) {
 	var err error
-	if engine, err = Create(name); err != nil {
-		log.Printf("Error Creating LevelDB Engine %v", err)
+	if engine, err = Create(name, opts); err != nil {
+		logger.With("index", name).Errorf("Error Creating LevelDB Engine %v", err)
 	}
 	return engine
 }
 
-func OpenIndexEngine(name string) (engine api.Finder) {
+func OpenIndexEngine(name string, opts Options) (engine api.Finder) {
 
 	var err error
-	if engine, err = Open(name); err != nil {
-		log.Printf("Error Creating LevelDB Engine %v", err)
+	if engine, err = Open(name, opts); err != nil {
+		logger.With("index", name).Errorf("Error Creating LevelDB Engine %v", err)
 	}
 	return engine
 }
@@ -11,94 +11,109 @@ package leveldb
 
 import (
 	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/hyperloglog"
 	"github.com/jmhodges/levigo"
-	"log"
+	"os"
+	"path/filepath"
 )
 
-func Create(name string) (*LevelDBEngine, error) {
+func Create(name string, opts Options) (*LevelDBEngine, error) {
 
 	var ldb LevelDBEngine
 	//FIXME move this to a dir
 	ldb.name = name
+	ldb.logger = logger.With("index", name)
 
-	ldb.options = levigo.NewOptions()
+	ldb.options = levigoOptions(opts)
 	ldb.options.SetCreateIfMissing(true)
 	ldb.options.SetErrorIfExists(true)
 
-	//set filter policy
-	filterPolicy := levigo.NewBloomFilter(10)
-	ldb.options.SetFilterPolicy(filterPolicy)
-
-	ldb.options.SetCompression(levigo.SnappyCompression)
-	ldb.options.SetMaxOpenFiles(500)
-
 	ldb.wo = levigo.NewWriteOptions()
 	ldb.ro = levigo.NewReadOptions()
 
 	var err error
 	if ldb.c, err = levigo.Open(ldb.name, ldb.options); err != nil {
-		return nil, err
+		return nil, api.EngineError(err)
 	}
 
 	//create a separate back-index
 	if ldb.b, err = levigo.Open(ldb.name+"_back", ldb.options); err != nil {
-		return nil, err
+		return nil, api.EngineError(err)
 	}
 
+	//new index, start with an empty sketch
+	ldb.hll, _ = hyperloglog.NewSketch(hyperloglog.DEFAULT_PRECISION)
+
 	return &ldb, nil
 }
 
-func Open(name string) (*LevelDBEngine, error) {
+func Open(name string, opts Options) (*LevelDBEngine, error) {
 
 	var ldb LevelDBEngine
 	//FIXME move this to a dir
 	ldb.name = name
+	ldb.logger = logger.With("index", name)
 
-	ldb.options = levigo.NewOptions()
+	ldb.options = levigoOptions(opts)
 	ldb.options.SetCreateIfMissing(false)
 
-	//set filter policy
-	filterPolicy := levigo.NewBloomFilter(10)
-	ldb.options.SetFilterPolicy(filterPolicy)
-
-	ldb.options.SetCompression(levigo.SnappyCompression)
-	ldb.options.SetMaxOpenFiles(500)
-
 	ldb.wo = levigo.NewWriteOptions()
 	ldb.ro = levigo.NewReadOptions()
 
 	var err error
 	if ldb.c, err = levigo.Open(ldb.name, ldb.options); err != nil {
-		return nil, err
+		return nil, api.EngineError(err)
 	}
 
 	//create a separate back-index
 	if ldb.b, err = levigo.Open(ldb.name+"_back", ldb.options); err != nil {
-		return nil, err
+		return nil, api.EngineError(err)
 	}
 
+	//load the persisted sketch, if missing it is rebuilt on first use
+	ldb.loadSketch()
+
 	return &ldb, nil
 
 }
 
+func levigoOptions(opts Options) *levigo.Options {
+
+	options := levigo.NewOptions()
+
+	//set filter policy
+	if opts.BloomBits > 0 {
+		filterPolicy := levigo.NewBloomFilter(opts.BloomBits)
+		options.SetFilterPolicy(filterPolicy)
+	}
+
+	if opts.Compression {
+		options.SetCompression(levigo.SnappyCompression)
+	} else {
+		options.SetCompression(levigo.NoCompression)
+	}
+	options.SetMaxOpenFiles(opts.MaxOpenFiles)
+	return options
+}
+
 func (ldb *LevelDBEngine) InsertMutation(k api.Key, v api.Value) error {
 
 	var err error
 	var backkey api.Key
 
-	if api.DebugLog {
-		log.Printf("LevelDB Set Key - %s Value - %s", k.String(), v.String())
+	if ldb.logger.IsDebug() {
+		ldb.logger.Debugf("Set Key - %s Value - %s", k.String(), v.String())
 	}
 
 	//check if the docid exists in the back index
 	if backkey, err = ldb.GetBackIndexEntry(v.Docid()); err != nil {
-		log.Printf("Error locating backindex entry %v", err)
+		ldb.logger.Errorf("Error locating backindex entry %v", err)
 		return err
 	} else if backkey.EncodedBytes() != nil {
 		//there is already an entry in main index for this docid
 		//delete from main index
 		if err = ldb.c.Delete(ldb.wo, backkey.EncodedBytes()); err != nil {
-			log.Printf("Error deleting entry from main index %v", err)
+			ldb.logger.Errorf("Error deleting entry from main index %v", err)
 			return err
 		}
 	}
@@ -106,9 +121,7 @@ func (ldb *LevelDBEngine) InsertMutation(k api.Key, v api.Value) error {
 	//if secondary-key is nil, no further processing is required. If this was a KV insert, nothing needs to be done.
 	//if this was a KV update, only delete old back/main index entry
 	if v.KeyBytes() == nil {
-		if api.DebugLog {
-			log.Printf("Received NIL secondary key. Skipping Index Insert.")
-		}
+		ldb.logger.Debugf("Received NIL secondary key. Skipping Index Insert.")
 		return nil
 	}
 	//FIXME : Handle the case if old-value from backindex matches with the new-value(false mutation). Skip It.
@@ -123,14 +136,14 @@ func (ldb *LevelDBEngine) InsertMutation(k api.Key, v api.Value) error {
 		return err
 	}
 
+	ldb.addToSketch(k)
+
 	return err
 }
 
 func (ldb *LevelDBEngine) InsertMeta(metaid string, metavalue string) error {
 
-	if api.DebugLog {
-		log.Printf("LevelDB Set Meta Key - %s, Value - %s", metaid, metavalue)
-	}
+	ldb.logger.Debugf("Set Meta Key - %s, Value - %s", metaid, metavalue)
 
 	var err error
 
@@ -147,9 +160,7 @@ func (ldb *LevelDBEngine) GetMeta(metaid string) (string, error) {
 	var metavalue []byte
 	var err error
 	if metavalue, err = ldb.b.Get(ldb.ro, []byte(metaid)); err == nil {
-		if api.DebugLog {
-			log.Printf("LevelDB Get Meta Key - %s, Value - %s", metaid, string(metavalue))
-		}
+		ldb.logger.Debugf("Get Meta Key - %s, Value - %s", metaid, string(metavalue))
 		return string(metavalue), nil
 	}
 
@@ -162,9 +173,7 @@ func (ldb *LevelDBEngine) GetBackIndexEntry(docid string) (api.Key, error) {
 	var kbyte []byte
 	var err error
 
-	if api.DebugLog {
-		log.Printf("LevelDB Get BackIndex Key - %s", docid)
-	}
+	ldb.logger.Debugf("Get BackIndex Key - %s", docid)
 
 	if kbyte, err = ldb.b.Get(ldb.ro, []byte(docid)); err != nil {
 		return k, err
@@ -177,26 +186,24 @@ func (ldb *LevelDBEngine) GetBackIndexEntry(docid string) (api.Key, error) {
 
 func (ldb *LevelDBEngine) DeleteMutation(docid string) error {
 
-	if api.DebugLog {
-		log.Printf("LevelDB Delete Key - %s", docid)
-	}
+	ldb.logger.Debugf("Delete Key - %s", docid)
 	var backkey api.Key
 	var err error
 
 	if backkey, err = ldb.GetBackIndexEntry(docid); err != nil {
-		log.Printf("Error locating backindex entry %v", err)
+		ldb.logger.Errorf("Error locating backindex entry %v", err)
 		return err
 	}
 
 	//delete from main index
 	if err = ldb.c.Delete(ldb.wo, backkey.EncodedBytes()); err != nil {
-		log.Printf("Error deleting entry from main index %v", err)
+		ldb.logger.Errorf("Error deleting entry from main index %v", err)
 		return err
 	}
 
 	//delete from the back index
 	if err = ldb.b.Delete(ldb.wo, []byte(docid)); err != nil {
-		log.Printf("Error deleting entry from back index %v", err)
+		ldb.logger.Errorf("Error deleting entry from back index %v", err)
 		return err
 	}
 
@@ -205,6 +212,12 @@ func (ldb *LevelDBEngine) DeleteMutation(docid string) error {
 }
 
 func (ldb *LevelDBEngine) Close() error {
+	//save the sketch so that it need not be rebuilt on open
+	if ldb.b != nil {
+		if err := ldb.persistSketch(); err != nil {
+			ldb.logger.Errorf("Error persisting HyperLogLog sketch %v", err)
+		}
+	}
 	//close the main index
 	if ldb.c != nil {
 		ldb.c.Close()
@@ -231,3 +244,24 @@ func (ldb *LevelDBEngine) Destroy() error {
 	}
 	return err
 }
+
+// api.Sizer interface
+func (ldb *LevelDBEngine) DiskSize() (uint64, error) {
+
+	var size uint64
+	for _, dir := range []string{ldb.name, ldb.name + "_back"} {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				size += uint64(info.Size())
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
@@ -12,7 +12,6 @@ package leveldb
 import (
 	"github.com/couchbaselabs/indexing/api"
 	"github.com/jmhodges/levigo"
-	"log"
 )
 
 var perfReadCount int64
@@ -61,9 +60,7 @@ func (ldb *LevelDBEngine) Lookup(key api.Key) (chan api.Value, chan error) {
 	chval := make(chan api.Value)
 	cherr := make(chan error)
 
-	if api.DebugLog {
-		log.Printf("Received Lookup Query for Key %s", key.String())
-	}
+	ldb.logger.Debugf("Received Lookup Query for Key %s", key.String())
 	go ldb.GetValueSetForKeyRange(key, key, api.Both, chval, cherr)
 	return chval, cherr
 }
@@ -126,9 +123,7 @@ func (ldb *LevelDBEngine) GetKeySetForKeyRange(low api.Key, high api.Key,
 	it := ldb.c.NewIterator(ro)
 	defer it.Close()
 
-	if api.DebugLog {
-		log.Printf("LevelDB Received Key Low - %s High - %s for Scan", low.String(), high.String())
-	}
+	ldb.logger.Debugf("Received Key Low - %s High - %s for Scan", low.String(), high.String())
 
 	var lowkey []byte
 	var err error
@@ -142,14 +137,10 @@ func (ldb *LevelDBEngine) GetKeySetForKeyRange(low api.Key, high api.Key,
 	var key api.Key
 	for it = it; it.Valid(); it.Next() {
 		if key, err = api.NewKeyFromEncodedBytes(it.Key()); err != nil {
-			log.Printf("Error Converting from bytes %v to key %v. Skipping row", it.Key(), err)
+			ldb.logger.Errorf("Error Converting from bytes %v to key %v. Skipping row", it.Key(), err)
 			continue
 		}
 
-		if api.DebugLog {
-			log.Printf("LevelDB Got Key - %s", key.String())
-		}
-
 		var highcmp int
 		if high.EncodedBytes() == nil {
 			highcmp = -1 //if high key is nil, iterate through the fullset
@@ -165,34 +156,14 @@ func (ldb *LevelDBEngine) GetKeySetForKeyRange(low api.Key, high api.Key,
 		}
 
 		if highcmp == 0 && (inclusion == api.Both || inclusion == api.High) {
-			if api.DebugLog {
-				log.Printf("LevelDB Sending Key Equal to High Key")
-			}
 			chkey <- key
 		} else if lowcmp == 0 && (inclusion == api.Both || inclusion == api.Low) {
-			if api.DebugLog {
-				log.Printf("LevelDB Sending Key Equal to Low Key")
-			}
 			chkey <- key
 		} else if (highcmp == -1) && (lowcmp == 1) { //key is between high and low
-			if highcmp == -1 {
-				if api.DebugLog {
-					log.Printf("LevelDB Sending Key Lesser Than High Key")
-				}
-			} else if lowcmp == 1 {
-				if api.DebugLog {
-					log.Printf("LevelDB Sending Key Greater Than Low Key")
-				}
-			}
 			chkey <- key
-		} else {
-			if api.DebugLog {
-				log.Printf("LevelDB not Sending Key")
-			}
+		} else if highcmp == 1 {
 			//if we have reached past the high key, no need to scan further
-			if highcmp == 1 {
-				break
-			}
+			break
 		}
 	}
 
@@ -221,9 +192,7 @@ func (ldb *LevelDBEngine) GetValueSetForKeyRange(low api.Key, high api.Key,
 	it := ldb.c.NewIterator(ro)
 	defer it.Close()
 
-	if api.DebugLog {
-		log.Printf("LevelDB Received Key Low - %s High - %s Inclusion - %v for Scan", low.String(), high.String(), inclusion)
-	}
+	ldb.logger.Debugf("Received Key Low - %s High - %s Inclusion - %v for Scan", low.String(), high.String(), inclusion)
 
 	var lowkey []byte
 	var err error
@@ -238,19 +207,15 @@ func (ldb *LevelDBEngine) GetValueSetForKeyRange(low api.Key, high api.Key,
 	var val api.Value
 	for it = it; it.Valid(); it.Next() {
 		if key, err = api.NewKeyFromEncodedBytes(it.Key()); err != nil {
-			log.Printf("Error Converting from bytes %v to key %v. Skipping row", it.Key(), err)
+			ldb.logger.Errorf("Error Converting from bytes %v to key %v. Skipping row", it.Key(), err)
 			continue
 		}
 
 		if val, err = api.NewValueFromEncodedBytes(it.Value()); err != nil {
-			log.Printf("Error Converting from bytes %v to value %v, Skipping row", it.Value(), err)
+			ldb.logger.Errorf("Error Converting from bytes %v to value %v, Skipping row", it.Value(), err)
 			continue
 		}
 
-		if api.DebugLog {
-			log.Printf("LevelDB Got Value - %s", val.String())
-		}
-
 		var highcmp int
 		if high.EncodedBytes() == nil {
 			highcmp = -1 //if high key is nil, iterate through the fullset
@@ -266,38 +231,18 @@ func (ldb *LevelDBEngine) GetValueSetForKeyRange(low api.Key, high api.Key,
 		}
 
 		if highcmp == 0 && (inclusion == api.Both || inclusion == api.High) {
-			if api.DebugLog {
-				log.Printf("LevelDB Sending Value Equal to High Key")
-			}
 			chval <- val
 		} else if lowcmp == 0 && (inclusion == api.Both || inclusion == api.Low) {
-			if api.DebugLog {
-				log.Printf("LevelDB Sending Value Equal to Low Key")
-			}
 			chval <- val
 		} else if (highcmp == -1) && (lowcmp == 1) { //key is between high and low
-			if highcmp == -1 {
-				if api.DebugLog {
-					log.Printf("LevelDB Sending Value Lesser Than High Key")
-				}
-			} else if lowcmp == 1 {
-				if api.DebugLog {
-					log.Printf("LevelDB Sending Value Greater Than Low Key")
-				}
-			}
 			chval <- val
-		} else {
-			if api.DebugLog {
-				log.Printf("LevelDB not Sending Value")
-			}
+		} else if highcmp == 1 {
 			//if we have reached past the high key, no need to scan further
-			if highcmp == 1 {
-				break
-			}
+			break
 		}
 		perfReadCount += 1
 	}
-	log.Printf("Index Values Read %v", perfReadCount)
+	ldb.logger.Debugf("Index Values Read %v", perfReadCount)
 
 	//FIXME
 	/*
@@ -323,9 +268,7 @@ func (ldb *LevelDBEngine) CountRange(low api.Key, high api.Key, inclusion api.In
 	it := ldb.c.NewIterator(ro)
 	defer it.Close()
 
-	if api.DebugLog {
-		log.Printf("LevelDB Received Key Low - %s High - %s for Scan", low.String(), high.String())
-	}
+	ldb.logger.Debugf("Received Key Low - %s High - %s for Scan", low.String(), high.String())
 
 	var lowkey []byte
 	var err error
@@ -339,14 +282,10 @@ func (ldb *LevelDBEngine) CountRange(low api.Key, high api.Key, inclusion api.In
 	var key api.Key
 	for it = it; it.Valid(); it.Next() {
 		if key, err = api.NewKeyFromEncodedBytes(it.Key()); err != nil {
-			log.Printf("Error Converting from bytes %v to key %v. Skipping row", it.Key(), err)
+			ldb.logger.Errorf("Error Converting from bytes %v to key %v. Skipping row", it.Key(), err)
 			continue
 		}
 
-		if api.DebugLog {
-			log.Printf("LevelDB Got Key - %s", key.String())
-		}
-
 		var highcmp int
 		if high.EncodedBytes() == nil {
 			highcmp = -1 //if high key is nil, iterate through the fullset
@@ -362,34 +301,14 @@ func (ldb *LevelDBEngine) CountRange(low api.Key, high api.Key, inclusion api.In
 		}
 
 		if highcmp == 0 && (inclusion == api.Both || inclusion == api.High) {
-			if api.DebugLog {
-				log.Printf("LevelDB Sending Value Equal to High Key")
-			}
 			count++
 		} else if lowcmp == 0 && (inclusion == api.Both || inclusion == api.Low) {
-			if api.DebugLog {
-				log.Printf("LevelDB Sending Value Equal to Low Key")
-			}
 			count++
 		} else if (highcmp == -1) && (lowcmp == 1) { //key is between high and low
-			if highcmp == -1 {
-				if api.DebugLog {
-					log.Printf("LevelDB Sending Value Lesser Than High Key")
-				}
-			} else if lowcmp == 1 {
-				if api.DebugLog {
-					log.Printf("LevelDB Sending Value Greater Than Low Key")
-				}
-			}
 			count++
-		} else {
-			if api.DebugLog {
-				log.Printf("LevelDB not Sending Value")
-			}
+		} else if highcmp == 1 {
 			//if we have reached past the high key, no need to scan further
-			if highcmp == 1 {
-				break
-			}
+			break
 		}
 	}
 
@@ -0,0 +1,175 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// api.Snapshotter implementation. A snapshot holds leveldb snapshots of the
+// main and back index, saving it copies both into new databases under the
+// snapshot path. Restoring deletes every entry of the index and copies the
+// saved databases back, in place, so that running scans are not disturbed.
+// A restore is not atomic, an index whose restore was interrupted must be
+// dropped and created again.
+
+package leveldb
+
+import (
+	"github.com/couchbaselabs/indexing/api"
+	"github.com/jmhodges/levigo"
+	"os"
+	"path/filepath"
+)
+
+const SNAPSHOT_BATCH_SIZE = 1000 //entries copied per write batch
+
+type snapshot struct {
+	ldb *LevelDBEngine
+	c   *levigo.Snapshot
+	b   *levigo.Snapshot
+}
+
+// api.Snapshotter interface
+func (ldb *LevelDBEngine) Snapshot() (api.Snapshot, error) {
+	return &snapshot{
+		ldb: ldb,
+		c:   ldb.c.NewSnapshot(),
+		b:   ldb.b.NewSnapshot(),
+	}, nil
+}
+
+func (s *snapshot) Save(path string) error {
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	if err := copyDB(s.ldb.c, s.c, filepath.Join(path, "main"), nil); err != nil {
+		return api.EngineError(err)
+	}
+	if err := copyDB(s.ldb.b, s.b, filepath.Join(path, "back"), nil); err != nil {
+		return api.EngineError(err)
+	}
+	return nil
+}
+
+func (s *snapshot) Release() {
+	s.ldb.c.ReleaseSnapshot(s.c)
+	s.ldb.b.ReleaseSnapshot(s.b)
+}
+
+// api.Snapshotter interface
+func (ldb *LevelDBEngine) Restore(path string) error {
+
+	ldb.logger.Infof("Restoring index from snapshot %q", path)
+	if err := restoreDB(ldb.c, ldb.wo, path, "main"); err != nil {
+		return api.EngineError(err)
+	}
+	if err := restoreDB(ldb.b, ldb.wo, path, "back"); err != nil {
+		return api.EngineError(err)
+	}
+	//the restored sketch, if any, matches the restored contents
+	ldb.loadSketch()
+	ldb.hllMutex.Lock()
+	ldb.hllDirty = 0
+	ldb.hllMutex.Unlock()
+	return nil
+}
+
+// restoreDB empties `dst` and copies the database saved as `name` under
+// `path` into it.
+func restoreDB(dst *levigo.DB, wo *levigo.WriteOptions, path, name string) error {
+
+	if err := clearDB(dst, wo); err != nil {
+		return err
+	}
+	if path == "" {
+		return nil
+	}
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(false)
+	src, err := levigo.Open(filepath.Join(path, name), opts)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return copyEntries(src, nil, dst, wo)
+}
+
+// copyDB writes the contents of `db` as of `snap` to a new database at
+// `path`.
+func copyDB(db *levigo.DB, snap *levigo.Snapshot, path string, wo *levigo.WriteOptions) error {
+
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	opts.SetErrorIfExists(true)
+	dst, err := levigo.Open(path, opts)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if wo == nil {
+		wo = levigo.NewWriteOptions()
+		defer wo.Close()
+	}
+	return copyEntries(db, snap, dst, wo)
+}
+
+func copyEntries(src *levigo.DB, snap *levigo.Snapshot, dst *levigo.DB, wo *levigo.WriteOptions) error {
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	if snap != nil {
+		ro.SetSnapshot(snap)
+	}
+	it := src.NewIterator(ro)
+	defer it.Close()
+
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	n := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		wb.Put(it.Key(), it.Value())
+		if n++; n%SNAPSHOT_BATCH_SIZE == 0 {
+			if err := dst.Write(wo, wb); err != nil {
+				return err
+			}
+			wb.Clear()
+		}
+	}
+	if err := it.GetError(); err != nil {
+		return err
+	}
+	return dst.Write(wo, wb)
+}
+
+// clearDB deletes every entry of `db`.
+func clearDB(db *levigo.DB, wo *levigo.WriteOptions) error {
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	it := db.NewIterator(ro)
+	defer it.Close()
+
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	n := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		wb.Delete(it.Key())
+		if n++; n%SNAPSHOT_BATCH_SIZE == 0 {
+			if err := db.Write(wo, wb); err != nil {
+				return err
+			}
+			wb.Clear()
+		}
+	}
+	if err := it.GetError(); err != nil {
+		return err
+	}
+	return db.Write(wo, wb)
+}
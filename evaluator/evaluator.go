@@ -0,0 +1,51 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Evaluators compute the secondary key of a document from the expressions
+// of an index, written in the language named by its Exprtype,
+//   n1ql        N1QL expressions, as marshalled by tuqtng
+//   simple      dotted JSON paths with array indexing,
+//               e.g. `name`, `address.city`, `orders[0].total`
+//   javascript  key functions of the document,
+//               e.g. `function(doc) { return doc.name.toLowerCase() }`
+// Indexes without Exprtype are N1QL indexes. Key components are JSON
+// encoded.
+
+package evaluator
+
+import (
+	"github.com/couchbaselabs/indexing/api"
+)
+
+// Evaluator computes the secondary key of documents, a component per
+// expression of the index.
+type Evaluator interface {
+	// Evaluate returns the key of the JSON document `doc`. Expressions that
+	// cannot be evaluated on it, e.g. a path it does not have, give an empty
+	// component, the last such error is returned with the key.
+	Evaluate(doc []byte) ([][]byte, error)
+}
+
+// New compiles the expressions of an index, failing with
+// api.ExprNotSupported if the evaluator for `exprtype` is unknown.
+func New(exprtype api.ExprType, exprs []string) (Evaluator, error) {
+	switch exprtype {
+	case api.N1QL, "":
+		return newN1QL(exprs)
+	case api.Simple:
+		return newSimple(exprs)
+	case api.JavaScript:
+		return newJavaScript(exprs)
+	}
+	return nil, api.ExprNotSupported
+}
+
+func invalidExpr(expr string, err error) error {
+	return api.NewError(api.ERR_BAD_REQUEST, "Invalid expression %q: %v", expr, err)
+}
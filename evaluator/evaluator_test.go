@@ -0,0 +1,100 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package evaluator
+
+import (
+	"fmt"
+	"github.com/couchbaselabs/indexing/api"
+	"testing"
+)
+
+var doc = []byte(`{"name":"Pail Ale","abv":5.25,"brewery":{"city":"Nashua","tags":["craft","local"]},"orders":[{"total":12},{"total":7}]}`)
+
+func keyOf(t *testing.T, ev Evaluator) string {
+	key, err := ev.Evaluate(doc)
+	s := make([]string, 0, len(key))
+	for _, component := range key {
+		s = append(s, string(component))
+	}
+	if err != nil {
+		t.Logf("Evaluate: %v", err)
+	}
+	return fmt.Sprint(s)
+}
+
+func TestSimple(t *testing.T) {
+	ev, err := New(api.Simple, []string{"name", "abv", "brewery.city", "brewery.tags[1]", "orders[1].total", "brewery.zip", "orders[5]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := keyOf(t, ev); key != `["Pail Ale" 5.25 "Nashua" "local" 7  ]` {
+		t.Errorf("Unexpected key %v", key)
+	}
+	if _, err = ev.Evaluate(doc); err == nil {
+		t.Error("Expected missing paths reported")
+	}
+
+	for _, expr := range []string{"", "a..b", "a[x]", "a[1", "a.[0]", "a[-1]"} {
+		if _, err := New(api.Simple, []string{expr}); api.CodeOf(err) != api.ERR_BAD_REQUEST {
+			t.Errorf("Expected %q rejected, got %v", expr, err)
+		}
+	}
+}
+
+func TestJavaScript(t *testing.T) {
+	ev, err := New(api.JavaScript, []string{
+		`function(doc) { return doc.name.toLowerCase() }`,
+		`function(doc) { doc.abv = 0; return doc.brewery.tags.length }`,
+		`function(doc) { return doc.abv }`,
+		`function(doc) { return doc.missing.field }`,
+		`function(doc) { return [doc.brewery.city, doc.orders[0].total] }`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := keyOf(t, ev); key != `["pail ale" 2 5.25  ["Nashua",12]]` {
+		t.Errorf("Unexpected key %v", key)
+	}
+
+	//functions are interrupted, and see no host objects
+	ev, err = New(api.JavaScript, []string{`function(doc) { while (true) {} }`, `function(doc) { console.log(doc) }`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := ev.Evaluate(doc); err == nil || len(key) != 2 || len(key[0]) != 0 {
+		t.Errorf("Expected functions to fail, got %q", key)
+	}
+
+	//no state is carried from a function or a document to the next
+	ev, err = New(api.JavaScript, []string{
+		`function(doc) { count = (typeof count == "undefined" ? 0 : count) + 1; Object.prototype.seen = doc.name; return count }`,
+		`function(doc) { return [typeof count, typeof {}.seen] }`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if key := keyOf(t, ev); key != `[1 ["undefined","undefined"]]` {
+			t.Errorf("Unexpected key %v", key)
+		}
+	}
+
+	for _, expr := range []string{`function(doc) {`, `42`, `(function() { while (true) {} })()`} {
+		if _, err := New(api.JavaScript, []string{expr}); api.CodeOf(err) != api.ERR_BAD_REQUEST {
+			t.Errorf("Expected %q rejected, got %v", expr, err)
+		}
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	if _, err := New("xpath", []string{"/name"}); err != api.ExprNotSupported {
+		t.Errorf("Expected unsupported expression type, got %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package evaluator
+
+import (
+	"errors"
+	"fmt"
+	"github.com/robertkrimen/otto"
+	"sync"
+	"time"
+)
+
+// time a key function may run on a document, or compile, before it is
+// interrupted.
+const JS_TIMEOUT = 100 * time.Millisecond
+
+var errTimeout = errors.New("key function interrupted after " + JS_TIMEOUT.String())
+var errUndefined = errors.New("key function returned undefined")
+
+// isolate runs once in a new interpreter, after the key functions are
+// compiled. It keeps the JSON functions as __parse and __stringify, freezes
+// the standard objects and their prototypes, and pins the globals defined so
+// far, not enumerable. Globals a key function adds are then enumerable, and
+// __reset deletes them.
+const isolate = `(function(global) {
+	var define = Object.defineProperty, defineAll = Object.defineProperties;
+	Object.defineProperty = function(object, name, desc) {
+		if (object === global) {
+			throw new TypeError("globals can not be defined");
+		}
+		return define(object, name, desc);
+	};
+	Object.defineProperties = function(object, descs) {
+		if (object === global) {
+			throw new TypeError("globals can not be defined");
+		}
+		return defineAll(object, descs);
+	};
+	global.__parse = JSON.parse;
+	global.__stringify = JSON.stringify;
+	global.__reset = function() {
+		for (var name in global) {
+			delete global[name];
+		}
+	};
+	var freeze = function(value) {
+		if (value === null || (typeof value != "object" && typeof value != "function") || Object.isFrozen(value)) {
+			return;
+		}
+		Object.freeze(value);
+		Object.getOwnPropertyNames(value).forEach(function(name) {
+			freeze(value[name]);
+		});
+	};
+	Object.getOwnPropertyNames(global).forEach(function(name) {
+		freeze(global[name]);
+		define(global, name, {enumerable: false, writable: false, configurable: false});
+	});
+})(this)`
+
+// jsEvaluator runs key functions in interpreters of their own, which have
+// the standard objects of the language only, no access to the host. The
+// standard objects are frozen, globals a function adds are deleted after
+// each call, and each call gets the document parsed anew, so that no state
+// is carried from a function or a document to the next.
+type jsEvaluator struct {
+	sync.Mutex            //the interpreter is copied one at a time
+	vm         *otto.Otto //functions are compiled in it, never run
+	pool       sync.Pool  //copies of vm, one per evaluation in progress
+	funcs      []string   //global names of the functions
+}
+
+func newJavaScript(exprs []string) (Evaluator, error) {
+	e := &jsEvaluator{vm: otto.New(), funcs: make([]string, 0, len(exprs))}
+	e.vm.Set("console", otto.UndefinedValue())
+	for i, expr := range exprs {
+		source := "(" + expr + ")"
+		fn, err := run(e.vm, func() (otto.Value, error) { return e.vm.Run(source) })
+		if err == nil && !fn.IsFunction() {
+			err = errors.New("not a function")
+		}
+		if err != nil {
+			return nil, invalidExpr(expr, err)
+		}
+		name := fmt.Sprintf("__key%d", i)
+		e.vm.Set(name, fn)
+		e.funcs = append(e.funcs, name)
+	}
+	if _, err := e.vm.Run(isolate); err != nil {
+		return nil, err
+	}
+	e.pool.New = func() interface{} { return e.copy() }
+	return e, nil
+}
+
+// run runs `fn` in `vm`, interrupted after JS_TIMEOUT.
+func run(vm *otto.Otto, fn func() (otto.Value, error)) (value otto.Value, err error) {
+
+	//a fresh channel each run, a late interrupt never reaches the next one
+	vm.Interrupt = make(chan func(), 1)
+	timer := time.AfterFunc(JS_TIMEOUT, func() {
+		vm.Interrupt <- func() { panic(errTimeout) }
+	})
+	defer func() {
+		timer.Stop()
+		if caught := recover(); caught != nil {
+			if caught != errTimeout {
+				panic(caught)
+			}
+			value, err = otto.UndefinedValue(), errTimeout
+		}
+	}()
+	return fn()
+}
+
+// copy returns a copy of the interpreter as it was once prepared.
+func (e *jsEvaluator) copy() *otto.Otto {
+	e.Lock()
+	defer e.Unlock()
+	return e.vm.Copy()
+}
+
+// call calls the global function `name` of `vm`. Unlike vm.Call, it does
+// not parse `name` as source.
+func call(vm *otto.Otto, name string, args ...interface{}) (otto.Value, error) {
+	fn, err := vm.Get(name)
+	if err != nil {
+		return fn, err
+	}
+	return fn.Call(otto.UndefinedValue(), args...)
+}
+
+func (e *jsEvaluator) Evaluate(doc []byte) ([][]byte, error) {
+
+	key := make([][]byte, len(e.funcs))
+	for i := range key {
+		key[i] = []byte{}
+	}
+	var err error
+	vm := e.pool.Get().(*otto.Otto)
+	for i, name := range e.funcs {
+		value, xerr := run(vm, func() (otto.Value, error) {
+			defer call(vm, "__reset")
+			arg, err := call(vm, "__parse", string(doc))
+			if err != nil {
+				return arg, err
+			}
+			value, err := call(vm, name, arg)
+			if err != nil || value.IsUndefined() {
+				return value, err
+			}
+			return call(vm, "__stringify", value)
+		})
+		if xerr == errTimeout {
+			//an interrupted interpreter is not reused
+			vm = e.copy()
+		}
+		if xerr == nil && value.IsUndefined() {
+			xerr = errUndefined
+		}
+		if xerr != nil {
+			err = xerr
+			continue
+		}
+		key[i] = []byte(value.String())
+	}
+	e.pool.Put(vm)
+	return key, err
+}
@@ -0,0 +1,45 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package evaluator
+
+import (
+	"github.com/couchbaselabs/dparval"
+	ast "github.com/couchbaselabs/tuqtng/ast"
+)
+
+type n1qlEvaluator []ast.Expression
+
+func newN1QL(exprs []string) (Evaluator, error) {
+	e := make(n1qlEvaluator, 0, len(exprs))
+	for _, expr := range exprs {
+		ex, err := ast.UnmarshalExpression([]byte(expr))
+		if err != nil {
+			return nil, invalidExpr(expr, err)
+		}
+		e = append(e, ex)
+	}
+	return e, nil
+}
+
+func (e n1qlEvaluator) Evaluate(doc []byte) ([][]byte, error) {
+	var err error
+
+	key := make([][]byte, 0, len(e))
+	for _, expr := range e {
+		value, xerr := expr.Evaluate(dparval.NewValueFromBytes(doc))
+		if xerr != nil {
+			err = xerr
+			key = append(key, []byte{})
+		} else {
+			key = append(key, value.Bytes())
+		}
+	}
+	return key, err
+}
@@ -0,0 +1,125 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package evaluator
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// step of a path, a field of an object or an element of an array.
+type step struct {
+	field string
+	index int //element, if field is empty
+}
+
+type path struct {
+	expr  string
+	steps []step
+}
+
+type simpleEvaluator []path
+
+func newSimple(exprs []string) (Evaluator, error) {
+	e := make(simpleEvaluator, 0, len(exprs))
+	for _, expr := range exprs {
+		steps, err := parsePath(expr)
+		if err != nil {
+			return nil, invalidExpr(expr, err)
+		}
+		e = append(e, path{expr, steps})
+	}
+	return e, nil
+}
+
+// parsePath parses fields separated by dots, each followed by any number
+// of array indexes, e.g. `orders[0].items[2].price`.
+func parsePath(expr string) ([]step, error) {
+	steps := make([]step, 0)
+	for i, segment := range strings.Split(expr, ".") {
+		field := segment
+		if n := strings.IndexByte(segment, '['); n >= 0 {
+			field, segment = segment[:n], segment[n:]
+		} else {
+			segment = ""
+		}
+		if field == "" && (i > 0 || segment == "") {
+			return nil, errors.New("empty field name")
+		}
+		if field != "" {
+			steps = append(steps, step{field: field})
+		}
+		for segment != "" {
+			end := strings.IndexByte(segment, ']')
+			if segment[0] != '[' || end < 0 {
+				return nil, errors.New("expected [index]")
+			}
+			index, err := strconv.Atoi(segment[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid array index %q", segment[1:end])
+			}
+			steps = append(steps, step{index: index})
+			segment = segment[end+1:]
+		}
+	}
+	return steps, nil
+}
+
+func (e simpleEvaluator) Evaluate(doc []byte) ([][]byte, error) {
+	var value interface{}
+
+	key := make([][]byte, len(e))
+	for i := range key {
+		key[i] = []byte{}
+	}
+	//numbers are kept as they are in the document
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return key, err
+	}
+	var err error
+	for i, p := range e {
+		component, xerr := p.evaluate(value)
+		if xerr != nil {
+			err = xerr
+			continue
+		}
+		key[i] = component
+	}
+	return key, err
+}
+
+func (p path) evaluate(value interface{}) ([]byte, error) {
+	for _, s := range p.steps {
+		var ok bool
+		if s.field != "" {
+			var object map[string]interface{}
+			if object, ok = value.(map[string]interface{}); ok {
+				value, ok = object[s.field]
+			}
+		} else {
+			var array []interface{}
+			if array, ok = value.([]interface{}); ok && s.index < len(array) {
+				value = array[s.index]
+			} else {
+				ok = false
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("document has no %v", p.expr)
+		}
+	}
+	return json.Marshal(value)
+}
@@ -0,0 +1,157 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// HyperLogLog sketch to estimate the number of distinct keys in an index
+// using a fixed amount of memory. Sketches can be serialized with Bytes()
+// and merged, so an engine can persist them next to its data.
+
+package hyperloglog
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+)
+
+const (
+	MIN_PRECISION     = 4
+	MAX_PRECISION     = 16
+	DEFAULT_PRECISION = 12 // 4096 registers, ~1.6% standard error
+)
+
+var (
+	InvalidPrecision = errors.New("HyperLogLog precision out of range")
+	InvalidSketch    = errors.New("Invalid HyperLogLog sketch encoding")
+	SketchMismatch   = errors.New("HyperLogLog sketches have different precision")
+)
+
+type Sketch struct {
+	p         uint8
+	registers []uint8
+}
+
+func NewSketch(precision uint8) (*Sketch, error) {
+	if precision < MIN_PRECISION || precision > MAX_PRECISION {
+		return nil, InvalidPrecision
+	}
+	return &Sketch{
+		p:         precision,
+		registers: make([]uint8, 1<<precision),
+	}, nil
+}
+
+// Create a sketch from bytes returned by Bytes().
+func NewSketchFromBytes(b []byte) (*Sketch, error) {
+	if len(b) < 1 {
+		return nil, InvalidSketch
+	}
+	s, err := NewSketch(b[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(b)-1 != len(s.registers) {
+		return nil, InvalidSketch
+	}
+	copy(s.registers, b[1:])
+	return s, nil
+}
+
+// Add a key to the sketch.
+func (s *Sketch) Add(key []byte) {
+	x := hash64(key)
+	idx := x >> (64 - s.p)
+	w := x<<s.p | 1<<(s.p-1) // guard bit bounds the rank
+	rank := uint8(1)
+	for w&(1<<63) == 0 {
+		rank++
+		w <<= 1
+	}
+	if rank > s.registers[idx] {
+		s.registers[idx] = rank
+	}
+}
+
+// Estimate returns the approximate number of distinct keys added.
+func (s *Sketch) Estimate() uint64 {
+	m := float64(len(s.registers))
+	sum := 0.0
+	zeros := 0
+	for _, r := range s.registers {
+		sum += 1.0 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := alpha(m) * m * m / sum
+	// small range correction, use linear counting.
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// Accuracy returns 1 - standard error of the estimate for this precision.
+func (s *Sketch) Accuracy() float64 {
+	return 1.0 - 1.04/math.Sqrt(float64(len(s.registers)))
+}
+
+// Merge other sketch into this one. Both must have the same precision.
+func (s *Sketch) Merge(other *Sketch) error {
+	if s.p != other.p {
+		return SketchMismatch
+	}
+	for i, r := range other.registers {
+		if r > s.registers[i] {
+			s.registers[i] = r
+		}
+	}
+	return nil
+}
+
+// Reset clears all registers.
+func (s *Sketch) Reset() {
+	for i := range s.registers {
+		s.registers[i] = 0
+	}
+}
+
+// Bytes returns the serialized form of the sketch, precision followed by
+// registers.
+func (s *Sketch) Bytes() []byte {
+	b := make([]byte, 1+len(s.registers))
+	b[0] = s.p
+	copy(b[1:], s.registers)
+	return b
+}
+
+func alpha(m float64) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	}
+	return 0.7213 / (1 + 1.079/m)
+}
+
+// fnv-1a followed by a 64-bit finalizer, fnv alone leaves the high bits
+// poorly mixed for short keys.
+func hash64(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
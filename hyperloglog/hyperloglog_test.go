@@ -0,0 +1,69 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package hyperloglog
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestEstimate(t *testing.T) {
+	for _, n := range []int{0, 10, 1000, 100000} {
+		s, _ := NewSketch(DEFAULT_PRECISION)
+		for i := 0; i < n; i++ {
+			s.Add([]byte("key" + strconv.Itoa(i)))
+			s.Add([]byte("key" + strconv.Itoa(i))) // duplicates don't count
+		}
+		estimate := float64(s.Estimate())
+		if diff := math.Abs(estimate - float64(n)); diff > float64(n)*0.05+1 {
+			t.Errorf("Estimate for %v distinct keys is %v", n, estimate)
+		}
+	}
+}
+
+func TestBytes(t *testing.T) {
+	s, _ := NewSketch(DEFAULT_PRECISION)
+	for i := 0; i < 5000; i++ {
+		s.Add([]byte(strconv.Itoa(i)))
+	}
+	s1, err := NewSketchFromBytes(s.Bytes())
+	if err != nil {
+		t.Fatalf("NewSketchFromBytes failed: %v", err)
+	}
+	if s.Estimate() != s1.Estimate() {
+		t.Errorf("Estimate mismatch after decode %v != %v", s.Estimate(), s1.Estimate())
+	}
+	if _, err := NewSketchFromBytes([]byte{DEFAULT_PRECISION, 1, 2}); err != InvalidSketch {
+		t.Errorf("Expected InvalidSketch, got %v", err)
+	}
+	if _, err := NewSketch(2); err != InvalidPrecision {
+		t.Errorf("Expected InvalidPrecision, got %v", err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	s1, _ := NewSketch(DEFAULT_PRECISION)
+	s2, _ := NewSketch(DEFAULT_PRECISION)
+	for i := 0; i < 10000; i++ {
+		s1.Add([]byte(strconv.Itoa(i)))
+		s2.Add([]byte(strconv.Itoa(i + 5000)))
+	}
+	if err := s1.Merge(s2); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if estimate := float64(s1.Estimate()); math.Abs(estimate-15000) > 750 {
+		t.Errorf("Estimate after merge is %v, expected ~15000", estimate)
+	}
+	s3, _ := NewSketch(10)
+	if err := s1.Merge(s3); err != SketchMismatch {
+		t.Errorf("Expected SketchMismatch, got %v", err)
+	}
+}
@@ -7,19 +7,21 @@
 //  either express or implied. See the License for the specific language governing permissions
 //  and limitations under the License.
 
-// A rest client to be used with server.
+// A rest client to be used with server. Errors reported by the server are
+// returned as api.Error values, callers can branch on api.CodeOf(err).
 package client
 
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
 	. "github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/logging"
 	"io/ioutil"
-	"log"
 	"net/http"
 )
 
+var logger = logging.NewLogger("client")
+
 // A notion of catalog on the client side. For most operations we access the
 // server - transparently.
 type RestClient struct {
@@ -35,6 +37,15 @@ func NewRestClient(addr string) *RestClient {
 	}
 }
 
+// Create a notion of catalog on the client side, using `httpc` for requests
+// to the server, like a client with TLS and credentials.
+func NewRestClientWithHTTP(addr string, httpc *http.Client) *RestClient {
+	return &RestClient{
+		addr:  addr,
+		httpc: httpc,
+	}
+}
+
 // Create a new index. If successful, return index-info as returned by the
 // server, also the unique id generated by the server.
 func (client *RestClient) Create(indexinfo IndexInfo) (
@@ -52,7 +63,7 @@ func (client *RestClient) Create(indexinfo IndexInfo) (
 		// Post HTTP request.
 		bodybuf := bytes.NewBuffer(body)
 		url := client.addr + "/create"
-		log.Printf("Posting %v to URL %v", bodybuf, url)
+		logger.Debugf("Posting %v to URL %v", bodybuf, url)
 		if resp, err = client.httpc.Post(url, "application/json", bodybuf); err == nil {
 			defer resp.Body.Close()
 			if mresp, err = MetaResponse(resp); err == nil {
@@ -80,7 +91,7 @@ func (client *RestClient) Drop(uuid string) (string, error) {
 		// Post HTTP request.
 		bodybuf := bytes.NewBuffer(body)
 		url := client.addr + "/drop"
-		log.Printf("Posting %v to URL %v", bodybuf, url)
+		logger.Debugf("Posting %v to URL %v", bodybuf, url)
 		if resp, err := client.httpc.Post(url, "application/json", bodybuf); err == nil {
 			defer resp.Body.Close()
 			if mresp, err = MetaResponse(resp); err == nil {
@@ -93,6 +104,38 @@ func (client *RestClient) Drop(uuid string) (string, error) {
 	return serverUuid, err
 }
 
+// Build deferred indexes identified by `uuids`, all of them are backfilled
+// together. The call returns server's new unique-id.
+func (client *RestClient) Build(uuids []string) (string, error) {
+	var body []byte
+	var resp *http.Response
+	var err error
+	var mresp IndexMetaResponse
+
+	// Construct request body.
+	indexes := make([]IndexInfo, 0, len(uuids))
+	for _, uuid := range uuids {
+		indexes = append(indexes, IndexInfo{Uuid: uuid})
+	}
+	indexreq := IndexRequest{Type: BUILD, Indexes: indexes}
+	if body, err = json.Marshal(indexreq); err != nil {
+		return "", err
+	}
+
+	// Post HTTP request.
+	bodybuf := bytes.NewBuffer(body)
+	url := client.addr + "/build"
+	logger.Debugf("Posting %v to URL %v", bodybuf, url)
+	if resp, err = client.httpc.Post(url, "application/json", bodybuf); err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if mresp, err = MetaResponse(resp); err != nil {
+		return "", err
+	}
+	return mresp.ServerUuid, nil
+}
+
 // List of all indexes. if `serverUuid` is same as server's unique-id then
 // index-data is not sent back, if it doesn't match or if it is empty, then
 // list of all index data is sent back.
@@ -114,7 +157,7 @@ func (client *RestClient) List(serverUuid string) (
 	// Post HTTP request.
 	bodybuf := bytes.NewBuffer(body)
 	url := client.addr + "/list"
-	log.Printf("Posting %v to URL %v", bodybuf, url)
+	logger.Debugf("Posting %v to URL %v", bodybuf, url)
 	if resp, err = client.httpc.Post(url, "application/json", bodybuf); err == nil {
 		defer resp.Body.Close()
 		if mresp, err = MetaResponse(resp); err == nil {
@@ -130,14 +173,14 @@ func (client *RestClient) Index(uuid string) (IndexInfo, error) {
 	var index IndexInfo
 	var err error
 
-	if _, indexinfos, err := client.List(""); err == nil {
+	var indexinfos []IndexInfo
+	if _, indexinfos, err = client.List(""); err == nil {
 		for _, indexinfo := range indexinfos {
 			if indexinfo.Uuid == uuid {
-				index = indexinfo
-				break
+				return indexinfo, nil
 			}
 		}
-		err = errors.New("Invalid uuid")
+		err = NoSuchIndex
 	}
 	return index, err
 }
@@ -153,6 +196,7 @@ func (client *RestClient) Scan(index *IndexInfo, q QueryParams) (
 
 	var body []byte
 	var rows []IndexRow
+	var resp *http.Response
 	var err error
 
 	// Construct request body.
@@ -164,24 +208,166 @@ func (client *RestClient) Scan(index *IndexInfo, q QueryParams) (
 	// Post HTTP request.
 	bodybuf := bytes.NewBuffer(body)
 	url := client.addr + "/scan"
-	log.Printf("Posting %v to URL %v", bodybuf, url)
-	if resp, err := client.httpc.Post(url, "application/json", bodybuf); err == nil {
+	logger.Debugf("Posting %v to URL %v", bodybuf, url)
+	if resp, err = client.httpc.Post(url, "application/json", bodybuf); err == nil {
 		defer resp.Body.Close()
 		// Gather indexinfo
-		indexres := IndexScanResponse{}
-		if body, err = ioutil.ReadAll(resp.Body); err == nil {
-			if err = json.Unmarshal(body, &indexres); err == nil {
-				if indexres.Status == ERROR {
-					err = errors.New(indexres.Errors[0].Msg)
-				} else {
-					rows = indexres.Rows
-				}
-			}
+		var indexres IndexScanResponse
+		if indexres, err = ScanResponse(resp); err == nil {
+			rows = indexres.Rows
 		}
 	}
 	return rows, err
 }
 
+// Estimate number of index entries, `q.ScanType` must be ESTIMATERANGE or
+// ESTIMATEDISTINCT. Returns the estimate along with its accuracy.
+func (client *RestClient) Estimate(index *IndexInfo, q QueryParams) (
+	uint64, Accuracy, error) {
+
+	var body []byte
+	var resp *http.Response
+	var err error
+	var indexres IndexScanResponse
+
+	// Construct request body.
+	indexreq := IndexRequest{Type: SCAN, Index: *index, Params: q}
+	if body, err = json.Marshal(indexreq); err != nil {
+		return 0, Useless, err
+	}
+
+	// Post HTTP request.
+	bodybuf := bytes.NewBuffer(body)
+	url := client.addr + "/scan"
+	logger.Debugf("Posting %v to URL %v", bodybuf, url)
+	if resp, err = client.httpc.Post(url, "application/json", bodybuf); err != nil {
+		return 0, Useless, err
+	}
+	defer resp.Body.Close()
+	if indexres, err = ScanResponse(resp); err != nil {
+		return 0, Useless, err
+	}
+	return indexres.TotalRows, indexres.Accuracy, nil
+}
+
+// Key statistics of an index, or of all indexes if `index` is nil. With
+// `refresh` the server recomputes them before replying.
+func (client *RestClient) KeyStats(index *IndexInfo, refresh bool) (
+	[]IndexKeyStats, error) {
+
+	var body []byte
+	var resp *http.Response
+	var err error
+
+	// Construct request body.
+	indexreq := IndexRequest{Type: KEYSTATS, Params: QueryParams{Refresh: refresh}}
+	if index != nil {
+		indexreq.Index = *index
+	}
+	if body, err = json.Marshal(indexreq); err != nil {
+		return nil, err
+	}
+
+	// Post HTTP request.
+	bodybuf := bytes.NewBuffer(body)
+	url := client.addr + "/keystats"
+	logger.Debugf("Posting %v to URL %v", bodybuf, url)
+	if resp, err = client.httpc.Post(url, "application/json", bodybuf); err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	indexres := IndexKeyStatsResponse{}
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(body, &indexres); err != nil {
+		return nil, err
+	}
+	if indexres.Status == ERROR {
+		return nil, ResponseError(indexres.Errors)
+	}
+	return indexres.Stats, nil
+}
+
+// Operational statistics of an index, or of all indexes if `index` is nil,
+// from an indexer node.
+func (client *RestClient) Stats(index *IndexInfo) (IndexStatsResponse, error) {
+
+	var body []byte
+	var resp *http.Response
+	var err error
+	var indexres IndexStatsResponse
+
+	// Construct request body.
+	indexreq := IndexRequest{Type: STATS}
+	if index != nil {
+		indexreq.Index = *index
+	}
+	if body, err = json.Marshal(indexreq); err != nil {
+		return indexres, err
+	}
+
+	// Post HTTP request.
+	bodybuf := bytes.NewBuffer(body)
+	url := client.addr + "/stats"
+	logger.Debugf("Posting %v to URL %v", bodybuf, url)
+	if resp, err = client.httpc.Post(url, "application/json", bodybuf); err != nil {
+		return indexres, err
+	}
+	defer resp.Body.Close()
+
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		return indexres, err
+	}
+	if err = json.Unmarshal(body, &indexres); err != nil {
+		return indexres, err
+	}
+	if indexres.Status == ERROR {
+		err = ResponseError(indexres.Errors)
+	}
+	return indexres, err
+}
+
+// Build progress of `index`, or of all indexes if `index` is nil. Like
+// Stats(), this is served by the indexer.
+func (client *RestClient) Progress(index *IndexInfo) ([]IndexProgress, error) {
+
+	var body []byte
+	var resp *http.Response
+	var err error
+	var indexres IndexProgressResponse
+
+	// Construct request body.
+	indexreq := IndexRequest{Type: PROGRESS}
+	if index != nil {
+		indexreq.Index = *index
+	}
+	if body, err = json.Marshal(indexreq); err != nil {
+		return nil, err
+	}
+
+	// Post HTTP request.
+	bodybuf := bytes.NewBuffer(body)
+	url := client.addr + "/progress"
+	logger.Debugf("Posting %v to URL %v", bodybuf, url)
+	if resp, err = client.httpc.Post(url, "application/json", bodybuf); err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(body, &indexres); err != nil {
+		return nil, err
+	}
+	if indexres.Status == ERROR {
+		return nil, ResponseError(indexres.Errors)
+	}
+	return indexres.Progress, nil
+}
+
 func (client *RestClient) Nodes() ([]NodeInfo, error) {
 	var err error
 	var body []byte
@@ -197,7 +383,7 @@ func (client *RestClient) Nodes() ([]NodeInfo, error) {
 	// Post HTTP request.
 	bodybuf := bytes.NewBuffer(body)
 	url := client.addr + "/nodes"
-	log.Printf("Posting %v to URL %v", bodybuf, url)
+	logger.Debugf("Posting %v to URL %v", bodybuf, url)
 	if resp, err := client.httpc.Post(url, "application/json", bodybuf); err == nil {
 		defer resp.Body.Close()
 		if mresp, err = MetaResponse(resp); err == nil {
@@ -222,7 +408,7 @@ func (client *RestClient) Notify(serverUuid string) (ResponseStatus, string, err
 		// Post HTTP request.
 		bodybuf := bytes.NewBuffer(body)
 		url := client.addr + "/notify"
-		log.Printf("Posting %v to URL %v", bodybuf, url)
+		logger.Debugf("Posting %v to URL %v", bodybuf, url)
 		if resp, err = client.httpc.Post(url, "application/json", bodybuf); err == nil {
 			defer resp.Body.Close()
 			if mresp, err = MetaResponse(resp); err == nil {
@@ -234,6 +420,22 @@ func (client *RestClient) Notify(serverUuid string) (ResponseStatus, string, err
 	return status, serverUuid, err
 }
 
+// Gather index scan response from http response.
+func ScanResponse(resp *http.Response) (IndexScanResponse, error) {
+	var body []byte
+	var err error
+
+	indexres := IndexScanResponse{}
+	if body, err = ioutil.ReadAll(resp.Body); err == nil {
+		if err = json.Unmarshal(body, &indexres); err == nil {
+			if indexres.Status == ERROR {
+				err = ResponseError(indexres.Errors)
+			}
+		}
+	}
+	return indexres, err
+}
+
 // Gather index meta response from http response.
 func MetaResponse(resp *http.Response) (IndexMetaResponse, error) {
 	var body []byte
@@ -242,9 +444,9 @@ func MetaResponse(resp *http.Response) (IndexMetaResponse, error) {
 	indexres := IndexMetaResponse{}
 	if body, err = ioutil.ReadAll(resp.Body); err == nil {
 		if err = json.Unmarshal(body, &indexres); err == nil {
-			log.Printf("Received raw response %s", string(body))
+			logger.Debugf("Received raw response %s", string(body))
 			if indexres.Status == ERROR {
-				err = errors.New(indexres.Errors[0].Msg)
+				err = ResponseError(indexres.Errors)
 			}
 		}
 	}
@@ -19,9 +19,14 @@ import (
 	"flag"
 	"fmt"
 	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/auth"
 	"github.com/couchbaselabs/indexing/catalog"
+	"github.com/couchbaselabs/indexing/config"
+	"github.com/couchbaselabs/indexing/evaluator"
+	"github.com/couchbaselabs/indexing/logging"
+	"github.com/couchbaselabs/indexing/metrics"
+	"github.com/couchbaselabs/indexing/rest"
 	"github.com/nu7hatch/gouuid" // TODO: Remove this dependancy ??
-	"log"
 	"net/http"
 	"sync"
 )
@@ -35,33 +40,89 @@ var ddlLock sync.Mutex
 
 var options struct {
 	indexerURL string
+	logLevel   string
 }
 
+var conf *config.Manager
+var security *auth.Security
+
+var logger = logging.NewLogger("manager")
+var ddlLog = logging.NewLogger("ddl")
+
 func main() {
 	argParse()
+	cfg := conf.Config().Manager
 	var err error
 
 	// Create index catalog
-	if c, err = catalog.NewIndexCatalog("./", "im_catalog.dat"); err != nil {
+	if c, err = catalog.NewIndexCatalog(cfg.DataDir, cfg.CatalogFile); err != nil {
 		panic(err)
 	}
 
-	addr := ":8094"
+	addr := cfg.HttpAddr
 	// Subscribe to HTTP server handlers
-	http.HandleFunc("/create", handleCreate)
-	http.HandleFunc("/drop", handleDrop)
-	http.HandleFunc("/list", handleList)
-	http.HandleFunc("/nodes", handleNodes)
-	http.HandleFunc("/notify", handleNotify)
-	log.Println("Index Manager Listening on", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Println("Fatal:", err)
+	http.HandleFunc("/create", security.Require(handleCreate, auth.ROLE_DDL))
+	http.HandleFunc("/drop", security.Require(handleDrop, auth.ROLE_DDL))
+	http.HandleFunc("/build", security.Require(handleBuild, auth.ROLE_DDL))
+	//projectors watch index metadata
+	http.HandleFunc("/list", security.Require(handleList, auth.ROLE_SCAN, auth.ROLE_INGEST))
+	http.HandleFunc("/nodes", security.Require(handleNodes, auth.ROLE_SCAN, auth.ROLE_INGEST))
+	http.HandleFunc("/notify", security.Require(handleNotify, auth.ROLE_SCAN, auth.ROLE_INGEST))
+	http.Handle("/metrics", metrics.Handler())
+	http.HandleFunc("/admin/loglevel", security.Require(logging.Handler().ServeHTTP, auth.ROLE_ADMIN))
+	http.HandleFunc("/config", security.Require(conf.Handler().ServeHTTP, auth.ROLE_ADMIN))
+	http.Handle("/v2/", v2Router())
+	l, err := security.Listen(addr)
+	if err != nil {
+		logger.Fatalf("Fatal: %v", err)
+	}
+	logger.Infof("Index Manager Listening on %v", addr)
+	if err := http.Serve(l, nil); err != nil {
+		logger.Errorf("Fatal: %v", err)
 	}
 }
 
 // /create
 func handleCreate(w http.ResponseWriter, r *http.Request) {
+	metricRequests.Inc("create")
 	var res api.IndexMetaResponse
+
+	indexinfo := indexRequest(r).Index // Get IndexInfo, without the `uuid`
+
+	if servUuid, indexinfo, err := createIndex(indexinfo); err == nil {
+		res = api.IndexMetaResponse{
+			Status:     api.SUCCESS,
+			Indexes:    []api.IndexInfo{indexinfo},
+			ServerUuid: servUuid,
+		}
+	} else {
+		res = createMetaResponseFromError(err)
+	}
+	sendResponse(w, res)
+}
+
+// /drop
+func handleDrop(w http.ResponseWriter, r *http.Request) {
+	metricRequests.Inc("drop")
+	var res api.IndexMetaResponse
+
+	indexinfo := indexRequest(r).Index
+
+	if servUuid, err := dropIndex(indexinfo.Uuid); err == nil {
+		res = api.IndexMetaResponse{
+			Status:     api.SUCCESS,
+			ServerUuid: servUuid,
+		}
+	} else {
+		res = createMetaResponseFromError(err)
+	}
+	sendResponse(w, res)
+}
+
+// createIndex validates `indexinfo`, creates the index on the indexer and
+// adds it to the catalog. Returns the catalog's new uuid and the index with
+// its `uuid`.
+func createIndex(indexinfo api.IndexInfo) (string, api.IndexInfo, error) {
 	var servUuid string
 	var err error
 
@@ -69,70 +130,144 @@ func handleCreate(w http.ResponseWriter, r *http.Request) {
 	ddlLock.Lock()
 	defer ddlLock.Unlock()
 
-	indexinfo := indexRequest(r).Index // Get IndexInfo, without the `uuid`
-
 	// Normalize IndexInfo
 	if indexinfo.Exprtype == "" {
 		indexinfo.Exprtype = api.N1QL
 	}
+	//indexer owns the state from here on, see its /progress
+	indexinfo.State = api.INDEX_CREATED
+	if indexinfo.DeferBuild {
+		indexinfo.State = api.INDEX_DEFERRED
+	}
 
 	if uvalue, err := uuid.NewV4(); err == nil {
 		indexinfo.Uuid = fmt.Sprintf("%v", uvalue)
 	} else {
-		log.Fatalln("Unable to generate UUID for index")
-	}
-
-	if err = c.Exists(indexinfo.Name, indexinfo.Bucket); err == nil {
-		if err = sendCreateToIndexer(indexinfo); err == nil {
-			if servUuid, err = c.Create(indexinfo); err == nil {
-				res = api.IndexMetaResponse{
-					Status:     api.SUCCESS,
-					Indexes:    []api.IndexInfo{indexinfo},
-					ServerUuid: servUuid,
-				}
-				notifyLongPolls(servUuid)
-				log.Printf("Created index(%v) %v", indexinfo.Uuid, indexinfo.OnExprList)
-			}
+		ddlLog.Fatalf("Unable to generate UUID for index")
+	}
+
+	err = validateIndex(indexinfo)
+	if err == nil {
+		err = c.Exists(indexinfo.Name, indexinfo.Bucket)
+	}
+	if err == nil {
+		if err = sendCreateToIndexer(indexinfo); err != nil {
+			err = indexerError(err)
+		} else if servUuid, err = c.Create(indexinfo); err == nil {
+			notifyLongPolls(servUuid)
+			ddlLog.With("index", indexinfo.Uuid).Infof("Created index %v", indexinfo.OnExprList)
 		}
 	}
 	if err != nil {
-		res = createMetaResponseFromError(err)
-		log.Println("ERROR: Failed to create index", err)
+		ddlLog.Errorf("Failed to create index %v", err)
 	}
-	sendResponse(w, res)
+	metricDDL.Inc("create", resultLabel(err))
+	return servUuid, indexinfo, err
 }
 
-// /drop
-func handleDrop(w http.ResponseWriter, r *http.Request) {
-	var res api.IndexMetaResponse
+// dropIndex drops the index on the indexer and removes it from the catalog.
+// Returns the catalog's new uuid.
+func dropIndex(uuid string) (string, error) {
+	var servUuid string
 	var err error
 
-	indexinfo := indexRequest(r).Index
-
 	//only one DDL (Create/Drop) can run concurrently
 	ddlLock.Lock()
 	defer ddlLock.Unlock()
 
-	if err = sendDropToIndexer(indexinfo.Uuid); err == nil {
-		if servUuid, err := c.Drop(indexinfo.Uuid); err == nil {
-			res = api.IndexMetaResponse{
-				Status:     api.SUCCESS,
-				ServerUuid: servUuid,
-			}
-			notifyLongPolls(servUuid)
-			log.Printf("Dropped index(%v) %v", indexinfo.Uuid, indexinfo.Name)
-		}
+	if _, err = c.Index(uuid); err != nil {
+		err = api.NoSuchIndex
+	} else if err = sendDropToIndexer(uuid); err != nil {
+		err = indexerError(err)
+	} else if servUuid, err = c.Drop(uuid); err == nil {
+		notifyLongPolls(servUuid)
+		ddlLog.With("index", uuid).Infof("Dropped index")
 	}
 
 	if err != nil {
+		ddlLog.With("index", uuid).Errorf("Failed to drop index %v", err)
+	}
+	metricDDL.Inc("drop", resultLabel(err))
+	return servUuid, err
+}
+
+func validateIndex(indexinfo api.IndexInfo) error {
+	if indexinfo.Name == "" {
+		return rest.BadRequest("Index name is missing")
+	}
+	if indexinfo.Bucket == "" {
+		return rest.BadRequest("Bucket is missing")
+	}
+	if indexinfo.Using != api.LevelDB {
+		return api.NoSuchType
+	}
+	if !indexinfo.IsPrimary && len(indexinfo.OnExprList) == 0 {
+		return rest.BadRequest("Expression list is missing")
+	}
+	//compiled as the projector will, bad expressions fail the create
+	if _, err := evaluator.New(indexinfo.Exprtype, indexinfo.OnExprList); err != nil {
+		return err
+	}
+	return nil
+}
+
+// indexerError marks failures reported by the indexer, they are not the
+// client's fault. The indexer's error code is kept.
+func indexerError(err error) error {
+	return rest.NewError(http.StatusBadGateway, api.CodeOf(err), "Indexer: %v", err)
+}
+
+// /build, start building a set of deferred indexes. The projector is
+// notified once, so that it backfills all of them with a single feed.
+func handleBuild(w http.ResponseWriter, r *http.Request) {
+	metricRequests.Inc("build")
+	var res api.IndexMetaResponse
+	var servUuid string
+	var err error
+
+	//only one DDL (Create/Drop/Build) can run concurrently
+	ddlLock.Lock()
+	defer ddlLock.Unlock()
+
+	indexinfos := indexRequest(r).Indexes
+	if len(indexinfos) == 0 {
+		err = api.NewError(api.ERR_BAD_REQUEST, "No indexes to build")
+	}
+	for i := 0; err == nil && i < len(indexinfos); i++ {
+		var indexinfo api.IndexInfo
+		if indexinfo, err = c.Index(indexinfos[i].Uuid); err == nil &&
+			indexinfo.State != api.INDEX_DEFERRED {
+			err = api.NewError(api.ERR_BAD_REQUEST, "Index %v is not deferred", indexinfo.Name)
+		}
+	}
+	if err == nil {
+		err = sendBuildToIndexer(indexinfos)
+	}
+	if err == nil {
+		for _, indexinfo := range indexinfos {
+			if servUuid, err = c.SetState(indexinfo.Uuid, api.INDEX_CREATED, ""); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		res = api.IndexMetaResponse{
+			Status:     api.SUCCESS,
+			ServerUuid: servUuid,
+		}
+		notifyLongPolls(servUuid)
+		ddlLog.Infof("Building %v deferred indexes", len(indexinfos))
+	} else {
 		res = createMetaResponseFromError(err)
-		log.Println("ERROR: Failed to drop index", err)
+		ddlLog.Errorf("Failed to build indexes %v", err)
 	}
+	metricDDL.Inc("build", resultLabel(err))
 	sendResponse(w, res)
 }
 
 // /list
 func handleList(w http.ResponseWriter, r *http.Request) {
+	metricRequests.Inc("list")
 	var res api.IndexMetaResponse
 
 	serverUuid := indexRequest(r).ServerUuid
@@ -142,23 +277,25 @@ func handleList(w http.ResponseWriter, r *http.Request) {
 			Indexes:    indexes,
 			ServerUuid: servUuid,
 		}
-		log.Printf("List server %v", c.GetUuid())
+		logger.Debugf("List server %v", c.GetUuid())
 	} else {
 		res = createMetaResponseFromError(err)
-		log.Println("ERROR: Listing server", err)
+		logger.Errorf("Listing server %v", err)
 	}
 	sendResponse(w, res)
 }
 
 // /nodes
 func handleNodes(w http.ResponseWriter, r *http.Request) {
+	metricRequests.Inc("nodes")
 	res := api.IndexMetaResponse{Status: api.SUCCESS, Nodes: []api.NodeInfo{node}, Errors: nil}
 	sendResponse(w, res)
-	log.Printf("Nodes list returned %v", node)
+	logger.Debugf("Nodes list returned %v", node)
 }
 
 // /notify
 func handleNotify(w http.ResponseWriter, r *http.Request) {
+	metricRequests.Inc("notify")
 	var res api.IndexMetaResponse
 	var newServerUuid string
 
@@ -166,7 +303,7 @@ func handleNotify(w http.ResponseWriter, r *http.Request) {
 	if servUuid, _, err := c.List(""); err == nil {
 		req := indexRequest(r)
 
-		log.Printf("Received Notify Request with ServerUuid %s", req.ServerUuid)
+		logger.Debugf("Received Notify Request with ServerUuid %s", req.ServerUuid)
 		if req.ServerUuid == servUuid {
 			ch := make(chan string, 1)
 			mutex.Lock()
@@ -174,9 +311,9 @@ func handleNotify(w http.ResponseWriter, r *http.Request) {
 			mutex.Unlock()
 			select {
 			case newServerUuid = <-ch:
-				log.Printf("Sending Notification to Client")
+				logger.Debugf("Sending Notification to Client")
 			case <-w.(http.CloseNotifier).CloseNotify():
-				log.Printf("Connection Closed by Client. Notify thread closing.")
+				logger.Debugf("Connection Closed by Client. Notify thread closing.")
 				return
 			}
 		}
@@ -187,7 +324,7 @@ func handleNotify(w http.ResponseWriter, r *http.Request) {
 	} else {
 		res = createMetaResponseFromError(err)
 	}
-	log.Printf("Exited Notify Request")
+	logger.Debugf("Exited Notify Request")
 	sendResponse(w, res)
 
 }
@@ -199,7 +336,7 @@ func sendResponse(w http.ResponseWriter, res interface{}) {
 	header["Content-Type"] = []string{"application/json"}
 
 	if buf, err = json.Marshal(&res); err != nil {
-		log.Println("Unable to marshal response", res)
+		logger.Errorf("Unable to marshal response %v", res)
 	}
 	w.Write(buf)
 }
@@ -207,9 +344,10 @@ func sendResponse(w http.ResponseWriter, res interface{}) {
 // Parse HTTP Request to get IndexInfo.
 func indexRequest(r *http.Request) *api.IndexRequest {
 	indexreq := api.IndexRequest{}
-	buf := make([]byte, r.ContentLength, r.ContentLength)
-	r.Body.Read(buf)
-	json.Unmarshal(buf, &indexreq)
+	//v1 endpoints reply with an empty request on errors
+	if err := rest.Decode(r, &indexreq); err != nil {
+		logger.Errorf("Error decoding request %v", err)
+	}
 	return &indexreq
 }
 
@@ -224,16 +362,43 @@ func notifyLongPolls(serverUuid string) {
 
 func createMetaResponseFromError(err error) api.IndexMetaResponse {
 
-	indexerr := api.IndexError{Code: string(api.ERROR), Msg: err.Error()}
 	res := api.IndexMetaResponse{
 		Status: api.ERROR,
-		Errors: []api.IndexError{indexerr},
+		Errors: []api.IndexError{api.IndexErrorOf(err)},
 	}
 	return res
 }
 
 func argParse() {
-	flag.StringVar(&options.indexerURL, "indexerURL", "http://localhost:8095", "Indexer Node URL")
+	path, overrides := config.Flags(flag.CommandLine)
+	flag.StringVar(&options.indexerURL, "indexerURL", config.Default().Manager.IndexerURL,
+		"Indexer Node URL")
+	flag.StringVar(&options.logLevel, "logLevel", "info",
+		"Log level for all subsystems, one of error, warn, info, debug, trace")
 	flag.Parse()
-	node = api.NodeInfo{IndexerURL: options.indexerURL}
+
+	overrides.Alias(flag.CommandLine, map[string]string{
+		"indexerURL": "manager.indexerURL",
+		"logLevel":   "logLevel",
+	})
+
+	var err error
+	if conf, err = config.NewManager(*path, overrides); err != nil {
+		logger.Fatalf("Configuration error: %v", err)
+	}
+	setLogLevel(conf.Config())
+	conf.OnChange(setLogLevel)
+	node = api.NodeInfo{IndexerURL: conf.Config().Manager.IndexerURL}
+
+	//manager.indexerURL must be https when TLS is enabled
+	if security, err = auth.New(conf.Config().Security); err != nil {
+		logger.Fatalf("Security configuration error: %v", err)
+	}
+	httpc = security.HTTPClient()
+}
+
+func setLogLevel(cfg config.Config) {
+	//validated by the config package
+	level, _ := logging.ParseLevel(cfg.LogLevel)
+	logging.SetLevel("all", level)
 }
@@ -0,0 +1,40 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Metrics exposed by the index manager at /metrics.
+
+package main
+
+import (
+	"github.com/couchbaselabs/indexing/metrics"
+)
+
+var (
+	metricRequests = metrics.NewCounter("index_manager_requests_total",
+		"REST requests received", "endpoint")
+	metricDDL = metrics.NewCounter("index_manager_ddl_total",
+		"Index create and drop requests", "op", "result")
+	metricIndexerRPC = metrics.NewHistogram("index_manager_indexer_request_seconds",
+		"Latency of DDL requests forwarded to the indexer", nil, "op")
+	metricLongPolls = metrics.NewGaugeFunc("index_manager_notify_waiters",
+		"Clients waiting on /notify",
+		func() float64 {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return float64(len(longPolls))
+		})
+)
+
+// result label for metrics
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
@@ -0,0 +1,138 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// v2 REST API of the index manager. Indexes are addressed by name, the
+// bucket query parameter is needed only when the name is used in more than
+// one bucket.
+//
+//   GET    /v2/indexes                  list of indexes
+//   GET    /v2/indexes/{name}?bucket=   index definition
+//   PUT    /v2/indexes/{name}           create index, body is api.IndexInfo
+//   DELETE /v2/indexes/{name}?bucket=   drop index
+
+package main
+
+import (
+	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/auth"
+	"github.com/couchbaselabs/indexing/rest"
+	"net/http"
+)
+
+func v2Router() *rest.Router {
+	router := rest.NewRouter("/v2")
+	router.Handle("GET", "/indexes", security.RequireREST(handleV2List, auth.ROLE_SCAN))
+	router.Handle("GET", "/indexes/{name}", security.RequireREST(handleV2Get, auth.ROLE_SCAN))
+	router.Handle("PUT", "/indexes/{name}", security.RequireREST(handleV2Create, auth.ROLE_DDL))
+	router.Handle("DELETE", "/indexes/{name}", security.RequireREST(handleV2Drop, auth.ROLE_DDL))
+	return router
+}
+
+func handleV2List(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	metricRequests.Inc("v2list")
+
+	servUuid, indexes, err := c.List("")
+	if err != nil {
+		rest.SendError(w, err)
+		return
+	}
+	rest.Send(w, http.StatusOK, api.IndexMetaResponse{
+		Status:     api.SUCCESS,
+		Indexes:    indexes,
+		ServerUuid: servUuid,
+	})
+}
+
+func handleV2Get(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	metricRequests.Inc("v2get")
+
+	indexinfo, err := findIndex(params["name"], r.FormValue("bucket"))
+	if err != nil {
+		rest.SendError(w, err)
+		return
+	}
+	rest.Send(w, http.StatusOK, api.IndexMetaResponse{
+		Status:     api.SUCCESS,
+		Indexes:    []api.IndexInfo{indexinfo},
+		ServerUuid: c.GetUuid(),
+	})
+}
+
+func handleV2Create(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	metricRequests.Inc("v2create")
+
+	var indexinfo api.IndexInfo
+	if err := rest.Decode(r, &indexinfo); err != nil {
+		rest.SendError(w, err)
+		return
+	}
+	if indexinfo.Name == "" {
+		indexinfo.Name = params["name"]
+	} else if indexinfo.Name != params["name"] {
+		rest.SendError(w, rest.BadRequest("Index name %v does not match %v",
+			indexinfo.Name, params["name"]))
+		return
+	}
+	if indexinfo.Uuid != "" {
+		rest.SendError(w, rest.BadRequest("Index uuid is assigned by the server"))
+		return
+	}
+
+	servUuid, indexinfo, err := createIndex(indexinfo)
+	if err != nil {
+		rest.SendError(w, err)
+		return
+	}
+	rest.Send(w, http.StatusCreated, api.IndexMetaResponse{
+		Status:     api.SUCCESS,
+		Indexes:    []api.IndexInfo{indexinfo},
+		ServerUuid: servUuid,
+	})
+}
+
+func handleV2Drop(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	metricRequests.Inc("v2drop")
+
+	indexinfo, err := findIndex(params["name"], r.FormValue("bucket"))
+	if err != nil {
+		rest.SendError(w, err)
+		return
+	}
+	servUuid, err := dropIndex(indexinfo.Uuid)
+	if err != nil {
+		rest.SendError(w, err)
+		return
+	}
+	rest.Send(w, http.StatusOK, api.IndexMetaResponse{
+		Status:     api.SUCCESS,
+		ServerUuid: servUuid,
+	})
+}
+
+// findIndex looks up an index by name, and by bucket if not empty.
+func findIndex(name, bucket string) (api.IndexInfo, error) {
+	var found []api.IndexInfo
+
+	_, indexes, err := c.List("")
+	if err != nil {
+		return api.IndexInfo{}, err
+	}
+	for _, indexinfo := range indexes {
+		if indexinfo.Name == name && (bucket == "" || indexinfo.Bucket == bucket) {
+			found = append(found, indexinfo)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return api.IndexInfo{}, api.NoSuchIndex
+	case 1:
+		return found[0], nil
+	}
+	return api.IndexInfo{}, rest.BadRequest("Index %v exists in more than one bucket", name)
+}
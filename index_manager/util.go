@@ -14,14 +14,19 @@ import (
 	"encoding/json"
 	. "github.com/couchbaselabs/indexing/api"
 	"github.com/couchbaselabs/indexing/index_manager/client"
-	"log"
 	"net/http"
+	"time"
 )
 
 var httpc = http.DefaultClient
 
 func sendCreateToIndexer(indexinfo IndexInfo) error {
 
+	start := time.Now()
+	defer func() {
+		metricIndexerRPC.Observe(time.Since(start).Seconds(), "create")
+	}()
+
 	var body []byte
 	var resp *http.Response
 	var err error
@@ -32,7 +37,7 @@ func sendCreateToIndexer(indexinfo IndexInfo) error {
 		// Post HTTP request.
 		bodybuf := bytes.NewBuffer(body)
 		url := node.IndexerURL + "/create"
-		log.Printf("Posting %v to URL %v", bodybuf, url)
+		ddlLog.Debugf("Posting %v to URL %v", bodybuf, url)
 		if resp, err = httpc.Post(url, "application/json", bodybuf); err == nil {
 			defer resp.Body.Close()
 			_, err = client.MetaResponse(resp)
@@ -44,6 +49,11 @@ func sendCreateToIndexer(indexinfo IndexInfo) error {
 
 func sendDropToIndexer(uuid string) error {
 
+	start := time.Now()
+	defer func() {
+		metricIndexerRPC.Observe(time.Since(start).Seconds(), "drop")
+	}()
+
 	var body []byte
 	var resp *http.Response
 	var err error
@@ -55,7 +65,33 @@ func sendDropToIndexer(uuid string) error {
 		// Post HTTP request.
 		bodybuf := bytes.NewBuffer(body)
 		url := node.IndexerURL + "/drop"
-		log.Printf("Posting %v to URL %v", bodybuf, url)
+		ddlLog.Debugf("Posting %v to URL %v", bodybuf, url)
+		if resp, err = httpc.Post(url, "application/json", bodybuf); err == nil {
+			defer resp.Body.Close()
+			_, err = client.MetaResponse(resp)
+		}
+	}
+	return err
+}
+
+func sendBuildToIndexer(indexinfos []IndexInfo) error {
+
+	start := time.Now()
+	defer func() {
+		metricIndexerRPC.Observe(time.Since(start).Seconds(), "build")
+	}()
+
+	var body []byte
+	var resp *http.Response
+	var err error
+
+	// Construct request body.
+	indexreq := IndexRequest{Type: BUILD, Indexes: indexinfos}
+	if body, err = json.Marshal(indexreq); err == nil {
+		// Post HTTP request.
+		bodybuf := bytes.NewBuffer(body)
+		url := node.IndexerURL + "/build"
+		ddlLog.Debugf("Posting %v to URL %v", bodybuf, url)
 		if resp, err = httpc.Post(url, "application/json", bodybuf); err == nil {
 			defer resp.Body.Close()
 			_, err = client.MetaResponse(resp)
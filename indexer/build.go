@@ -0,0 +1,205 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Index builds. A new index is in INDEX_CREATED state until the projector
+// opens a feed for its bucket and sends the bucket's high seqnos as build
+// target. The index is then INDEX_BUILDING, and becomes INDEX_READY once
+// the seqno applied for every vbucket has reached the target. Indexes
+// created with DeferBuild are INDEX_DEFERRED until a BUILD request moves
+// them to INDEX_CREATED. Index state is saved in the catalog, build targets
+// are kept in memory and sent again by the projector every time it
+// reconnects.
+
+package main
+
+import (
+	"fmt"
+	"github.com/couchbaselabs/indexing/api"
+	"sync"
+	"sync/atomic"
+)
+
+// mutations failing in a row that fail a build, the engine is failing as a
+// whole. Mutations failing on their own are kept as dead letters.
+const BUILD_FAILURE_LIMIT = 100
+
+type indexBuild struct {
+	target  api.SequenceVector
+	reached []bool //vbuckets that caught up with the target
+	pending int    //vbuckets still below the target
+}
+
+type buildManager struct {
+	sync.Mutex
+	starts sync.Mutex //serializes build starts
+	builds map[string]*indexBuild
+}
+
+var builds = newBuildManager()
+
+func newBuildManager() *buildManager {
+	return &buildManager{builds: make(map[string]*indexBuild)}
+}
+
+// start begins, or restarts with a new target, the build of an index. It is
+// a no-op for indexes that are ready, failed or deferred.
+func (b *buildManager) start(indexid string, target api.SequenceVector) error {
+
+	b.starts.Lock()
+	defer b.starts.Unlock()
+
+	indexinfo, err := c.Index(indexid)
+	if err != nil {
+		return err
+	}
+	switch indexinfo.State {
+	case api.INDEX_CREATED, api.INDEX_BUILDING:
+	default:
+		return nil //ready, failed, or deferred until a BUILD request
+	}
+	//the index is building before the build can finish
+	if indexinfo.State != api.INDEX_BUILDING {
+		if _, err = c.SetState(indexid, api.INDEX_BUILDING, ""); err != nil {
+			return err
+		}
+	}
+
+	build := &indexBuild{
+		target:  make(api.SequenceVector, api.MAX_VBUCKETS),
+		reached: make([]bool, api.MAX_VBUCKETS),
+	}
+	copy(build.target, target)
+	//seqnos applied are read with the build registered, those applied
+	//meanwhile are noted by noteApplied
+	applied := stats.index(indexid).applied
+	b.Lock()
+	for vb := range build.target {
+		if atomic.LoadUint64(&applied[vb]) >= build.target[vb] {
+			build.reached[vb] = true
+		} else {
+			build.pending++
+		}
+	}
+	b.builds[indexid] = build
+	pending := build.pending
+	b.Unlock()
+
+	if pending == 0 {
+		b.finish(indexid)
+		return nil
+	}
+	logger.With("index", indexid).Infof("Building index, %v vbuckets to catch up", pending)
+	return nil
+}
+
+// noteApplied is called by the mutation manager for every applied seqno.
+func (b *buildManager) noteApplied(indexid string, vbucket uint16, seqno uint64) {
+
+	b.Lock()
+	build, ok := b.builds[indexid]
+	if !ok || build.reached[vbucket] || seqno < build.target[vbucket] {
+		b.Unlock()
+		return
+	}
+	build.reached[vbucket] = true
+	build.pending--
+	done := build.pending == 0
+	b.Unlock()
+
+	if done {
+		b.finish(indexid)
+	}
+}
+
+// noteFailure is called by the mutation manager for every mutation the
+// engine failed to apply, `failing` being the number failed in a row.
+func (b *buildManager) noteFailure(indexid string, failing uint64, err error) {
+	if failing >= BUILD_FAILURE_LIMIT {
+		b.fail(indexid, fmt.Errorf("%v mutations failed in a row, the last one with %v", failing, err))
+	}
+}
+
+// fail moves a building index to INDEX_ERROR, the index can not become
+// ready while its engine fails.
+func (b *buildManager) fail(indexid string, err error) {
+
+	b.Lock()
+	_, ok := b.builds[indexid]
+	delete(b.builds, indexid)
+	b.Unlock()
+
+	if !ok {
+		return
+	}
+	if _, serr := c.SetState(indexid, api.INDEX_ERROR, err.Error()); serr != nil {
+		logger.With("index", indexid).Errorf("Error saving index state %v", serr)
+	}
+	logger.With("index", indexid).Errorf("Index build failed %v", err)
+}
+
+func (b *buildManager) finish(indexid string) {
+
+	b.Lock()
+	delete(b.builds, indexid)
+	b.Unlock()
+
+	if _, err := c.SetState(indexid, api.INDEX_READY, ""); err != nil {
+		logger.With("index", indexid).Errorf("Error saving index state %v", err)
+		return
+	}
+	logger.With("index", indexid).Infof("Index is ready")
+}
+
+func (b *buildManager) drop(indexid string) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.builds, indexid)
+}
+
+// progress reports how far the build of an index has come.
+func (b *buildManager) progress(indexinfo api.IndexInfo) api.IndexProgress {
+
+	res := api.IndexProgress{
+		Indexid:  indexinfo.Uuid,
+		State:    indexinfo.State,
+		StateMsg: indexinfo.StateMsg,
+	}
+	if indexinfo.IsReady() {
+		res.State = api.INDEX_READY
+		res.Percent = 100
+		return res
+	}
+
+	b.Lock()
+	build, ok := b.builds[indexinfo.Uuid]
+	b.Unlock()
+	if !ok {
+		return res
+	}
+
+	applied := stats.index(indexinfo.Uuid).applied
+	for vb, target := range build.target {
+		res.Target += target
+		if seqno := atomic.LoadUint64(&applied[vb]); seqno < target {
+			res.Applied += seqno
+		} else {
+			res.Applied += target
+		}
+	}
+	if res.Target > 0 {
+		res.Percent = float64(res.Applied) * 100 / float64(res.Target)
+	}
+	return res
+}
+
+// notReadyError is returned for scans on an index that is not ready.
+func notReadyError(indexinfo api.IndexInfo) error {
+	return api.NewError(api.ERR_NOT_READY, "Index %v is not ready, state %v",
+		indexinfo.Name, indexinfo.State)
+}
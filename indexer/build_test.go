@@ -0,0 +1,67 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/catalog"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBuildFailureLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := c
+	defer func() { c = saved }()
+	if c, err = catalog.NewIndexCatalog(dir, "build.dat"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Create(api.IndexInfo{Name: "idx", Uuid: "idx", Bucket: "b", State: api.INDEX_CREATED}); err != nil {
+		t.Fatal(err)
+	}
+	is := stats.add("idx")
+	defer stats.drop("idx")
+	defer builds.drop("idx")
+	target := make(api.SequenceVector, api.MAX_VBUCKETS)
+	target[1] = 100
+	if err = builds.start("idx", target); err != nil {
+		t.Fatal(err)
+	}
+	state := func() api.IndexState {
+		indexinfo, _ := c.Index("idx")
+		return indexinfo.State
+	}
+
+	//failures of single documents do not fail the build
+	engineErr := errors.New("engine broken")
+	for i := 0; i < 2*BUILD_FAILURE_LIMIT; i++ {
+		if i%10 == 0 {
+			is.noteProcessed()
+		}
+		builds.noteFailure("idx", is.noteFailed(), engineErr)
+	}
+	if s := state(); s != api.INDEX_BUILDING {
+		t.Fatalf("Expected index building, got %v", s)
+	}
+
+	//an engine failing every mutation does
+	for i := 0; i < BUILD_FAILURE_LIMIT; i++ {
+		builds.noteFailure("idx", is.noteFailed(), engineErr)
+	}
+	if s := state(); s != api.INDEX_ERROR {
+		t.Errorf("Expected index failed, got %v", s)
+	}
+}
@@ -0,0 +1,387 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Dead letters, mutations that could not be applied to an index because
+// their key or value could not be generated or the engine failed. Their
+// seqnos are recorded applied all the same, a dead letter is what is left
+// of the document for the index. Dead letters are kept per index in
+// <dataDir>/deadletters/<uuid>.json, at
+//   GET  /admin/deadletters[?index=<uuid>]                        lists them
+//   POST /admin/deadletters?index=<uuid>&action=retry|purge[&id=<n>]
+// retry applies them again, purge discards them, every dead letter of the
+// index unless `id` is given.
+//
+// An index keeps the dead letter of the last failed mutation of a document
+// only. A later mutation of the document applied supersedes it, so that a
+// retry never overwrites a newer version of a document. An index keeps
+// DEAD_LETTERS_KEPT dead letters at most, a mutation failing beyond that
+// fails the stream of its vbucket, which does not move past the mutation
+// until dead letters are retried or purged.
+//
+// Dead letters are persisted with the checkpoints of the sequence vectors,
+// before the seqnos of their mutations, retries and purges at once. Dead
+// letters past the seqnos an index rolls back to are discarded, their
+// mutations are received again.
+
+package main
+
+import (
+	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/rest"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEAD_LETTER_DIR = "deadletters"
+
+// dead letters kept per index, later failures fail their stream
+const DEAD_LETTERS_KEPT = 1000
+
+const (
+	DEAD_LETTER_KEY    = "key"
+	DEAD_LETTER_VALUE  = "value"
+	DEAD_LETTER_ENGINE = "engine"
+)
+
+type deadLetterStore struct {
+	sync.RWMutex
+	dir       string //empty to keep dead letters in memory only
+	lastId    uint64
+	indexes   map[string]map[string]*api.DeadLetter //by index, by docid
+	dirty     map[string]bool                       //indexes changed since flushed
+	flushLock sync.Mutex                            //held by flush writing files
+}
+
+var deadLetters = newDeadLetterStore("")
+
+func newDeadLetterStore(dir string) *deadLetterStore {
+	return &deadLetterStore{
+		dir:     dir,
+		indexes: make(map[string]map[string]*api.DeadLetter),
+		dirty:   make(map[string]bool),
+	}
+}
+
+// openDeadLetterStore loads the dead letters kept in `dir`.
+func openDeadLetterStore(dir string) (*deadLetterStore, error) {
+
+	s := newDeadLetterStore(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		var letters []*api.DeadLetter
+		if err = readJSON(file, &letters); err != nil {
+			return nil, err
+		}
+		byDocid := make(map[string]*api.DeadLetter, len(letters))
+		for _, letter := range letters {
+			byDocid[letter.Docid] = letter
+			if letter.Id > s.lastId {
+				s.lastId = letter.Id
+			}
+		}
+		s.indexes[strings.TrimSuffix(filepath.Base(file), ".json")] = byDocid
+	}
+	return s, nil
+}
+
+// add keeps a mutation that failed to apply, in place of the dead letter of
+// an earlier mutation of its document. Returns false if the index keeps too
+// many dead letters.
+func (s *deadLetterStore) add(mutation *api.Mutation, reason string, err error) bool {
+
+	s.Lock()
+	defer s.Unlock()
+	letters, ok := s.indexes[mutation.Indexid]
+	if !ok {
+		letters = make(map[string]*api.DeadLetter)
+		s.indexes[mutation.Indexid] = letters
+	}
+	if _, ok = letters[mutation.Docid]; !ok && len(letters) >= DEAD_LETTERS_KEPT {
+		mutationLog.With("index", mutation.Indexid).Errorf("%v dead letters kept, mutation of %v not kept",
+			len(letters), mutation.Docid)
+		return false
+	}
+	s.lastId++
+	letters[mutation.Docid] = &api.DeadLetter{
+		Id:           s.lastId,
+		Index:        mutation.Indexid,
+		Type:         mutation.Type,
+		Docid:        mutation.Docid,
+		Vbucket:      mutation.Vbucket,
+		Seqno:        mutation.Seqno,
+		Vbuuid:       mutation.Vbuuid,
+		SecondaryKey: mutation.SecondaryKey,
+		Reason:       reason,
+		Error:        err.Error(),
+		Failed:       time.Now().UnixNano() / int64(time.Millisecond),
+		Attempts:     1,
+	}
+	metricMutations.Inc(mutation.Indexid, "deadletter")
+	s.dirty[mutation.Indexid] = true
+	return true
+}
+
+// superseded discards the dead letter of a document once a later mutation
+// of it is applied.
+func (s *deadLetterStore) superseded(mutation *api.Mutation) {
+	s.RLock()
+	_, ok := s.indexes[mutation.Indexid][mutation.Docid]
+	s.RUnlock()
+	if ok {
+		s.remove(mutation.Indexid, mutation.Docid)
+	}
+}
+
+func (s *deadLetterStore) remove(indexid, docid string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.indexes[indexid], docid)
+	s.dirty[indexid] = true
+}
+
+// failed notes that a retried dead letter failed again.
+func (s *deadLetterStore) failed(indexid, docid string, err error) {
+	s.Lock()
+	defer s.Unlock()
+	if letter, ok := s.indexes[indexid][docid]; ok {
+		letter.Error = err.Error()
+		letter.Failed = time.Now().UnixNano() / int64(time.Millisecond)
+		letter.Attempts++
+		s.dirty[indexid] = true
+	}
+}
+
+// purge discards the dead letters of an index, the one numbered `id` only
+// unless 0. Returns the number discarded.
+func (s *deadLetterStore) purge(indexid string, id uint64) int {
+	s.Lock()
+	n := 0
+	for docid, letter := range s.indexes[indexid] {
+		if id == 0 || letter.Id == id {
+			delete(s.indexes[indexid], docid)
+			n++
+		}
+	}
+	s.dirty[indexid] = true
+	s.Unlock()
+	s.flush()
+	return n
+}
+
+// rollback discards the dead letters of mutations past `vector`, the index
+// receives them again.
+func (s *deadLetterStore) rollback(indexid string, vector api.SequenceVector) {
+	s.Lock()
+	defer s.Unlock()
+	for docid, letter := range s.indexes[indexid] {
+		if int(letter.Vbucket) >= len(vector) || letter.Seqno > vector[letter.Vbucket] {
+			delete(s.indexes[indexid], docid)
+			s.dirty[indexid] = true
+		}
+	}
+}
+
+func (s *deadLetterStore) drop(indexid string) {
+	s.Lock()
+	delete(s.indexes, indexid)
+	s.dirty[indexid] = true
+	s.Unlock()
+	s.flush()
+}
+
+// flush persists the dead letters of indexes changed since the last flush.
+// Failures are logged, the dead letters are kept in memory and persisted
+// at the next flush.
+func (s *deadLetterStore) flush() {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+
+	s.RLock()
+	n := len(s.dirty)
+	s.RUnlock()
+	if n == 0 {
+		return
+	}
+	//copied, letters change while files are written
+	s.Lock()
+	lists := make(map[string][]api.DeadLetter, len(s.dirty))
+	for indexid := range s.dirty {
+		letters := s.indexes[indexid]
+		if len(letters) == 0 {
+			delete(s.indexes, indexid)
+		}
+		list := make([]api.DeadLetter, 0, len(letters))
+		for _, letter := range letters {
+			list = append(list, *letter)
+		}
+		lists[indexid] = list
+	}
+	s.dirty = make(map[string]bool)
+	s.Unlock()
+
+	if s.dir == "" {
+		return
+	}
+	for indexid, list := range lists {
+		if err := s.write(indexid, list); err != nil {
+			mutationLog.With("index", indexid).Errorf("Failed to persist dead letters %v", err)
+			s.Lock()
+			s.dirty[indexid] = true
+			s.Unlock()
+		}
+	}
+}
+
+// write rewrites the dead letters file of an index, removes it if there
+// are none.
+func (s *deadLetterStore) write(indexid string, list []api.DeadLetter) error {
+
+	path := filepath.Join(s.dir, indexid+".json")
+	if len(list) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	//a partially written file would lose every dead letter of the index
+	err := writeJSON(path+".tmp", list)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	return err
+}
+
+// list returns the dead letters of an index, of every index if empty, in
+// the order they were kept.
+func (s *deadLetterStore) list(indexid string) []api.DeadLetter {
+	s.RLock()
+	defer s.RUnlock()
+	letters := make([]api.DeadLetter, 0)
+	for id, byDocid := range s.indexes {
+		if indexid != "" && id != indexid {
+			continue
+		}
+		for _, letter := range byDocid {
+			letters = append(letters, *letter)
+		}
+	}
+	sort.Sort(byLetterId(letters))
+	return letters
+}
+
+func (s *deadLetterStore) count(indexid string) int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.indexes[indexid])
+}
+
+type byLetterId []api.DeadLetter
+
+func (l byLetterId) Len() int           { return len(l) }
+func (l byLetterId) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byLetterId) Less(i, j int) bool { return l[i].Id < l[j].Id }
+
+// retryDeadLetters applies the dead letters of an index again, the one
+// numbered `id` only unless 0, and returns the number applied. Workers are
+// held back meanwhile, later mutations of the documents are applied after.
+// Called with ddlLock held.
+func (m *MutationManager) retryDeadLetters(indexid string, id uint64) (int, error) {
+
+	engine, ok := m.engine(indexid)
+	if !ok {
+		return 0, api.NoSuchIndex
+	}
+	m.applyLock.Lock()
+	defer m.applyLock.Unlock()
+
+	n := 0
+	for _, letter := range deadLetters.list(indexid) {
+		if id != 0 && letter.Id != id {
+			continue
+		}
+		if err := applyDeadLetter(engine, letter); err != nil {
+			deadLetters.failed(indexid, letter.Docid, err)
+			continue
+		}
+		deadLetters.remove(indexid, letter.Docid)
+		stats.index(indexid).noteProcessed()
+		metricMutations.Inc(indexid, "retried")
+		keyStats.noteMutation(indexid)
+		n++
+	}
+	deadLetters.flush()
+	return n, nil
+}
+
+func applyDeadLetter(engine api.Finder, letter api.DeadLetter) error {
+
+	if letter.Type == api.DELETE {
+		return engine.DeleteMutation(letter.Docid)
+	}
+	key, err := api.NewKey(letter.SecondaryKey, letter.Docid)
+	if err != nil {
+		return err
+	}
+	value, err := api.NewValue(letter.SecondaryKey, letter.Docid, letter.Vbucket, letter.Seqno)
+	if err != nil {
+		return err
+	}
+	return engine.InsertMutation(key, value)
+}
+
+// /admin/deadletters
+func handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+
+	indexid := r.FormValue("index")
+	if r.Method == "POST" {
+		var id uint64
+		var err error
+		if s := r.FormValue("id"); s != "" {
+			if id, err = strconv.ParseUint(s, 10, 64); err != nil || id == 0 {
+				rest.SendError(w, rest.BadRequest("id must be the number of a dead letter"))
+				return
+			}
+		}
+		if _, err = c.Index(indexid); err != nil {
+			rest.SendError(w, err)
+			return
+		}
+		switch r.FormValue("action") {
+		case "retry":
+			//drops wait, the engine of the index is not destroyed under the retry
+			ddlLock.Lock()
+			n, err := mutationMgr.retryDeadLetters(indexid, id)
+			ddlLock.Unlock()
+			if err != nil {
+				rest.SendError(w, err)
+				return
+			}
+			mutationLog.With("index", indexid).Infof("Retried dead letters, %v applied", n)
+		case "purge":
+			n := deadLetters.purge(indexid, id)
+			mutationLog.With("index", indexid).Infof("Purged %v dead letters", n)
+		default:
+			rest.SendError(w, rest.BadRequest("action must be retry or purge"))
+			return
+		}
+	}
+	rest.Send(w, http.StatusOK, deadLetters.list(indexid))
+}
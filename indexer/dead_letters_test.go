@@ -0,0 +1,157 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/couchbaselabs/indexing/api"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// failingEngine fails every mutation while broken.
+type failingEngine struct {
+	api.Finder
+	broken  bool
+	applied []string
+}
+
+func (e *failingEngine) InsertMutation(key api.Key, value api.Value) error {
+	if e.broken {
+		return errors.New("engine broken")
+	}
+	e.applied = append(e.applied, "insert")
+	return nil
+}
+
+func (e *failingEngine) DeleteMutation(docid string) error {
+	if e.broken {
+		return errors.New("engine broken")
+	}
+	e.applied = append(e.applied, "delete "+docid)
+	return nil
+}
+
+func TestDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := deadLetters
+	defer func() { deadLetters = saved }()
+	if deadLetters, err = openDeadLetterStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	engine := &failingEngine{broken: true}
+	m := &MutationManager{
+		enginemap: map[string]api.Finder{"idx": engine},
+		chseq:     make(chan seqNotification, 10),
+	}
+	defer stats.drop("idx")
+	insert := func(docid string, seqno uint64) *api.Mutation {
+		return &api.Mutation{Type: api.INSERT, Indexid: "idx", Docid: docid, Vbucket: 1, Seqno: seqno,
+			SecondaryKey: [][]byte{[]byte(`"k"`)}}
+	}
+
+	//failed mutations are kept, the last one of a document only
+	m.handleMutation(insert("a", 1))
+	m.handleMutation(insert("a", 2))
+	m.handleMutation(insert("b", 3))
+	m.handleMutation(&api.Mutation{Type: api.DELETE, Indexid: "idx", Docid: "c", Vbucket: 1, Seqno: 4})
+	letters := deadLetters.list("idx")
+	if len(letters) != 3 || letters[0].Docid != "a" || letters[0].Seqno != 2 || letters[0].Reason != DEAD_LETTER_ENGINE {
+		t.Fatalf("Unexpected dead letters %v", letters)
+	}
+	if len(m.chseq) != 4 {
+		t.Errorf("Expected seqnos of failed mutations recorded, got %v", len(m.chseq))
+	}
+
+	//dead letters are persisted with the checkpoint, and survive a restart,
+	//a later mutation supersedes one
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected dead letters persisted at the checkpoint, got %v files", len(files))
+	}
+	m.persistSequenceMap()
+	if deadLetters, err = openDeadLetterStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	engine.broken = false
+	m.handleMutation(insert("b", 5))
+	if letters = deadLetters.list(""); len(letters) != 2 || letters[0].Docid != "a" || letters[1].Docid != "c" {
+		t.Fatalf("Expected dead letters of a and c left, got %v", letters)
+	}
+
+	//retried, a failure is noted and the dead letter kept
+	engine.broken = true
+	if n, err := m.retryDeadLetters("idx", 0); err != nil || n != 0 {
+		t.Fatalf("Expected no dead letter applied, got %v %v", n, err)
+	}
+	if letters = deadLetters.list("idx"); letters[0].Attempts != 2 {
+		t.Errorf("Expected 2 attempts, got %v", letters[0].Attempts)
+	}
+	engine.broken = false
+	if n, err := m.retryDeadLetters("idx", letters[1].Id); err != nil || n != 1 {
+		t.Fatalf("Expected the dead letter of c applied, got %v %v", n, err)
+	}
+	if last := engine.applied[len(engine.applied)-1]; last != "delete c" {
+		t.Errorf("Expected c deleted, got %v", last)
+	}
+
+	if n := deadLetters.purge("idx", 0); n != 1 || deadLetters.count("idx") != 0 {
+		t.Errorf("Expected 1 dead letter purged, got %v", n)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected no dead letters file left, got %v", len(files))
+	}
+	if _, err := m.retryDeadLetters("gone", 0); err != api.NoSuchIndex {
+		t.Errorf("Expected unknown index, got %v", err)
+	}
+}
+
+func TestDeadLettersKept(t *testing.T) {
+	saved := deadLetters
+	defer func() { deadLetters = saved }()
+	deadLetters = newDeadLetterStore("")
+	m := &MutationManager{
+		enginemap: map[string]api.Finder{"idx": &failingEngine{broken: true}},
+		chseq:     make(chan seqNotification, DEAD_LETTERS_KEPT+1),
+	}
+	defer stats.drop("idx")
+	defer failures.drop("idx")
+	remove := func(vbucket uint16, seqno uint64) *api.Mutation {
+		return &api.Mutation{Type: api.DELETE, Indexid: "idx", Docid: fmt.Sprint(seqno), Vbucket: vbucket, Seqno: seqno}
+	}
+
+	//dead letters past the seqnos rolled back to are discarded
+	m.handleMutation(remove(1, 10))
+	m.handleMutation(remove(2, 20))
+	deadLetters.rollback("idx", make(api.SequenceVector, api.MAX_VBUCKETS))
+	if n := deadLetters.count("idx"); n != 0 {
+		t.Errorf("Expected dead letters discarded on rollback, got %v", n)
+	}
+	<-m.chseq
+	<-m.chseq
+
+	//beyond the dead letters kept, the stream fails and its seqno is not
+	//recorded
+	for seqno := uint64(1); seqno <= DEAD_LETTERS_KEPT; seqno++ {
+		m.handleMutation(remove(1, seqno))
+	}
+	if n := len(m.chseq); n != DEAD_LETTERS_KEPT || failures.failed(remove(1, 0)) {
+		t.Fatalf("Expected %v seqnos recorded, got %v", DEAD_LETTERS_KEPT, n)
+	}
+	m.handleMutation(remove(3, DEAD_LETTERS_KEPT+1))
+	if n := len(m.chseq); n != DEAD_LETTERS_KEPT || !failures.failed(remove(3, 0)) {
+		t.Errorf("Expected stream of vbucket 3 failed, %v seqnos recorded", n)
+	}
+}
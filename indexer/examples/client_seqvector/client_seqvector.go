@@ -28,9 +28,9 @@ func main() {
 	c := jsonrpc.NewClient(conn)
 
 	var indexList api.IndexList
-	var returnMap api.IndexSequenceMap
+	var returnMap api.IndexVectors
 
-	err = c.Call("MutationManager.GetSequenceVector", &indexList, &returnMap)
+	err = c.Call("MutationManager.GetSequenceVectors", &indexList, &returnMap)
 	if err != nil {
 		log.Fatal("Mutation error:", err)
 	}
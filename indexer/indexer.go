@@ -16,15 +16,20 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/auth"
 	"github.com/couchbaselabs/indexing/catalog"
+	"github.com/couchbaselabs/indexing/config"
 	"github.com/couchbaselabs/indexing/engine/leveldb"
-	"log"
+	"github.com/couchbaselabs/indexing/logging"
+	"github.com/couchbaselabs/indexing/metrics"
+	"github.com/couchbaselabs/indexing/rest"
 	"net/http"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
 var c catalog.IndexCatalog
@@ -34,42 +39,82 @@ var engineMap map[string]api.Finder
 
 var options struct {
 	debugLog bool
+	logLevel string
 }
 
+var conf *config.Manager
+var security *auth.Security
+
+var logger = logging.NewLogger("indexer")
+var ddlLog = logging.NewLogger("ddl")
+var scanLog = logging.NewLogger("scan")
+
 func main() {
 	var err error
 
 	argParse()
+	cfg := conf.Config().Indexer
 
 	// Create index catalog
-	if c, err = catalog.NewIndexCatalog("./", "icatalog.dat"); err != nil {
-		log.Fatalf("Fatal error opening catalog: %v", err)
+	if c, err = catalog.NewIndexCatalog(cfg.DataDir, cfg.CatalogFile); err != nil {
+		logger.Fatalf("Fatal error opening catalog: %v", err)
 	}
 
 	engineMap = make(map[string]api.Finder)
 	//open engine for existing indexes and assign to engineMap
-	openIndexEngine()
+	if err = openIndexEngine(); err != nil {
+		logger.Fatalf("Fatal error opening index engines: %v", err)
+	}
 
-	//FIXME add error handing to this
-	if chnotify, err = StartMutationManager(engineMap); err != nil {
-		log.Printf("Error Starting Mutation Manager %v", err)
-		return
+	if snapshots, err = newSnapshotManager(filepath.Join(cfg.DataDir, SNAPSHOT_DIR)); err != nil {
+		logger.Fatalf("Fatal error loading index snapshots: %v", err)
 	}
 
-	addr := ":8095"
-	// Subscribe to HTTP server handlers
-	http.HandleFunc("/create", handleCreate)
-	http.HandleFunc("/drop", handleDrop)
-	http.HandleFunc("/scan", handleScan)
-	http.HandleFunc("/stats", handleStats)
+	if deadLetters, err = openDeadLetterStore(filepath.Join(cfg.DataDir, DEAD_LETTER_DIR)); err != nil {
+		logger.Fatalf("Fatal error loading dead letters: %v", err)
+	}
 
-	//FIXME This doesn't work on Ctrl-C
-	defer freeResourcesOnExit()
-	log.Println("Indexer Listening on", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatalf("Fatal: %v", err)
+	if chnotify, err = StartMutationManager(engineMap, cfg); err != nil {
+		closeIndexEngines()
+		logger.Fatalf("Error Starting Mutation Manager %v", err)
 	}
+	conf.OnChange(resizeWorkers)
+	scans = newScanScheduler(cfg.ScanWorkers, cfg.ScanQueueSize)
+	if cfg.SnapshotInterval > 0 {
+		go snapshots.run(time.Duration(cfg.SnapshotInterval) * time.Second)
+	}
+
+	addr := cfg.HttpAddr
+	// Subscribe to HTTP server handlers
+	http.HandleFunc("/create", lifecycle.serve(security.Require(handleCreate, auth.ROLE_DDL)))
+	http.HandleFunc("/drop", lifecycle.serve(security.Require(handleDrop, auth.ROLE_DDL)))
+	http.HandleFunc("/build", lifecycle.serve(security.Require(handleBuild, auth.ROLE_DDL)))
+	http.HandleFunc("/scan", lifecycle.serve(security.Require(handleScan, auth.ROLE_SCAN)))
+	http.HandleFunc("/stats", lifecycle.serve(security.Require(handleStats, auth.ROLE_SCAN)))
+	http.HandleFunc("/keystats", lifecycle.serve(security.Require(handleKeyStats, auth.ROLE_SCAN)))
+	http.HandleFunc("/progress", lifecycle.serve(security.Require(handleProgress, auth.ROLE_SCAN)))
+	http.HandleFunc("/v2/", lifecycle.serve(security.Require(v2Router().ServeHTTP, auth.ROLE_SCAN)))
+	http.Handle("/metrics", metrics.Handler())
+	http.HandleFunc("/admin/loglevel", security.Require(logging.Handler().ServeHTTP, auth.ROLE_ADMIN))
+	http.HandleFunc("/config", security.Require(conf.Handler().ServeHTTP, auth.ROLE_ADMIN))
+	http.HandleFunc("/admin/workers", lifecycle.serve(security.Require(handleWorkers, auth.ROLE_ADMIN)))
+	http.HandleFunc("/admin/ingest", lifecycle.serve(security.Require(handleIngest, auth.ROLE_ADMIN)))
+	http.HandleFunc("/admin/deadletters", lifecycle.serve(security.Require(handleDeadLetters, auth.ROLE_ADMIN)))
+
+	l, err := security.Listen(addr)
+	if err != nil {
+		lifecycle.shutdown()
+		logger.Fatalf("Fatal: %v", err)
+	}
+	lifecycle.addListener(l)
+	go lifecycle.handleSignals()
 
+	logger.Infof("Indexer Listening on %v", addr)
+	if err := http.Serve(l, nil); err != nil && !lifecycle.isStopping() {
+		lifecycle.shutdown()
+		logger.Fatalf("Fatal: %v", err)
+	}
+	<-lifecycle.done
 }
 
 // /create
@@ -78,6 +123,12 @@ func handleCreate(w http.ResponseWriter, r *http.Request) {
 	var err error
 
 	indexinfo := indexRequest(r).Index // Get IndexInfo
+	//empty until the projector sends a build target
+	indexinfo.State = api.INDEX_CREATED
+	indexinfo.StateMsg = ""
+	if indexinfo.DeferBuild {
+		indexinfo.State = api.INDEX_DEFERRED
+	}
 
 	ddlLock.Lock()
 	defer ddlLock.Unlock()
@@ -95,13 +146,14 @@ func handleCreate(w http.ResponseWriter, r *http.Request) {
 			res = api.IndexMetaResponse{
 				Status: api.SUCCESS,
 			}
-			log.Printf("Created index(%v) %v", indexinfo.Uuid, indexinfo.Name)
+			ddlLog.With("index", indexinfo.Uuid).Infof("Created index %v", indexinfo.Name)
 		}
 	}
 	if err != nil {
 		res = createMetaResponseFromError(err)
-		log.Println("ERROR: Failed to create index", err)
+		ddlLog.Errorf("Failed to create index %v", err)
 	}
+	metricDDL.Inc("create", resultLabel(err))
 	sendResponse(w, res)
 }
 
@@ -123,13 +175,18 @@ func handleDrop(w http.ResponseWriter, r *http.Request) {
 			indexinfo: indexinfo,
 		}
 		chnotify <- notification
+		snapshots.drop(indexinfo.Uuid)
 
 		if err = engineMap[indexinfo.Uuid].Destroy(); err == nil {
 			if _, err = c.Drop(indexinfo.Uuid); err == nil {
+				keyStats.drop(indexinfo.Uuid)
+				stats.drop(indexinfo.Uuid)
+				builds.drop(indexinfo.Uuid)
+				deadLetters.drop(indexinfo.Uuid)
 				res = api.IndexMetaResponse{
 					Status: api.SUCCESS,
 				}
-				log.Printf("Dropped index(%v) %v", indexinfo.Uuid, indexinfo.Name)
+				ddlLog.With("index", indexinfo.Uuid).Infof("Dropped index %v", indexinfo.Name)
 			}
 		}
 
@@ -140,81 +197,321 @@ func handleDrop(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		res = createMetaResponseFromError(err)
-		log.Println("ERROR: Failed to drop index", err)
+		ddlLog.With("index", indexinfo.Uuid).Errorf("Failed to drop index %v", err)
+	}
+	metricDDL.Inc("drop", resultLabel(err))
+	sendResponse(w, res)
+}
+
+// /build, release deferred indexes to be built. Either all indexes of the
+// request are released or none.
+func handleBuild(w http.ResponseWriter, r *http.Request) {
+	var res api.IndexMetaResponse
+	var err error
+
+	indexinfos := indexRequest(r).Indexes
+
+	ddlLock.Lock()
+	defer ddlLock.Unlock()
+
+	for _, indexinfo := range indexinfos {
+		if err = checkDeferred(indexinfo.Uuid); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		for _, indexinfo := range indexinfos {
+			//the projector sends build targets once it reopens its feeds
+			if _, err = c.SetState(indexinfo.Uuid, api.INDEX_CREATED, ""); err != nil {
+				break
+			}
+			ddlLog.With("index", indexinfo.Uuid).Infof("Released deferred index for build")
+		}
+	}
+	if err == nil {
+		res = api.IndexMetaResponse{
+			Status: api.SUCCESS,
+		}
+	} else {
+		res = createMetaResponseFromError(err)
+		ddlLog.Errorf("Failed to build indexes %v", err)
 	}
+	metricDDL.Inc("build", resultLabel(err))
 	sendResponse(w, res)
 }
 
 // /scan
 func handleScan(w http.ResponseWriter, r *http.Request) {
-	var err error
 
 	indexreq := indexRequest(r) // Gather request
-	uuid := indexreq.Index.Uuid
-	q := indexreq.Params
 
-	if options.debugLog {
-		log.Printf("Received Scan Index %v Params %v %v", uuid, q.Low, q.High)
+	res, err := scanIndex(indexreq.Index.Uuid, indexreq.Params)
+	if err != nil {
+		sendScanResponse(w, nil, 0, api.Useless, false, err)
+		return
+	}
+	// send back the response
+	sendResponse(w, res)
+}
+
+// scanIndex runs a scan of type `q.ScanType` on index `uuid`, through the
+// scan scheduler.
+func scanIndex(uuid string, q api.QueryParams) (api.IndexScanResponse, error) {
+	var err error
+
+	start := time.Now()
+
+	if scanLog.IsDebug() {
+		scanLog.With("index", uuid).Debugf("Received Scan %v Params %v %v", q.ScanType, q.Low, q.High)
 	}
 
-	// Scan
-	rows := make([]api.IndexRow, 0)
-	var totalRows uint64
 	var lowkey, highkey api.Key
+	var stale bool
 
 	if lowkey, err = api.NewKey(q.Low, ""); err != nil {
-		sendScanResponse(w, nil, 0, err)
-		return
+		return api.IndexScanResponse{}, rest.BadRequest("Invalid low key: %v", err)
 	}
 
 	if highkey, err = api.NewKey(q.High, ""); err != nil {
-		sendScanResponse(w, nil, 0, err)
-		return
+		return api.IndexScanResponse{}, rest.BadRequest("Invalid high key: %v", err)
 	}
 
 	var indexinfo api.IndexInfo
-	if indexinfo, err = c.Index(uuid); err == nil {
-		switch q.ScanType {
+	if indexinfo, err = c.Index(uuid); err != nil {
+		err = api.NoSuchIndex
+	} else if !indexinfo.IsReady() {
+		//scans on an index still building see partial results
+		if stale = q.AllowStale; !stale {
+			err = notReadyError(indexinfo)
+		}
+	}
+
+	var res api.IndexScanResponse
+	if err == nil {
+		timeout := time.Duration(conf.Config().Indexer.ScanTimeoutMs) * time.Millisecond
+		deadline := deadlineOf(q, start, timeout)
+		res, err = scans.run(priorityOf(q), deadline, func(ctx *scanContext) (
+			api.IndexScanResponse, error) {
+
+			var err error
+			rows := make([]api.IndexRow, 0)
+			var totalRows uint64
+			var accuracy api.Accuracy = api.Perfect
+
+			switch q.ScanType {
+
+			case api.COUNT:
+				totalRows, err = countQuery(&indexinfo, q.Limit)
+
+			case api.EXISTS:
+				var exists bool
+				exists, err = existsQuery(&indexinfo, lowkey)
+				if exists {
+					totalRows = 1
+				}
+
+			case api.LOOKUP:
 
-		case api.COUNT:
-			totalRows, err = countQuery(&indexinfo, q.Limit)
+				rows, err = lookupQuery(ctx, &indexinfo, lowkey, q.Limit)
+				totalRows = uint64(len(rows))
 
-		case api.EXISTS:
-			var exists bool
-			exists, err = existsQuery(&indexinfo, lowkey)
-			if exists {
-				totalRows = 1
+			case api.RANGESCAN:
+
+				rows, err = rangeQuery(ctx, &indexinfo, lowkey, highkey, q.Inclusion, q.Limit)
+				totalRows = uint64(len(rows))
+
+			case api.FULLSCAN:
+				rows, err = scanQuery(ctx, &indexinfo, q.Limit)
+				totalRows = uint64(len(rows))
+
+			case api.RANGECOUNT:
+				totalRows, err = rangeCountQuery(&indexinfo, lowkey, highkey, q.Inclusion, q.Limit)
+
+			case api.ESTIMATERANGE:
+				totalRows, accuracy, err = estimateRangeQuery(&indexinfo, lowkey, highkey, q.Inclusion)
+
+			case api.ESTIMATEDISTINCT:
+				totalRows, accuracy, err = estimateDistinctQuery(&indexinfo)
+
+			default:
+				err = rest.BadRequest("Unknown scan type %v", q.ScanType)
 			}
+			return api.IndexScanResponse{
+				Status:    api.SUCCESS,
+				TotalRows: totalRows,
+				Accuracy:  accuracy,
+				Stale:     stale,
+				Rows:      rows,
+			}, api.EngineError(err)
+		})
+		stats.index(uuid).noteScan(time.Since(start), err)
+	}
+	metricScans.Inc(string(q.ScanType), resultLabel(err))
+	metricScanDuration.Observe(time.Since(start).Seconds(), string(q.ScanType))
+	if err != nil {
+		return api.IndexScanResponse{}, err
+	}
+	return res, nil
+}
 
-		case api.LOOKUP:
+// /stats, statistics of a single index or of all indexes if no uuid is
+// specified, along with mutation queue lengths.
+func handleStats(w http.ResponseWriter, r *http.Request) {
 
-			rows, err = lookupQuery(&indexinfo, lowkey, q.Limit)
-			totalRows = uint64(len(rows))
+	uuid := indexRequest(r).Index.Uuid
 
-		case api.RANGESCAN:
+	res, err := indexerStats(uuid)
+	if err != nil {
+		indexerr := api.IndexErrorOf(err)
+		res = api.IndexStatsResponse{
+			Status: api.ERROR,
+			Errors: []api.IndexError{indexerr},
+		}
+		logger.Errorf("Failed to get stats %v", err)
+	}
+	sendResponse(w, res)
+}
 
-			rows, err = rangeQuery(&indexinfo, lowkey, highkey, q.Inclusion, q.Limit)
-			totalRows = uint64(len(rows))
+func indexerStats(uuid string) (api.IndexStatsResponse, error) {
+	var indexinfos []api.IndexInfo
+	var err error
 
-		case api.FULLSCAN:
-			rows, err = scanQuery(&indexinfo, q.Limit)
-			totalRows = uint64(len(rows))
+	if uuid == "" {
+		_, indexinfos, err = c.List("")
+	} else {
+		var indexinfo api.IndexInfo
+		if indexinfo, err = c.Index(uuid); err == nil {
+			indexinfos = []api.IndexInfo{indexinfo}
+		} else {
+			err = api.NoSuchIndex
+		}
+	}
 
-		case api.RANGECOUNT:
-			totalRows, err = rangeCountQuery(&indexinfo, lowkey, highkey, q.Inclusion, q.Limit)
+	indexstats := make([]api.IndexStats, 0, len(indexinfos))
+	if err == nil {
+		for _, indexinfo := range indexinfos {
+			var s api.IndexStats
+			if s, err = indexStatsFor(indexinfo.Uuid, engineMap[indexinfo.Uuid]); err != nil {
+				break
+			}
+			indexstats = append(indexstats, s)
 		}
 	}
-	// send back the response
-	sendScanResponse(w, rows, totalRows, err)
+	if err != nil {
+		return api.IndexStatsResponse{}, err
+	}
+	return api.IndexStatsResponse{
+		Status:  api.SUCCESS,
+		Queues:  append(mutationMgr.queueStats(), scans.queueStats()...),
+		Indexes: indexstats,
+	}, nil
 }
 
-// /stats.
-func handleStats(w http.ResponseWriter, r *http.Request) {
-	panic("Not yet implemented")
+// /keystats, statistics of a single index or of all indexes if no uuid is
+// specified.
+func handleKeyStats(w http.ResponseWriter, r *http.Request) {
+	var res api.IndexKeyStatsResponse
+	var indexinfos []api.IndexInfo
+	var err error
+
+	indexreq := indexRequest(r)
+	uuid := indexreq.Index.Uuid
+
+	if uuid == "" {
+		_, indexinfos, err = c.List("")
+	} else {
+		var indexinfo api.IndexInfo
+		if indexinfo, err = c.Index(uuid); err == nil {
+			indexinfos = []api.IndexInfo{indexinfo}
+		}
+	}
+
+	stats := make([]api.IndexKeyStats, 0, len(indexinfos))
+	if err == nil {
+		for _, indexinfo := range indexinfos {
+			var s api.IndexKeyStats
+			if s, err = keyStats.get(indexinfo.Uuid, indexreq.Params.Refresh); err != nil {
+				break
+			}
+			stats = append(stats, s)
+		}
+	}
+
+	if err == nil {
+		res = api.IndexKeyStatsResponse{
+			Status: api.SUCCESS,
+			Stats:  stats,
+		}
+	} else {
+		indexerr := api.IndexErrorOf(err)
+		res = api.IndexKeyStatsResponse{
+			Status: api.ERROR,
+			Errors: []api.IndexError{indexerr},
+		}
+		logger.Errorf("Failed to get key statistics %v", err)
+	}
+	sendResponse(w, res)
+}
+
+// /progress, build progress of a single index or of all indexes if no uuid
+// is specified.
+func handleProgress(w http.ResponseWriter, r *http.Request) {
+	var res api.IndexProgressResponse
+	var indexinfos []api.IndexInfo
+	var err error
+
+	uuid := indexRequest(r).Index.Uuid
+
+	if uuid == "" {
+		_, indexinfos, err = c.List("")
+	} else {
+		var indexinfo api.IndexInfo
+		if indexinfo, err = c.Index(uuid); err == nil {
+			indexinfos = []api.IndexInfo{indexinfo}
+		}
+	}
+
+	if err == nil {
+		progress := make([]api.IndexProgress, 0, len(indexinfos))
+		for _, indexinfo := range indexinfos {
+			progress = append(progress, builds.progress(indexinfo))
+		}
+		res = api.IndexProgressResponse{
+			Status:   api.SUCCESS,
+			Progress: progress,
+		}
+	} else {
+		indexerr := api.IndexErrorOf(err)
+		res = api.IndexProgressResponse{
+			Status: api.ERROR,
+			Errors: []api.IndexError{indexerr},
+		}
+		logger.Errorf("Failed to get build progress %v", err)
+	}
+	sendResponse(w, res)
 }
 
 //---- helper functions
 
+func checkDeferred(uuid string) error {
+	indexinfo, err := c.Index(uuid)
+	if err != nil {
+		return err
+	}
+	if indexinfo.State != api.INDEX_DEFERRED {
+		return api.NewError(api.ERR_BAD_REQUEST, "Index %v is not deferred, state %v",
+			indexinfo.Name, indexinfo.State)
+	}
+	return nil
+}
+
+// unsupportedScan is returned when the engine of an index does not
+// implement the interface a scan type needs.
+func unsupportedScan(indexinfo *api.IndexInfo, iface string) error {
+	return api.NewError(api.ERR_SCAN_NOT_SUPPORTED, "Index %v does not support %v interface",
+		indexinfo.Name, iface)
+}
+
 func countQuery(indexinfo *api.IndexInfo, limit int64) (
 	uint64, error) {
 
@@ -222,7 +519,7 @@ func countQuery(indexinfo *api.IndexInfo, limit int64) (
 		count, err := counter.CountTotal()
 		return count, err
 	}
-	err := errors.New("Index does not support Looker interface")
+	err := unsupportedScan(indexinfo, "Counter")
 	return uint64(0), err
 }
 
@@ -232,44 +529,44 @@ func existsQuery(indexinfo *api.IndexInfo, key api.Key) (bool, error) {
 		exists := exister.Exists(key)
 		return exists, nil
 	}
-	err := errors.New("Index does not support Exister interface")
+	err := unsupportedScan(indexinfo, "Exister")
 	return false, err
 }
 
-func scanQuery(indexinfo *api.IndexInfo, limit int64) (
+func scanQuery(ctx *scanContext, indexinfo *api.IndexInfo, limit int64) (
 	[]api.IndexRow, error) {
 
 	if looker, ok := engineMap[indexinfo.Uuid].(api.Looker); ok {
 		ch, cherr := looker.ValueSet()
-		return receiveValue(ch, cherr, limit)
+		return receiveValue(ctx, ch, cherr, limit)
 	}
-	err := errors.New("Index does not support Looker interface")
+	err := unsupportedScan(indexinfo, "Looker")
 	return nil, err
 }
 
-func rangeQuery(
+func rangeQuery(ctx *scanContext,
 	indexinfo *api.IndexInfo, low, high api.Key, incl api.Inclusion,
 	limit int64) ([]api.IndexRow, error) {
 
 	if ranger, ok := engineMap[indexinfo.Uuid].(api.Ranger); ok {
 		ch, cherr, _ := ranger.ValueRange(low, high, incl)
-		return receiveValue(ch, cherr, limit)
+		return receiveValue(ctx, ch, cherr, limit)
 	}
-	err := errors.New("Index does not support ranger interface")
+	err := unsupportedScan(indexinfo, "Ranger")
 	return nil, err
 }
 
-func lookupQuery(indexinfo *api.IndexInfo, key api.Key, limit int64) (
+func lookupQuery(ctx *scanContext, indexinfo *api.IndexInfo, key api.Key, limit int64) (
 	[]api.IndexRow, error) {
 
 	if looker, ok := engineMap[indexinfo.Uuid].(api.Looker); ok {
-		if options.debugLog {
-			log.Printf("Looking up key %s", key.String())
+		if scanLog.IsDebug() {
+			scanLog.With("index", indexinfo.Uuid).Debugf("Looking up key %s", key.String())
 		}
 		ch, cherr := looker.Lookup(key)
-		return receiveValue(ch, cherr, limit)
+		return receiveValue(ctx, ch, cherr, limit)
 	}
-	err := errors.New("Index does not support looker interface")
+	err := unsupportedScan(indexinfo, "Looker")
 	return nil, err
 }
 
@@ -281,9 +578,30 @@ func rangeCountQuery(
 		totalRows, err := rangeCounter.CountRange(low, high, incl)
 		return totalRows, err
 	}
-	err := errors.New("Index does not support RangeCounter interface")
+	err := unsupportedScan(indexinfo, "RangeCounter")
 	return 0, err
 }
+
+func estimateRangeQuery(
+	indexinfo *api.IndexInfo, low, high api.Key, incl api.Inclusion) (
+	uint64, api.Accuracy, error) {
+
+	if estimator, ok := engineMap[indexinfo.Uuid].(api.Estimator); ok {
+		return estimator.EstimateRange(low, high, incl)
+	}
+	err := unsupportedScan(indexinfo, "Estimator")
+	return 0, api.Useless, err
+}
+
+func estimateDistinctQuery(indexinfo *api.IndexInfo) (uint64, api.Accuracy, error) {
+
+	if estimator, ok := engineMap[indexinfo.Uuid].(api.Estimator); ok {
+		return estimator.EstimateDistinct()
+	}
+	err := unsupportedScan(indexinfo, "Estimator")
+	return 0, api.Useless, err
+}
+
 func sendResponse(w http.ResponseWriter, res interface{}) {
 	var buf []byte
 	var err error
@@ -291,23 +609,26 @@ func sendResponse(w http.ResponseWriter, res interface{}) {
 	header["Content-Type"] = []string{"application/json"}
 
 	if buf, err = json.Marshal(&res); err != nil {
-		log.Println("Unable to marshal response", res)
+		logger.Errorf("Unable to marshal response %v", res)
 	}
 	w.Write(buf)
 }
 
-func sendScanResponse(w http.ResponseWriter, rows []api.IndexRow, totalRows uint64, err error) {
+func sendScanResponse(w http.ResponseWriter, rows []api.IndexRow, totalRows uint64,
+	accuracy api.Accuracy, stale bool, err error) {
 	var res api.IndexScanResponse
 
 	if err == nil {
 		res = api.IndexScanResponse{
 			Status:    api.SUCCESS,
 			TotalRows: totalRows,
+			Accuracy:  accuracy,
+			Stale:     stale,
 			Rows:      rows,
 			Errors:    nil,
 		}
 	} else {
-		indexerr := api.IndexError{Code: string(api.ERROR), Msg: err.Error()}
+		indexerr := api.IndexErrorOf(err)
 		res = api.IndexScanResponse{
 			Status:    api.ERROR,
 			TotalRows: uint64(0),
@@ -318,7 +639,7 @@ func sendScanResponse(w http.ResponseWriter, rows []api.IndexRow, totalRows uint
 	sendResponse(w, res)
 }
 
-func receiveValue(ch chan api.Value, cherr chan error, limit int64) (
+func receiveValue(ctx *scanContext, ch chan api.Value, cherr chan error, limit int64) (
 	[]api.IndexRow, error) {
 
 	//FIXME limit should be sent to the engine and only limit response be sent on the
@@ -328,6 +649,9 @@ func receiveValue(ch chan api.Value, cherr chan error, limit int64) (
 	if limit == 0 {
 		nolimit = true
 	}
+	timer := time.NewTimer(ctx.deadline.Sub(time.Now()))
+	defer timer.Stop()
+
 	ok := true
 	var value api.Value
 	var err error
@@ -335,9 +659,6 @@ func receiveValue(ch chan api.Value, cherr chan error, limit int64) (
 		select {
 		case value, ok = <-ch:
 			if ok {
-				if options.debugLog {
-					log.Printf("Indexer Received Value %s", value.String())
-				}
 				row := api.IndexRow{
 					Key:   value.KeyBytes(),
 					Value: value.Docid(),
@@ -349,23 +670,48 @@ func receiveValue(ch chan api.Value, cherr chan error, limit int64) (
 			if err != nil {
 				return rows, err
 			}
+		case <-timer.C:
+			ctx.atExit(func() { drainValues(ch, cherr) })
+			return nil, timeoutError()
 		}
 	}
+	if ok {
+		//limit reached, the engine is blocked sending the next value
+		ctx.atExit(func() { drainValues(ch, cherr) })
+	}
 	return rows, nil
 }
 
+// drainValues lets an engine run a scan to its end once the results are no
+// longer needed.
+func drainValues(ch chan api.Value, cherr chan error) {
+	for ch != nil || cherr != nil {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				ch = nil
+			}
+		case _, ok := <-cherr:
+			if !ok {
+				cherr = nil
+			}
+		}
+	}
+}
+
 // Parse HTTP Request to get IndexInfo.
 func indexRequest(r *http.Request) *api.IndexRequest {
 	indexreq := api.IndexRequest{}
-	buf := make([]byte, r.ContentLength, r.ContentLength)
-	r.Body.Read(buf)
-	json.Unmarshal(buf, &indexreq)
+	//v1 endpoints reply with an empty request on errors
+	if err := rest.Decode(r, &indexreq); err != nil {
+		logger.Errorf("Error decoding request %v", err)
+	}
 	return &indexreq
 }
 
 func createMetaResponseFromError(err error) api.IndexMetaResponse {
 
-	indexerr := api.IndexError{Code: string(api.ERROR), Msg: err.Error()}
+	indexerr := api.IndexErrorOf(err)
 	res := api.IndexMetaResponse{
 		Status: api.ERROR,
 		Errors: []api.IndexError{indexerr},
@@ -378,9 +724,12 @@ func assignIndexEngine(indexinfo *api.IndexInfo) error {
 	var err error
 	switch indexinfo.Using {
 	case api.LevelDB:
-		engineMap[indexinfo.Uuid] = leveldb.NewIndexEngine(indexinfo.Uuid)
+		var engine *leveldb.LevelDBEngine
+		if engine, err = leveldb.Create(indexinfo.Uuid, leveldbOptions()); err == nil {
+			engineMap[indexinfo.Uuid] = engine
+		}
 	default:
-		err = errors.New(fmt.Sprintf("Invalid index-type, `%v`", indexinfo.Using))
+		err = api.NewError(api.ERR_BAD_REQUEST, "Invalid index-type, `%v`", indexinfo.Using)
 	}
 	return err
 }
@@ -391,59 +740,87 @@ func openIndexEngine() error {
 	var indexinfos []api.IndexInfo
 	//For the existing indexes, open the existing engine
 	if _, indexinfos, err = c.List(""); err != nil {
-		log.Printf("Error while retrieving index list %v", err)
+		logger.Errorf("Error while retrieving index list %v", err)
 		return err
 	}
 
 	for _, indexinfo := range indexinfos {
-		log.Printf("Try Finding Existing Engine for Index %v", indexinfo)
+		logger.With("index", indexinfo.Uuid).Infof("Try Finding Existing Engine for Index %v", indexinfo)
 		switch indexinfo.Using {
 		case api.LevelDB:
-			engineMap[indexinfo.Uuid] = leveldb.OpenIndexEngine(indexinfo.Uuid)
-			log.Printf("Got Existing Engine for Index %v", indexinfo.Uuid)
+			var engine *leveldb.LevelDBEngine
+			if engine, err = leveldb.Open(indexinfo.Uuid, leveldbOptions()); err != nil {
+				//close what was opened so far, engines hold file locks
+				closeIndexEngines()
+				return fmt.Errorf("Index %v: %v", indexinfo.Uuid, err)
+			}
+			engineMap[indexinfo.Uuid] = engine
+			logger.With("index", indexinfo.Uuid).Infof("Got Existing Engine for Index")
 		default:
-			err = errors.New(fmt.Sprintf("Unknown Index Type. Skipping Opening Engine"))
+			logger.With("index", indexinfo.Uuid).Errorf("Unknown Index Type %v. Skipping Opening Engine", indexinfo.Using)
 		}
 	}
+	logger.Infof("Opened %v index engines", len(engineMap))
 
-	return err
+	return nil
 
 }
 
-func freeResourcesOnExit() {
+// closeIndexEngines closes every open engine. The catalog is left intact so
+// that the engines are reopened on the next start.
+func closeIndexEngines() error {
 
-	//purge the catalog
-	if err := c.Purge(); err != nil {
-		log.Printf("Error Purging Catalog %v", err)
+	var err error
+	for uuid, engine := range engineMap {
+		if cerr := engine.Close(); cerr != nil {
+			logger.With("index", uuid).Errorf("Error Closing Index Engine %v", cerr)
+			err = cerr
+		}
+		delete(engineMap, uuid)
 	}
+	return err
+}
 
-	//close the index engines
-	if err := closeIndexEngines(); err != nil {
-		log.Printf("Error Closing Index Engine %v", err)
+// leveldbOptions returns engine options from the current configuration.
+func leveldbOptions() leveldb.Options {
+	cfg := conf.Config().LevelDB
+	return leveldb.Options{
+		BloomBits:    cfg.BloomBits,
+		MaxOpenFiles: cfg.MaxOpenFiles,
+		Compression:  cfg.Compression,
 	}
-
-	//FIXME close the mutation manager?
-
 }
 
-func closeIndexEngines() error {
+func argParse() {
+	path, overrides := config.Flags(flag.CommandLine)
+	flag.BoolVar(&options.debugLog, "debugLog", false, "Debug Logging Enabled")
+	flag.StringVar(&options.logLevel, "logLevel", "info",
+		"Log level for all subsystems, one of error, warn, info, debug, trace")
+	flag.Parse()
 
-	if _, indexinfos, err := c.List(""); err == nil {
+	overrides.Alias(flag.CommandLine, map[string]string{"logLevel": "logLevel"})
+	if options.debugLog && overrides["logLevel"] != "trace" {
+		overrides["logLevel"] = "debug"
+	}
 
-		for _, indexinfo := range indexinfos {
-			if err := engineMap[indexinfo.Uuid].Close(); err != nil {
-				return err
-			}
-		}
-	} else {
-		return err
+	var err error
+	if conf, err = config.NewManager(*path, overrides); err != nil {
+		logger.Fatalf("Configuration error: %v", err)
 	}
+	setLogLevel(conf.Config())
+	conf.OnChange(setLogLevel)
 
-	return nil
+	if security, err = auth.New(conf.Config().Security); err != nil {
+		logger.Fatalf("Security configuration error: %v", err)
+	}
 }
 
-func argParse() {
-	flag.BoolVar(&options.debugLog, "debugLog", false, "Debug Logging Enabled")
-	flag.Parse()
-	api.DebugLog = options.debugLog
+func resizeWorkers(cfg config.Config) {
+	mutationMgr.setWorkers("", cfg.Indexer.MutationWorkers)
+}
+
+func setLogLevel(cfg config.Config) {
+	//validated by the config package
+	level, _ := logging.ParseLevel(cfg.LogLevel)
+	logging.SetLevel("all", level)
 }
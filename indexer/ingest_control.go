@@ -0,0 +1,300 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Ingestion control per index, at
+//   GET  /admin/ingest                                         lists settings
+//   POST /admin/ingest?index=<uuid>&action=pause|resume
+//   POST /admin/ingest?index=<uuid>&action=throttle&rate=<n>
+//
+// A paused index drops the mutations received for it, mutations queued
+// before are still applied. Its sequence vector stays frozen while the
+// seqnos received keep moving, its stats show it `paused` and how far it is
+// behind in `sequenceLag`. On resume, mutation batches holding mutations of
+// the index are rejected with ERR_STREAM_FAILED until the projector
+// handshakes again, it then replays the backlog from the frozen vector.
+//
+// A throttled index has at most `rate` mutations admitted per second, rate 0
+// lifts the limit. Batches holding mutations of an index ahead of its rate
+// are rejected with ERR_QUEUE_FULL and the projector backs off, JSON-RPC
+// clients are held back instead. Workers never wait for a throttled index.
+//
+// Settings are not persisted, a restarted indexer ingests every index.
+
+package main
+
+import (
+	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/rest"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// codes of mutation requests rejected by ingestion control, in the
+// rejected mutations metric.
+const (
+	REJECTED_RESUMED   = "index_resumed"
+	REJECTED_THROTTLED = "index_throttled"
+)
+
+type ingestState struct {
+	paused  bool
+	resumed bool //rejects mutations until the projector handshakes
+	limiter *rateLimiter
+}
+
+type ingestControl struct {
+	sync.RWMutex
+	indexes map[string]*ingestState
+}
+
+var ingest = &ingestControl{indexes: make(map[string]*ingestState)}
+
+// rateLimiter admits mutations at a rate, a batch is admitted once those
+// before it would have been at the rate.
+type rateLimiter struct {
+	sync.Mutex
+	rate float64   //mutations per second
+	next time.Time //when the next batch may be admitted
+}
+
+// delay returns how long until the next batch may be admitted.
+func (l *rateLimiter) delay() time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	if now := time.Now(); l.next.After(now) {
+		return l.next.Sub(now)
+	}
+	return 0
+}
+
+// reserve admits `n` mutations.
+func (l *rateLimiter) reserve(n int) {
+	l.Lock()
+	defer l.Unlock()
+	if now := time.Now(); l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) * float64(time.Second) / l.rate))
+}
+
+// state returns the settings of an index, creating them. Called with the
+// lock held.
+func (ic *ingestControl) state(indexid string) *ingestState {
+	st, ok := ic.indexes[indexid]
+	if !ok {
+		st = &ingestState{}
+		ic.indexes[indexid] = st
+	}
+	return st
+}
+
+// forget removes the settings of an index that are all default.
+func (ic *ingestControl) forget(indexid string) {
+	if st := ic.indexes[indexid]; !st.paused && !st.resumed && st.limiter == nil {
+		delete(ic.indexes, indexid)
+	}
+}
+
+func (ic *ingestControl) pause(indexid string) {
+	ic.Lock()
+	defer ic.Unlock()
+	st := ic.state(indexid)
+	st.paused, st.resumed = true, false
+}
+
+func (ic *ingestControl) resume(indexid string) {
+	ic.Lock()
+	defer ic.Unlock()
+	st := ic.state(indexid)
+	if st.paused {
+		st.paused, st.resumed = false, true
+	}
+	ic.forget(indexid)
+}
+
+func (ic *ingestControl) throttle(indexid string, rate float64) {
+	ic.Lock()
+	defer ic.Unlock()
+	st := ic.state(indexid)
+	if rate > 0 {
+		st.limiter = &rateLimiter{rate: rate}
+	} else {
+		st.limiter = nil
+	}
+	ic.forget(indexid)
+}
+
+func (ic *ingestControl) drop(indexid string) {
+	ic.Lock()
+	defer ic.Unlock()
+	delete(ic.indexes, indexid)
+}
+
+// check returns an error if any of `muts` belongs to an index resumed
+// since the last handshake.
+func (ic *ingestControl) check(muts []*api.Mutation) error {
+	ic.RLock()
+	defer ic.RUnlock()
+	if len(ic.indexes) == 0 {
+		return nil
+	}
+	for _, mutation := range muts {
+		if st, ok := ic.indexes[mutation.Indexid]; ok && st.resumed {
+			return api.NewError(api.ERR_STREAM_FAILED,
+				"Index %v resumed, handshake to replay its mutations", mutation.Indexid)
+		}
+	}
+	return nil
+}
+
+// admitted returns `muts` without the mutations of paused indexes, which
+// are noted received.
+func (ic *ingestControl) admitted(muts []*api.Mutation) []*api.Mutation {
+	ic.RLock()
+	defer ic.RUnlock()
+	if len(ic.indexes) == 0 {
+		return muts
+	}
+	admitted := muts[:0:0]
+	for _, mutation := range muts {
+		if st, ok := ic.indexes[mutation.Indexid]; ok && st.paused {
+			stats.index(mutation.Indexid).noteReceived(mutation.Vbucket, mutation.Seqno)
+			metricMutations.Inc(mutation.Indexid, "paused")
+			continue
+		}
+		admitted = append(admitted, mutation)
+	}
+	return admitted
+}
+
+// handshake lets resumed indexes ingest again, the projector restarts
+// from their sequence vectors. Empty `indexes` stands for every index.
+func (ic *ingestControl) handshake(indexes api.IndexList) {
+	requested := make(map[string]bool, len(indexes))
+	for _, indexid := range indexes {
+		requested[indexid] = true
+	}
+	ic.Lock()
+	defer ic.Unlock()
+	for indexid, st := range ic.indexes {
+		if st.resumed && (len(indexes) == 0 || requested[indexid]) {
+			st.resumed = false
+			ic.forget(indexid)
+			mutationLog.With("index", indexid).Infof("Replaying mutations of resumed index")
+		}
+	}
+}
+
+// limit admits `muts` at the rates of their throttled indexes. If one of
+// them is ahead of its rate, nothing is admitted and the index is returned
+// with how long until it may be admitted.
+func (ic *ingestControl) limit(muts []*api.Mutation) (string, time.Duration) {
+	ic.RLock()
+	if len(ic.indexes) == 0 {
+		ic.RUnlock()
+		return "", 0
+	}
+	counts := make(map[*rateLimiter]int)
+	indexes := make(map[*rateLimiter]string)
+	for _, mutation := range muts {
+		if st, ok := ic.indexes[mutation.Indexid]; ok && st.limiter != nil {
+			counts[st.limiter]++
+			indexes[st.limiter] = mutation.Indexid
+		}
+	}
+	ic.RUnlock()
+
+	for limiter := range counts {
+		if delay := limiter.delay(); delay > 0 {
+			return indexes[limiter], delay
+		}
+	}
+	for limiter, n := range counts {
+		limiter.reserve(n)
+	}
+	return "", 0
+}
+
+func (ic *ingestControl) info(indexid string) api.IngestState {
+	ic.RLock()
+	defer ic.RUnlock()
+	info := api.IngestState{Index: indexid}
+	if st, ok := ic.indexes[indexid]; ok {
+		info.Paused = st.paused
+		if st.limiter != nil {
+			info.Rate = st.limiter.rate
+		}
+	}
+	return info
+}
+
+func (ic *ingestControl) list() []api.IngestState {
+	ic.RLock()
+	indexes := make([]string, 0, len(ic.indexes))
+	for indexid := range ic.indexes {
+		indexes = append(indexes, indexid)
+	}
+	ic.RUnlock()
+	sort.Strings(indexes)
+	infos := make([]api.IngestState, 0, len(indexes))
+	for _, indexid := range indexes {
+		infos = append(infos, ic.info(indexid))
+	}
+	return infos
+}
+
+// pause stops an index from consuming mutations
+func (m *MutationManager) pause(indexid string) {
+	ingest.pause(indexid)
+	mutationLog.With("index", indexid).Infof("Ingestion paused")
+}
+
+// resume lets an index consume mutations again, from where it was paused
+func (m *MutationManager) resume(indexid string) {
+	ingest.resume(indexid)
+	mutationLog.With("index", indexid).Infof("Ingestion resumed")
+}
+
+// throttle caps the mutations applied to an index per second, 0 for none
+func (m *MutationManager) throttle(indexid string, rate float64) {
+	ingest.throttle(indexid, rate)
+	mutationLog.With("index", indexid).Infof("Ingestion limited to %v mutations per second", rate)
+}
+
+// /admin/ingest
+func handleIngest(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method == "POST" {
+		indexid := r.FormValue("index")
+		if _, err := c.Index(indexid); err != nil {
+			rest.SendError(w, err)
+			return
+		}
+		switch r.FormValue("action") {
+		case "pause":
+			mutationMgr.pause(indexid)
+		case "resume":
+			mutationMgr.resume(indexid)
+		case "throttle":
+			rate, err := strconv.ParseFloat(r.FormValue("rate"), 64)
+			if err != nil || rate < 0 {
+				rest.SendError(w, rest.BadRequest("rate must be a number of mutations per second, 0 for no limit"))
+				return
+			}
+			mutationMgr.throttle(indexid, rate)
+		default:
+			rest.SendError(w, rest.BadRequest("action must be pause, resume or throttle"))
+			return
+		}
+	}
+	rest.Send(w, http.StatusOK, ingest.list())
+}
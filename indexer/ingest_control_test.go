@@ -0,0 +1,109 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"github.com/couchbaselabs/indexing/api"
+	"testing"
+	"time"
+)
+
+func TestPauseResume(t *testing.T) {
+	m := &MutationManager{
+		chmutation:  make(chan *api.Mutation, 10),
+		sequencemap: api.IndexSequenceMap{"paused": make(api.SequenceVector, api.MAX_VBUCKETS)},
+		vbuuidmap:   api.IndexVbuuidMap{"paused": make(api.VbuuidVector, api.MAX_VBUCKETS)},
+	}
+	defer ingest.drop("paused")
+	stats.add("paused")
+	defer stats.drop("paused")
+	muts := []*api.Mutation{
+		{Type: api.INSERT, Indexid: "paused", Docid: "a", Vbucket: 1, Seqno: 5},
+		{Type: api.INSERT, Indexid: "other", Docid: "b", Vbucket: 1, Seqno: 6},
+	}
+
+	//mutations of a paused index are acknowledged and dropped
+	m.pause("paused")
+	if credits, err := m.admit(muts); err != nil || credits != 9 || len(m.chmutation) != 1 {
+		t.Fatalf("Expected one mutation queued, got %v %v %v", len(m.chmutation), credits, err)
+	}
+	if lag := stats.index("paused").sequenceLag(); lag != 5 {
+		t.Errorf("Expected paused index 5 seqnos behind, got %v", lag)
+	}
+	if info := ingest.info("paused"); !info.Paused {
+		t.Error("Expected index reported paused")
+	}
+
+	//resumed, batches are rejected until the projector handshakes
+	m.resume("paused")
+	if _, err := m.admit(muts); api.CodeOf(err) != api.ERR_STREAM_FAILED {
+		t.Errorf("Expected batch rejected after resume, got %v", err)
+	}
+	if _, err := m.admit(muts[1:]); err != nil {
+		t.Errorf("Expected other indexes admitted, got %v", err)
+	}
+	var reply api.IndexVectors
+	if err := m.GetSequenceVectors(api.IndexList{"paused"}, &reply); err != nil || reply.Seqnos["paused"][1] != 0 {
+		t.Fatalf("Expected frozen vector, got %v", err)
+	}
+	if _, err := m.admit(muts); err != nil || len(m.chmutation) != 4 {
+		t.Errorf("Expected batch admitted after handshake, got %v %v", len(m.chmutation), err)
+	}
+	if n := len(ingest.list()); n != 0 {
+		t.Errorf("Expected no settings left, got %v", n)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	m := &MutationManager{chmutation: make(chan *api.Mutation, 10)}
+	defer ingest.drop("throttled")
+	muts := []*api.Mutation{
+		{Type: api.INSERT, Indexid: "throttled", Docid: "a", Vbucket: 1, Seqno: 1},
+		{Type: api.INSERT, Indexid: "throttled", Docid: "b", Vbucket: 1, Seqno: 2},
+	}
+	other := []*api.Mutation{{Type: api.INSERT, Indexid: "other", Docid: "c", Vbucket: 1, Seqno: 3}}
+
+	//a batch is admitted once those before it would have been at the rate
+	m.throttle("throttled", 100)
+	start := time.Now()
+	if _, err := m.admit(muts); err != nil {
+		t.Fatal(err)
+	}
+	_, err := m.admit(muts)
+	if api.CodeOf(err) != api.ERR_QUEUE_FULL || len(m.chmutation) != 2 {
+		t.Errorf("Expected throttled batch rejected as a full queue, got %v", err)
+	}
+	if info := ingest.info("throttled"); info.Rate != 100 {
+		t.Errorf("Expected rate 100, got %v", info.Rate)
+	}
+	//other indexes are not held back
+	if _, err := m.admit(other); err != nil {
+		t.Errorf("Expected other indexes admitted, got %v", err)
+	}
+	for api.CodeOf(err) == api.ERR_QUEUE_FULL {
+		time.Sleep(5 * time.Millisecond)
+		_, err = m.admit(muts)
+	}
+	if elapsed := time.Since(start); err != nil || elapsed < 20*time.Millisecond {
+		t.Errorf("Expected batch admitted after 20ms at least, took %v %v", elapsed, err)
+	}
+
+	//the limit can be lifted
+	m.throttle("throttled", 0)
+	for i := 0; i < 2; i++ {
+		if _, err = m.admit(muts); err != nil {
+			t.Errorf("Expected batch admitted, got %v", err)
+		}
+	}
+	var reply bool
+	if err = m.ProcessSingleMutation(muts[0], &reply); err != nil || !reply {
+		t.Errorf("Expected mutation queued, got %v %v", reply, err)
+	}
+}
@@ -0,0 +1,164 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Per index key statistics. Statistics are computed on demand through
+// /keystats, and refreshed in the background once the number of mutations
+// applied since the last refresh crosses a fraction of the index size.
+
+package main
+
+import (
+	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/keystats"
+	"sync"
+	"sync/atomic"
+)
+
+const KEYSTATS_BUCKETS = 64
+const KEYSTATS_STALE_RATIO = 0.2     //fraction of rows mutated before refresh
+const KEYSTATS_MIN_MUTATIONS = 10000 //never refresh more often than this
+const KEYSTATS_CHECK_INTERVAL = 1000 //mutations between staleness checks
+
+type keyStatsManager struct {
+	sync.RWMutex
+	stats      map[string]*api.IndexKeyStats
+	mutations  map[string]*uint64 //mutations applied since last refresh
+	refreshing map[string]bool
+}
+
+var keyStats = newKeyStatsManager()
+
+func newKeyStatsManager() *keyStatsManager {
+	return &keyStatsManager{
+		stats:      make(map[string]*api.IndexKeyStats),
+		mutations:  make(map[string]*uint64),
+		refreshing: make(map[string]bool),
+	}
+}
+
+// noteMutation is called by mutation workers for every applied mutation.
+func (k *keyStatsManager) noteMutation(indexid string) {
+
+	k.RLock()
+	counter, ok := k.mutations[indexid]
+	k.RUnlock()
+
+	if !ok {
+		k.Lock()
+		if counter, ok = k.mutations[indexid]; !ok {
+			counter = new(uint64)
+			k.mutations[indexid] = counter
+		}
+		k.Unlock()
+	}
+
+	if n := atomic.AddUint64(counter, 1); n%KEYSTATS_CHECK_INTERVAL == 0 {
+		k.refreshIfStale(indexid, n)
+	}
+}
+
+func (k *keyStatsManager) refreshIfStale(indexid string, mutations uint64) {
+
+	k.RLock()
+	stats, ok := k.stats[indexid]
+	k.RUnlock()
+
+	if mutations < KEYSTATS_MIN_MUTATIONS {
+		return
+	}
+	if ok && float64(mutations) < float64(stats.Rows)*KEYSTATS_STALE_RATIO {
+		return
+	}
+	go func() {
+		if _, err := k.refresh(indexid); err != nil {
+			logger.With("index", indexid).Errorf("Error refreshing key statistics %v", err)
+		}
+	}()
+}
+
+// get returns statistics for an index, computing them if they were never
+// computed or if `refresh` is set.
+func (k *keyStatsManager) get(indexid string, refresh bool) (api.IndexKeyStats, error) {
+
+	k.RLock()
+	stats, ok := k.stats[indexid]
+	k.RUnlock()
+
+	if ok && !refresh {
+		statsClone := *stats // Copy
+		statsClone.Mutations = k.mutationsSinceRefresh(indexid)
+		return statsClone, nil
+	}
+	return k.refresh(indexid)
+}
+
+func (k *keyStatsManager) refresh(indexid string) (api.IndexKeyStats, error) {
+
+	k.Lock()
+	if k.refreshing[indexid] {
+		k.Unlock()
+		return api.IndexKeyStats{}, api.NewError(api.ERR_NOT_READY, "Key statistics refresh already in progress")
+	}
+	k.refreshing[indexid] = true
+	counter, ok := k.mutations[indexid]
+	if !ok {
+		counter = new(uint64)
+		k.mutations[indexid] = counter
+	}
+	k.Unlock()
+
+	defer func() {
+		k.Lock()
+		delete(k.refreshing, indexid)
+		k.Unlock()
+	}()
+
+	ddlLock.Lock()
+	engine, ok := engineMap[indexid]
+	ddlLock.Unlock()
+	if !ok {
+		return api.IndexKeyStats{}, api.NewError(api.ERR_INDEX_NOT_FOUND, "Unknown Index %v", indexid)
+	}
+	looker, ok := engine.(api.Looker)
+	if !ok {
+		return api.IndexKeyStats{}, api.NewError(api.ERR_SCAN_NOT_SUPPORTED, "Index does not support Looker interface")
+	}
+
+	//mutations applied during the scan count towards the next refresh
+	atomic.StoreUint64(counter, 0)
+	stats, err := keystats.Compute(looker, KEYSTATS_BUCKETS)
+	if err != nil {
+		return api.IndexKeyStats{}, err
+	}
+	stats.Indexid = indexid
+
+	k.Lock()
+	k.stats[indexid] = &stats
+	k.Unlock()
+
+	logger.With("index", indexid).Infof("Refreshed key statistics, %v rows", stats.Rows)
+	return stats, nil
+}
+
+func (k *keyStatsManager) mutationsSinceRefresh(indexid string) uint64 {
+	k.RLock()
+	defer k.RUnlock()
+	if counter, ok := k.mutations[indexid]; ok {
+		return atomic.LoadUint64(counter)
+	}
+	return 0
+}
+
+// drop forgets statistics of a dropped index.
+func (k *keyStatsManager) drop(indexid string) {
+	k.Lock()
+	defer k.Unlock()
+	delete(k.stats, indexid)
+	delete(k.mutations, indexid)
+}
@@ -0,0 +1,130 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Process lifecycle of the indexer. On SIGINT or SIGTERM the indexer
+// shuts down in order,
+//  - stop accepting connections on the REST and RPC listeners,
+//  - reject new requests and wait for in-flight ones to finish,
+//  - drain the mutation queue, worker queues and sequence queue,
+//  - persist the final sequence map,
+//  - close the index engines.
+// The catalog is left intact so that the indexes are reopened on restart.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var ErrShuttingDown = errors.New("Indexer is shutting down")
+
+type lifecycleManager struct {
+	sync.RWMutex
+	stopping  bool
+	requests  sync.WaitGroup //in-flight REST requests and RPC calls
+	listeners []net.Listener
+	done      chan bool //closed once shutdown is complete
+}
+
+var lifecycle = &lifecycleManager{done: make(chan bool)}
+
+// addListener registers a listener to be closed on shutdown.
+func (l *lifecycleManager) addListener(listener net.Listener) {
+	l.Lock()
+	defer l.Unlock()
+	l.listeners = append(l.listeners, listener)
+}
+
+// enter admits a request, returns false if the indexer is shutting down.
+// Every admitted request must call exit.
+func (l *lifecycleManager) enter() bool {
+	l.RLock()
+	defer l.RUnlock()
+	if l.stopping {
+		return false
+	}
+	l.requests.Add(1)
+	return true
+}
+
+func (l *lifecycleManager) exit() {
+	l.requests.Done()
+}
+
+func (l *lifecycleManager) isStopping() bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.stopping
+}
+
+// serve wraps a REST handler so that it is rejected once shutdown began,
+// and waited upon otherwise.
+func (l *lifecycleManager) serve(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !l.enter() {
+			w.Header()["Content-Type"] = []string{"application/json"}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			sendResponse(w, createMetaResponseFromError(ErrShuttingDown))
+			return
+		}
+		defer l.exit()
+		handler(w, r)
+	}
+}
+
+// handleSignals shuts the indexer down on SIGINT or SIGTERM. A second
+// signal during shutdown exits immediately.
+func (l *lifecycleManager) handleSignals() {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-ch
+	logger.Infof("Received %v, shutting down", sig)
+	go func() {
+		sig := <-ch
+		logger.Fatalf("Received %v during shutdown, exiting immediately", sig)
+	}()
+	l.shutdown()
+}
+
+func (l *lifecycleManager) shutdown() {
+
+	l.Lock()
+	if l.stopping {
+		l.Unlock()
+		return
+	}
+	l.stopping = true
+	for _, listener := range l.listeners {
+		listener.Close()
+	}
+	l.Unlock()
+
+	//wait for in-flight scans, ddl and rpc calls
+	l.requests.Wait()
+	logger.Infof("Stopped accepting requests")
+
+	//drain queues and persist the final sequence map
+	mutationMgr.stop()
+
+	ddlLock.Lock()
+	if err := closeIndexEngines(); err != nil {
+		logger.Errorf("Error Closing Index Engine %v", err)
+	}
+	ddlLock.Unlock()
+
+	logger.Infof("Shutdown complete")
+	close(l.done)
+}
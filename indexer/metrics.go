@@ -0,0 +1,69 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Metrics exposed by the indexer at /metrics.
+
+package main
+
+import (
+	"github.com/couchbaselabs/indexing/metrics"
+)
+
+var (
+	metricMutations = metrics.NewCounter("indexer_mutations_total",
+		"Mutations handled by mutation workers", "index", "result")
+	metricMutationsReceived = metrics.NewCounter("indexer_mutations_received_total",
+		"Mutations received from projectors")
+	metricScans = metrics.NewCounter("indexer_scans_total",
+		"Scans served", "type", "result")
+	metricScanDuration = metrics.NewHistogram("indexer_scan_duration_seconds",
+		"Scan latency", nil, "type")
+	metricScansRejected = metrics.NewCounter("indexer_scans_rejected_total",
+		"Scans rejected by admission control or timed out", "priority", "reason")
+	metricDDL = metrics.NewCounter("indexer_ddl_total",
+		"Index create and drop requests", "op", "result")
+	metricRPC = metrics.NewCounter("indexer_rpc_requests_total",
+		"Mutation RPC requests", "method")
+	metricMutationsRejected = metrics.NewCounter("indexer_mutations_rejected_total",
+		"Mutation requests rejected, by error code or ingestion control", "code")
+	metricStreamFailures = metrics.NewCounter("indexer_stream_failures_total",
+		"Mutation streams of an index for a vbucket that failed", "index")
+	metricOutOfOrder = metrics.NewCounter("indexer_mutations_out_of_order_total",
+		"Mutations whose seqno does not follow the last one applied", "index", "order")
+	metricSnapshots = metrics.NewCounter("indexer_snapshots_total",
+		"Index snapshots taken", "index", "result")
+	metricRollbacks = metrics.NewCounter("indexer_rollbacks_total",
+		"Index rollbacks after the data source rolled back", "index", "result")
+	metricRecoveries = metrics.NewCounter("indexer_recoveries_total",
+		"Indexes recovered on restart, by checkpoint state", "index", "checkpoint")
+
+	metricMutationQueue = metrics.NewGaugeFunc("indexer_mutation_queue_length",
+		"Mutations waiting to be routed to workers",
+		func() float64 { return float64(len(mutationMgr.chmutation)) })
+	metricWorkerQueue = metrics.NewGaugeFunc("indexer_worker_queue_length",
+		"Mutations waiting in worker queues",
+		func() float64 {
+			n := 0
+			for _, g := range mutationMgr.workerGroups() {
+				n += g.queued()
+			}
+			return float64(n)
+		})
+	metricSequenceQueue = metrics.NewGaugeFunc("indexer_sequence_queue_length",
+		"Sequence notifications waiting to be recorded",
+		func() float64 { return float64(len(mutationMgr.chseq)) })
+)
+
+// result label for metrics
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
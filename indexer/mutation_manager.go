@@ -10,24 +10,45 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
-	"errors"
-	"fmt"
 	"github.com/couchbaselabs/indexing/api"
-	"log"
+	"github.com/couchbaselabs/indexing/auth"
+	"github.com/couchbaselabs/indexing/config"
+	"github.com/couchbaselabs/indexing/logging"
+	"github.com/couchbaselabs/indexing/stream"
+	"github.com/couchbaselabs/indexing/wal"
+	"io"
 	"net"
 	"net/rpc"
 	"net/rpc/jsonrpc"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type MutationManager struct {
+	mapLock     sync.RWMutex //guards enginemap, sequencemap and vbuuidmap
 	enginemap   map[string]api.Finder
 	sequencemap api.IndexSequenceMap
-	chmutation  chan *api.Mutation                       //buffered channel to store incoming mutations
-	chworkers   [MAX_MUTATION_WORKERS]chan *api.Mutation //buffered channel for each worker
-	chseq       chan seqNotification                     //buffered channel to store sequence notifications from workers
-	chddl       chan ddlNotification                     //channel for incoming ddl notifications
+	vbuuidmap   api.IndexVbuuidMap      //vbucket branches of the sequence map
+	vbuuidDirty map[string]bool         //indexes whose branches changed since persisted
+	chmutation  chan *api.Mutation      //buffered channel to store incoming mutations
+	chseq       chan seqNotification    //buffered channel to store sequence notifications from workers
+	chddl       chan ddlNotification    //channel for incoming ddl notifications
+	chregroup   chan regroupRequest     //changes to worker groups, applied by the router
+	shared      *workerGroup            //workers of indexes without workers of their own
+	groups      map[string]*workerGroup //indexes with workers of their own
+	groupsLock  sync.RWMutex            //held by the router changing groups
+	workers     sync.WaitGroup          //running group dispatchers and mutation workers
+	inflight    int64                   //mutations queued and not applied yet
+	done        chan bool               //closed when queues are drained on stop
+	admitLock   sync.Mutex              //serializes admission of stream batches
+	mutationHWM int64                   //high-water marks of the queues
+	seqHWM      int64
+	applyLock   sync.RWMutex //held by workers applying mutations, exclusively by snapshots and rollbacks
+	wal         *mutationWAL //logs mutations before they are acknowledged, nil if disabled
 }
 
 type ddlNotification struct {
@@ -41,115 +62,451 @@ type seqNotification struct {
 	indexid string
 	seqno   uint64
 	vbucket uint16
+	vbuuid  uint64
+	vector  api.SequenceVector //replace the index's vectors on rollback
+	vbuuids api.VbuuidVector
+	done    chan bool //closed once the vectors are persisted
 }
 
-//error state flag
-var indexerErrorState bool
-var indexerErrorString string
-var wg sync.WaitGroup
-var chdrain chan bool
-
-const MAX_INCOMING_QUEUE = 50000
-const MAX_MUTATION_WORKERS = 8
-const MAX_WORKER_QUEUE = 1000
-const MAX_SEQUENCE_QUEUE = 50000
 const META_DOC_ID = "."
+const META_VBUUID_ID = ".vbuuids"
 const SEQ_MAP_PERSIST_INTERVAL = 1 //number of mutations after which sequence map is persisted
 
+const ROLLBACK_IDLE_TIMEOUT = 30 * time.Second //wait for queued mutations before a rollback
+
 var mutationMgr MutationManager
 
+var mutationLog = logging.NewLogger("mutation")
+
 //perf data
 var mutationCount int64
 
 //---Exported RPC methods which are available to remote clients
 
-//This function returns a map of <Index, SequenceVector> based on the IndexList received in request
-func (m *MutationManager) GetSequenceVectors(indexList api.IndexList, reply *api.IndexSequenceMap) error {
+//This function returns a map of <Index, SequenceVector> based on the IndexList received in request,
+//along with the vbucket UUIDs of the seqnos
+func (m *MutationManager) GetSequenceVectors(indexList api.IndexList, reply *api.IndexVectors) error {
+
+	metricRPC.Inc("GetSequenceVectors")
 
-	// if indexer is in error state, let the error handing routines finish
-	if indexerErrorState == true {
-		wg.Wait()
-		//reset the error state at each handshake
-		indexerErrorState = false
-		indexerErrorString = ""
+	if !lifecycle.enter() {
+		return ErrShuttingDown
 	}
+	defer lifecycle.exit()
 
-	//if indexList is nil, return the complete map
+	//resumed indexes replay their mutations from the vectors returned
+	ingest.handshake(indexList)
+	//failed streams resume once their queued mutations are dropped, the
+	//workers need the map lock to drop them
+	failures.drain(STREAM_DRAIN_TIMEOUT)
+
+	//vectors are copied, they change as mutations are applied
+	m.mapLock.RLock()
+	defer m.mapLock.RUnlock()
+
+	//if indexList is nil, return the complete map. Failed streams restart
+	//from before their failed mutation at each handshake.
 	if len(indexList) == 0 {
-		*reply = m.sequencemap
-		if options.debugLog {
-			log.Printf("Mutation Manager returning complete SequenceMap %v", m.sequencemap)
+		replyMap := make(api.IndexSequenceMap, len(m.sequencemap))
+		vbuuidMap := make(api.IndexVbuuidMap, len(m.vbuuidmap))
+		for idx, v := range m.sequencemap {
+			replyMap[idx] = append(api.SequenceVector(nil), v...)
+			vbuuidMap[idx] = append(api.VbuuidVector(nil), m.vbuuidmap[idx]...)
+		}
+		*reply = api.IndexVectors{
+			Seqnos:  failures.resume(replyMap, true),
+			Vbuuids: vbuuidMap,
+		}
+		if mutationLog.IsDebug() {
+			mutationLog.Debugf("Mutation Manager returning complete SequenceMap %v", replyMap)
 		}
 		return nil
 	}
 
 	//loop through the list of requested indexes and return the sequenceVector for those indexes
 	var replyMap = make(api.IndexSequenceMap)
+	var vbuuidMap = make(api.IndexVbuuidMap)
 	for _, idx := range indexList {
 		//if the requested index is not found, return an error
 		v, ok := m.sequencemap[idx]
 		if !ok {
-			return errors.New("Requested Index Not Found")
+			return api.NewError(api.ERR_INDEX_NOT_FOUND, "Requested Index Not Found")
 		}
 
 		//add to the reply map
-		if options.debugLog {
-			log.Printf("Mutation Manager returning sequence vector for index %v %v", idx, v)
+		if mutationLog.IsDebug() {
+			mutationLog.With("index", idx).Debugf("Mutation Manager returning sequence vector %v", v)
 		}
-		replyMap[idx] = v
+		replyMap[idx] = append(api.SequenceVector(nil), v...)
+		vbuuidMap[idx] = append(api.VbuuidVector(nil), m.vbuuidmap[idx]...)
+	}
+	*reply = api.IndexVectors{
+		Seqnos:  failures.resume(replyMap, false),
+		Vbuuids: vbuuidMap,
 	}
-	*reply = replyMap
 	return nil
 
 }
 
 //This method takes as input an api.Mutation and copies into mutation queue for processing
 func (m *MutationManager) ProcessSingleMutation(mutation *api.Mutation, reply *bool) error {
-	if options.debugLog {
-		log.Printf("Received Mutation Type %s Indexid %v, Docid %v, Vbucket %v, Seqno %v", mutation.Type, mutation.Indexid, mutation.Docid, mutation.Vbucket, mutation.Seqno)
+	if mutationLog.IsDebug() {
+		mutationLog.With("index", mutation.Indexid, "vbucket", mutation.Vbucket, "seqno", mutation.Seqno).Debugf("Received Mutation Type %s Docid %v", mutation.Type, mutation.Docid)
+	}
+
+	metricRPC.Inc("ProcessSingleMutation")
+
+	if err := checkVbuckets([]*api.Mutation{mutation}); err != nil {
+		*reply = false
+		metricMutationsRejected.Inc(string(api.ERR_BAD_REQUEST))
+		return err
+	}
+	//if the mutation's stream failed, reply with that. This will force a handshake again.
+	if err := failures.check([]*api.Mutation{mutation}); err != nil {
+		*reply = false
+		metricMutationsRejected.Inc(string(api.ERR_STREAM_FAILED))
+		return err
+	}
+	//a resumed index makes the projector handshake again as well
+	if err := ingest.check([]*api.Mutation{mutation}); err != nil {
+		*reply = false
+		metricMutationsRejected.Inc(REJECTED_RESUMED)
+		return err
 	}
 
-	//if there is any pending error, reply with that. This will force a handshake again.
-	if indexerErrorState == true {
+	//no mutations are queued once shutdown began, the projector will
+	//restart from the persisted sequence vector
+	if !lifecycle.enter() {
 		*reply = false
+		return ErrShuttingDown
 	}
+	defer lifecycle.exit()
 
-	//copy the mutation data and return
-	m.chmutation <- mutation
+	//mutations of a paused index are acknowledged and dropped
+	if len(ingest.admitted([]*api.Mutation{mutation})) == 0 {
+		*reply = true
+		return nil
+	}
+	//a throttled index holds back its client, until shutdown
+	for {
+		_, delay := ingest.limit([]*api.Mutation{mutation})
+		if delay == 0 || lifecycle.isStopping() {
+			break
+		}
+		time.Sleep(delay)
+	}
+
+	//the mutation is acknowledged once logged
+	if m.wal != nil {
+		if err := m.wal.append([]*api.Mutation{mutation}); err != nil {
+			*reply = false
+			metricMutationsRejected.Inc(string(api.ERR_INTERNAL))
+			return api.NewError(api.ERR_INTERNAL, "Error logging mutation %v", err)
+		}
+	}
+
+	//copy the mutation data and return. JSON-RPC clients send one mutation
+	//at a time, they are slowed down by blocking on a full queue.
+	m.queueMutation(mutation)
 	*reply = true
 	return nil
 
 }
 
+//This method receives build targets, the bucket's high seqnos, for indexes
+//of a bucket each time the projector opens a feed for it
+func (m *MutationManager) SetBuildTargets(targets api.IndexSequenceMap, reply *bool) error {
+
+	metricRPC.Inc("SetBuildTargets")
+
+	if !lifecycle.enter() {
+		return ErrShuttingDown
+	}
+	defer lifecycle.exit()
+
+	for indexid, target := range targets {
+		if err := builds.start(indexid, target); err != nil {
+			mutationLog.With("index", indexid).Errorf("Error starting index build %v", err)
+			return err
+		}
+	}
+	*reply = true
+	return nil
+}
+
+//This method rolls indexes back after their data source rolled back, so
+//that none of their vbuckets is past the target, and returns the seqnos
+//to restart their streams from
+func (m *MutationManager) Rollback(req api.RollbackRequest, reply *api.IndexVectors) error {
+
+	metricRPC.Inc("Rollback")
+
+	if !lifecycle.enter() {
+		return ErrShuttingDown
+	}
+	defer lifecycle.exit()
+
+	//mutations of the rolled back history must not be applied after it
+	if err := m.waitIdle(ROLLBACK_IDLE_TIMEOUT); err != nil {
+		return err
+	}
+	replyMap := api.IndexVectors{
+		Seqnos:  make(api.IndexSequenceMap),
+		Vbuuids: make(api.IndexVbuuidMap),
+	}
+	for _, indexid := range req.Indexes {
+		vector, vbuuids, err := m.rollback(indexid, req.Target)
+		metricRollbacks.Inc(indexid, resultLabel(err))
+		if err != nil {
+			mutationLog.With("index", indexid).Errorf("Error rolling back index %v", err)
+			return err
+		}
+		replyMap.Seqnos[indexid] = vector
+		replyMap.Vbuuids[indexid] = vbuuids
+	}
+	*reply = replyMap
+	return nil
+}
+
 //---End of exported RPC methods
 
-//read incoming mutation and distribute it on worker queues based on vbucketid
+//queueMutation copies a received mutation into the mutation queue
+func (m *MutationManager) queueMutation(mutation *api.Mutation) {
+	atomic.AddInt64(&m.inflight, 1)
+	metricMutationsReceived.Inc()
+	stats.index(mutation.Indexid).noteReceived(mutation.Vbucket, mutation.Seqno)
+	ordering.enqueue(mutation)
+	m.chmutation <- mutation
+	noteQueueLength(&m.mutationHWM, len(m.chmutation))
+}
+
+//credits returns the number of mutations the mutation queue can take
+//without blocking
+func (m *MutationManager) credits() int {
+	return cap(m.chmutation) - len(m.chmutation)
+}
+
+//admit queues all mutations of a stream batch if they fit in the mutation
+//queue, rejects the batch with ERR_QUEUE_FULL otherwise. Returns the credits
+//left for the client.
+func (m *MutationManager) admit(muts []*api.Mutation) (int, error) {
+	m.admitLock.Lock()
+	defer m.admitLock.Unlock()
+
+	if err := checkVbuckets(muts); err != nil {
+		metricMutationsRejected.Inc(string(api.ERR_BAD_REQUEST))
+		return m.credits(), err
+	}
+	if err := failures.check(muts); err != nil {
+		metricMutationsRejected.Inc(string(api.ERR_STREAM_FAILED))
+		return m.credits(), err
+	}
+	if err := ingest.check(muts); err != nil {
+		metricMutationsRejected.Inc(REJECTED_RESUMED)
+		return m.credits(), err
+	}
+	//mutations of paused indexes are acknowledged and dropped
+	muts = ingest.admitted(muts)
+	if credits := m.credits(); len(muts) > credits {
+		metricMutationsRejected.Inc(string(api.ERR_QUEUE_FULL))
+		return credits, api.NewError(api.ERR_QUEUE_FULL,
+			"Mutation queue is full, %v of %v mutations fit", credits, len(muts))
+	}
+	//throttled indexes make the projector back off like a full queue
+	if indexid, delay := ingest.limit(muts); delay > 0 {
+		metricMutationsRejected.Inc(REJECTED_THROTTLED)
+		return m.credits(), api.NewError(api.ERR_QUEUE_FULL,
+			"Index %v is throttled, retry in %v", indexid, delay)
+	}
+	//the batch is acknowledged once logged
+	if m.wal != nil {
+		if err := m.wal.append(muts); err != nil {
+			metricMutationsRejected.Inc(string(api.ERR_INTERNAL))
+			return m.credits(), api.NewError(api.ERR_INTERNAL, "Error logging mutations %v", err)
+		}
+	}
+	for _, mutation := range muts {
+		m.queueMutation(mutation)
+	}
+	return m.credits(), nil
+}
+
+//checkVbuckets rejects mutations for vbuckets out of the sequence vectors
+func checkVbuckets(muts []*api.Mutation) error {
+	for _, mutation := range muts {
+		if mutation.Vbucket >= api.MAX_VBUCKETS {
+			return api.NewError(api.ERR_BAD_REQUEST, "Mutation of %v for vbucket %v, vbuckets go up to %v",
+				mutation.Docid, mutation.Vbucket, api.MAX_VBUCKETS-1)
+		}
+	}
+	return nil
+}
+
+//noteQueueLength raises a queue's high-water mark to `length`
+func noteQueueLength(mark *int64, length int) {
+	for {
+		hwm := atomic.LoadInt64(mark)
+		if int64(length) <= hwm || atomic.CompareAndSwapInt64(mark, hwm, int64(length)) {
+			return
+		}
+	}
+}
+
+//serveStream receives mutation batches of the binary stream protocol on a
+//connection that started with a HELLO frame
+func (m *MutationManager) serveStream(r *bufio.Reader, conn net.Conn) {
+	defer conn.Close()
+
+	sconn, err := stream.Accept(r, conn, m.credits())
+	if err != nil {
+		mutationLog.Errorf("Stream handshake with %v failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	log := mutationLog.With("remote", conn.RemoteAddr().String())
+	log.Infof("Receiving mutation stream")
+
+	for {
+		batch, err := sconn.Next()
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("Error reading mutation stream %v", err)
+			}
+			return
+		}
+		metricRPC.Inc("StreamBatch")
+		if mutationLog.IsDebug() {
+			log.With("vbucket", batch.Vbucket).Debugf("Received batch %v of %v mutations", batch.Id, len(batch.Mutations))
+		}
+
+		//no mutations are queued once shutdown began, the projector will
+		//restart from the persisted sequence vector
+		if !lifecycle.enter() {
+			sconn.Reject(batch, ErrShuttingDown, 0)
+			return
+		}
+		muts := make([]*api.Mutation, 0, len(batch.Mutations))
+		for i := range batch.Mutations {
+			muts = append(muts, batch.Mutations[i].Split()...)
+		}
+		//a failed stream rejects the batch, forcing a handshake again, a full
+		//queue makes the projector back off
+		if credits, aerr := m.admit(muts); aerr != nil {
+			if api.CodeOf(aerr) == api.ERR_QUEUE_FULL && mutationLog.IsDebug() {
+				log.With("vbucket", batch.Vbucket).Debugf("Rejected batch %v: %v", batch.Id, aerr)
+			}
+			err = sconn.Reject(batch, aerr, credits)
+		} else {
+			err = sconn.Ack(batch, credits)
+		}
+		lifecycle.exit()
+		if err != nil {
+			log.Errorf("Error replying to mutation stream %v", err)
+			return
+		}
+	}
+}
+
+//rollback restores a snapshot of the index and records its seqnos
+func (m *MutationManager) rollback(indexid string, target api.SequenceVector) (
+	api.SequenceVector, api.VbuuidVector, error) {
+
+	engine, ok := m.engine(indexid)
+	if !ok {
+		return nil, nil, api.NoSuchIndex
+	}
+	snapshotter, ok := engine.(api.Snapshotter)
+	if !ok {
+		return nil, nil, api.NewError(api.ERR_ENGINE, "Engine of index %v cannot roll back", indexid)
+	}
+	//logged mutations of the index are never replayed past the rollback
+	if m.wal != nil {
+		if err := m.wal.rollback(indexid); err != nil {
+			return nil, nil, api.NewError(api.ERR_INTERNAL, "Error logging rollback %v", err)
+		}
+	}
+	vector, vbuuids, err := snapshots.rollback(indexid, snapshotter, target)
+	if err != nil {
+		return nil, nil, err
+	}
+	deadLetters.rollback(indexid, vector)
+	done := make(chan bool)
+	m.chseq <- seqNotification{indexid: indexid, vector: vector, vbuuids: vbuuids, done: done}
+	<-done
+	mutationLog.With("index", indexid).Infof("Index rolled back")
+	return vector, vbuuids, nil
+}
+
+//waitIdle waits until queued mutations are applied and their seqnos recorded
+func (m *MutationManager) waitIdle(timeout time.Duration) error {
+
+	deadline := time.Now().Add(timeout)
+	for !m.idle() {
+		if time.Now().After(deadline) {
+			return api.NewError(api.ERR_TIMEOUT, "Mutations still queued after %v", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func (m *MutationManager) idle() bool {
+	return atomic.LoadInt64(&m.inflight) == 0 && len(m.chseq) == 0
+}
+
+//read incoming mutation and route it to the worker group of its index
 func (m *MutationManager) manageMutationQueue() {
 
 	for {
 		select {
 		case mut, ok := <-m.chmutation:
-			if ok {
-				m.chworkers[mut.Vbucket%MAX_MUTATION_WORKERS] <- mut
+			if !ok {
+				//stopping, let the workers drain their queues
+				m.stopGroups()
+				close(m.chseq)
+				return
 			}
-		case <-chdrain:
-			wg.Add(1)
-			m.drainMutationChannel(m.chmutation)
+			m.route(mut)
+		case req := <-m.chregroup:
+			m.regroup(req)
 		}
 	}
 
 }
 
-//start a mutation worker which handles mutation on the specified workerId channel
-func (m *MutationManager) startMutationWorker(workerId int) {
+//start a mutation worker which handles mutations queued on `queue`
+func (m *MutationManager) startMutationWorker(queue chan groupTask, group *sync.WaitGroup) {
 
-	for {
-		select {
-		case mutation := <-m.chworkers[workerId]:
-			m.handleMutation(mutation)
-		case <-chdrain:
-			wg.Add(1)
-			m.drainMutationChannel(m.chworkers[workerId])
+	defer m.workers.Done()
+	defer group.Done()
+	for task := range queue {
+		if task.fence != nil {
+			task.fence.Done()
+			continue
+		}
+		m.applyMutation(task.mutation)
+		atomic.AddInt64(&m.inflight, -1)
+	}
+}
+
+func (m *MutationManager) applyMutation(mutation *api.Mutation) {
+
+	defer ordering.dequeue(mutation)
+	//mutations queued behind a failed one are replayed after the
+	//stream restarts
+	if failures.failed(mutation) {
+		metricMutations.Inc(mutation.Indexid, "dropped")
+		return
+	}
+	//snapshots and rollbacks hold back mutations
+	m.applyLock.RLock()
+	defer m.applyLock.RUnlock()
+	//mutations replayed by a reconnecting projector are applied once
+	if ordering.order(mutation) {
+		metricMutations.Inc(mutation.Indexid, "dropped")
+	} else {
+		m.handleMutation(mutation)
+		if !failures.failed(mutation) {
+			ordering.advance(mutation)
 		}
 	}
 }
@@ -163,65 +520,122 @@ func (m *MutationManager) handleMutation(mutation *api.Mutation) {
 		var err error
 
 		if key, err = api.NewKey(mutation.SecondaryKey, mutation.Docid); err != nil {
-			log.Printf("Error Generating Key From Mutation %v. Skipped.", err)
+			mutationLog.With("index", mutation.Indexid, "vbucket", mutation.Vbucket, "seqno", mutation.Seqno).Errorf("Error Generating Key From Mutation %v. Skipped.", err)
+			atomic.AddUint64(&stats.index(mutation.Indexid).skipped, 1)
+			metricMutations.Inc(mutation.Indexid, "skipped")
+			m.deadLetter(nil, mutation, DEAD_LETTER_KEY, err)
 			return
 		}
 
 		if value, err = api.NewValue(mutation.SecondaryKey, mutation.Docid, mutation.Vbucket, mutation.Seqno); err != nil {
-			log.Printf("Error Generating Value From Mutation %v. Skipped.", err)
+			mutationLog.With("index", mutation.Indexid, "vbucket", mutation.Vbucket, "seqno", mutation.Seqno).Errorf("Error Generating Value From Mutation %v. Skipped.", err)
+			atomic.AddUint64(&stats.index(mutation.Indexid).skipped, 1)
+			metricMutations.Inc(mutation.Indexid, "skipped")
+			m.deadLetter(nil, mutation, DEAD_LETTER_VALUE, err)
 			return
 		}
 
-		if engine, ok := m.enginemap[mutation.Indexid]; ok {
+		if engine, ok := m.engine(mutation.Indexid); ok {
 			if err := engine.InsertMutation(key, value); err != nil {
-				log.Printf("Error from Engine during InsertMutation. Key %v. Index %v. Error %v", key, mutation.Docid, err)
-			}
-			//send notification for this seqno to be recorded in SeqVector
-			seqnotify := seqNotification{engine: engine,
-				indexid: mutation.Indexid,
-				seqno:   mutation.Seqno,
-				vbucket: mutation.Vbucket,
+				mutationLog.With("index", mutation.Indexid, "vbucket", mutation.Vbucket, "seqno", mutation.Seqno).Errorf("Error from Engine during InsertMutation. Key %v. Docid %v. Error %v", key, mutation.Docid, err)
+				failing := stats.index(mutation.Indexid).noteFailed()
+				metricMutations.Inc(mutation.Indexid, "failed")
+				builds.noteFailure(mutation.Indexid, failing, err)
+				m.deadLetter(engine, mutation, DEAD_LETTER_ENGINE, err)
+				return
 			}
-			m.chseq <- seqnotify
+			stats.index(mutation.Indexid).noteProcessed()
+			metricMutations.Inc(mutation.Indexid, "processed")
+			keyStats.noteMutation(mutation.Indexid)
+			deadLetters.superseded(mutation)
+			m.notifySeq(engine, mutation)
 		} else {
-			err := fmt.Sprintf("Unknown Index %v or Engine not found", mutation.Indexid)
-			m.initErrorState(err)
+			failures.fail(mutation, api.NewError(api.ERR_INDEX_NOT_FOUND,
+				"Unknown Index %v or Engine not found", mutation.Indexid))
 		}
 
 	} else if mutation.Type == api.DELETE {
 
-		if engine, ok := m.enginemap[mutation.Indexid]; ok {
+		if engine, ok := m.engine(mutation.Indexid); ok {
 			if err := engine.DeleteMutation(mutation.Docid); err != nil {
-				log.Printf("Error from Engine during Delete Mutation. Key %v. Error %v", mutation.Docid, err)
+				mutationLog.With("index", mutation.Indexid, "vbucket", mutation.Vbucket, "seqno", mutation.Seqno).Errorf("Error from Engine during Delete Mutation. Key %v. Error %v", mutation.Docid, err)
+				failing := stats.index(mutation.Indexid).noteFailed()
+				metricMutations.Inc(mutation.Indexid, "failed")
+				builds.noteFailure(mutation.Indexid, failing, err)
+				m.deadLetter(engine, mutation, DEAD_LETTER_ENGINE, err)
 				return
 			}
-			//send notification for this seqno to be recorded in SeqVector
-			seqnotify := seqNotification{engine: engine,
-				indexid: mutation.Indexid,
-				seqno:   mutation.Seqno,
-				vbucket: mutation.Vbucket,
-			}
-			m.chseq <- seqnotify
+			stats.index(mutation.Indexid).noteProcessed()
+			metricMutations.Inc(mutation.Indexid, "processed")
+			keyStats.noteMutation(mutation.Indexid)
+			deadLetters.superseded(mutation)
+			m.notifySeq(engine, mutation)
 		} else {
-			err := fmt.Sprintf("Unknown Index %v or Engine not found", mutation.Indexid)
-			m.initErrorState(err)
+			failures.fail(mutation, api.NewError(api.ERR_INDEX_NOT_FOUND,
+				"Unknown Index %v or Engine not found", mutation.Indexid))
 		}
 	}
 }
 
-func StartMutationManager(engineMap map[string]api.Finder) (chan ddlNotification, error) {
+//notifySeq sends the seqno of a mutation to be recorded in the SeqVector
+//of its index
+func (m *MutationManager) notifySeq(engine api.Finder, mutation *api.Mutation) {
+	seqnotify := seqNotification{engine: engine,
+		indexid: mutation.Indexid,
+		seqno:   mutation.Seqno,
+		vbucket: mutation.Vbucket,
+		vbuuid:  mutation.Vbuuid,
+	}
+	m.chseq <- seqnotify
+	noteQueueLength(&m.seqHWM, len(m.chseq))
+}
+
+//deadLetter keeps a mutation that failed to apply and records its seqno.
+//An index keeping too many dead letters fails the stream of the vbucket
+//instead, it does not move past the mutation until they are handled.
+func (m *MutationManager) deadLetter(engine api.Finder, mutation *api.Mutation, reason string, err error) {
+	if !deadLetters.add(mutation, reason, err) {
+		failures.fail(mutation, api.NewError(api.ERR_ENGINE,
+			"%v dead letters kept, retry or purge them: %v", DEAD_LETTERS_KEPT, err))
+		return
+	}
+	m.notifySeq(engine, mutation)
+}
+
+func StartMutationManager(engineMap map[string]api.Finder, cfg config.IndexerConfig) (
+	chan ddlNotification, error) {
 
 	var err error
 
 	//init the mutation manager maps
 	mutationMgr.sequencemap = make(api.IndexSequenceMap)
-	//copy the inital map from the indexer
-	mutationMgr.enginemap = engineMap
-	mutationMgr.initSequenceMapFromPersistence()
+	mutationMgr.vbuuidmap = make(api.IndexVbuuidMap)
+	mutationMgr.vbuuidDirty = make(map[string]bool)
+	//copy the inital map from the indexer, later changes are notified
+	mutationMgr.enginemap = make(map[string]api.Finder, len(engineMap))
+	for idx, engine := range engineMap {
+		mutationMgr.enginemap[idx] = engine
+	}
+	if err = mutationMgr.recoverSequenceMaps(); err != nil {
+		return nil, err
+	}
+
+	//mutations logged past the recovered checkpoints are replayed once
+	//the workers run
+	checkpoints := make(api.IndexSequenceMap)
+	if cfg.WalEnabled {
+		opts := wal.Options{SegmentSize: int64(cfg.WalSegmentMB) << 20, Sync: cfg.WalSync}
+		if mutationMgr.wal, err = openMutationWAL(filepath.Join(cfg.DataDir, WAL_DIR), opts); err != nil {
+			return nil, err
+		}
+		for idx, vector := range mutationMgr.sequencemap {
+			checkpoints[idx] = append(api.SequenceVector(nil), vector...)
+		}
+	}
 
 	//create channel to receive notification for new sequence numbers
 	//and start a goroutine to manage it
-	mutationMgr.chseq = make(chan seqNotification, MAX_SEQUENCE_QUEUE)
+	mutationMgr.chseq = make(chan seqNotification, cfg.SequenceQueueSize)
 	go mutationMgr.manageSeqNotification()
 
 	//create a channel to receive notification from indexer
@@ -229,57 +643,98 @@ func StartMutationManager(engineMap map[string]api.Finder) (chan ddlNotification
 	mutationMgr.chddl = make(chan ddlNotification)
 	go mutationMgr.manageIndexerNotification()
 
-	//init the channel for incoming mutations
-	mutationMgr.chmutation = make(chan *api.Mutation, MAX_INCOMING_QUEUE)
+	//init the worker groups for processing mutations, indexes keep the
+	//workers they were given
+	mutationMgr.shared = mutationMgr.startGroup(SHARED_GROUP, cfg.MutationWorkers,
+		cfg.MutationQueueSize, cfg.WorkerQueueSize)
+	mutationMgr.groups = make(map[string]*workerGroup)
+	for idx := range mutationMgr.enginemap {
+		if indexinfo, err := c.Index(idx); err == nil && indexinfo.Workers > 0 {
+			mutationMgr.groups[idx] = mutationMgr.startGroup(idx, indexinfo.Workers,
+				cfg.MutationQueueSize, cfg.WorkerQueueSize)
+		}
+	}
+
+	//init the channel for incoming mutations and route them to the groups
+	mutationMgr.chmutation = make(chan *api.Mutation, cfg.MutationQueueSize)
+	mutationMgr.chregroup = make(chan regroupRequest)
+	mutationMgr.done = make(chan bool)
 	go mutationMgr.manageMutationQueue()
 
-	//init the workers for processing mutations
-	for w := 0; w < MAX_MUTATION_WORKERS; w++ {
-		mutationMgr.chworkers[w] = make(chan *api.Mutation, MAX_WORKER_QUEUE)
-		go mutationMgr.startMutationWorker(w)
+	if mutationMgr.wal != nil {
+		n, err := mutationMgr.wal.replay(checkpoints, mutationMgr.queueMutation)
+		if err != nil {
+			return nil, err
+		}
+		mutationLog.Infof("Replayed %v logged mutations", n)
 	}
 
-	//init error state
-	indexerErrorState = false
-	indexerErrorString = ""
-	chdrain = make(chan bool)
-
 	//start the rpc server
-	if err = startRPCServer(); err != nil {
+	if err = startRPCServer(cfg.RpcAddr); err != nil {
 		return nil, err
 	}
 
 	return mutationMgr.chddl, nil
 }
 
-func startRPCServer() error {
+func startRPCServer(addr string) error {
 
-	log.Println("Starting Mutation Manager")
+	mutationLog.Infof("Starting Mutation Manager")
 	server := rpc.NewServer()
 	server.Register(&mutationMgr)
 
-	server.HandleHTTP(rpc.DefaultRPCPath, rpc.DefaultDebugPath)
-
-	l, err := net.Listen("tcp", ":8096")
+	l, err := security.Listen(addr)
 	if err != nil {
 		return err
 	}
+	lifecycle.addListener(l)
 
 	go func() {
 		for {
 			conn, err := l.Accept()
 			if err != nil {
-				log.Printf("Error in Accept %v. Shutting down")
-				//FIXME Add a cleanup function
+				if lifecycle.isStopping() {
+					mutationLog.Infof("Mutation Manager stopped accepting connections")
+				} else {
+					mutationLog.Errorf("Error in Accept %v. Shutting down", err)
+				}
 				return
 			}
-			go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+			go func(conn net.Conn) {
+				if err := security.Accept(conn, auth.ROLE_INGEST); err != nil {
+					mutationLog.Errorf("Rejected connection from %v: %v", conn.RemoteAddr(), err)
+					conn.Close()
+					return
+				}
+				//the first byte tells the stream protocol from JSON-RPC
+				r := bufio.NewReader(conn)
+				b, err := r.Peek(1)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				if stream.IsHello(b[0]) {
+					mutationMgr.serveStream(r, conn)
+					return
+				}
+				server.ServeCodec(jsonrpc.NewServerCodec(&bufferedConn{r, conn}))
+			}(conn)
 		}
 	}()
 	return nil
 
 }
 
+//bufferedConn reads through the reader that peeked at the connection
+type bufferedConn struct {
+	r *bufio.Reader
+	net.Conn
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
 func (m *MutationManager) manageIndexerNotification() {
 
 	ok := true
@@ -289,15 +744,34 @@ func (m *MutationManager) manageIndexerNotification() {
 		if ok {
 			switch ddl.ddltype {
 			case api.CREATE:
-				m.enginemap[ddl.indexinfo.Uuid] = ddl.engine
+				stats.add(ddl.indexinfo.Uuid)
 				//init sequence map of new index
 				seqVec := make(api.SequenceVector, api.MAX_VBUCKETS)
+				vbuuidVec := make(api.VbuuidVector, api.MAX_VBUCKETS)
+				ordering.reset(ddl.indexinfo.Uuid, seqVec, vbuuidVec)
+				m.mapLock.Lock()
+				m.enginemap[ddl.indexinfo.Uuid] = ddl.engine
 				m.sequencemap[ddl.indexinfo.Uuid] = seqVec
+				m.vbuuidmap[ddl.indexinfo.Uuid] = vbuuidVec
+				m.mapLock.Unlock()
+				if ddl.indexinfo.Workers > 0 {
+					m.setWorkers(ddl.indexinfo.Uuid, ddl.indexinfo.Workers)
+				}
 			case api.DROP:
+				m.mapLock.Lock()
 				delete(m.enginemap, ddl.indexinfo.Uuid)
-				//FIXME : Delete index entry from sequence map
+				//a vector without an engine cannot be persisted
+				delete(m.sequencemap, ddl.indexinfo.Uuid)
+				delete(m.vbuuidmap, ddl.indexinfo.Uuid)
+				m.mapLock.Unlock()
+				failures.drop(ddl.indexinfo.Uuid)
+				ordering.drop(ddl.indexinfo.Uuid)
+				ingest.drop(ddl.indexinfo.Uuid)
+				if m.hasGroup(ddl.indexinfo.Uuid) {
+					m.requestRegroup(regroupRequest{indexid: ddl.indexinfo.Uuid, drop: true})
+				}
 			default:
-				log.Printf("Mutation Manager Received Unsupported Notification %v", ddl.ddltype)
+				mutationLog.Warnf("Mutation Manager Received Unsupported Notification %v", ddl.ddltype)
 			}
 		}
 	}
@@ -305,113 +779,154 @@ func (m *MutationManager) manageIndexerNotification() {
 
 func (m *MutationManager) manageSeqNotification() {
 
-	var seq seqNotification
 	openSeqCount := 0
-	ok := true
 	var perfWriteCount int64
 
-	for ok {
-		select {
-		case seq, ok = <-m.chseq:
-			if ok {
-				seqVector, exists := m.sequencemap[seq.indexid]
-				if !exists {
-					log.Printf("IndexId %v not found in Sequence Vector. INCONSISTENT INDEXER STATE!!!", seq.indexid)
-					break
-				}
-				seqVector[seq.vbucket] = seq.seqno
-				m.sequencemap[seq.indexid] = seqVector
-				openSeqCount += 1
-				perfWriteCount += 1
-				//persist only after SEQ_MAP_PERSIST_INTERVAL
-				if openSeqCount == SEQ_MAP_PERSIST_INTERVAL {
-					m.persistSequenceMap()
-					openSeqCount = 0
-				}
-				if perfWriteCount%10000 == 0 {
-					log.Printf("Processed Mutation %v", perfWriteCount)
-				}
+	for seq := range m.chseq {
+		if !m.recordSeq(seq) {
+			if seq.done != nil {
+				close(seq.done)
 			}
-		case <-chdrain:
-			wg.Add(1)
-			m.drainSeqChannel(m.chseq)
+			continue
 		}
-	}
-}
-
-func (m *MutationManager) initSequenceMapFromPersistence() {
-
-	sequenceVector := make(api.SequenceVector, api.MAX_VBUCKETS)
-	for idx, engine := range m.enginemap {
-		metaval, err := engine.GetMeta(META_DOC_ID)
-		if err != nil {
-			log.Printf("Error retreiving Meta from Engine %v", err)
+		//rolled back, notifications queued before were applied first
+		if seq.vector != nil {
+			stats.index(seq.indexid).noteRollback(seq.vector)
+			m.persistSequenceMap()
+			close(seq.done)
+			continue
 		}
-		err = json.Unmarshal([]byte(metaval), &sequenceVector)
-		if err != nil {
-			log.Printf("Error unmarshalling SequenceVector %v", err)
+		stats.index(seq.indexid).noteApplied(seq.vbucket, seq.seqno)
+		builds.noteApplied(seq.indexid, seq.vbucket, seq.seqno)
+		openSeqCount += 1
+		perfWriteCount += 1
+		//persist only after SEQ_MAP_PERSIST_INTERVAL
+		if openSeqCount == SEQ_MAP_PERSIST_INTERVAL {
+			m.persistSequenceMap()
+			openSeqCount = 0
+		}
+		if perfWriteCount%10000 == 0 {
+			mutationLog.Infof("Processed Mutation %v", perfWriteCount)
 		}
-		m.sequencemap[idx] = sequenceVector
 	}
-}
 
-func (m *MutationManager) persistSequenceMap() {
-
-	for idx, seqm := range m.sequencemap {
-		jsonval, err := json.Marshal(seqm)
-		if err != nil {
-			log.Printf("Error Marshalling SequenceMap %v", err)
-		} else {
-			//FIXME - Handle Error here
-			m.enginemap[idx].InsertMeta(META_DOC_ID, string(jsonval))
-		}
+	//sequence queue was closed on stop, all applied seqnos are recorded
+	m.persistSequenceMap()
+	if m.wal != nil {
+		m.wal.close()
 	}
+	close(m.done)
 }
 
-func (m *MutationManager) initErrorState(err string) {
-
-	indexerErrorState = true
-	indexerErrorString = err
-
-	//send drain signal to mutation queue
-	chdrain <- true
+//recordSeq records a notification in the vectors of its index, returns
+//false if it was not recorded
+func (m *MutationManager) recordSeq(seq seqNotification) bool {
+	m.mapLock.Lock()
+	defer m.mapLock.Unlock()
 
-	//send drain signal to sequence queue
-	chdrain <- true
-
-	//send drain signal to worker queues
-	for w := 0; w < MAX_MUTATION_WORKERS; w++ {
-		chdrain <- true
+	seqVector, exists := m.sequencemap[seq.indexid]
+	if !exists {
+		mutationLog.With("index", seq.indexid).Errorf("Index not found in Sequence Vector. INCONSISTENT INDEXER STATE!!!")
+		return false
+	}
+	if seq.vector != nil {
+		copy(seqVector, seq.vector)
+		copy(m.vbuuidmap[seq.indexid], seq.vbuuids)
+		m.vbuuidDirty[seq.indexid] = true
+		return true
+	}
+	//workers apply mutations of a vbucket in seqno order, a vector
+	//never goes backwards
+	if seq.seqno < seqVector[seq.vbucket] {
+		mutationLog.With("index", seq.indexid, "vbucket", seq.vbucket).Errorf("Sequence regression from %v to %v ignored", seqVector[seq.vbucket], seq.seqno)
+		metricOutOfOrder.Inc(seq.indexid, "regression")
+		return false
+	}
+	seqVector[seq.vbucket] = seq.seqno
+	//the branch changes after a failover, seldom enough to be
+	//persisted only then
+	if vbuuids := m.vbuuidmap[seq.indexid]; vbuuids[seq.vbucket] != seq.vbuuid {
+		vbuuids[seq.vbucket] = seq.vbuuid
+		m.vbuuidDirty[seq.indexid] = true
 	}
+	return true
+}
 
+//engine returns the engine of an index
+func (m *MutationManager) engine(indexid string) (api.Finder, bool) {
+	m.mapLock.RLock()
+	defer m.mapLock.RUnlock()
+	engine, ok := m.enginemap[indexid]
+	return engine, ok
 }
 
-func (m *MutationManager) drainMutationChannel(ch chan *api.Mutation) {
+// stop drains the mutation, worker and sequence queues and persists the
+// final sequence map. Callers must ensure no more mutations are queued.
+func (m *MutationManager) stop() {
+	mutationLog.Infof("Draining %v queued mutations", len(m.chmutation))
+	close(m.chmutation)
+	<-m.done
+	mutationLog.Infof("Mutation Manager stopped")
+}
 
-loop:
-	for {
-		select {
-		case <-ch:
-			continue
-		default:
-			break loop
-		}
+// queueStats reports the length of mutation manager queues.
+func (m *MutationManager) queueStats() []api.QueueStats {
+
+	queues := make([]api.QueueStats, 0)
+	queues = append(queues, api.QueueStats{
+		Name:      "mutation",
+		Length:    len(m.chmutation),
+		Capacity:  cap(m.chmutation),
+		HighWater: int(atomic.LoadInt64(&m.mutationHWM)),
+	})
+	for _, g := range m.workerGroups() {
+		queues = append(queues, g.queueStats()...)
 	}
-	wg.Done()
-
+	queues = append(queues, api.QueueStats{
+		Name:      "sequence",
+		Length:    len(m.chseq),
+		Capacity:  cap(m.chseq),
+		HighWater: int(atomic.LoadInt64(&m.seqHWM)),
+	})
+	return queues
 }
 
-func (m *MutationManager) drainSeqChannel(ch chan seqNotification) {
+//persistSequenceMap persists the vectors, called by the goroutine that
+//records notifications, the only one changing them
+func (m *MutationManager) persistSequenceMap() {
+	m.mapLock.RLock()
+	defer m.mapLock.RUnlock()
 
-loop:
-	for {
-		select {
-		case <-ch:
-			continue
-		default:
-			break loop
+	//dead letters are kept before the seqnos of their mutations
+	deadLetters.flush()
+	persisted := true
+	for idx, seqm := range m.sequencemap {
+		jsonval, err := json.Marshal(seqm)
+		if err != nil {
+			mutationLog.With("index", idx).Errorf("Error Marshalling SequenceMap %v", err)
+			persisted = false
+		} else if err = m.enginemap[idx].InsertMeta(META_DOC_ID, string(jsonval)); err != nil {
+			//FIXME - Handle Error here
+			persisted = false
 		}
 	}
-	wg.Done()
-
+	//logged mutations are released once every checkpoint passed them
+	if m.wal != nil && persisted {
+		m.wal.checkpointed(m.sequencemap)
+	}
+	for idx := range m.vbuuidDirty {
+		if vbuuids, ok := m.vbuuidmap[idx]; ok {
+			jsonval, err := json.Marshal(vbuuids)
+			if err != nil {
+				mutationLog.With("index", idx).Errorf("Error Marshalling VbuuidVector %v", err)
+				continue
+			}
+			if err = m.enginemap[idx].InsertMeta(META_VBUUID_ID, string(jsonval)); err != nil {
+				mutationLog.With("index", idx).Errorf("Error persisting VbuuidVector %v", err)
+				continue
+			}
+		}
+		delete(m.vbuuidDirty, idx)
+	}
 }
+
@@ -0,0 +1,147 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/stream"
+	"testing"
+)
+
+func TestAdmitCredits(t *testing.T) {
+	m := &MutationManager{chmutation: make(chan *api.Mutation, 3)}
+	muts := []*api.Mutation{
+		{Type: api.INSERT, Indexid: "idx", Docid: "a", Seqno: 1},
+		{Type: api.INSERT, Indexid: "idx", Docid: "b", Seqno: 2},
+	}
+
+	credits, err := m.admit(muts)
+	if err != nil || credits != 1 {
+		t.Fatalf("Expected batch admitted with 1 credit left, got %v %v", credits, err)
+	}
+	//a batch is admitted whole or not at all
+	credits, err = m.admit(muts)
+	if api.CodeOf(err) != api.ERR_QUEUE_FULL || credits != 1 || len(m.chmutation) != 2 {
+		t.Errorf("Expected queue full with 1 credit, got %v %v", credits, err)
+	}
+	if m.mutationHWM != 2 {
+		t.Errorf("Expected high-water mark 2, got %v", m.mutationHWM)
+	}
+
+	failures.fail(muts[0], api.NoSuchIndex)
+	defer failures.drop("idx")
+	if _, err = m.admit(muts[:1]); api.CodeOf(err) != api.ERR_STREAM_FAILED {
+		t.Errorf("Expected rejection of failed stream, got %v", err)
+	}
+	var reply bool
+	if err = m.ProcessSingleMutation(muts[0], &reply); err == nil || reply {
+		t.Errorf("Expected rejection of failed stream, got %v %v", reply, err)
+	}
+}
+
+func TestAdmitCreditsPerEntry(t *testing.T) {
+	m := &MutationManager{chmutation: make(chan *api.Mutation, 5)}
+	entries := []stream.Entry{{Indexid: "idx1"}, {Indexid: "idx2"}, {Indexid: "idx3"}}
+	docs := []stream.Mutation{
+		{Type: api.DELETE, Docid: "a", Vbucket: 1, Seqno: 1, Entries: entries},
+		{Type: api.DELETE, Docid: "b", Vbucket: 1, Seqno: 2, Entries: entries},
+	}
+	admit := func(docs []stream.Mutation) (int, error) {
+		muts := make([]*api.Mutation, 0)
+		for i := range docs {
+			muts = append(muts, docs[i].Split()...)
+		}
+		return m.admit(muts)
+	}
+
+	//the projector sends what fits in the credits, counted per index
+	n := stream.Fit(docs, m.credits())
+	if n != 1 {
+		t.Fatalf("Expected one document of three indexes to fit, got %v", n)
+	}
+	credits, err := admit(docs[:n])
+	if err != nil || credits != 2 {
+		t.Fatalf("Expected document admitted with 2 credits left, got %v %v", credits, err)
+	}
+	if n = stream.Fit(docs[1:], credits); n != 0 {
+		t.Errorf("Expected no document to fit, got %v", n)
+	}
+	if _, err = admit(docs[1:]); api.CodeOf(err) != api.ERR_QUEUE_FULL {
+		t.Errorf("Expected queue full, got %v", err)
+	}
+}
+
+func TestAdmitBadVbucket(t *testing.T) {
+	m := &MutationManager{chmutation: make(chan *api.Mutation, 3)}
+	muts := []*api.Mutation{
+		{Type: api.INSERT, Indexid: "unknown", Docid: "a", Vbucket: 1, Seqno: 1},
+		{Type: api.INSERT, Indexid: "unknown", Docid: "b", Vbucket: api.MAX_VBUCKETS, Seqno: 2},
+	}
+
+	if _, err := m.admit(muts); api.CodeOf(err) != api.ERR_BAD_REQUEST || len(m.chmutation) != 0 {
+		t.Errorf("Expected batch rejected, got %v", err)
+	}
+	var reply bool
+	if err := m.ProcessSingleMutation(muts[1], &reply); api.CodeOf(err) != api.ERR_BAD_REQUEST || reply {
+		t.Errorf("Expected mutation rejected, got %v %v", reply, err)
+	}
+	//mutations of indexes the indexer does not have create no stats
+	if _, err := m.admit(muts[:1]); err != nil {
+		t.Fatal(err)
+	}
+	stats.RLock()
+	_, ok := stats.indexes["unknown"]
+	stats.RUnlock()
+	if ok || stats.index("unknown") != untracked {
+		t.Error("Expected no stats for an unknown index")
+	}
+}
+
+func TestVectorsWhileDropping(t *testing.T) {
+	m := &MutationManager{
+		enginemap:   make(map[string]api.Finder),
+		sequencemap: make(api.IndexSequenceMap),
+		vbuuidmap:   make(api.IndexVbuuidMap),
+		vbuuidDirty: make(map[string]bool),
+		chseq:       make(chan seqNotification, 10),
+		chddl:       make(chan ddlNotification),
+		done:        make(chan bool),
+	}
+	defer stats.drop("idx")
+	defer ordering.drop("idx")
+	go m.manageSeqNotification()
+	go m.manageIndexerNotification()
+
+	//indexes come and go while their seqnos are recorded and read
+	dropped := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			engine := &metaEngine{meta: make(map[string]string)}
+			m.chddl <- ddlNotification{ddltype: api.CREATE, engine: engine, indexinfo: api.IndexInfo{Uuid: "idx"}}
+			m.chddl <- ddlNotification{ddltype: api.DROP, indexinfo: api.IndexInfo{Uuid: "idx"}}
+		}
+		close(m.chddl)
+		close(dropped)
+	}()
+	var reply api.IndexVectors
+	for seqno := uint64(1); ; seqno++ {
+		select {
+		case <-dropped:
+			close(m.chseq)
+			<-m.done
+			return
+		default:
+		}
+		m.chseq <- seqNotification{indexid: "idx", vbucket: 1, seqno: seqno}
+		if err := m.GetSequenceVectors(nil, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
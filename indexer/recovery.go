@@ -0,0 +1,208 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Recovery of sequence vectors on restart. Every index checkpoints the
+// seqnos applied to it, and their vbucket UUIDs, in the meta of its engine.
+// On restart each index gets vectors of its own from its checkpoint,
+//  - a valid checkpoint resumes the index where it left off,
+//  - no checkpoint on an empty index starts it from seqno 0,
+//  - no checkpoint on an index holding entries, or a checkpoint that cannot
+//    be decoded, leaves the index unable to tell which mutations it holds.
+//    It is rebuilt, emptied and built again from seqno 0.
+// Vbucket UUIDs that cannot be decoded are only lost, streams then resume
+// on the branch the seqnos fall in. Errors reading an engine fail the
+// start, indexes are not rebuilt for them.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/couchbaselabs/indexing/api"
+)
+
+type checkpointState int
+
+const (
+	CHECKPOINT_OK      checkpointState = iota
+	CHECKPOINT_NONE                    //never written, the index is empty
+	CHECKPOINT_LOST                    //missing while the index holds entries
+	CHECKPOINT_CORRUPT                 //cannot be decoded or invalid
+)
+
+func (s checkpointState) String() string {
+	switch s {
+	case CHECKPOINT_NONE:
+		return "none"
+	case CHECKPOINT_LOST:
+		return "lost"
+	case CHECKPOINT_CORRUPT:
+		return "corrupt"
+	}
+	return "ok"
+}
+
+// checkpoint holds the vectors recovered for an index, always allocated
+// for the index alone.
+type checkpoint struct {
+	seqnos  api.SequenceVector
+	vbuuids api.VbuuidVector
+	state   checkpointState
+	err     error //why the checkpoint cannot be used
+}
+
+// rebuild tells whether the index must be emptied and built again.
+func (cp *checkpoint) rebuild() bool {
+	return cp.state == CHECKPOINT_LOST || cp.state == CHECKPOINT_CORRUPT
+}
+
+// loadCheckpoint reads and validates the checkpoint of an index. `state` is
+// the index state saved in the catalog, it tells whether an engine that
+// cannot count its entries holds any. Returns an error if the engine
+// cannot be read.
+func loadCheckpoint(indexid string, engine api.Finder, state api.IndexState) (*checkpoint, error) {
+
+	cp := &checkpoint{
+		seqnos:  make(api.SequenceVector, api.MAX_VBUCKETS),
+		vbuuids: make(api.VbuuidVector, api.MAX_VBUCKETS),
+	}
+	metaval, err := engine.GetMeta(META_DOC_ID)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %q: %v", META_DOC_ID, err)
+	}
+	seqnos, err := decodeVector(META_DOC_ID, metaval)
+	switch {
+	case err != nil:
+		cp.state, cp.err = CHECKPOINT_CORRUPT, err
+		return cp, nil
+	case seqnos == nil:
+		cp.state = CHECKPOINT_NONE
+		holds, err := holdsEntries(engine, state)
+		if err != nil {
+			return nil, err
+		}
+		if holds {
+			cp.state, cp.err = CHECKPOINT_LOST, fmt.Errorf("No checkpoint for an index holding entries")
+		}
+		return cp, nil
+	}
+	cp.seqnos = seqnos
+
+	if metaval, err = engine.GetMeta(META_VBUUID_ID); err != nil {
+		return nil, fmt.Errorf("Error reading %q: %v", META_VBUUID_ID, err)
+	}
+	vbuuids, err := decodeVector(META_VBUUID_ID, metaval)
+	if err != nil {
+		mutationLog.With("index", indexid).Warnf("Ignoring vbucket UUIDs of checkpoint %v", err)
+	} else if vbuuids != nil {
+		cp.vbuuids = api.VbuuidVector(vbuuids)
+	}
+	return cp, nil
+}
+
+// decodeVector decodes a vector read from engine meta `metaid`, nil if
+// there is none.
+func decodeVector(metaid, metaval string) ([]uint64, error) {
+
+	if metaval == "" {
+		return nil, nil
+	}
+	var vector []uint64
+	if err := json.Unmarshal([]byte(metaval), &vector); err != nil {
+		return nil, fmt.Errorf("Error unmarshalling %q: %v", metaid, err)
+	}
+	if len(vector) != api.MAX_VBUCKETS {
+		return nil, fmt.Errorf("Vector %q has %v vbuckets, expected %v", metaid, len(vector), api.MAX_VBUCKETS)
+	}
+	return vector, nil
+}
+
+// holdsEntries tells whether an index without checkpoint has entries.
+func holdsEntries(engine api.Finder, state api.IndexState) (bool, error) {
+	if counter, ok := engine.(api.Counter); ok {
+		n, err := counter.CountTotal()
+		if err != nil {
+			return false, fmt.Errorf("Error counting entries: %v", err)
+		}
+		return n > 0, nil
+	}
+	return state == api.INDEX_BUILDING || state == api.INDEX_READY || state == "", nil
+}
+
+// recoverSequenceMaps recovers the vectors of every index, and rebuilds
+// indexes whose checkpoint cannot be used. Returns an error if an engine
+// cannot be read, or the state of an index that cannot be rebuilt cannot be
+// saved.
+func (m *MutationManager) recoverSequenceMaps() error {
+
+	for idx, engine := range m.enginemap {
+		var state api.IndexState
+		if indexinfo, err := c.Index(idx); err == nil {
+			state = indexinfo.State
+		}
+		cp, err := loadCheckpoint(idx, engine, state)
+		if err != nil {
+			return fmt.Errorf("Index %v: %v", idx, err)
+		}
+		if cp.rebuild() {
+			mutationLog.With("index", idx).Errorf("Checkpoint %v, rebuilding index: %v", cp.state, cp.err)
+			if err := rebuildIndex(idx, engine, state, cp); err != nil {
+				return fmt.Errorf("Index %v: error rebuilding index %v", idx, err)
+			}
+		} else if cp.state == CHECKPOINT_NONE {
+			mutationLog.With("index", idx).Infof("No persisted SequenceVector, starting from 0")
+		}
+		metricRecoveries.Inc(idx, cp.state.String())
+
+		m.sequencemap[idx] = cp.seqnos
+		m.vbuuidmap[idx] = cp.vbuuids
+		ordering.reset(idx, cp.seqnos, cp.vbuuids)
+		//builds and stats start from what was recovered
+		is := stats.add(idx)
+		for vb, seqno := range cp.seqnos {
+			is.noteApplied(uint16(vb), seqno)
+		}
+	}
+	return nil
+}
+
+// rebuildIndex empties an index and writes a zero checkpoint, the index
+// is then built like a new one. Indexes that cannot be emptied, or whose
+// checkpoint cannot be written, move to INDEX_ERROR, they must be dropped and
+// created again. Returns an error if the state of the index cannot be saved,
+// the index would keep its state with its data gone.
+func rebuildIndex(indexid string, engine api.Finder, state api.IndexState, cp *checkpoint) error {
+
+	fail := func(format string, args ...interface{}) error {
+		msg := fmt.Sprintf("Checkpoint %v and "+format, append([]interface{}{cp.state}, args...)...)
+		mutationLog.With("index", indexid).Errorf("%v", msg)
+		_, err := c.SetState(indexid, api.INDEX_ERROR, msg)
+		return err
+	}
+	snapshotter, ok := engine.(api.Snapshotter)
+	if !ok {
+		return fail("the engine cannot be emptied, drop and create the index again")
+	}
+	if err := snapshotter.Restore(""); err != nil {
+		return fail("emptying the index failed: %v", err)
+	}
+	for metaid, vector := range map[string]interface{}{META_DOC_ID: cp.seqnos, META_VBUUID_ID: cp.vbuuids} {
+		jsonval, _ := json.Marshal(vector)
+		if err := engine.InsertMeta(metaid, string(jsonval)); err != nil {
+			return fail("writing a zero checkpoint failed: %v", err)
+		}
+	}
+	//deferred indexes wait for their BUILD request
+	if state != api.INDEX_DEFERRED {
+		if _, err := c.SetState(indexid, api.INDEX_CREATED, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/catalog"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// metaEngine keeps meta in memory and counts entries.
+type metaEngine struct {
+	api.Finder
+	meta      map[string]string
+	metaErr   error
+	insertErr error
+	entries   uint64
+	emptied   bool
+}
+
+func (e *metaEngine) GetMeta(metaid string) (string, error) { return e.meta[metaid], e.metaErr }
+
+func (e *metaEngine) InsertMeta(metaid, metavalue string) error {
+	if e.insertErr != nil {
+		return e.insertErr
+	}
+	e.meta[metaid] = metavalue
+	return nil
+}
+
+func (e *metaEngine) CountTotal() (uint64, error) { return e.entries, nil }
+
+func (e *metaEngine) Snapshot() (api.Snapshot, error) { return nil, errors.New("not supported") }
+
+func (e *metaEngine) Restore(path string) error {
+	e.meta, e.entries, e.emptied = make(map[string]string), 0, true
+	return nil
+}
+
+func checkpointOf(vbucket uint16, seqno uint64) map[string]string {
+	vector := make(api.SequenceVector, api.MAX_VBUCKETS)
+	vector[vbucket] = seqno
+	data, _ := json.Marshal(vector)
+	return map[string]string{META_DOC_ID: string(data)}
+}
+
+func TestRecoverSequenceMaps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := c
+	defer func() { c = saved }()
+	if c, err = catalog.NewIndexCatalog(dir, "recovery.dat"); err != nil {
+		t.Fatal(err)
+	}
+
+	engines := map[string]*metaEngine{
+		"ok1":     {meta: checkpointOf(1, 10)},
+		"ok2":     {meta: checkpointOf(2, 20)},
+		"fresh":   {meta: map[string]string{}},
+		"lost":    {meta: map[string]string{}, entries: 5},
+		"corrupt": {meta: map[string]string{META_DOC_ID: "[1, 2"}, entries: 5},
+		"short":   {meta: map[string]string{META_DOC_ID: "[1, 2]"}, entries: 5},
+		"nometa":  {meta: map[string]string{}, entries: 5, insertErr: errors.New("IO error")},
+	}
+	engines["ok2"].meta[META_VBUUID_ID] = "[not json"
+	m := &MutationManager{
+		enginemap:   make(map[string]api.Finder),
+		sequencemap: make(api.IndexSequenceMap),
+		vbuuidmap:   make(api.IndexVbuuidMap),
+		vbuuidDirty: make(map[string]bool),
+	}
+	for id, engine := range engines {
+		m.enginemap[id] = engine
+		c.Create(api.IndexInfo{Uuid: id, State: api.INDEX_READY})
+		defer ordering.drop(id)
+		defer stats.drop(id)
+	}
+	if err = m.recoverSequenceMaps(); err != nil {
+		t.Fatal(err)
+	}
+
+	//every index gets a vector of its own
+	if m.sequencemap["ok1"][1] != 10 || m.sequencemap["ok2"][2] != 20 || m.sequencemap["ok1"][2] != 0 {
+		t.Errorf("Unexpected vectors %v %v", m.sequencemap["ok1"][:3], m.sequencemap["ok2"][:3])
+	}
+	m.sequencemap["ok1"][5] = 50
+	if m.sequencemap["ok2"][5] != 0 {
+		t.Error("Indexes must not share vectors")
+	}
+	//unreadable vbucket UUIDs are lost, the seqnos kept
+	if len(m.vbuuidmap["ok2"]) != api.MAX_VBUCKETS || engines["ok2"].emptied {
+		t.Errorf("Expected ok2 recovered without vbucket UUIDs")
+	}
+
+	for id, rebuilt := range map[string]bool{
+		"ok1": false, "ok2": false, "fresh": false,
+		"lost": true, "corrupt": true, "short": true, "nometa": true,
+	} {
+		engine := engines[id]
+		indexinfo, _ := c.Index(id)
+		if engine.emptied != rebuilt {
+			t.Errorf("Index %v: expected rebuilt %v", id, rebuilt)
+		}
+		if id == "nometa" {
+			//emptied without a checkpoint, the index must not serve
+			if indexinfo.State != api.INDEX_ERROR {
+				t.Errorf("Index %v: expected error state, got %v", id, indexinfo.State)
+			}
+		} else if rebuilt {
+			if indexinfo.State != api.INDEX_CREATED || engine.meta[META_DOC_ID] == "" {
+				t.Errorf("Index %v: expected to build from a zero checkpoint, state %v", id, indexinfo.State)
+			}
+			if m.sequencemap[id][3] != 0 {
+				t.Errorf("Index %v: expected zero vector", id)
+			}
+		} else if indexinfo.State != api.INDEX_READY {
+			t.Errorf("Index %v: unexpected state %v", id, indexinfo.State)
+		}
+	}
+
+	//a rebuilt index restarts with a valid checkpoint
+	engines["lost"].entries = 5
+	if cp, err := loadCheckpoint("lost", engines["lost"], api.INDEX_BUILDING); err != nil || cp.state != CHECKPOINT_OK {
+		t.Errorf("Expected checkpoint after rebuild, got %v %v", cp, err)
+	}
+
+	//engines that cannot be read fail the start, they are not rebuilt
+	ioerror := &metaEngine{meta: checkpointOf(3, 30), metaErr: errors.New("IO error")}
+	c.Create(api.IndexInfo{Uuid: "ioerror", State: api.INDEX_READY})
+	failed := &MutationManager{
+		enginemap:   map[string]api.Finder{"ioerror": ioerror},
+		sequencemap: make(api.IndexSequenceMap),
+		vbuuidmap:   make(api.IndexVbuuidMap),
+	}
+	if err = failed.recoverSequenceMaps(); err == nil {
+		t.Error("Expected recovery to fail on IO errors")
+	}
+	if indexinfo, _ := c.Index("ioerror"); ioerror.emptied || indexinfo.State != api.INDEX_READY {
+		t.Errorf("Expected ioerror left as it was, state %v", indexinfo.State)
+	}
+	//as do indexes whose state cannot be saved after a failed rebuild
+	failed.enginemap = map[string]api.Finder{"unknown": &metaEngine{meta: map[string]string{}, entries: 5, insertErr: errors.New("IO error")}}
+	defer stats.drop("unknown")
+	if err = failed.recoverSequenceMaps(); err == nil {
+		t.Error("Expected recovery to fail when the state cannot be saved")
+	}
+
+	//dropped indexes leave no vectors behind
+	m.chddl = make(chan ddlNotification, 1)
+	m.chddl <- ddlNotification{ddltype: api.DROP, indexinfo: api.IndexInfo{Uuid: "ok1"}}
+	close(m.chddl)
+	m.manageIndexerNotification()
+	if _, ok := m.sequencemap["ok1"]; ok {
+		t.Error("Expected vector of dropped index removed")
+	}
+	if _, ok := m.vbuuidmap["ok1"]; ok {
+		t.Error("Expected vbucket UUIDs of dropped index removed")
+	}
+}
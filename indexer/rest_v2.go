@@ -0,0 +1,51 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// v2 REST API of the indexer, indexes are addressed by uuid.
+//
+//   POST /v2/indexes/{id}/scan    scan index, body is api.QueryParams
+//   GET  /v2/indexes/{id}/stats   statistics of index
+
+package main
+
+import (
+	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/rest"
+	"net/http"
+)
+
+func v2Router() *rest.Router {
+	router := rest.NewRouter("/v2")
+	router.Handle("POST", "/indexes/{id}/scan", handleV2Scan)
+	router.Handle("GET", "/indexes/{id}/stats", handleV2Stats)
+	return router
+}
+
+func handleV2Scan(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var q api.QueryParams
+	if err := rest.Decode(r, &q); err != nil {
+		rest.SendError(w, err)
+		return
+	}
+	res, err := scanIndex(params["id"], q)
+	if err != nil {
+		rest.SendError(w, err)
+		return
+	}
+	rest.Send(w, http.StatusOK, res)
+}
+
+func handleV2Stats(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	res, err := indexerStats(params["id"])
+	if err != nil {
+		rest.SendError(w, err)
+		return
+	}
+	rest.Send(w, http.StatusOK, res)
+}
@@ -0,0 +1,194 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Scan admission control. Scans run on a fixed pool of workers so that a
+// burst of scans cannot starve mutation processing. Scans wait in one of
+// two queues,
+//  - short, lookups, exists, estimates and scans with a small limit,
+//  - long, counts and range or full scans.
+// Workers prefer short scans, and a quarter of them only run short scans,
+// so that lookups are served while long scans occupy the pool. A scan is
+// rejected with ERR_QUEUE_FULL if its queue is full, and fails with
+// ERR_TIMEOUT if it does not complete before its deadline.
+
+package main
+
+import (
+	"github.com/couchbaselabs/indexing/api"
+	"sync/atomic"
+	"time"
+)
+
+// scans with a limit up to this are short.
+const SHORT_SCAN_LIMIT = 100
+
+type scanPriority int
+
+const (
+	SCAN_SHORT scanPriority = iota
+	SCAN_LONG
+)
+
+func (p scanPriority) String() string {
+	if p == SCAN_SHORT {
+		return "short"
+	}
+	return "long"
+}
+
+// scanContext is handed to a running scan.
+type scanContext struct {
+	deadline time.Time
+	cleanup  []func() //run by the worker after the reply is sent
+}
+
+// atExit defers work that need not delay the reply, like draining an
+// engine's result channel. The worker is not released before it is done.
+func (ctx *scanContext) atExit(fn func()) {
+	ctx.cleanup = append(ctx.cleanup, fn)
+}
+
+type scanFunc func(ctx *scanContext) (api.IndexScanResponse, error)
+
+type scanJob struct {
+	ctx       scanContext
+	fn        scanFunc
+	abandoned int32 //set by the requester on timeout
+	res       api.IndexScanResponse
+	err       error
+	done      chan bool
+}
+
+type scanScheduler struct {
+	short chan *scanJob
+	long  chan *scanJob
+}
+
+var scans *scanScheduler
+
+// newScanScheduler starts `workers` scan workers, `queueSize` scans may
+// wait per priority.
+func newScanScheduler(workers, queueSize int) *scanScheduler {
+	s := &scanScheduler{
+		short: make(chan *scanJob, queueSize),
+		long:  make(chan *scanJob, queueSize),
+	}
+	reserved := workers / 4
+	for w := 0; w < workers; w++ {
+		go s.worker(w < reserved)
+	}
+	scanLog.Infof("Started %v scan workers, %v for short scans only", workers, reserved)
+	return s
+}
+
+// priorityOf classifies a scan by the work it may cause.
+func priorityOf(q api.QueryParams) scanPriority {
+	switch q.ScanType {
+	case api.EXISTS, api.LOOKUP, api.ESTIMATERANGE, api.ESTIMATEDISTINCT:
+		return SCAN_SHORT
+	case api.RANGESCAN, api.FULLSCAN:
+		if q.Limit > 0 && q.Limit <= SHORT_SCAN_LIMIT {
+			return SCAN_SHORT
+		}
+	}
+	return SCAN_LONG
+}
+
+// deadlineOf returns the deadline of a scan started at `start`, `timeout`
+// applies if the request has neither timeout nor deadline.
+func deadlineOf(q api.QueryParams, start time.Time, timeout time.Duration) time.Time {
+	if q.Timeout > 0 {
+		timeout = time.Duration(q.Timeout) * time.Millisecond
+	}
+	deadline := start.Add(timeout)
+	if q.Deadline > 0 {
+		if d := time.Unix(0, q.Deadline*int64(time.Millisecond)); d.Before(deadline) {
+			deadline = d
+		}
+	}
+	return deadline
+}
+
+// run queues `fn` and waits for its result until `deadline`.
+func (s *scanScheduler) run(p scanPriority, deadline time.Time, fn scanFunc) (
+	api.IndexScanResponse, error) {
+
+	job := &scanJob{
+		ctx:  scanContext{deadline: deadline},
+		fn:   fn,
+		done: make(chan bool, 1),
+	}
+	queue := s.long
+	if p == SCAN_SHORT {
+		queue = s.short
+	}
+	select {
+	case queue <- job:
+	default:
+		metricScansRejected.Inc(p.String(), string(api.ERR_QUEUE_FULL))
+		return api.IndexScanResponse{}, api.NewError(api.ERR_QUEUE_FULL,
+			"Too many %v scans queued, retry later", p)
+	}
+
+	timer := time.NewTimer(deadline.Sub(time.Now()))
+	defer timer.Stop()
+	select {
+	case <-job.done:
+		return job.res, job.err
+	case <-timer.C:
+		atomic.StoreInt32(&job.abandoned, 1)
+		metricScansRejected.Inc(p.String(), string(api.ERR_TIMEOUT))
+		return api.IndexScanResponse{}, timeoutError()
+	}
+}
+
+func (s *scanScheduler) worker(shortOnly bool) {
+	var job *scanJob
+	for {
+		//short scans first
+		select {
+		case job = <-s.short:
+		default:
+			if shortOnly {
+				job = <-s.short
+			} else {
+				select {
+				case job = <-s.short:
+				case job = <-s.long:
+				}
+			}
+		}
+		s.execute(job)
+	}
+}
+
+func (s *scanScheduler) execute(job *scanJob) {
+	if atomic.LoadInt32(&job.abandoned) == 1 || time.Now().After(job.ctx.deadline) {
+		job.err = timeoutError()
+		job.done <- true
+		return
+	}
+	job.res, job.err = job.fn(&job.ctx)
+	job.done <- true
+	for _, fn := range job.ctx.cleanup {
+		fn()
+	}
+}
+
+// queueStats reports the length of the scan queues.
+func (s *scanScheduler) queueStats() []api.QueueStats {
+	return []api.QueueStats{
+		{Name: "scan_short", Length: len(s.short), Capacity: cap(s.short)},
+		{Name: "scan_long", Length: len(s.long), Capacity: cap(s.long)},
+	}
+}
+
+func timeoutError() error {
+	return api.NewError(api.ERR_TIMEOUT, "Scan did not complete before its deadline")
+}
@@ -0,0 +1,105 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"github.com/couchbaselabs/indexing/api"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// blockingScan signals `started` once a worker runs it, and completes when
+// `release` is closed.
+func blockingScan(started, release chan bool) scanFunc {
+	return func(ctx *scanContext) (api.IndexScanResponse, error) {
+		started <- true
+		<-release
+		return api.IndexScanResponse{Status: api.SUCCESS}, nil
+	}
+}
+
+func TestScanSchedulerQueueFull(t *testing.T) {
+	s := newScanScheduler(1, 1)
+	started, release := make(chan bool, 3), make(chan bool)
+	defer close(release)
+	deadline := time.Now().Add(time.Minute)
+
+	//one long scan running, one queued behind it
+	go s.run(SCAN_LONG, deadline, blockingScan(started, release))
+	<-started
+	go s.run(SCAN_LONG, deadline, blockingScan(started, release))
+	for len(s.long) == 0 {
+		runtime.Gosched()
+	}
+
+	_, err := s.run(SCAN_LONG, deadline, blockingScan(started, release))
+	if api.CodeOf(err) != api.ERR_QUEUE_FULL || !api.CodeOf(err).Retryable() {
+		t.Errorf("Expected retryable queue full error, got %v", err)
+	}
+}
+
+func TestScanSchedulerTimeout(t *testing.T) {
+	s := newScanScheduler(1, 10)
+	started, release := make(chan bool, 1), make(chan bool)
+	defer close(release)
+
+	_, err := s.run(SCAN_LONG, time.Now().Add(50*time.Millisecond), blockingScan(started, release))
+	if api.CodeOf(err) != api.ERR_TIMEOUT {
+		t.Errorf("Expected timeout, got %v", err)
+	}
+}
+
+func TestScanSchedulerShortReserved(t *testing.T) {
+	s := newScanScheduler(4, 10)
+	started, release := make(chan bool, 4), make(chan bool)
+	defer close(release)
+	deadline := time.Now().Add(time.Minute)
+
+	//long scans occupy every worker that takes them, three of four
+	for i := 0; i < 4; i++ {
+		go s.run(SCAN_LONG, deadline, blockingScan(started, release))
+	}
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+
+	lookup := func(ctx *scanContext) (api.IndexScanResponse, error) {
+		return api.IndexScanResponse{Status: api.SUCCESS, TotalRows: 1}, nil
+	}
+	res, err := s.run(SCAN_SHORT, time.Now().Add(time.Second), lookup)
+	if err != nil || res.TotalRows != 1 {
+		t.Errorf("Expected short scan to run, got %v %v", res, err)
+	}
+}
+
+func TestScanPriorityAndDeadline(t *testing.T) {
+	if priorityOf(api.QueryParams{ScanType: api.LOOKUP}) != SCAN_SHORT {
+		t.Error("Lookups must be short")
+	}
+	if priorityOf(api.QueryParams{ScanType: api.FULLSCAN}) != SCAN_LONG {
+		t.Error("Full scans must be long")
+	}
+	if priorityOf(api.QueryParams{ScanType: api.RANGESCAN, Limit: 10}) != SCAN_SHORT {
+		t.Error("Range scans with a small limit must be short")
+	}
+
+	start := time.Now()
+	if d := deadlineOf(api.QueryParams{}, start, time.Second); !d.Equal(start.Add(time.Second)) {
+		t.Errorf("Expected default timeout, got %v", d.Sub(start))
+	}
+	if d := deadlineOf(api.QueryParams{Timeout: 10}, start, time.Second); !d.Equal(start.Add(10 * time.Millisecond)) {
+		t.Errorf("Expected request timeout, got %v", d.Sub(start))
+	}
+	ms := start.Add(5*time.Millisecond).UnixNano() / int64(time.Millisecond)
+	if d := deadlineOf(api.QueryParams{Deadline: ms}, start, time.Second); d.After(start.Add(5 * time.Millisecond)) {
+		t.Errorf("Expected request deadline, got %v", d.Sub(start))
+	}
+}
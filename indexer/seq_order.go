@@ -0,0 +1,203 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Seqno ordering of mutation streams. All mutations of a vbucket go to the
+// same mutation worker, which tracks the highest seqno applied per index
+// and vbucket and classifies each mutation against it,
+//  - next, the seqno follows the last one applied,
+//  - gap, seqnos were skipped, which is expected when UPR deduplicates
+//    mutations of a document,
+//  - duplicate, the seqno was already applied,
+//  - stale, the seqno is older than the last one applied.
+// Duplicates and stale mutations are dropped, a projector that reconnects
+// replays mutations the indexer may already have applied. Every anomaly is
+// counted in the index's stats. Mutations queued per stream and not yet
+// handled are counted as well, a failed stream resumes once they are gone.
+
+package main
+
+import (
+	"github.com/couchbaselabs/indexing/api"
+	"sync"
+	"sync/atomic"
+)
+
+type seqOrder int
+
+const (
+	SEQ_NEXT seqOrder = iota
+	SEQ_GAP
+	SEQ_DUPLICATE
+	SEQ_STALE
+)
+
+func (o seqOrder) String() string {
+	switch o {
+	case SEQ_GAP:
+		return "gap"
+	case SEQ_DUPLICATE:
+		return "duplicate"
+	case SEQ_STALE:
+		return "stale"
+	}
+	return "next"
+}
+
+// orderTracker holds the highest seqno applied per index and vbucket, and
+// the vbucket UUID of the branch it is on. A vbucket's slot is only written
+// by the worker owning the vbucket.
+type orderTracker struct {
+	sync.RWMutex
+	applied map[string][]uint64
+	vbuuids map[string][]uint64
+	queued  map[string][]int64
+}
+
+var ordering = newOrderTracker()
+
+func newOrderTracker() *orderTracker {
+	return &orderTracker{
+		applied: make(map[string][]uint64),
+		vbuuids: make(map[string][]uint64),
+		queued:  make(map[string][]int64),
+	}
+}
+
+// reset starts tracking an index from `vector` on branches `vbuuids`.
+func (o *orderTracker) reset(indexid string, vector api.SequenceVector, vbuuids api.VbuuidVector) {
+	applied := make([]uint64, api.MAX_VBUCKETS)
+	copy(applied, vector)
+	branches := make([]uint64, api.MAX_VBUCKETS)
+	copy(branches, vbuuids)
+
+	o.Lock()
+	defer o.Unlock()
+	o.applied[indexid] = applied
+	o.vbuuids[indexid] = branches
+	//mutations already queued are still counted out
+	if _, ok := o.queued[indexid]; !ok {
+		o.queued[indexid] = make([]int64, api.MAX_VBUCKETS)
+	}
+}
+
+func (o *orderTracker) drop(indexid string) {
+	o.Lock()
+	defer o.Unlock()
+	delete(o.applied, indexid)
+	delete(o.vbuuids, indexid)
+	delete(o.queued, indexid)
+}
+
+func (o *orderTracker) slot(indexid string, vbucket uint16) (seqno, vbuuid *uint64) {
+	o.RLock()
+	defer o.RUnlock()
+	if applied, ok := o.applied[indexid]; ok && int(vbucket) < len(applied) {
+		return &applied[vbucket], &o.vbuuids[indexid][vbucket]
+	}
+	return nil, nil
+}
+
+func (o *orderTracker) count(mutation *api.Mutation, delta int64) {
+	o.RLock()
+	defer o.RUnlock()
+	if queued, ok := o.queued[mutation.Indexid]; ok && int(mutation.Vbucket) < len(queued) {
+		atomic.AddInt64(&queued[mutation.Vbucket], delta)
+	}
+}
+
+// enqueue counts `mutation` in the mutations queued for its stream
+func (o *orderTracker) enqueue(mutation *api.Mutation) {
+	o.count(mutation, 1)
+}
+
+// dequeue counts `mutation` out once it was applied or dropped
+func (o *orderTracker) dequeue(mutation *api.Mutation) {
+	o.count(mutation, -1)
+}
+
+// pending tells whether mutations of a stream are queued and not handled yet
+func (o *orderTracker) pending(indexid string, vbucket uint16) bool {
+	o.RLock()
+	defer o.RUnlock()
+	if queued, ok := o.queued[indexid]; ok && int(vbucket) < len(queued) {
+		return atomic.LoadInt64(&queued[vbucket]) > 0
+	}
+	return false
+}
+
+// vector returns the seqnos applied to an index and their branches, nil if
+// the index is unknown.
+func (o *orderTracker) vector(indexid string) (api.SequenceVector, api.VbuuidVector) {
+	o.RLock()
+	defer o.RUnlock()
+	applied, ok := o.applied[indexid]
+	if !ok {
+		return nil, nil
+	}
+	branches := o.vbuuids[indexid]
+	vector := make(api.SequenceVector, len(applied))
+	vbuuids := make(api.VbuuidVector, len(branches))
+	for vb := range applied {
+		vector[vb] = atomic.LoadUint64(&applied[vb])
+		vbuuids[vb] = atomic.LoadUint64(&branches[vb])
+	}
+	return vector, vbuuids
+}
+
+// check classifies `mutation` against the last seqno applied to its
+// stream. Mutations of unknown indexes are SEQ_NEXT, they fail later.
+func (o *orderTracker) check(mutation *api.Mutation) (seqOrder, uint64) {
+	slot, _ := o.slot(mutation.Indexid, mutation.Vbucket)
+	if slot == nil {
+		return SEQ_NEXT, 0
+	}
+	last := atomic.LoadUint64(slot)
+	switch {
+	case mutation.Seqno == last:
+		return SEQ_DUPLICATE, last
+	case mutation.Seqno < last:
+		return SEQ_STALE, last
+	case mutation.Seqno > last+1:
+		return SEQ_GAP, last
+	}
+	return SEQ_NEXT, last
+}
+
+// advance records that `mutation` was applied.
+func (o *orderTracker) advance(mutation *api.Mutation) {
+	if seqno, vbuuid := o.slot(mutation.Indexid, mutation.Vbucket); seqno != nil {
+		atomic.StoreUint64(seqno, mutation.Seqno)
+		atomic.StoreUint64(vbuuid, mutation.Vbuuid)
+	}
+}
+
+// order checks a mutation before it is applied, and tells whether it
+// must be dropped.
+func (o *orderTracker) order(mutation *api.Mutation) bool {
+	order, last := o.check(mutation)
+	if order == SEQ_NEXT {
+		return false
+	}
+
+	is := stats.index(mutation.Indexid)
+	metricOutOfOrder.Inc(mutation.Indexid, order.String())
+	if mutationLog.IsDebug() {
+		mutationLog.With("index", mutation.Indexid, "vbucket", mutation.Vbucket, "seqno", mutation.Seqno).Debugf("Mutation is %v, last applied seqno %v", order, last)
+	}
+	switch order {
+	case SEQ_GAP:
+		atomic.AddUint64(&is.gaps, 1)
+		return false
+	case SEQ_DUPLICATE:
+		atomic.AddUint64(&is.duplicates, 1)
+	case SEQ_STALE:
+		atomic.AddUint64(&is.stale, 1)
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"github.com/couchbaselabs/indexing/api"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSeqOrder(t *testing.T) {
+	o := newOrderTracker()
+	vector := make(api.SequenceVector, api.MAX_VBUCKETS)
+	vector[2] = 10
+	o.reset("order", vector, nil)
+	stats.add("order")
+	defer stats.drop("order")
+
+	apply := func(seqno uint64) bool {
+		m := &api.Mutation{Indexid: "order", Vbucket: 2, Seqno: seqno}
+		if o.order(m) {
+			return false
+		}
+		o.advance(m)
+		return true
+	}
+	for _, tc := range []struct {
+		seqno   uint64
+		applied bool
+	}{
+		{11, true},  //next
+		{11, false}, //duplicate
+		{9, false},  //stale replay
+		{15, true},  //gap
+		{16, true},
+	} {
+		if apply(tc.seqno) != tc.applied {
+			t.Errorf("Seqno %v: expected applied %v", tc.seqno, tc.applied)
+		}
+	}
+
+	is := stats.index("order")
+	if atomic.LoadUint64(&is.duplicates) != 1 || atomic.LoadUint64(&is.stale) != 1 ||
+		atomic.LoadUint64(&is.gaps) != 1 {
+		t.Errorf("Unexpected anomalies %v %v %v", is.duplicates, is.stale, is.gaps)
+	}
+	//other vbuckets and unknown indexes are not affected
+	if order, _ := o.check(&api.Mutation{Indexid: "order", Vbucket: 3, Seqno: 1}); order != SEQ_NEXT {
+		t.Errorf("Expected next, got %v", order)
+	}
+	if order, _ := o.check(&api.Mutation{Indexid: "unknown", Seqno: 1}); order != SEQ_NEXT {
+		t.Errorf("Expected next, got %v", order)
+	}
+}
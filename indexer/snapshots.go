@@ -0,0 +1,286 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Index snapshots and rollback. Every `indexer.snapshotInterval` seconds
+// the indexer saves a snapshot of each index whose engine is an
+// api.Snapshotter, along with the seqnos applied to it and their vbucket
+// UUIDs, under
+//   <dataDir>/snapshots/<index uuid>/<unix nano>/
+// keeping the newest `indexer.snapshotsKept` of them.
+//
+// When UPR rolls a vbucket back, the projector asks the indexer to roll
+// the indexes of its feed back to the rollback seqnos. The indexer restores
+// the newest snapshot that is not past any of them, or empties the index if
+// there is none, and the projector restarts the feed from the restored
+// seqnos.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/couchbaselabs/indexing/api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const SNAPSHOT_DIR = "snapshots"
+const SNAPSHOT_VECTOR_FILE = "vector.json" //written last, marks a complete snapshot
+const SNAPSHOT_VBUUID_FILE = "vbuuids.json"
+
+type indexSnapshot struct {
+	path    string
+	vector  api.SequenceVector
+	vbuuids api.VbuuidVector
+}
+
+// snapshotManager serializes snapshots and rollbacks, so that an index is
+// never restored while it is being saved.
+type snapshotManager struct {
+	sync.Mutex
+	dir       string
+	snapshots map[string][]*indexSnapshot //per index, oldest first
+	dropped   map[string]bool
+}
+
+var snapshots *snapshotManager
+
+// newSnapshotManager loads the snapshots saved under `dir`. Incomplete
+// snapshots, left by a crash while saving, are removed.
+func newSnapshotManager(dir string) (*snapshotManager, error) {
+
+	s := &snapshotManager{
+		dir:       dir,
+		snapshots: make(map[string][]*indexSnapshot),
+		dropped:   make(map[string]bool),
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	indexes, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		if !index.IsDir() {
+			continue
+		}
+		indexid := index.Name()
+		entries, err := ioutil.ReadDir(filepath.Join(dir, indexid))
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			if _, err := strconv.ParseInt(entry.Name(), 10, 64); err == nil && entry.IsDir() {
+				names = append(names, entry.Name())
+			}
+		}
+		sort.Sort(byTime(names))
+		for _, name := range names {
+			path := filepath.Join(dir, indexid, name)
+			var vector api.SequenceVector
+			var vbuuids api.VbuuidVector
+			err := readJSON(filepath.Join(path, SNAPSHOT_VECTOR_FILE), &vector)
+			if err == nil {
+				err = readJSON(filepath.Join(path, SNAPSHOT_VBUUID_FILE), &vbuuids)
+			}
+			if err != nil {
+				logger.With("index", indexid).Warnf("Removing incomplete snapshot %v: %v", path, err)
+				os.RemoveAll(path)
+				continue
+			}
+			s.snapshots[indexid] = append(s.snapshots[indexid], &indexSnapshot{path, vector, vbuuids})
+		}
+	}
+	return s, nil
+}
+
+// byTime sorts snapshot directory names, unix nano timestamps, oldest first.
+type byTime []string
+
+func (t byTime) Len() int      { return len(t) }
+func (t byTime) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t byTime) Less(i, j int) bool {
+	a, _ := strconv.ParseInt(t[i], 10, 64)
+	b, _ := strconv.ParseInt(t[j], 10, 64)
+	return a < b
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// take saves a snapshot of an index and keeps the newest `kept`.
+// Mutations are held back while the engine snapshot is taken, so that
+// its contents match the recorded seqnos.
+func (s *snapshotManager) take(indexid string, engine api.Snapshotter, kept int) error {
+
+	s.Lock()
+	defer s.Unlock()
+	if s.dropped[indexid] {
+		return api.NoSuchIndex
+	}
+
+	mutationMgr.applyLock.Lock()
+	snap, err := engine.Snapshot()
+	vector, vbuuids := ordering.vector(indexid)
+	mutationMgr.applyLock.Unlock()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+	if vector == nil {
+		return api.NoSuchIndex
+	}
+
+	path := filepath.Join(s.dir, indexid, strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err = snap.Save(path); err != nil {
+		os.RemoveAll(path)
+		return err
+	}
+	err = writeJSON(filepath.Join(path, SNAPSHOT_VBUUID_FILE), vbuuids)
+	if err == nil {
+		err = writeJSON(filepath.Join(path, SNAPSHOT_VECTOR_FILE), vector)
+	}
+	if err != nil {
+		os.RemoveAll(path)
+		return err
+	}
+	s.snapshots[indexid] = append(s.snapshots[indexid], &indexSnapshot{path, vector, vbuuids})
+	for len(s.snapshots[indexid]) > kept {
+		os.RemoveAll(s.snapshots[indexid][0].path)
+		s.snapshots[indexid] = s.snapshots[indexid][1:]
+	}
+	logger.With("index", indexid).Debugf("Saved snapshot %v", path)
+	return nil
+}
+
+// rollback restores the newest snapshot of an index that is not past
+// `target` on any vbucket, or empties the index if there is none, and
+// returns the seqnos restored and their vbucket UUIDs. Snapshots past `target` are removed, they
+// belong to the history the data source rolled back. An index already at
+// or below `target` is left as it is.
+func (s *snapshotManager) rollback(indexid string, engine api.Snapshotter,
+	target api.SequenceVector) (api.SequenceVector, api.VbuuidVector, error) {
+
+	s.Lock()
+	defer s.Unlock()
+	if s.dropped[indexid] {
+		return nil, nil, api.NoSuchIndex
+	}
+
+	mutationMgr.applyLock.Lock()
+	defer mutationMgr.applyLock.Unlock()
+
+	current, vbuuids := ordering.vector(indexid)
+	if current == nil {
+		return nil, nil, api.NoSuchIndex
+	}
+	if !pastTarget(current, target) {
+		return current, vbuuids, nil
+	}
+
+	snaps := s.snapshots[indexid]
+	i := len(snaps) - 1
+	for i >= 0 && pastTarget(snaps[i].vector, target) {
+		i--
+	}
+	path, vector := "", make(api.SequenceVector, api.MAX_VBUCKETS)
+	vbuuids = make(api.VbuuidVector, api.MAX_VBUCKETS)
+	if i >= 0 {
+		path = snaps[i].path
+		copy(vector, snaps[i].vector)
+		copy(vbuuids, snaps[i].vbuuids)
+	}
+	if err := engine.Restore(path); err != nil {
+		return nil, nil, err
+	}
+	for _, snap := range snaps[i+1:] {
+		os.RemoveAll(snap.path)
+	}
+	s.snapshots[indexid] = snaps[:i+1]
+
+	ordering.reset(indexid, vector, vbuuids)
+	failures.drop(indexid)
+	return vector, vbuuids, nil
+}
+
+// pastTarget tells whether `vector` is past `target` on any vbucket.
+func pastTarget(vector, target api.SequenceVector) bool {
+	for vb, seqno := range vector {
+		if vb < len(target) && seqno > target[vb] {
+			return true
+		}
+	}
+	return false
+}
+
+// drop removes the snapshots of a dropped index, after waiting for a
+// snapshot of it being saved.
+func (s *snapshotManager) drop(indexid string) {
+	s.Lock()
+	defer s.Unlock()
+	s.dropped[indexid] = true
+	delete(s.snapshots, indexid)
+	if err := os.RemoveAll(filepath.Join(s.dir, indexid)); err != nil {
+		logger.With("index", indexid).Errorf("Error removing snapshots %v", err)
+	}
+}
+
+// run snapshots every index each `interval`, until shutdown.
+func (s *snapshotManager) run(interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !lifecycle.enter() {
+			return
+		}
+		s.snapshotAll()
+		lifecycle.exit()
+	}
+}
+
+func (s *snapshotManager) snapshotAll() {
+
+	ddlLock.Lock()
+	engines := make(map[string]api.Snapshotter)
+	for indexid, engine := range engineMap {
+		if snapshotter, ok := engine.(api.Snapshotter); ok {
+			engines[indexid] = snapshotter
+		}
+	}
+	ddlLock.Unlock()
+
+	kept := conf.Config().Indexer.SnapshotsKept
+	for indexid, engine := range engines {
+		err := s.take(indexid, engine, kept)
+		if err != nil && err != api.NoSuchIndex {
+			logger.With("index", indexid).Errorf("Error taking snapshot %v", err)
+		}
+		metricSnapshots.Inc(indexid, resultLabel(err))
+	}
+}
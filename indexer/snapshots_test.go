@@ -0,0 +1,120 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"github.com/couchbaselabs/indexing/api"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// snapEngine snapshots by saving the number of mutations applied to it.
+type snapEngine struct {
+	api.Finder
+	contents string
+	restored string
+}
+
+type snapView struct{ contents string }
+
+func (e *snapEngine) Snapshot() (api.Snapshot, error) { return &snapView{e.contents}, nil }
+
+func (e *snapEngine) Restore(path string) error {
+	e.restored, e.contents = path, ""
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(path, "contents"))
+	e.contents = string(data)
+	return err
+}
+
+func (v *snapView) Save(path string) error {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(path, "contents"), []byte(v.contents), 0644)
+}
+
+func (v *snapView) Release() {}
+
+func TestSnapshotRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := newSnapshotManager(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ordering.drop("snap")
+	defer stats.drop("snap")
+
+	engine := &snapEngine{}
+	vector := make(api.SequenceVector, api.MAX_VBUCKETS)
+	ordering.reset("snap", vector, nil)
+	for seqno := uint64(1); seqno <= 4; seqno++ {
+		ordering.advance(&api.Mutation{Indexid: "snap", Vbucket: 3, Seqno: seqno * 10, Vbuuid: seqno})
+		engine.contents = string('0' + byte(seqno))
+		if err = s.take("snap", engine, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(s.snapshots["snap"]); n != 3 {
+		t.Fatalf("Expected 3 snapshots kept, got %v", n)
+	}
+
+	//snapshots survive a restart
+	if s, err = newSnapshotManager(dir); err != nil {
+		t.Fatal(err)
+	}
+	target := make(api.SequenceVector, api.MAX_VBUCKETS)
+	for vb := range target {
+		target[vb] = math.MaxUint64
+	}
+	target[3] = 35
+	restored, vbuuids, err := s.rollback("snap", engine, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored[3] != 30 || vbuuids[3] != 3 || engine.contents != "3" {
+		t.Errorf("Expected snapshot at seqno 30, got %v %v %q", restored[3], vbuuids[3], engine.contents)
+	}
+	if n := len(s.snapshots["snap"]); n != 2 {
+		t.Errorf("Expected newer snapshot removed, %v left", n)
+	}
+	if v, b := ordering.vector("snap"); v[3] != 30 || b[3] != 3 {
+		t.Errorf("Expected ordering reset to 30, got %v %v", v[3], b[3])
+	}
+
+	//an index at or below the target is left as it is
+	engine.restored = "none"
+	if restored, _, err = s.rollback("snap", engine, target); err != nil || restored[3] != 30 || engine.restored != "none" {
+		t.Errorf("Expected no restore, got %v %v %q", restored[3], err, engine.restored)
+	}
+
+	//no snapshot old enough empties the index
+	target[3] = 5
+	if restored, _, err = s.rollback("snap", engine, target); err != nil || restored[3] != 0 || engine.restored != "" {
+		t.Errorf("Expected empty index, got %v %v %q", restored[3], err, engine.restored)
+	}
+	if n := len(s.snapshots["snap"]); n != 0 {
+		t.Errorf("Expected no snapshots left, got %v", n)
+	}
+
+	s.drop("snap")
+	if err = s.take("snap", engine, 3); err != api.NoSuchIndex {
+		t.Errorf("Expected dropped index to fail, got %v", err)
+	}
+}
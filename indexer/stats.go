@@ -0,0 +1,234 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Operational statistics served by /stats. Counters are updated by the
+// mutation manager and the scan handler, engine figures are collected when
+// stats are requested.
+
+package main
+
+import (
+	"github.com/couchbaselabs/indexing/api"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const SCAN_LATENCY_SAMPLES = 1024 //latencies kept per index for percentiles
+
+type indexStats struct {
+	processed  uint64
+	skipped    uint64
+	failed     uint64
+	failing    uint64 //failed in a row, since the last mutation processed
+	duplicates uint64 //seqno already applied, dropped
+	stale      uint64 //seqno older than the last applied, dropped
+	gaps       uint64 //seqnos skipped
+	scans      uint64
+	scanErrors uint64
+
+	received []uint64 //highest seqno received per vbucket
+	applied  []uint64 //highest seqno applied per vbucket
+
+	latencyLock sync.Mutex
+	latencies   []time.Duration //ring buffer of recent scan latencies
+	latencyPos  int
+}
+
+type statsManager struct {
+	sync.RWMutex
+	indexes map[string]*indexStats
+}
+
+var stats = newStatsManager()
+
+// counters of mutations and scans of unknown indexes, never reported
+var untracked = newIndexStats()
+
+func newStatsManager() *statsManager {
+	return &statsManager{indexes: make(map[string]*indexStats)}
+}
+
+func newIndexStats() *indexStats {
+	return &indexStats{
+		received:  make([]uint64, api.MAX_VBUCKETS),
+		applied:   make([]uint64, api.MAX_VBUCKETS),
+		latencies: make([]time.Duration, 0, SCAN_LATENCY_SAMPLES),
+	}
+}
+
+// add creates the counters of an index of the engine map, if it has none.
+func (s *statsManager) add(indexid string) *indexStats {
+	s.Lock()
+	defer s.Unlock()
+	is, ok := s.indexes[indexid]
+	if !ok {
+		is = newIndexStats()
+		s.indexes[indexid] = is
+	}
+	return is
+}
+
+// index returns counters of an index, those of untracked indexes unless it
+// was added. Mutations for unknown indexes do not create counters.
+func (s *statsManager) index(indexid string) *indexStats {
+	s.RLock()
+	defer s.RUnlock()
+	if is, ok := s.indexes[indexid]; ok {
+		return is
+	}
+	return untracked
+}
+
+func (s *statsManager) drop(indexid string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.indexes, indexid)
+}
+
+// noteProcessed counts a mutation applied to the engine.
+func (is *indexStats) noteProcessed() {
+	atomic.AddUint64(&is.processed, 1)
+	if atomic.LoadUint64(&is.failing) != 0 {
+		atomic.StoreUint64(&is.failing, 0)
+	}
+}
+
+// noteFailed counts a mutation the engine failed to apply and returns the
+// number failed in a row.
+func (is *indexStats) noteFailed() uint64 {
+	atomic.AddUint64(&is.failed, 1)
+	return atomic.AddUint64(&is.failing, 1)
+}
+
+func (is *indexStats) noteReceived(vbucket uint16, seqno uint64) {
+	if int(vbucket) < len(is.received) {
+		storeMax(&is.received[vbucket], seqno)
+	}
+}
+
+func (is *indexStats) noteApplied(vbucket uint16, seqno uint64) {
+	if int(vbucket) < len(is.applied) {
+		storeMax(&is.applied[vbucket], seqno)
+	}
+}
+
+// noteRollback moves the seqnos of an index back to the rollback point.
+func (is *indexStats) noteRollback(vector api.SequenceVector) {
+	for vb, seqno := range vector {
+		if vb < len(is.applied) {
+			atomic.StoreUint64(&is.applied[vb], seqno)
+			atomic.StoreUint64(&is.received[vb], seqno)
+		}
+	}
+}
+
+func (is *indexStats) noteScan(latency time.Duration, err error) {
+
+	atomic.AddUint64(&is.scans, 1)
+	if err != nil {
+		atomic.AddUint64(&is.scanErrors, 1)
+	}
+
+	is.latencyLock.Lock()
+	defer is.latencyLock.Unlock()
+	if len(is.latencies) < SCAN_LATENCY_SAMPLES {
+		is.latencies = append(is.latencies, latency)
+	} else {
+		is.latencies[is.latencyPos] = latency
+	}
+	is.latencyPos = (is.latencyPos + 1) % SCAN_LATENCY_SAMPLES
+}
+
+// sequenceLag is the number of seqnos, summed across vbuckets, that were
+// received from the projector and not yet applied to the engine.
+func (is *indexStats) sequenceLag() uint64 {
+	var lag uint64
+	for vb := range is.received {
+		received := atomic.LoadUint64(&is.received[vb])
+		applied := atomic.LoadUint64(&is.applied[vb])
+		if received > applied {
+			lag += received - applied
+		}
+	}
+	return lag
+}
+
+func (is *indexStats) latencyPercentiles() api.LatencyStats {
+
+	is.latencyLock.Lock()
+	samples := make([]time.Duration, len(is.latencies))
+	copy(samples, is.latencies)
+	is.latencyLock.Unlock()
+
+	if len(samples) == 0 {
+		return api.LatencyStats{}
+	}
+	sort.Sort(durations(samples))
+	percentile := func(p float64) float64 {
+		d := samples[int(p*float64(len(samples)-1))]
+		return float64(d) / float64(time.Millisecond)
+	}
+	return api.LatencyStats{
+		P50: percentile(0.50),
+		P90: percentile(0.90),
+		P99: percentile(0.99),
+	}
+}
+
+// indexStatsFor gathers counters and engine figures of an index.
+func indexStatsFor(indexid string, engine api.Finder) (api.IndexStats, error) {
+
+	is := stats.index(indexid)
+	res := api.IndexStats{
+		Indexid:            indexid,
+		MutationsProcessed: atomic.LoadUint64(&is.processed),
+		MutationsSkipped:   atomic.LoadUint64(&is.skipped),
+		MutationsFailed:    atomic.LoadUint64(&is.failed),
+		MutationsDuplicate: atomic.LoadUint64(&is.duplicates),
+		MutationsStale:     atomic.LoadUint64(&is.stale),
+		SeqnoGaps:          atomic.LoadUint64(&is.gaps),
+		Scans:              atomic.LoadUint64(&is.scans),
+		ScanErrors:         atomic.LoadUint64(&is.scanErrors),
+		ScanLatency:        is.latencyPercentiles(),
+		SequenceLag:        is.sequenceLag(),
+	}
+	ingestion := ingest.info(indexid)
+	res.Paused, res.RateLimit = ingestion.Paused, ingestion.Rate
+	res.DeadLetters = deadLetters.count(indexid)
+
+	var err error
+	if counter, ok := engine.(api.Counter); ok {
+		if res.Items, err = counter.CountTotal(); err != nil {
+			return res, err
+		}
+	}
+	if sizer, ok := engine.(api.Sizer); ok {
+		if res.DiskSize, err = sizer.DiskSize(); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+func storeMax(addr *uint64, val uint64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		if val <= old || atomic.CompareAndSwapUint64(addr, old, val) {
+			return
+		}
+	}
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
@@ -0,0 +1,173 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Error isolation of mutation streams. Mutations of an index for a vbucket
+// form a stream, applied in seqno order by one mutation worker. When a
+// mutation of a stream cannot be applied, only that stream fails,
+//  - the worker drops the stream's mutations still queued,
+//  - new mutations of the stream are rejected with ERR_STREAM_FAILED, which
+//    makes the projector handshake again,
+//  - the next GetSequenceVectors returns, for the stream's vbucket, the seqno
+//    preceding the failed mutation, and resumes the stream once the worker
+//    dropped the mutations queued before the handshake. Resuming earlier
+//    would apply them ahead of the replayed failed mutation, which is then
+//    stale and lost. A stream still draining resumes at a later handshake.
+// Other indexes, and other vbuckets of the index, keep ingesting.
+
+package main
+
+import (
+	"github.com/couchbaselabs/indexing/api"
+	"sync"
+	"time"
+)
+
+// STREAM_DRAIN_TIMEOUT bounds the wait of a handshake for the queued
+// mutations of failed streams to be dropped
+const STREAM_DRAIN_TIMEOUT = 5 * time.Second
+
+// streamKey identifies the mutation stream of an index for a vbucket
+type streamKey struct {
+	indexid string
+	vbucket uint16
+}
+
+type streamFailure struct {
+	restart uint64 //seqno to restart after, the failed mutation follows it
+	err     error
+}
+
+type failedStreams struct {
+	sync.RWMutex
+	streams map[streamKey]*streamFailure
+}
+
+var failures = &failedStreams{streams: make(map[streamKey]*streamFailure)}
+
+// fail marks the stream of `mutation` as failed, unless it already is
+func (f *failedStreams) fail(mutation *api.Mutation, err error) {
+	f.Lock()
+	defer f.Unlock()
+
+	key := streamKey{mutation.Indexid, mutation.Vbucket}
+	if _, ok := f.streams[key]; ok {
+		return
+	}
+	var restart uint64
+	if mutation.Seqno > 0 {
+		restart = mutation.Seqno - 1
+	}
+	f.streams[key] = &streamFailure{restart: restart, err: err}
+	metricStreamFailures.Inc(mutation.Indexid)
+	mutationLog.With("index", mutation.Indexid, "vbucket", mutation.Vbucket, "seqno", mutation.Seqno).Errorf("Mutation stream failed, restarts after seqno %v: %v", restart, err)
+}
+
+// failed tells whether the stream of `mutation` failed
+func (f *failedStreams) failed(mutation *api.Mutation) bool {
+	f.RLock()
+	defer f.RUnlock()
+	_, ok := f.streams[streamKey{mutation.Indexid, mutation.Vbucket}]
+	return ok
+}
+
+// check returns an error if any of `muts` belongs to a failed stream
+func (f *failedStreams) check(muts []*api.Mutation) error {
+	f.RLock()
+	defer f.RUnlock()
+
+	if len(f.streams) == 0 {
+		return nil
+	}
+	for _, mutation := range muts {
+		if sf, ok := f.streams[streamKey{mutation.Indexid, mutation.Vbucket}]; ok {
+			return api.NewError(api.ERR_STREAM_FAILED,
+				"Stream of index %v vbucket %v failed, handshake to restart after seqno %v: %v",
+				mutation.Indexid, mutation.Vbucket, sf.restart, sf.err)
+		}
+	}
+	return nil
+}
+
+// drain waits until no failed stream has mutations queued, at most `timeout`
+func (f *failedStreams) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for f.draining() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (f *failedStreams) draining() bool {
+	f.RLock()
+	defer f.RUnlock()
+	for key := range f.streams {
+		if ordering.pending(key.indexid, key.vbucket) {
+			return true
+		}
+	}
+	return false
+}
+
+// resume returns `vectors` with the restart seqnos of failed streams, and
+// clears the failures of streams with no mutation queued. With `all`,
+// failures of indexes not in `vectors` are cleared as well, they belong to
+// indexes the indexer does not know.
+func (f *failedStreams) resume(vectors api.IndexSequenceMap, all bool) api.IndexSequenceMap {
+	f.Lock()
+	defer f.Unlock()
+
+	if len(f.streams) == 0 {
+		return vectors
+	}
+	reply := make(api.IndexSequenceMap, len(vectors))
+	for indexid, vector := range vectors {
+		reply[indexid] = vector
+	}
+	copied := make(map[string]bool)
+	for key, sf := range f.streams {
+		vector, ok := reply[key.indexid]
+		if !ok {
+			if all {
+				delete(f.streams, key)
+			}
+			continue
+		}
+		if int(key.vbucket) < len(vector) {
+			//copy, the vector is shared with the mutation manager
+			if !copied[key.indexid] {
+				vector = append(api.SequenceVector(nil), vector...)
+				reply[key.indexid] = vector
+				copied[key.indexid] = true
+			}
+			//the recorded seqno may lag behind, replaying more is safe
+			if sf.restart < vector[key.vbucket] {
+				vector[key.vbucket] = sf.restart
+			}
+		}
+		if ordering.pending(key.indexid, key.vbucket) {
+			mutationLog.With("index", key.indexid, "vbucket", key.vbucket).Warnf("Mutation stream still has mutations queued, resumes at a later handshake")
+			continue
+		}
+		if int(key.vbucket) < len(vector) {
+			mutationLog.With("index", key.indexid, "vbucket", key.vbucket).Infof("Resuming mutation stream after seqno %v", vector[key.vbucket])
+		}
+		delete(f.streams, key)
+	}
+	return reply
+}
+
+// drop clears the failures of a dropped index
+func (f *failedStreams) drop(indexid string) {
+	f.Lock()
+	defer f.Unlock()
+	for key := range f.streams {
+		if key.indexid == indexid {
+			delete(f.streams, key)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/couchbaselabs/indexing/api"
+	"testing"
+)
+
+func TestStreamFailureIsolation(t *testing.T) {
+	f := &failedStreams{streams: make(map[streamKey]*streamFailure)}
+	bad := &api.Mutation{Indexid: "idx1", Vbucket: 3, Seqno: 20}
+	f.fail(bad, api.NoSuchIndex)
+	//later failures of the stream keep the first restart seqno
+	f.fail(&api.Mutation{Indexid: "idx1", Vbucket: 3, Seqno: 25}, api.NoSuchIndex)
+
+	healthy := []*api.Mutation{
+		{Indexid: "idx1", Vbucket: 4, Seqno: 21},
+		{Indexid: "idx2", Vbucket: 3, Seqno: 21},
+	}
+	for _, m := range healthy {
+		if f.failed(m) {
+			t.Errorf("Stream of %v must not fail", m)
+		}
+	}
+	if err := f.check(healthy); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := f.check(append(healthy, bad)); api.CodeOf(err) != api.ERR_STREAM_FAILED {
+		t.Errorf("Expected failed stream, got %v", err)
+	}
+
+	vector := make(api.SequenceVector, api.MAX_VBUCKETS)
+	vector[3], vector[4] = 22, 30
+	vectors := api.IndexSequenceMap{"idx1": vector}
+	reply := f.resume(vectors, false)
+	if reply["idx1"][3] != 19 || reply["idx1"][4] != 30 {
+		t.Errorf("Expected restart after seqno 19, got %v", reply["idx1"][:5])
+	}
+	if vector[3] != 22 {
+		t.Error("Vectors of the mutation manager must not change")
+	}
+	if f.failed(bad) {
+		t.Error("Expected stream to resume after handshake")
+	}
+}
+
+func TestStreamResumeAfterDrain(t *testing.T) {
+	engine := &failingEngine{}
+	m := &MutationManager{
+		enginemap:  map[string]api.Finder{"drain": engine},
+		chmutation: make(chan *api.Mutation, 10),
+		chseq:      make(chan seqNotification, 10),
+	}
+	ordering.reset("drain", make(api.SequenceVector, api.MAX_VBUCKETS), nil)
+	defer ordering.drop("drain")
+	defer stats.drop("drain")
+	defer failures.drop("drain")
+	remove := func(seqno uint64) *api.Mutation {
+		return &api.Mutation{Type: api.DELETE, Indexid: "drain", Docid: fmt.Sprint(seqno), Vbucket: 5, Seqno: seqno}
+	}
+
+	//seqno 2 is queued behind the failed seqno 1
+	m.queueMutation(remove(1))
+	m.queueMutation(remove(2))
+	failures.fail(<-m.chmutation, api.NoSuchIndex)
+	ordering.dequeue(remove(1))
+	vectors := api.IndexSequenceMap{"drain": make(api.SequenceVector, api.MAX_VBUCKETS)}
+	if reply := failures.resume(vectors, false); reply["drain"][5] != 0 || !failures.failed(remove(2)) {
+		t.Fatalf("Expected stream to resume after seqno 0 once drained, got %v", reply["drain"][5])
+	}
+
+	//drained, the stream resumes and the replayed seqnos are applied in order
+	m.applyMutation(<-m.chmutation)
+	failures.resume(vectors, false)
+	if failures.failed(remove(2)) {
+		t.Fatal("Expected stream to resume after the handshake")
+	}
+	for _, seqno := range []uint64{1, 2} {
+		m.queueMutation(remove(seqno))
+		m.applyMutation(<-m.chmutation)
+	}
+	if fmt.Sprint(engine.applied) != "[delete 1 delete 2]" {
+		t.Errorf("Expected seqnos 1 and 2 applied, got %v", engine.applied)
+	}
+	if slot, _ := ordering.slot("drain", 5); *slot != 2 {
+		t.Errorf("Expected seqno 2 applied last, got %v", *slot)
+	}
+}
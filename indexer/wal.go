@@ -0,0 +1,228 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Mutation write-ahead log. With `indexer.walEnabled` every batch of
+// mutations received is appended to a log under <dataDir>/wal before it
+// is acknowledged, so that an acknowledged mutation survives a crash
+// before its seqno is checkpointed in the engine of its index. On restart
+// the mutations past the recovered checkpoints are queued again, before
+// any new mutation is received.
+//
+// The log is truncated as checkpoints pass the mutations in it. A record
+// is kept until every index it holds mutations for has checkpointed their
+// seqnos, or was dropped. A mutation whose key or value is invalid, or that
+// the engine fails to apply, is kept as a dead letter, its seqno is recorded
+// and checkpointed like any other, which releases its record. Only a stream
+// that fails holds back its records, until its mutations are replayed.
+//
+// A rollback appends a record of its own: mutations of the index logged
+// before it belong to the history the data source rolled back, they are
+// never replayed.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/wal"
+	"sync"
+)
+
+const WAL_DIR = "wal"
+
+type walEntry struct {
+	Mutations []*api.Mutation `json:"mutations,omitempty"`
+	Rollback  string          `json:"rollback,omitempty"` //index rolled back
+}
+
+// walMark is the highest seqno of an index and vbucket in a record.
+type walMark struct {
+	indexid string
+	vbucket uint16
+	seqno   uint64
+}
+
+type walRecord struct {
+	lsn   uint64
+	marks []walMark
+}
+
+type mutationWAL struct {
+	sync.Mutex
+	log       *wal.Log
+	pending   []*walRecord //records not checkpointed yet, in lsn order
+	last      uint64       //highest lsn appended or replayed
+	truncated uint64       //log truncated up to this lsn
+}
+
+func openMutationWAL(dir string, opts wal.Options) (*mutationWAL, error) {
+	log, err := wal.Open(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &mutationWAL{log: log}, nil
+}
+
+func marksOf(muts []*api.Mutation) []walMark {
+	marks := make([]walMark, 0, 1)
+	index := make(map[walMark]int)
+	for _, mutation := range muts {
+		key := walMark{indexid: mutation.Indexid, vbucket: mutation.Vbucket}
+		if i, ok := index[key]; !ok {
+			index[key] = len(marks)
+			marks = append(marks, walMark{mutation.Indexid, mutation.Vbucket, mutation.Seqno})
+		} else if mutation.Seqno > marks[i].seqno {
+			marks[i].seqno = mutation.Seqno
+		}
+	}
+	return marks
+}
+
+// append logs a batch of mutations, they can be acknowledged once it
+// returns.
+func (w *mutationWAL) append(muts []*api.Mutation) error {
+
+	payload, err := json.Marshal(walEntry{Mutations: muts})
+	if err != nil {
+		return err
+	}
+	marks := marksOf(muts)
+
+	w.Lock()
+	defer w.Unlock()
+	lsn, err := w.log.Append(payload)
+	if err != nil {
+		return err
+	}
+	w.pending = append(w.pending, &walRecord{lsn, marks})
+	w.last = lsn
+	return nil
+}
+
+// rollback logs the rollback of an index. Its queued mutations must be
+// applied, mutations logged before are not waited for anymore.
+func (w *mutationWAL) rollback(indexid string) error {
+
+	payload, err := json.Marshal(walEntry{Rollback: indexid})
+	if err != nil {
+		return err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	lsn, err := w.log.Append(payload)
+	if err != nil {
+		return err
+	}
+	w.last = lsn
+	for _, record := range w.pending {
+		marks := record.marks[:0]
+		for _, mark := range record.marks {
+			if mark.indexid != indexid {
+				marks = append(marks, mark)
+			}
+		}
+		record.marks = marks
+	}
+	return nil
+}
+
+// replay queues the logged mutations past `checkpoints` with `queue`, and
+// returns their number. Mutations of indexes not in `checkpoints` were
+// dropped with their index.
+func (w *mutationWAL) replay(checkpoints api.IndexSequenceMap, queue func(*api.Mutation)) (int, error) {
+
+	//mutations logged before the last rollback of their index are obsolete
+	rollbacks := make(map[string]uint64)
+	err := w.log.Replay(0, func(lsn uint64, payload []byte) error {
+		var entry walEntry
+		if err := json.Unmarshal(payload, &entry); err != nil {
+			return err
+		}
+		if entry.Rollback != "" {
+			rollbacks[entry.Rollback] = lsn
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err = w.log.Replay(0, func(lsn uint64, payload []byte) error {
+		var entry walEntry
+		if err := json.Unmarshal(payload, &entry); err != nil {
+			return err
+		}
+		muts := make([]*api.Mutation, 0, len(entry.Mutations))
+		for _, mutation := range entry.Mutations {
+			vector, ok := checkpoints[mutation.Indexid]
+			if !ok || lsn < rollbacks[mutation.Indexid] || mutation.Seqno <= vector[mutation.Vbucket] {
+				continue
+			}
+			muts = append(muts, mutation)
+		}
+		w.Lock()
+		if len(muts) > 0 {
+			w.pending = append(w.pending, &walRecord{lsn, marksOf(muts)})
+		}
+		w.last = lsn
+		w.Unlock()
+		for _, mutation := range muts {
+			queue(mutation)
+		}
+		n += len(muts)
+		return nil
+	})
+	return n, err
+}
+
+// checkpointed releases the records whose mutations are checkpointed in
+// `vectors`, the sequence vectors persisted, and truncates the log up to
+// the first record still pending.
+func (w *mutationWAL) checkpointed(vectors api.IndexSequenceMap) {
+
+	w.Lock()
+	i := 0
+	for ; i < len(w.pending); i++ {
+		if !w.pending[i].checkpointed(vectors) {
+			break
+		}
+	}
+	w.pending = w.pending[i:]
+	upto := w.last
+	if len(w.pending) > 0 {
+		upto = w.pending[0].lsn - 1
+	}
+	if upto <= w.truncated {
+		w.Unlock()
+		return
+	}
+	w.truncated = upto
+	w.Unlock()
+
+	if err := w.log.Truncate(upto); err != nil {
+		mutationLog.Errorf("Error truncating mutation log %v", err)
+	}
+}
+
+func (r *walRecord) checkpointed(vectors api.IndexSequenceMap) bool {
+	for _, mark := range r.marks {
+		if vector, ok := vectors[mark.indexid]; ok && vector[mark.vbucket] < mark.seqno {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *mutationWAL) close() {
+	if err := w.log.Close(); err != nil {
+		mutationLog.Errorf("Error closing mutation log %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/wal"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func walMutation(indexid string, vbucket uint16, seqno uint64) *api.Mutation {
+	return &api.Mutation{Type: api.INSERT, Indexid: indexid, Vbucket: vbucket, Seqno: seqno}
+}
+
+func TestMutationWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := wal.Options{SegmentSize: 1}
+	w, err := openMutationWAL(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batches := [][]*api.Mutation{
+		{walMutation("a", 1, 10), walMutation("a", 1, 11), walMutation("b", 2, 20)},
+		{walMutation("a", 1, 12)},
+		{walMutation("b", 2, 21), walMutation("gone", 3, 30)},
+	}
+	for _, muts := range batches {
+		if err = w.append(muts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.rollback("b"); err != nil {
+		t.Fatal(err)
+	}
+	w.append([]*api.Mutation{walMutation("b", 2, 15)})
+
+	//the first record is checkpointed, "gone" was dropped
+	vectors := api.IndexSequenceMap{
+		"a": make(api.SequenceVector, api.MAX_VBUCKETS),
+		"b": make(api.SequenceVector, api.MAX_VBUCKETS),
+	}
+	vectors["a"][1] = 11
+	w.checkpointed(vectors)
+	if n := len(w.pending); n != 3 || w.pending[0].lsn != 2 {
+		t.Errorf("Expected records from lsn 2 pending, got %v", n)
+	}
+	if n := w.log.Segments(); n != 4 {
+		t.Errorf("Expected first segment truncated, %v left", n)
+	}
+	w.close()
+
+	//restart with the checkpoints above
+	if w, err = openMutationWAL(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	var replayed []string
+	n, err := w.replay(vectors, func(mutation *api.Mutation) {
+		replayed = append(replayed, fmt.Sprintf("%v/%v/%v", mutation.Indexid, mutation.Vbucket, mutation.Seqno))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//mutations of "b" before its rollback are not replayed
+	if fmt.Sprint(replayed) != "[a/1/12 b/2/15]" || n != 2 {
+		t.Errorf("Unexpected mutations replayed %v", replayed)
+	}
+
+	vectors["a"][1], vectors["b"][2] = 12, 15
+	w.checkpointed(vectors)
+	if len(w.pending) != 0 || w.log.Segments() != 1 {
+		t.Errorf("Expected log truncated, %v pending in %v segments", len(w.pending), w.log.Segments())
+	}
+	w.close()
+}
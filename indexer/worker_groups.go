@@ -0,0 +1,322 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Mutation worker groups. Mutations are routed to the group of their index,
+// the shared group unless the index has workers of its own, and within the
+// group to a worker by vbucket, so that the mutations of an index for a
+// vbucket are applied in order by a single worker. Every group has a queue
+// of its own, a slow engine (e.g. one being compacted) only holds back the
+// indexes of its group until that queue is full.
+//
+// The shared group has `indexer.mutationWorkers` workers, reloadable.
+// Indexes created with `workers` set, or given workers with
+//   POST /admin/workers?index=<uuid>&workers=<n>
+// get a group of their own, 0 workers return them to the shared group.
+// When an index moves between groups, its new group waits until the old one
+// applied the mutations routed to it before, and when a group is resized
+// its new workers wait until the old ones are done.
+
+package main
+
+import (
+	"fmt"
+	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/rest"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const SHARED_GROUP = "shared"
+
+// groupTask is a mutation to apply, or a change to the group.
+type groupTask struct {
+	mutation *api.Mutation
+	drained  chan bool       //closed once the tasks before are applied
+	wait     chan bool       //tasks after are applied once it is closed
+	resize   int             //number of workers
+	fence    *sync.WaitGroup //done by each worker reaching it
+}
+
+type workerGroup struct {
+	sync.RWMutex //guards queues and hwm, replaced on resize
+	name         string
+	intake       chan groupTask
+	intakeHWM    int64
+	queues       []chan groupTask
+	hwm          []int64
+	queueSize    int
+	workers      sync.WaitGroup //workers of the current queues
+}
+
+type regroupRequest struct {
+	indexid string //empty for the shared group
+	workers int
+	drop    bool
+	done    chan bool
+}
+
+// startGroup starts the dispatcher and workers of a new group.
+func (m *MutationManager) startGroup(name string, workers, intakeSize, queueSize int) *workerGroup {
+	g := &workerGroup{
+		name:      name,
+		intake:    make(chan groupTask, intakeSize),
+		queueSize: queueSize,
+	}
+	g.startWorkers(m, workers)
+	m.workers.Add(1)
+	go m.dispatch(g)
+	return g
+}
+
+func (g *workerGroup) startWorkers(m *MutationManager, n int) {
+	queues := make([]chan groupTask, n)
+	for w := range queues {
+		queues[w] = make(chan groupTask, g.queueSize)
+		g.workers.Add(1)
+		m.workers.Add(1)
+		go m.startMutationWorker(queues[w], &g.workers)
+	}
+	g.Lock()
+	g.queues, g.hwm = queues, make([]int64, n)
+	g.Unlock()
+}
+
+// stopWorkers lets the workers drain their queues and waits for them.
+func (g *workerGroup) stopWorkers() {
+	for _, ch := range g.queues {
+		close(ch)
+	}
+	g.workers.Wait()
+}
+
+// dispatch distributes the tasks of a group on its workers based on
+// vbucketid, until the group is removed or the indexer stops.
+func (m *MutationManager) dispatch(g *workerGroup) {
+
+	defer m.workers.Done()
+	for task := range g.intake {
+		switch {
+		case task.mutation != nil:
+			w := int(task.mutation.Vbucket) % len(g.queues)
+			g.queues[w] <- task
+			noteQueueLength(&g.hwm[w], len(g.queues[w]))
+		case task.wait != nil:
+			<-task.wait
+		case task.drained != nil:
+			fence := &sync.WaitGroup{}
+			fence.Add(len(g.queues))
+			for _, ch := range g.queues {
+				ch <- groupTask{fence: fence}
+			}
+			go func(drained chan bool) {
+				fence.Wait()
+				close(drained)
+			}(task.drained)
+		case task.resize > 0 && task.resize != len(g.queues):
+			g.stopWorkers()
+			g.startWorkers(m, task.resize)
+			mutationLog.Infof("Worker group %v resized to %v workers", g.name, task.resize)
+		}
+	}
+	g.stopWorkers()
+}
+
+// groupOf returns the group mutations of an index are routed to. Called
+// by the router only.
+func (m *MutationManager) groupOf(indexid string) *workerGroup {
+	if g, ok := m.groups[indexid]; ok {
+		return g
+	}
+	return m.shared
+}
+
+// route queues a mutation on its group.
+func (m *MutationManager) route(mutation *api.Mutation) {
+	g := m.groupOf(mutation.Indexid)
+	g.intake <- groupTask{mutation: mutation}
+	noteQueueLength(&g.intakeHWM, len(g.intake))
+}
+
+// regroup applies a change to the worker groups. Called by the router
+// only, so that it takes place between the mutations routed before and
+// after.
+func (m *MutationManager) regroup(req regroupRequest) {
+
+	defer close(req.done)
+	if req.indexid == "" {
+		m.shared.intake <- groupTask{resize: req.workers}
+		return
+	}
+
+	g, ok := m.groups[req.indexid]
+	switch {
+	case req.drop:
+		//mutations of a dropped index fail, there is no order to keep
+		if ok {
+			m.removeGroup(req.indexid)
+		}
+	case ok && req.workers > 0:
+		g.intake <- groupTask{resize: req.workers}
+	case ok:
+		drained := make(chan bool)
+		g.intake <- groupTask{drained: drained}
+		m.removeGroup(req.indexid)
+		m.shared.intake <- groupTask{wait: drained}
+		mutationLog.With("index", req.indexid).Infof("Index moved to the shared worker group")
+	case req.workers > 0:
+		drained := make(chan bool)
+		m.shared.intake <- groupTask{drained: drained}
+		g = m.startGroup(req.indexid, req.workers, cap(m.shared.intake), m.shared.queueSize)
+		g.intake <- groupTask{wait: drained}
+		m.groupsLock.Lock()
+		m.groups[req.indexid] = g
+		m.groupsLock.Unlock()
+		mutationLog.With("index", req.indexid).Infof("Index moved to a worker group of %v workers", req.workers)
+	}
+}
+
+func (m *MutationManager) hasGroup(indexid string) bool {
+	m.groupsLock.RLock()
+	defer m.groupsLock.RUnlock()
+	_, ok := m.groups[indexid]
+	return ok
+}
+
+func (m *MutationManager) removeGroup(indexid string) {
+	m.groupsLock.Lock()
+	close(m.groups[indexid].intake)
+	delete(m.groups, indexid)
+	m.groupsLock.Unlock()
+}
+
+// setWorkers gives an index `workers` of its own, 0 returns it to the
+// shared group. An empty `indexid` resizes the shared group. Returns once
+// the router applied the change, or the indexer stopped.
+func (m *MutationManager) setWorkers(indexid string, workers int) {
+	m.requestRegroup(regroupRequest{indexid: indexid, workers: workers})
+}
+
+func (m *MutationManager) requestRegroup(req regroupRequest) {
+	req.done = make(chan bool)
+	select {
+	case m.chregroup <- req:
+		<-req.done
+	case <-m.done:
+	}
+}
+
+// stopGroups lets every group drain its queues, the router stopped.
+func (m *MutationManager) stopGroups() {
+	m.groupsLock.Lock()
+	close(m.shared.intake)
+	for _, g := range m.groups {
+		close(g.intake)
+	}
+	m.groups = make(map[string]*workerGroup)
+	m.groupsLock.Unlock()
+	m.workers.Wait()
+}
+
+// workerGroups lists the worker groups, the shared group first.
+func (m *MutationManager) workerGroups() []*workerGroup {
+	m.groupsLock.RLock()
+	defer m.groupsLock.RUnlock()
+	groups := make([]*workerGroup, 0, len(m.groups)+1)
+	groups = append(groups, m.shared)
+	for _, g := range m.groups {
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// queueStats reports the length of the group queue and of each worker
+// queue. Workers of the shared group are named as before groups existed.
+func (g *workerGroup) queueStats() []api.QueueStats {
+	g.RLock()
+	defer g.RUnlock()
+	prefix := g.name + "/"
+	if g.name == SHARED_GROUP {
+		prefix = ""
+	}
+	queues := make([]api.QueueStats, 0, len(g.queues)+1)
+	queues = append(queues, api.QueueStats{
+		Name:      g.name,
+		Length:    len(g.intake),
+		Capacity:  cap(g.intake),
+		HighWater: int(atomic.LoadInt64(&g.intakeHWM)),
+	})
+	for w := range g.queues {
+		queues = append(queues, api.QueueStats{
+			Name:      fmt.Sprintf("%vworker%d", prefix, w),
+			Length:    len(g.queues[w]),
+			Capacity:  cap(g.queues[w]),
+			HighWater: int(atomic.LoadInt64(&g.hwm[w])),
+		})
+	}
+	return queues
+}
+
+// queued returns the number of mutations waiting in worker queues.
+func (g *workerGroup) queued() int {
+	g.RLock()
+	defer g.RUnlock()
+	n := 0
+	for _, ch := range g.queues {
+		n += len(ch)
+	}
+	return n
+}
+
+func (g *workerGroup) info() api.WorkerGroup {
+	g.RLock()
+	defer g.RUnlock()
+	info := api.WorkerGroup{Workers: len(g.queues), Queued: len(g.intake)}
+	if g.name != SHARED_GROUP {
+		info.Index = g.name
+	}
+	return info
+}
+
+// /admin/workers
+//
+//	GET                            lists worker groups
+//	POST ?index=<uuid>&workers=<n> gives an index n workers of its own, 0
+//	                               returns it to the shared group
+func handleWorkers(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method == "POST" {
+		indexid := r.FormValue("index")
+		workers, err := strconv.Atoi(r.FormValue("workers"))
+		if err != nil || workers < 0 || indexid == "" {
+			rest.SendError(w, rest.BadRequest("Expected index and workers, 0 to share workers"))
+			return
+		}
+		//drops wait, the group of a dropped index is never created
+		ddlLock.Lock()
+		_, err = c.SetWorkers(indexid, workers)
+		if err == nil {
+			mutationMgr.setWorkers(indexid, workers)
+		}
+		ddlLock.Unlock()
+		if err != nil {
+			rest.SendError(w, err)
+			return
+		}
+		ddlLog.With("index", indexid).Infof("Index given %v mutation workers", workers)
+	}
+
+	groups := mutationMgr.workerGroups()
+	infos := make([]api.WorkerGroup, 0, len(groups))
+	for _, g := range groups {
+		infos = append(infos, g.info())
+	}
+	rest.Send(w, http.StatusOK, infos)
+}
@@ -0,0 +1,136 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/couchbaselabs/indexing/api"
+	"sync"
+	"testing"
+	"time"
+)
+
+// deleteEngine records deleted docids, blocking while held.
+type deleteEngine struct {
+	api.Finder
+	sync.Mutex
+	hold    chan bool
+	deleted []string
+}
+
+func (e *deleteEngine) DeleteMutation(docid string) error {
+	if e.hold != nil {
+		<-e.hold
+	}
+	e.Lock()
+	defer e.Unlock()
+	e.deleted = append(e.deleted, docid)
+	return nil
+}
+
+func (e *deleteEngine) count() int {
+	e.Lock()
+	defer e.Unlock()
+	return len(e.deleted)
+}
+
+func waitCount(t *testing.T, e *deleteEngine, n int) {
+	for deadline := time.Now().Add(5 * time.Second); e.count() < n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %v mutations applied, got %v", n, e.count())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func deletion(indexid string, vbucket uint16, seqno uint64) *api.Mutation {
+	return &api.Mutation{Type: api.DELETE, Indexid: indexid, Vbucket: vbucket, Seqno: seqno,
+		Docid: fmt.Sprintf("%v/%v", vbucket, seqno)}
+}
+
+func TestWorkerGroups(t *testing.T) {
+	slow := &deleteEngine{hold: make(chan bool)}
+	fast := &deleteEngine{}
+	m := &MutationManager{
+		enginemap:  map[string]api.Finder{"slow": slow, "fast": fast},
+		chmutation: make(chan *api.Mutation, 100),
+		chseq:      make(chan seqNotification, 1000),
+		chregroup:  make(chan regroupRequest),
+		groups:     make(map[string]*workerGroup),
+		done:       make(chan bool),
+	}
+	defer stats.drop("slow")
+	defer stats.drop("fast")
+	m.shared = m.startGroup(SHARED_GROUP, 2, 100, 10)
+	go m.manageMutationQueue()
+	notified := make(chan int)
+	go func() {
+		n := 0
+		for range m.chseq {
+			n++
+		}
+		notified <- n
+	}()
+
+	//a held engine of its own group does not stall other indexes
+	m.setWorkers("slow", 1)
+	for seqno := uint64(1); seqno <= 10; seqno++ {
+		m.queueMutation(deletion("slow", uint16(seqno%3), seqno))
+	}
+	for seqno := uint64(1); seqno <= 20; seqno++ {
+		m.queueMutation(deletion("fast", uint16(seqno%3), seqno))
+	}
+	waitCount(t, fast, 20)
+	if m.idle() {
+		t.Error("Expected mutations of the held index in flight")
+	}
+
+	//back to the shared group, mutations queued before are applied first
+	close(slow.hold)
+	m.setWorkers("slow", 0)
+	for seqno := uint64(11); seqno <= 30; seqno++ {
+		m.queueMutation(deletion("slow", uint16(seqno%3), seqno))
+	}
+	waitCount(t, slow, 30)
+	for i, docid := range slow.deleted {
+		var vb, seqno int
+		fmt.Sscanf(docid, "%d/%d", &vb, &seqno)
+		for _, earlier := range slow.deleted[i+1:] {
+			var evb, eseqno int
+			fmt.Sscanf(earlier, "%d/%d", &evb, &eseqno)
+			if evb == vb && eseqno < seqno {
+				t.Errorf("Mutation %v applied before %v", docid, earlier)
+			}
+		}
+	}
+
+	//the shared group is resized once its queues are drained
+	m.setWorkers("", 3)
+	for deadline := time.Now().Add(5 * time.Second); m.shared.info().Workers != 3; {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the shared group resized to 3 workers")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if groups := m.workerGroups(); len(groups) != 1 {
+		t.Errorf("Expected the shared group only, got %v groups", len(groups))
+	}
+	for deadline := time.Now().Add(5 * time.Second); !m.idle(); {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected every mutation applied")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(m.chmutation)
+	if n := <-notified; n != 50 {
+		t.Errorf("Expected 50 seqnos notified, got %v", n)
+	}
+}
@@ -0,0 +1,161 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Computes key distribution statistics for an index with a single ordered
+// pass over its entries. Works with any engine implementing api.Looker.
+//
+// The equi-depth histogram is built without knowing the row count up
+// front: buckets are closed once they reach the current depth, and when
+// there are twice as many buckets as requested, adjacent pairs are merged
+// and the depth doubled. A run of equal leading keys is never split across
+// buckets, so per bucket distinct counts add up.
+
+package keystats
+
+import (
+	"bytes"
+	"github.com/couchbaselabs/indexing/api"
+	"time"
+)
+
+const DEFAULT_BUCKETS = 64
+
+var nullKey = []byte("null")
+
+// Compute statistics for all entries of an index.
+func Compute(looker api.Looker, nbuckets int) (api.IndexKeyStats, error) {
+	chval, cherr := looker.ValueSet()
+	return Build(chval, cherr, nbuckets)
+}
+
+// Build statistics from values received in index order on `chval`.
+func Build(chval chan api.Value, cherr chan error, nbuckets int) (
+	api.IndexKeyStats, error) {
+
+	if nbuckets <= 0 {
+		nbuckets = DEFAULT_BUCKETS
+	}
+	b := builder{nbuckets: nbuckets, depth: 1}
+
+	ok := true
+	var value api.Value
+	var err error
+	for ok {
+		select {
+		case value, ok = <-chval:
+			if ok {
+				b.add(&value)
+			}
+		case err, ok = <-cherr:
+			if err != nil {
+				return api.IndexKeyStats{}, err
+			}
+		}
+	}
+	return b.finish(), nil
+}
+
+type builder struct {
+	stats    api.IndexKeyStats
+	nbuckets int
+	depth    uint64
+	buckets  []api.HistogramBucket
+	current  *api.HistogramBucket
+
+	keyBytes   uint64
+	valueBytes uint64
+	lastLead   []byte
+	lastKey    api.Keybytes
+}
+
+func (b *builder) add(value *api.Value) {
+
+	keybytes := value.KeyBytes()
+	b.stats.Rows++
+	for _, k := range keybytes {
+		b.keyBytes += uint64(len(k))
+	}
+	b.valueBytes += uint64(len(value.EncodedBytes()))
+
+	var lead []byte
+	if len(keybytes) > 0 {
+		lead = keybytes[0]
+	}
+	if len(lead) == 0 {
+		b.stats.MissingCount++
+	} else if bytes.Equal(lead, nullKey) {
+		b.stats.NullCount++
+	}
+
+	if b.lastKey == nil || !equalKeys(b.lastKey, keybytes) {
+		b.stats.DistinctKeys++
+		b.lastKey = keybytes
+	}
+
+	newLead := b.current == nil || !bytes.Equal(b.lastLead, lead)
+	if newLead && b.current != nil && b.current.Count >= b.depth {
+		b.closeBucket()
+	}
+	if b.current == nil {
+		b.current = &api.HistogramBucket{LowKey: lead}
+	}
+	b.current.HighKey = lead
+	b.current.Count++
+	if newLead {
+		b.current.Distinct++
+	}
+	b.lastLead = lead
+}
+
+func (b *builder) closeBucket() {
+	b.buckets = append(b.buckets, *b.current)
+	b.current = nil
+	if len(b.buckets) >= 2*b.nbuckets {
+		merged := make([]api.HistogramBucket, 0, b.nbuckets)
+		for i := 0; i+1 < len(b.buckets); i += 2 {
+			merged = append(merged, api.HistogramBucket{
+				LowKey:   b.buckets[i].LowKey,
+				HighKey:  b.buckets[i+1].HighKey,
+				Count:    b.buckets[i].Count + b.buckets[i+1].Count,
+				Distinct: b.buckets[i].Distinct + b.buckets[i+1].Distinct,
+			})
+		}
+		b.buckets = merged
+		b.depth *= 2
+	}
+}
+
+func (b *builder) finish() api.IndexKeyStats {
+	if b.current != nil {
+		b.buckets = append(b.buckets, *b.current)
+	}
+	stats := b.stats
+	stats.Histogram = b.buckets
+	if stats.Rows > 0 {
+		stats.AvgKeySize = float64(b.keyBytes) / float64(stats.Rows)
+		stats.AvgValueSize = float64(b.valueBytes) / float64(stats.Rows)
+	}
+	if stats.DistinctKeys > 0 {
+		stats.DocsPerKey = float64(stats.Rows) / float64(stats.DistinctKeys)
+	}
+	stats.Timestamp = time.Now().Unix()
+	return stats
+}
+
+func equalKeys(a, b api.Keybytes) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package keystats
+
+import (
+	"errors"
+	"fmt"
+	"github.com/couchbaselabs/indexing/api"
+	"testing"
+)
+
+// feed values on a channel, like an engine's ValueSet() would.
+func feed(t *testing.T, keys [][][]byte, err error) (chan api.Value, chan error) {
+	chval := make(chan api.Value)
+	cherr := make(chan error)
+	go func() {
+		defer close(chval)
+		defer close(cherr)
+		for i, k := range keys {
+			v, e := api.NewValue(k, fmt.Sprintf("doc%d", i), 0, uint64(i))
+			if e != nil {
+				t.Errorf("NewValue failed: %v", e)
+			}
+			chval <- v
+		}
+		if err != nil {
+			cherr <- err
+		}
+	}()
+	return chval, cherr
+}
+
+func TestBuild(t *testing.T) {
+	keys := make([][][]byte, 0)
+	keys = append(keys, [][]byte{[]byte{}}, [][]byte{[]byte("null")})
+	for i := 0; i < 1000; i++ {
+		// 100 distinct leading keys, 10 docs each
+		keys = append(keys, [][]byte{[]byte(fmt.Sprintf("%03d", i/10))})
+	}
+	chval, cherr := feed(t, keys, nil)
+	stats, err := Build(chval, cherr, 8)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if stats.Rows != 1002 {
+		t.Errorf("Expected 1002 rows, got %v", stats.Rows)
+	}
+	if stats.MissingCount != 1 || stats.NullCount != 1 {
+		t.Errorf("Expected 1 missing and 1 null, got %v %v", stats.MissingCount, stats.NullCount)
+	}
+	if stats.DistinctKeys != 102 {
+		t.Errorf("Expected 102 distinct keys, got %v", stats.DistinctKeys)
+	}
+	if n := len(stats.Histogram); n < 8 || n >= 16 {
+		t.Errorf("Expected between 8 and 16 buckets, got %v", n)
+	}
+	var count, distinct uint64
+	for _, b := range stats.Histogram {
+		count += b.Count
+		distinct += b.Distinct
+	}
+	if count != stats.Rows || distinct != stats.DistinctKeys {
+		t.Errorf("Histogram totals %v/%v do not match %v/%v", count, distinct, stats.Rows, stats.DistinctKeys)
+	}
+	if stats.DocsPerKey < 9.8 || stats.DocsPerKey > 9.9 {
+		t.Errorf("Unexpected docs per key %v", stats.DocsPerKey)
+	}
+}
+
+func TestBuildError(t *testing.T) {
+	chval, cherr := feed(t, [][][]byte{{[]byte("1")}}, errors.New("scan failed"))
+	if _, err := Build(chval, cherr, 8); err == nil {
+		t.Error("Expected error from Build")
+	}
+}
@@ -0,0 +1,225 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Leveled logging with per-subsystem loggers. Every subsystem (engine,
+// mutation, scan, ddl, projector ...) gets its own logger whose level can be
+// changed at runtime, either with SetLevel() or through Handler(), which
+// processes mount at /admin/loglevel.
+//
+//   var logger = logging.NewLogger("mutation")
+//   logger.With("index", uuid, "vbucket", vb).Debugf("Applied seqno %v", seqno)
+//
+// Output goes through the standard `log` package, formatted as
+//
+//   2013/11/20 10:00:00 [DEBUG] [mutation] Applied seqno 10 index=... vbucket=3
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type Level int32
+
+const (
+	Error Level = iota
+	Warn
+	Info
+	Debug
+	Trace
+)
+
+var levelNames = []string{"error", "warn", "info", "debug", "trace"}
+
+var UnknownLevel = errors.New("Unknown log level")
+var UnknownSubsystem = errors.New("Unknown logging subsystem")
+
+func (l Level) String() string {
+	if l < Error || l > Trace {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel converts a level name, case insensitive, to a Level.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return Info, UnknownLevel
+}
+
+type Logger struct {
+	subsystem string
+	level     *int32 // shared with loggers derived using With()
+	fields    string // preformatted key=value pairs
+}
+
+var registry = struct {
+	sync.Mutex
+	loggers      map[string]*Logger
+	defaultLevel Level
+}{
+	loggers:      make(map[string]*Logger),
+	defaultLevel: Info,
+}
+
+var output = log.New(os.Stderr, "", log.LstdFlags)
+
+// NewLogger returns the logger for a subsystem, creating it at the default
+// level if it does not exist yet.
+func NewLogger(subsystem string) *Logger {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if l, ok := registry.loggers[subsystem]; ok {
+		return l
+	}
+	level := int32(registry.defaultLevel)
+	l := &Logger{subsystem: subsystem, level: &level}
+	registry.loggers[subsystem] = l
+	return l
+}
+
+// SetLevel changes the level of a subsystem. An empty subsystem, or "all",
+// changes every subsystem as well as the default for new ones.
+func SetLevel(subsystem string, level Level) error {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if subsystem == "" || subsystem == "all" {
+		registry.defaultLevel = level
+		for _, l := range registry.loggers {
+			atomic.StoreInt32(l.level, int32(level))
+		}
+		return nil
+	}
+	l, ok := registry.loggers[subsystem]
+	if !ok {
+		return UnknownSubsystem
+	}
+	atomic.StoreInt32(l.level, int32(level))
+	return nil
+}
+
+// Levels returns the current level of every subsystem.
+func Levels() map[string]string {
+	registry.Lock()
+	defer registry.Unlock()
+
+	levels := make(map[string]string)
+	for name, l := range registry.loggers {
+		levels[name] = l.Level().String()
+	}
+	return levels
+}
+
+// With returns a logger that appends the key/value pairs to every line. The
+// new logger shares its level with the parent.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	var buf bytes.Buffer
+	buf.WriteString(l.fields)
+	for i := 0; i < len(kv); i += 2 {
+		if i+1 < len(kv) {
+			fmt.Fprintf(&buf, " %v=%v", kv[i], kv[i+1])
+		} else {
+			fmt.Fprintf(&buf, " %v=?", kv[i])
+		}
+	}
+	return &Logger{subsystem: l.subsystem, level: l.level, fields: buf.String()}
+}
+
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(l.level))
+}
+
+// Enabled is cheap enough to guard expensive log arguments in hot paths.
+func (l *Logger) Enabled(level Level) bool {
+	return level <= l.Level()
+}
+
+func (l *Logger) IsDebug() bool {
+	return l.Enabled(Debug)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(Error, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(Warn, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(Info, format, args...)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(Debug, format, args...)
+}
+
+func (l *Logger) Tracef(format string, args ...interface{}) {
+	l.logf(Trace, format, args...)
+}
+
+// Fatalf logs irrespective of level and exits the process.
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.output("FATAL", format, args...)
+	os.Exit(1)
+}
+
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.output(strings.ToUpper(level.String()), format, args...)
+}
+
+func (l *Logger) output(prefix, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	output.Printf("[%s] [%s] %s%s", prefix, l.subsystem, msg, l.fields)
+}
+
+// Handler serves the admin endpoint for log levels.
+//
+//	GET               returns {"subsystem": "level", ...}
+//	POST/PUT          ?subsystem=scan&level=debug, subsystem defaults to all
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "POST", "PUT":
+			level, err := ParseLevel(r.FormValue("level"))
+			if err == nil {
+				err = SetLevel(r.FormValue("subsystem"), level)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		buf, _ := json.Marshal(Levels())
+		w.Write(buf)
+	})
+}
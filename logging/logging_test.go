@@ -0,0 +1,76 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func capture() *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	output = log.New(buf, "", 0)
+	return buf
+}
+
+func TestLevels(t *testing.T) {
+	buf := capture()
+	l := NewLogger("test")
+	SetLevel("test", Info)
+
+	l.Debugf("hidden %v", 1)
+	l.Infof("shown %v", 2)
+	if out := buf.String(); out != "[INFO] [test] shown 2\n" {
+		t.Errorf("Unexpected output %q", out)
+	}
+
+	buf.Reset()
+	SetLevel("test", Debug)
+	l.With("index", "abc", "vbucket", 3).Debugf("applied")
+	if out := buf.String(); out != "[DEBUG] [test] applied index=abc vbucket=3\n" {
+		t.Errorf("Unexpected output %q", out)
+	}
+	if NewLogger("test") != l {
+		t.Error("NewLogger must return the registered logger")
+	}
+	if err := SetLevel("nosuch", Debug); err != UnknownSubsystem {
+		t.Errorf("Expected UnknownSubsystem, got %v", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	capture()
+	l := NewLogger("handler")
+	SetLevel("handler", Info)
+
+	req, _ := http.NewRequest("POST", "/admin/loglevel?subsystem=handler&level=trace", nil)
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %s", w.Code, w.Body.String())
+	}
+	if l.Level() != Trace {
+		t.Errorf("Expected trace level, got %v", l.Level())
+	}
+	if !strings.Contains(w.Body.String(), `"handler":"trace"`) {
+		t.Errorf("Unexpected body %s", w.Body.String())
+	}
+
+	req, _ = http.NewRequest("POST", "/admin/loglevel?level=verbose", nil)
+	w = httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for bad level, got %v", w.Code)
+	}
+}
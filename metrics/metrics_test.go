@@ -0,0 +1,88 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_mutations_total", "Mutations", "index", "result")
+	g := r.NewGauge("test_queue_length", "Queue length")
+	gf := r.NewGaugeFunc("test_workers", "Workers", func() float64 { return 8 })
+	h := r.NewHistogram("test_scan_seconds", "Scan latency", []float64{0.1, 1}, "type")
+
+	c.Inc("idx1", "processed")
+	c.Add(2, "idx1", "processed")
+	c.Inc("idx2", "failed")
+	g.Set(42)
+	h.Observe(0.05, "lookup")
+	h.Observe(0.5, "lookup")
+	h.Observe(5, "lookup")
+
+	if v := c.Value("idx1", "processed"); v != 3 {
+		t.Errorf("Expected counter 3, got %v", v)
+	}
+	if v := gf.Value(); v != 8 {
+		t.Errorf("Expected gauge func 8, got %v", v)
+	}
+	if n := h.Count("lookup"); n != 3 {
+		t.Errorf("Expected histogram count 3, got %v", n)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := r.WriteText(buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE test_mutations_total counter",
+		`test_mutations_total{index="idx1",result="processed"} 3`,
+		`test_mutations_total{index="idx2",result="failed"} 1`,
+		"# TYPE test_queue_length gauge",
+		"test_queue_length 42",
+		"test_workers 8",
+		"# TYPE test_scan_seconds histogram",
+		`test_scan_seconds_bucket{type="lookup",le="0.1"} 1`,
+		`test_scan_seconds_bucket{type="lookup",le="1"} 2`,
+		`test_scan_seconds_bucket{type="lookup",le="+Inf"} 3`,
+		`test_scan_seconds_sum{type="lookup"} 5.55`,
+		`test_scan_seconds_count{type="lookup"} 3`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Missing %q in output\n%s", line, out)
+		}
+	}
+}
+
+func TestLabelMismatch(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Test", "index")
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected panic on wrong number of label values")
+		}
+	}()
+	c.Inc()
+}
+
+func TestDuplicate(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Test")
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected panic on duplicate metric")
+		}
+	}()
+	r.NewGauge("test_total", "Test")
+}
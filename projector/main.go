@@ -12,12 +12,19 @@ package main
 import (
 	"flag"
 	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/auth"
+	"github.com/couchbaselabs/indexing/config"
+	"github.com/couchbaselabs/indexing/evaluator"
 	imclient "github.com/couchbaselabs/indexing/index_manager/client"
-	ast "github.com/couchbaselabs/tuqtng/ast"
+	"github.com/couchbaselabs/indexing/logging"
 	"github.com/prataprc/go-couchbase"
-	"log"
 )
 
+var logger = logging.NewLogger("projector")
+
+var conf *config.Manager
+var security *auth.Security
+
 // TODO:
 // [1] the node in which router runs will have to be mentioned in indexinfo
 //     structure. once that is available change the projector accordingly
@@ -33,20 +40,32 @@ var options struct {
 	inhost string // TODO: [1]
 	nconn  int
 	proto  string
+	mproto string // mutation protocol, `binary` or `jsonrpc`
+	maddr  string
+	level  string
 }
 
 const (
 	GETSEQUENCE_VECTOR string = "MutationManager.GetSequenceVectors"
 	PROCESS_1MUTATION  string = "MutationManager.ProcessSingleMutation"
+	SET_BUILDTARGETS   string = "MutationManager.SetBuildTargets"
+	ROLLBACK           string = "MutationManager.Rollback"
+	STREAM_BATCH       string = "StreamBatch" // binary stream protocol
 	DEFAULT_NCONN      int    = 8
 )
 
 type bucketMeta struct {
+	bucket     string // bucket name, a bucket can have more than one feed
 	vector     api.SequenceVector
+	vbuuids    api.VbuuidVector // branch of each seqno of vector
 	indexMap   map[string]*api.IndexInfo
-	indexExprs map[string][]ast.Expression
+	evaluators map[string]evaluator.Evaluator
 }
-type bucketMap map[string]*bucketMeta
+type bucketMap map[string]*bucketMeta // indexed with feed name
+
+// feed of indexes being built from seqno 0 is named after the bucket with
+// this suffix.
+const BUILD_FEED_SUFFIX = "/build"
 
 // Supervisor messages
 type ImNotify struct {
@@ -64,24 +83,26 @@ type projectorInfo struct {
 }
 
 type streamer interface {
-	openFeed(api.SequenceVector) error
+	openFeed(api.SequenceVector, api.VbuuidVector, rollbackFunc) error
 	closeFeed()
 }
 
 func main() {
 	argParse()
+	startMetricsServer(options.maddr)
 	// Couchbase client, pool and default bucket
 	couch, err := couchbase.Connect("http://" + options.kvhost)
 	if err != nil {
-		log.Fatalf("Error connecting:  %v", err)
+		logger.Fatalf("Error connecting:  %v", err)
 	}
 	pool, err := couch.GetPool("default")
 	if err != nil {
-		log.Fatalf("Error getting pool:  %v", err)
+		logger.Fatalf("Error getting pool:  %v", err)
 	}
 
 	p := &projectorInfo{
-		imanager: imclient.NewRestClient("http://" + options.imhost),
+		imanager: imclient.NewRestClientWithHTTP(
+			security.Scheme()+"://"+options.imhost, security.HTTPClient()),
 	}
 	superch := make(chan interface{})
 	for {
@@ -89,22 +110,20 @@ func main() {
 		if p.serverUuid, err = p.getMetaData(); err != nil {
 			continue
 		}
-		for bucket, bmeta := range p.buckets {
+		for _, bmeta := range p.buckets {
 			bw := NewBucketWorker(BucketWorkerCmd{
 				client:     couch,
 				pool:       &pool,
-				bucketname: bucket,
+				bucketname: bmeta.bucket,
 				bmeta:      bmeta,
 				nconn:      options.nconn,
 				rpcurl:     options.inhost,
 			})
 			// Workers to push mutations to indexer through parallel connection
-			for _, iclients := range bw.mclients {
-				for _, s := range iclients {
-					killch := make(chan bool)
-					go push2Indexer(s, superch, killch)
-					workers = append(workers, killch)
-				}
+			for _, s := range bw.mclients {
+				killch := make(chan bool)
+				go push2Indexer(s, superch, killch)
+				workers = append(workers, killch)
 			}
 			// Workers to gather UprEvents from upr-feed.
 			killch := make(chan bool)
@@ -116,8 +135,10 @@ func main() {
 		case msg, _ := <-superch:
 			if notify, ok := msg.(ImNotify); ok {
 				p.serverUuid = notify.serverUuid
+				metricRestarts.Inc("notify")
 			} else if exit, ok := msg.(ExitRoutine); ok {
-				log.Println(exit.err)
+				logger.Errorf("Worker exited %v", exit.err)
+				metricRestarts.Inc("exit")
 			} else {
 				panic("Unknown supervisor message")
 			}
@@ -133,15 +154,61 @@ func main() {
 }
 
 func argParse() {
-	flag.StringVar(&options.kvhost, "kvhost", "localhost:11211",
+	path, overrides := config.Flags(flag.CommandLine)
+	defaults := config.Default().Projector
+	flag.StringVar(&options.kvhost, "kvhost", defaults.KVHost,
 		"Port to connect to kv-cluster")
-	flag.StringVar(&options.inhost, "inhost", "localhost:8096",
+	flag.StringVar(&options.inhost, "inhost", defaults.INHost,
 		"Port to connect to indexer node") // TODO [1]
-	flag.StringVar(&options.imhost, "imhost", "localhost:8094",
+	flag.StringVar(&options.imhost, "imhost", defaults.IMHost,
 		"Port to connect to index-manager node")
-	flag.StringVar(&options.proto, "proto", "upr",
+	flag.StringVar(&options.proto, "proto", defaults.Proto,
 		"Use either `tap` or `upr`")
-	flag.IntVar(&options.nconn, "nconn", DEFAULT_NCONN,
+	flag.StringVar(&options.mproto, "mutationProtocol", defaults.MutationProtocol,
+		"Protocol for mutations to the indexer, `binary` or `jsonrpc`")
+	flag.IntVar(&options.nconn, "nconn", defaults.NConn,
 		"Number of indexer (rpc) connections ber bucket")
+	flag.StringVar(&options.maddr, "metricsAddr", defaults.MetricsAddr,
+		"Address to serve /metrics, /config and /admin/loglevel on")
+	flag.StringVar(&options.level, "logLevel", "info",
+		"Log level for all subsystems, one of error, warn, info, debug, trace")
 	flag.Parse()
+
+	overrides.Alias(flag.CommandLine, map[string]string{
+		"kvhost":           "projector.kvhost",
+		"inhost":           "projector.inhost",
+		"imhost":           "projector.imhost",
+		"proto":            "projector.proto",
+		"nconn":            "projector.nconn",
+		"mutationProtocol": "projector.mutationProtocol",
+		"metricsAddr":      "projector.metricsAddr",
+		"logLevel":         "logLevel",
+	})
+
+	var err error
+	if conf, err = config.NewManager(*path, overrides); err != nil {
+		logger.Fatalf("Configuration error: %v", err)
+	}
+	cfg := conf.Config()
+	options.kvhost = cfg.Projector.KVHost
+	options.inhost = cfg.Projector.INHost
+	options.imhost = cfg.Projector.IMHost
+	options.proto = cfg.Projector.Proto
+	options.nconn = cfg.Projector.NConn
+	options.mproto = cfg.Projector.MutationProtocol
+	options.maddr = cfg.Projector.MetricsAddr
+	options.level = cfg.LogLevel
+
+	setLogLevel(cfg)
+	conf.OnChange(setLogLevel)
+
+	if security, err = auth.New(cfg.Security); err != nil {
+		logger.Fatalf("Security configuration error: %v", err)
+	}
+}
+
+func setLogLevel(cfg config.Config) {
+	//validated by the config package
+	level, _ := logging.ParseLevel(cfg.LogLevel)
+	logging.SetLevel("all", level)
 }
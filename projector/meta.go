@@ -11,8 +11,7 @@ package main
 
 import (
 	"github.com/couchbaselabs/indexing/api"
-	ast "github.com/couchbaselabs/tuqtng/ast"
-	"log"
+	"github.com/couchbaselabs/indexing/evaluator"
 	"net"
 	"net/rpc/jsonrpc"
 	"time"
@@ -24,80 +23,107 @@ const maximumRetryInterval = 30 * time.Second
 
 func (p *projectorInfo) getMetaData() (serverUuid string, err error) {
 	var rpcconn net.Conn
-	var returnMap api.IndexSequenceMap
+	var returnMap api.IndexVectors
 	var indexinfos []api.IndexInfo
-	var ex ast.Expression
 
-	bmap := make(bucketMap)
+	var bmap bucketMap
 	tryConnection(func() bool {
+		bmap = make(bucketMap) // start afresh on every retry
 		// Create a map of indexinfos structured around buckets.
 		if serverUuid, indexinfos, err = p.imanager.List(""); err != nil {
-			log.Println("Error getting list:", err)
+			logger.Errorf("Error getting list: %v", err)
 			return false
 		}
 		for i, ii := range indexinfos {
-			bmeta := bmap[ii.Bucket]
-			if bmeta == nil {
-				bmeta = &bucketMeta{
-					indexMap:   make(map[string]*api.IndexInfo),
-					indexExprs: make(map[string][]ast.Expression),
-					vector:     make(api.SequenceVector, api.MAX_VBUCKETS),
-				}
+			if ii.State == api.INDEX_DEFERRED {
+				continue // waiting for a BUILD request
 			}
-			bmeta.indexMap[ii.Uuid] = &indexinfos[i]
 			// Get sequence vector for each index
 			url := options.inhost // TODO [1]
 			// url := ii.RouterNode
-			if rpcconn, err = net.Dial("tcp", url); err != nil {
-				log.Printf("error connecting with indexer %v: %v\n", url, err)
+			if rpcconn, err = security.Dial(url); err != nil {
+				logger.Errorf("error connecting with indexer %v: %v", url, err)
 				return false
 			}
 			c := jsonrpc.NewClient(rpcconn)
 			indexList := api.IndexList{ii.Uuid}
 			if err = c.Call(GETSEQUENCE_VECTOR, &indexList, &returnMap); err != nil {
-				log.Printf("error getting sequence vector %v: %v\n", url, err)
+				logger.Errorf("error getting sequence vector %v: %v", url, err)
 				return false
 			}
-			// Build sequence vector per bucket based on the collection of indexes
-			// defined on the bucket.
-			for uuid, vector := range returnMap {
-				if len(vector) == 0 {
-					log.Printf("error sequence vector empty for %v\n", uuid)
-					return false
+			vector, ok := returnMap.Seqnos[ii.Uuid]
+			vbuuids := returnMap.Vbuuids[ii.Uuid]
+			if !ok || len(vector) == 0 {
+				logger.With("index", ii.Uuid).Errorf("error sequence vector empty")
+				return false
+			}
+			// Indexes that were never built are backfilled together on a
+			// separate feed from seqno 0, other indexes of the bucket
+			// continue from where they left off.
+			feedname := ii.Bucket
+			if isZeroVector(vector) {
+				feedname = ii.Bucket + BUILD_FEED_SUFFIX
+			}
+			bmeta := bmap[feedname]
+			if bmeta == nil {
+				bmeta = &bucketMeta{
+					bucket:     ii.Bucket,
+					indexMap:   make(map[string]*api.IndexInfo),
+					evaluators: make(map[string]evaluator.Evaluator),
+					vector:     nil,
 				}
-				for vb, seqno := range vector {
-					if bmeta.vector[vb] == 0 || bmeta.vector[vb] > seqno {
-						bmeta.vector[vb] = seqno
+			}
+			bmeta.indexMap[ii.Uuid] = &indexinfos[i]
+			// Build sequence vector per feed based on the collection of indexes
+			// sharing the feed, each seqno on the branch of the index it
+			// comes from.
+			if bmeta.vector == nil {
+				bmeta.vector = make(api.SequenceVector, api.MAX_VBUCKETS)
+				bmeta.vbuuids = make(api.VbuuidVector, api.MAX_VBUCKETS)
+				copy(bmeta.vector, vector)
+				copy(bmeta.vbuuids, vbuuids)
+			}
+			for vb, seqno := range vector {
+				if bmeta.vector[vb] > seqno {
+					bmeta.vector[vb] = seqno
+					bmeta.vbuuids[vb] = 0
+					if vb < len(vbuuids) {
+						bmeta.vbuuids[vb] = vbuuids[vb]
 					}
 				}
 			}
-			// AST expression
-			astexprs := make([]ast.Expression, 0)
-			for _, expr := range ii.OnExprList {
-				ex, err = ast.UnmarshalExpression([]byte(expr))
-				if err != nil {
-					log.Printf("unmarshal error: %v", err)
-					return false
-				}
-				astexprs = append(astexprs, ex)
+			// Evaluator of the index expressions, in its expression language
+			var ev evaluator.Evaluator
+			if ev, err = evaluator.New(ii.Exprtype, ii.OnExprList); err != nil {
+				logger.With("index", ii.Uuid).Errorf("expression error: %v", err)
+				return false
 			}
-			bmeta.indexExprs[ii.Uuid] = astexprs
-			bmap[ii.Bucket] = bmeta
+			bmeta.evaluators[ii.Uuid] = ev
+			bmap[feedname] = bmeta
 		}
-		log.Printf("Got %v indexes in %v buckets\n", len(indexinfos), len(bmap))
+		logger.Infof("Got %v indexes in %v feeds", len(indexinfos), len(bmap))
 		return true
 	})
 	p.buckets = bmap
 	return serverUuid, nil
 }
 
+func isZeroVector(vector api.SequenceVector) bool {
+	for _, seqno := range vector {
+		if seqno != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 func (p *projectorInfo) waitNotify(serverUuid string, quit chan interface{}) {
 	var err error
 	if _, serverUuid, err = p.imanager.Notify(serverUuid); err != nil {
-		log.Println("Index manager closed connection:", err)
+		logger.Warnf("Index manager closed connection: %v", err)
 	}
 	quit <- ImNotify{serverUuid}
-	log.Println("Projector exiting wait-notify")
+	logger.Debugf("Projector exiting wait-notify")
 }
 
 func (p *projectorInfo) close() {
@@ -110,7 +136,7 @@ func tryConnection(fn func() bool) {
 		if ok {
 			return
 		}
-		log.Printf("Retrying after %v seconds ...\n", retryInterval)
+		logger.Infof("Retrying after %v ...", retryInterval)
 		<-time.After(retryInterval)
 		if retryInterval *= 2; retryInterval > maximumRetryInterval {
 			retryInterval = maximumRetryInterval
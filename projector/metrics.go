@@ -0,0 +1,52 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Metrics exposed by the projector at /metrics.
+
+package main
+
+import (
+	"github.com/couchbaselabs/indexing/auth"
+	"github.com/couchbaselabs/indexing/logging"
+	"github.com/couchbaselabs/indexing/metrics"
+	"net/http"
+)
+
+var (
+	metricUprEvents = metrics.NewCounter("projector_upr_events_total",
+		"Events received from UPR feeds", "bucket", "type")
+	metricMutationsSent = metrics.NewCounter("projector_mutations_sent_total",
+		"Mutations sent to indexer", "index")
+	metricRPCDuration = metrics.NewHistogram("projector_rpc_duration_seconds",
+		"Latency of mutation RPC calls to indexer", nil, "method")
+	metricRPCErrors = metrics.NewCounter("projector_rpc_errors_total",
+		"Failed mutation RPC calls to indexer", "method")
+	metricRestarts = metrics.NewCounter("projector_restarts_total",
+		"Times the projector restarted its feeds", "reason")
+	metricPaused = metrics.NewCounter("projector_paused_seconds_total",
+		"Time spent waiting for a full indexer queue")
+)
+
+// serve /metrics for the projector, which has no other http endpoint.
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/admin/loglevel", security.Require(logging.Handler().ServeHTTP, auth.ROLE_ADMIN))
+	mux.HandleFunc("/config", security.Require(conf.Handler().ServeHTTP, auth.ROLE_ADMIN))
+	go func() {
+		l, err := security.Listen(addr)
+		if err == nil {
+			logger.Infof("Projector metrics listening on %v", addr)
+			err = http.Serve(l, mux)
+		}
+		if err != nil {
+			logger.Errorf("Error serving metrics: %v", err)
+		}
+	}()
+}
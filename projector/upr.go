@@ -13,28 +13,50 @@ import (
 	"fmt"
 	"github.com/couchbaselabs/indexing/api"
 	"github.com/prataprc/go-couchbase"
-	"log"
+	"math"
+	"strconv"
 	"time"
 )
 
 type UprBucketFeed struct {
-	bucket *couchbase.Bucket // [bucketname]*couchbase.Bucket
-	feed   *couchbase.UprFeed
+	bucket  *couchbase.Bucket // [bucketname]*couchbase.Bucket
+	feed    *couchbase.UprFeed
+	vbuuids api.VbuuidVector // branch of the mutations received, per vbucket
 }
 
 func NewUprStreams(b *couchbase.Bucket) *UprBucketFeed {
 	return &UprBucketFeed{bucket: b}
 }
 
-func (bfeed *UprBucketFeed) openFeed(sv api.SequenceVector) (err error) {
-	log.Println("Opening feed for bucket:", bfeed.bucket.Name)
+// rollbackFunc rolls the indexes of a feed back to `target`, and returns
+// the vector and branches to restart the feed from.
+type rollbackFunc func(target api.SequenceVector) (api.SequenceVector, api.VbuuidVector, error)
+
+func (bfeed *UprBucketFeed) openFeed(sv api.SequenceVector, vbuuids api.VbuuidVector,
+	rollback rollbackFunc) (err error) {
+
+	logger.With("bucket", bfeed.bucket.Name).Infof("Opening feed")
 	name := fmt.Sprintf("%v", time.Now().UnixNano())
 	//name := "index"
 	flogs, err := bfeed.bucket.GetFailoverLogs(name)
 	if err != nil {
 		return
 	}
-	uprstreams := makeUprStream(sv, flogs)
+	uprstreams := makeUprStream(sv, vbuuids, flogs)
+	if target := rollbackTarget(sv, uprstreams); target != nil {
+		logger.With("bucket", bfeed.bucket.Name).Warnf("Bucket rolled back, rolling indexes back")
+		if sv, vbuuids, err = rollback(target); err != nil {
+			return
+		}
+		uprstreams = makeUprStream(sv, vbuuids, flogs)
+	}
+	// Mutations streamed are on the newest branch of their vbucket.
+	bfeed.vbuuids = make(api.VbuuidVector, api.MAX_VBUCKETS)
+	for vbno, flog := range flogs {
+		if vbno < len(bfeed.vbuuids) && len(flog) > 0 {
+			bfeed.vbuuids[vbno] = flog[0][0]
+		}
+	}
 	bfeed.feed, err = couchbase.StartUprFeed(bfeed.bucket, name, uprstreams)
 	if err != nil {
 		return
@@ -43,17 +65,21 @@ func (bfeed *UprBucketFeed) openFeed(sv api.SequenceVector) (err error) {
 }
 
 func (bfeed *UprBucketFeed) closeFeed() {
-	log.Printf("Closing feed for %v ...\n", bfeed.bucket.Name)
+	logger.With("bucket", bfeed.bucket.Name).Infof("Closing feed ...")
 	bfeed.feed.Close()
 }
 
-func makeUprStream(seqVector api.SequenceVector,
+func makeUprStream(seqVector api.SequenceVector, vbuuids api.VbuuidVector,
 	flogs []couchbase.FailoverLog) map[uint16]*couchbase.UprStream {
 
 	uprstreams := make(map[uint16]*couchbase.UprStream)
 	for vbno, flog := range flogs {
 		vb := uint16(vbno)
-		vuuid, startSeq, highSeq := couchbase.CalculateVector(seqVector[vb], flog)
+		var vbuuid uint64
+		if vbno < len(vbuuids) {
+			vbuuid = vbuuids[vb]
+		}
+		vuuid, startSeq, highSeq := streamVector(seqVector[vb], vbuuid, flog)
 		uprstream := &couchbase.UprStream{
 			Vbucket:  vb,
 			Vuuid:    vuuid,
@@ -66,3 +92,70 @@ func makeUprStream(seqVector api.SequenceVector,
 	}
 	return uprstreams
 }
+
+// streamVector returns the vbucket UUID and seqnos to stream a vbucket
+// from `seqno` on history branch `vbuuid`. A branch that forked off the
+// vbucket's history resumes from where it forked, a branch missing from the
+// failover log from 0. Seqnos of an unknown branch are placed in the
+// failover log by seqno alone.
+func streamVector(seqno, vbuuid uint64, flog couchbase.FailoverLog) (uint64, uint64, uint64) {
+	if vbuuid == 0 {
+		return couchbase.CalculateVector(seqno, flog)
+	}
+	// Entries are newest first, a branch ends where the next one starts.
+	for i, entry := range flog {
+		if entry[0] != vbuuid {
+			continue
+		}
+		if i > 0 && seqno > flog[i-1][1] {
+			return vbuuid, flog[i-1][1], flog[i-1][1]
+		}
+		return vbuuid, seqno, seqno
+	}
+	return couchbase.CalculateVector(0, flog)
+}
+
+// rollbackTarget returns the seqnos the indexes must roll back to when
+// streams start before the vector, because vbuckets took another branch
+// of their failover log. Vbuckets that did not roll back are not bounded.
+// Returns nil if no vbucket rolled back.
+func rollbackTarget(seqVector api.SequenceVector,
+	uprstreams map[uint16]*couchbase.UprStream) api.SequenceVector {
+
+	var target api.SequenceVector
+	for vb, uprstream := range uprstreams {
+		if int(vb) >= len(seqVector) || uprstream.Startseq >= seqVector[vb] {
+			continue
+		}
+		if target == nil {
+			target = make(api.SequenceVector, len(seqVector))
+			for i := range target {
+				target[i] = math.MaxUint64
+			}
+		}
+		target[vb] = uprstream.Startseq
+	}
+	return target
+}
+
+// highSeqnos returns the high seqno of every vbucket, gathered from the
+// `vbucket-seqno` stats of all nodes of the bucket.
+func highSeqnos(bucket *couchbase.Bucket) api.SequenceVector {
+	vector := make(api.SequenceVector, api.MAX_VBUCKETS)
+	for _, stats := range bucket.GetStats("vbucket-seqno") {
+		for key, value := range stats {
+			var vb int
+			if _, err := fmt.Sscanf(key, "vb_%d:high_seqno", &vb); err != nil {
+				continue
+			}
+			seqno, err := strconv.ParseUint(value, 10, 64)
+			if err != nil || vb < 0 || vb >= api.MAX_VBUCKETS {
+				continue
+			}
+			if seqno > vector[vb] {
+				vector[vb] = seqno
+			}
+		}
+	}
+	return vector
+}
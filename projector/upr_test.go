@@ -0,0 +1,53 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"github.com/couchbaselabs/indexing/api"
+	"github.com/prataprc/go-couchbase"
+	"math"
+	"testing"
+)
+
+func TestStreamVector(t *testing.T) {
+	// branch 0xc forked from 0xb at seqno 100, which forked from 0xa at 50
+	flog := couchbase.FailoverLog{{0xc, 100}, {0xb, 50}, {0xa, 0}}
+	for _, tc := range []struct {
+		seqno, vbuuid, start uint64
+	}{
+		{120, 0xc, 120}, // newest branch
+		{80, 0xb, 80},   // before the fork, still in history
+		{130, 0xb, 100}, // past the fork, rolls back to it
+		{70, 0xa, 50},
+	} {
+		vuuid, start, _ := streamVector(tc.seqno, tc.vbuuid, flog)
+		if vuuid != tc.vbuuid || start != tc.start {
+			t.Errorf("Seqno %v on %x: expected start %v, got %x %v",
+				tc.seqno, tc.vbuuid, tc.start, vuuid, start)
+		}
+	}
+}
+
+func TestRollbackTarget(t *testing.T) {
+	sv := make(api.SequenceVector, api.MAX_VBUCKETS)
+	sv[1], sv[2] = 10, 20
+	uprstreams := map[uint16]*couchbase.UprStream{
+		1: {Vbucket: 1, Startseq: 10},
+		2: {Vbucket: 2, Startseq: 15},
+	}
+	target := rollbackTarget(sv, uprstreams)
+	if target == nil || target[2] != 15 || target[1] != math.MaxUint64 {
+		t.Fatalf("Expected rollback of vbucket 2 to 15, got %v", target)
+	}
+	uprstreams[2].Startseq = 20
+	if target = rollbackTarget(sv, uprstreams); target != nil {
+		t.Errorf("Expected no rollback, got %v", target[2])
+	}
+}
@@ -10,14 +10,14 @@
 package main
 
 import (
-	"github.com/couchbaselabs/dparval"
+	"errors"
 	"github.com/couchbaselabs/indexing/api"
-	ast "github.com/couchbaselabs/tuqtng/ast"
+	"github.com/couchbaselabs/indexing/evaluator"
+	"github.com/couchbaselabs/indexing/stream"
 	"github.com/prataprc/go-couchbase"
-	"log"
-	"net"
 	"net/rpc"
 	"net/rpc/jsonrpc"
+	"time"
 )
 
 type BucketWorkerCmd struct {
@@ -30,63 +30,209 @@ type BucketWorkerCmd struct {
 }
 
 type BucketWorker struct {
-	client     couchbase.Client            // couchbase client
-	pool       *couchbase.Pool             // pool where the bucket lives
-	bucketname string                      // bucket for which to open the feed
-	bmeta      *bucketMeta                 // bucket meta-data
-	mclients   map[string][]*indexerClient // rpc clients per index
+	client     couchbase.Client // couchbase client
+	pool       *couchbase.Pool  // pool where the bucket lives
+	bucketname string           // bucket for which to open the feed
+	bmeta      *bucketMeta      // bucket meta-data
+	rpcurl     string           // indexer's mutation server
+	mclients   []*indexerClient // connections carrying all indexes of the bucket
 }
 
+// indexerClient is a connection to the indexer's mutation server, speaking
+// either the binary stream protocol or, with older indexers, JSON-RPC.
 type indexerClient struct {
+	stream *stream.Client
 	client *rpc.Client
-	mch    chan *api.Mutation
+	mch    chan *stream.Mutation
 }
 
-func NewBucketWorker(bwc BucketWorkerCmd) *BucketWorker {
-	var rpcconn net.Conn
-	var err error
+// mutations sent to the indexer in one batch, at most.
+const MAX_STREAM_BATCH = 500
 
-	mclients := make(map[string][]*indexerClient)
-	for uuid, _ := range bwc.bmeta.indexMap {
-		iclients := make([]*indexerClient, 0, bwc.nconn)
-		for i := 0; i < bwc.nconn; i++ {
-			if rpcconn, err = net.Dial("tcp", bwc.rpcurl); err != nil {
-				log.Printf(
-					"error connecting with mutation server %v: %v\n", bwc.rpcurl, err)
-				return nil
-			}
-			s := &indexerClient{
-				client: jsonrpc.NewClient(rpcconn),
-				mch:    make(chan *api.Mutation, 1000),
-			}
-			iclients = append(iclients, s)
+// Backoff while the indexer's queue is full. Meanwhile mutations are
+// buffered in mch, and once it is full the UPR feed is no longer read.
+const (
+	MIN_BACKOFF = 10 * time.Millisecond
+	MAX_BACKOFF = 1 * time.Second
+)
+
+// errKilled is returned by send when the worker is killed while backing off.
+var errKilled = errors.New("killed")
+
+func NewBucketWorker(bwc BucketWorkerCmd) *BucketWorker {
+	mclients := make([]*indexerClient, 0, bwc.nconn)
+	for i := 0; i < bwc.nconn; i++ {
+		s, err := dialIndexer(bwc.rpcurl)
+		if err != nil {
+			logger.Errorf(
+				"error connecting with mutation server %v: %v", bwc.rpcurl, err)
+			return nil
 		}
-		mclients[uuid] = iclients
+		mclients = append(mclients, s)
 	}
 	return &BucketWorker{
 		client:     bwc.client,
 		pool:       bwc.pool,
 		bucketname: bwc.bucketname,
 		bmeta:      bwc.bmeta,
+		rpcurl:     bwc.rpcurl,
 		mclients:   mclients,
 	}
 }
 
-func push2Indexer(s *indexerClient, quit chan interface{}, kill chan bool) {
+// dialIndexer connects to the mutation server, negotiating the stream
+// protocol unless configured for JSON-RPC. Indexers that do not know the
+// stream protocol are spoken to with JSON-RPC.
+func dialIndexer(url string) (*indexerClient, error) {
+	s := &indexerClient{mch: make(chan *stream.Mutation, 1000)}
+	conn, err := security.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	if options.mproto == "binary" {
+		if s.stream, err = stream.Hello(conn); err == nil {
+			return s, nil
+		}
+		logger.Warnf("indexer %v refused the stream protocol (%v), using JSON-RPC", url, err)
+		if conn, err = security.Dial(url); err != nil {
+			return nil, err
+		}
+	}
+	s.client = jsonrpc.NewClient(conn)
+	return s, nil
+}
+
+// send sends mutations, in the order they were received, batched per
+// vbucket.
+func (s *indexerClient) send(muts []*stream.Mutation, kill chan bool) error {
+	if s.stream == nil {
+		return s.call(muts)
+	}
+	vbuckets := make([]uint16, 0)
+	batches := make(map[uint16][]stream.Mutation)
+	for _, m := range muts {
+		if _, ok := batches[m.Vbucket]; !ok {
+			vbuckets = append(vbuckets, m.Vbucket)
+		}
+		batches[m.Vbucket] = append(batches[m.Vbucket], *m)
+	}
+	for _, vbucket := range vbuckets {
+		if err := s.sendBatch(vbucket, batches[vbucket], kill); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendBatch sends mutations of a vbucket in batches that fit the indexer's
+// credits, backing off while the indexer's queue is full.
+func (s *indexerClient) sendBatch(vbucket uint16, muts []stream.Mutation, kill chan bool) error {
+	var paused time.Time
+
+	backoff := MIN_BACKOFF
+	for len(muts) > 0 {
+		// Credits count index entries. Without credits a single mutation
+		// probes the indexer.
+		n := stream.Fit(muts, s.stream.Credits())
+		if n < 1 {
+			n = 1
+		}
+		start := time.Now()
+		_, err := s.stream.Send(vbucket, muts[:n])
+		metricRPCDuration.Observe(time.Since(start).Seconds(), STREAM_BATCH)
+		if api.CodeOf(err) == api.ERR_QUEUE_FULL {
+			if paused.IsZero() {
+				paused = time.Now()
+				logger.Warnf("indexer queue is full, pausing mutations")
+			}
+			select {
+			case <-time.After(backoff):
+			case <-kill:
+				return errKilled
+			}
+			if backoff *= 2; backoff > MAX_BACKOFF {
+				backoff = MAX_BACKOFF
+			}
+			continue
+		} else if err != nil {
+			metricRPCErrors.Inc(STREAM_BATCH)
+			return err
+		}
+		if !paused.IsZero() {
+			metricPaused.Add(time.Since(paused).Seconds())
+			logger.Infof("indexer accepts mutations again after %v", time.Since(paused))
+			paused = time.Time{}
+		}
+		backoff = MIN_BACKOFF
+		for _, m := range muts[:n] {
+			for _, e := range m.Entries {
+				metricMutationsSent.Inc(e.Indexid)
+			}
+		}
+		muts = muts[n:]
+	}
+	return nil
+}
+
+// call sends mutations with one JSON-RPC call per index and mutation.
+func (s *indexerClient) call(muts []*stream.Mutation) error {
 	var r bool
+
+	for _, m := range muts {
+		for _, im := range m.Split() {
+			start := time.Now()
+			err := s.client.Call(PROCESS_1MUTATION, *im, &r)
+			metricRPCDuration.Observe(time.Since(start).Seconds(), PROCESS_1MUTATION)
+			if err != nil {
+				metricRPCErrors.Inc(PROCESS_1MUTATION)
+				return err
+			}
+			metricMutationsSent.Inc(im.Indexid)
+		}
+	}
+	return nil
+}
+
+func (s *indexerClient) close() {
+	if s.stream != nil {
+		s.stream.Close()
+	} else {
+		s.client.Close()
+	}
+}
+
+func push2Indexer(s *indexerClient, quit chan interface{}, kill chan bool) {
 	var err error
 
+	defer s.close()
 loop:
 	for {
 		select {
 		case m, ok := <-s.mch:
-			if ok {
-				err = s.client.Call(PROCESS_1MUTATION, *m, &r)
+			if !ok {
+				break loop
+			}
+			// Batch whatever else is already waiting.
+			muts := []*stream.Mutation{m}
+		batch:
+			for len(muts) < MAX_STREAM_BATCH {
+				select {
+				case m, ok = <-s.mch:
+					if !ok {
+						break batch
+					}
+					muts = append(muts, m)
+				default:
+					break batch
+				}
 			}
+			err = s.send(muts, kill)
 		case <-kill:
 			break loop
 		}
-		if err != nil {
+		if err == errKilled {
+			break
+		} else if err != nil {
 			quit <- ExitRoutine{kill, err}
 			break
 		}
@@ -107,14 +253,14 @@ func (bw *BucketWorker) run(quit chan interface{}, kill chan bool) {
 	tryConnection(func() bool {
 		// Refresh the pool to get any new buckets created on the server.
 		if pool, err = bw.client.GetPool("default"); err != nil {
-			log.Println("Error getting pool", err)
+			logger.Errorf("Error getting pool %v", err)
 			finish()
 			return false
 		}
 		bw.pool = &pool
 		// Get bucket instance
 		if bucket, err = bw.pool.GetBucket(bw.bucketname); err != nil {
-			log.Printf("Unable to get bucket %v\n", bw.bucketname)
+			logger.With("bucket", bw.bucketname).Errorf("Unable to get bucket")
 			finish()
 			return false
 		}
@@ -123,11 +269,14 @@ func (bw *BucketWorker) run(quit chan interface{}, kill chan bool) {
 
 	// Open feed
 	bfeed := NewUprStreams(bucket)
-	if err := bfeed.openFeed(bw.bmeta.vector); err != nil {
-		log.Printf("Unable to open feed for bucket %v: %v\n", bw.bucketname, err)
+	if err := bfeed.openFeed(bw.bmeta.vector, bw.bmeta.vbuuids, bw.rollback); err != nil {
+		logger.With("bucket", bw.bucketname).Errorf("Unable to open feed: %v", err)
 		finish()
 		return
 	}
+	if err := bw.sendBuildTargets(bucket); err != nil {
+		logger.With("bucket", bw.bucketname).Errorf("Unable to send build targets: %v", err)
+	}
 
 	count := 0
 loop:
@@ -138,53 +287,129 @@ loop:
 				quit <- ExitRoutine{kill, nil}
 				break loop
 			}
-			for uuid, astexprs := range bw.bmeta.indexExprs {
+			metricUprEvents.Inc(bw.bucketname, e.Opstr)
+			m := &stream.Mutation{
+				Type:    api.UprEventName(e.Opstr),
+				Docid:   string(e.Key),
+				Vbucket: e.Vbucket,
+				Seqno:   e.Seqno,
+				Vbuuid:  bfeed.vbuuids[e.Vbucket],
+				Entries: make([]stream.Entry, 0, len(bw.bmeta.evaluators)),
+			}
+			for uuid, ev := range bw.bmeta.evaluators {
 				ii := bw.bmeta.indexMap[uuid]
-				m := api.Mutation{
-					Type:    api.UprEventName(e.Opstr),
-					Indexid: uuid,
-					Docid:   string(e.Key),
-					Vbucket: e.Vbucket,
-					Seqno:   e.Seqno,
-				}
+				entry := stream.Entry{Indexid: uuid}
 				if ii.IsPrimary && m.Type == api.INSERT {
-					m.SecondaryKey = [][]byte{e.Key}
+					entry.SecondaryKey = [][]byte{e.Key}
 				} else if m.Type == api.INSERT {
-					m.SecondaryKey = evaluate(e.Value, astexprs)
+					entry.SecondaryKey = evaluate(e.Value, ev)
 				}
-				//log.Println(e.Opstr, e.Seqno, uuid[:8], bw.bucketname, m.Docid, fmtSKey(m.SecondaryKey))
-				x := int(e.Vbucket) % len(bw.mclients[uuid])
-				//x := count % len(bw.mclients[uuid])
-				bw.mclients[uuid][x].mch <- &m
-				count++
-				//if count%10000 == 0 {
-				//    log.Println("Count:", count)
-				//}
+				//log.Println(e.Opstr, e.Seqno, uuid[:8], bw.bucketname, m.Docid, fmtSKey(entry.SecondaryKey))
+				m.Entries = append(m.Entries, entry)
 			}
+			// Mutations of a vbucket always take the same connection, in order.
+			x := int(e.Vbucket) % len(bw.mclients)
+			bw.mclients[x].mch <- m
+			count++
+			//if count%10000 == 0 {
+			//    log.Println("Count:", count)
+			//}
 		case <-kill:
 			break loop
 		}
 	}
 	bfeed.closeFeed()
 	// Close all connections with indexer.
-	for _, sl := range bw.mclients {
-		for _, s := range sl {
-			close(s.mch)
-		}
+	for _, s := range bw.mclients {
+		close(s.mch)
 	}
 }
 
-func evaluate(value []byte, astexprs []ast.Expression) [][]byte {
-	secKey := make([][]byte, 0)
-	for _, expr := range astexprs {
-		key, err := expr.Evaluate(dparval.NewValueFromBytes([]byte(value)))
-		if err != nil {
-			log.Println(err)
-			secKey = append(secKey, []byte{})
-		} else {
-			secKey = append(secKey, key.Bytes())
+// sendBuildTargets sends the bucket's high seqnos to the indexer. Indexes
+// still building become ready once they catch up with them, indexes that
+// are ready ignore them.
+func (bw *BucketWorker) sendBuildTargets(bucket *couchbase.Bucket) error {
+	var r bool
+
+	targets := make(api.IndexSequenceMap)
+	vector := highSeqnos(bucket)
+	for uuid := range bw.bmeta.indexMap {
+		targets[uuid] = vector
+	}
+	// All indexes live on the same indexer.
+	start := time.Now()
+	err := callIndexer(bw.rpcurl, SET_BUILDTARGETS, targets, &r)
+	metricRPCDuration.Observe(time.Since(start).Seconds(), SET_BUILDTARGETS)
+	if err != nil {
+		metricRPCErrors.Inc(SET_BUILDTARGETS)
+	}
+	return err
+}
+
+// rollback asks the indexer to roll the feed's indexes back to `target`
+// and returns the lowest seqnos they restarted from and their branches,
+// which become the feed's vector.
+func (bw *BucketWorker) rollback(target api.SequenceVector) (
+	api.SequenceVector, api.VbuuidVector, error) {
+
+	req := api.RollbackRequest{
+		Indexes: make(api.IndexList, 0, len(bw.bmeta.indexMap)),
+		Target:  target,
+	}
+	for uuid := range bw.bmeta.indexMap {
+		req.Indexes = append(req.Indexes, uuid)
+	}
+	var reply api.IndexVectors
+	start := time.Now()
+	err := callIndexer(bw.rpcurl, ROLLBACK, req, &reply)
+	metricRPCDuration.Observe(time.Since(start).Seconds(), ROLLBACK)
+	if err != nil {
+		metricRPCErrors.Inc(ROLLBACK)
+		return nil, nil, err
+	}
+
+	vector := make(api.SequenceVector, api.MAX_VBUCKETS)
+	vbuuids := make(api.VbuuidVector, api.MAX_VBUCKETS)
+	copy(vector, bw.bmeta.vector)
+	copy(vbuuids, bw.bmeta.vbuuids)
+	for vb, seqno := range target {
+		if vb < len(vector) && seqno < vector[vb] {
+			vector[vb], vbuuids[vb] = seqno, 0
 		}
 	}
+	for uuid, restored := range reply.Seqnos {
+		branches := reply.Vbuuids[uuid]
+		for vb, seqno := range restored {
+			if vb < len(vector) && seqno < vector[vb] {
+				vector[vb] = seqno
+				vbuuids[vb] = 0
+				if vb < len(branches) {
+					vbuuids[vb] = branches[vb]
+				}
+			}
+		}
+	}
+	bw.bmeta.vector, bw.bmeta.vbuuids = vector, vbuuids
+	return vector, vbuuids, nil
+}
+
+// callIndexer makes a JSON-RPC call to the mutation server on a connection
+// of its own.
+func callIndexer(url, method string, args interface{}, reply interface{}) error {
+	conn, err := security.Dial(url)
+	if err != nil {
+		return err
+	}
+	c := jsonrpc.NewClient(conn)
+	defer c.Close()
+	return c.Call(method, args, reply)
+}
+
+func evaluate(value []byte, ev evaluator.Evaluator) [][]byte {
+	secKey, err := ev.Evaluate(value)
+	if err != nil {
+		logger.Debugf("Error evaluating expression %v", err)
+	}
 	return secKey
 }
 
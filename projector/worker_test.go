@@ -10,7 +10,8 @@
 package main
 
 import (
-	ast "github.com/couchbaselabs/tuqtng/ast"
+	"github.com/couchbaselabs/indexing/api"
+	"github.com/couchbaselabs/indexing/evaluator"
 	"testing"
 )
 
@@ -18,11 +19,22 @@ var doc = []byte(`{"name":"Fireman's Pail Ale","abv":0.0,"ibu":0.0,"srm":0.0,"up
 
 func BenchmarkEvaluate(b *testing.B) {
 	expr := `{"type":"property","path":"name"}`
-	ex, err := ast.UnmarshalExpression([]byte(expr))
+	ev, err := evaluator.New(api.N1QL, []string{expr})
 	if err != nil {
 		b.Fatal(err)
 	}
 	for i := 0; i < b.N; i++ {
-		evaluate(doc, []ast.Expression{ex})
+		evaluate(doc, ev)
+	}
+}
+
+func BenchmarkEvaluateJavaScript(b *testing.B) {
+	expr := `function(doc) { return doc.name }`
+	ev, err := evaluator.New(api.JavaScript, []string{expr})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		evaluate(doc, ev)
 	}
 }
@@ -0,0 +1,213 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Helpers for the v2 REST API served by index manager and indexer. Routes
+// are matched on method and path, path segments in braces are parameters,
+//
+//   router := rest.NewRouter("/v2")
+//   router.Handle("GET", "/indexes/{name}", handleGetIndex)
+//   http.Handle("/v2/", router)
+//
+// Request bodies are JSON, failures are sent with a HTTP status code mapped
+// from the error and the same error body as v1 responses.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/couchbaselabs/indexing/api"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const MAX_REQUEST_SIZE = 16 * 1024 * 1024 //bytes
+
+// Error carries the HTTP status code to reply with, for failures that are
+// specific to HTTP. Other errors are mapped from their api.ErrorCode.
+type Error struct {
+	Status int
+	Code   api.ErrorCode
+	Msg    string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func (e *Error) ErrorCode() api.ErrorCode {
+	return e.Code
+}
+
+func NewError(status int, code api.ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Status: status, Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+func BadRequest(format string, args ...interface{}) *Error {
+	return NewError(http.StatusBadRequest, api.ERR_BAD_REQUEST, format, args...)
+}
+
+func NotFound(format string, args ...interface{}) *Error {
+	return NewError(http.StatusNotFound, api.ERR_BAD_REQUEST, format, args...)
+}
+
+// StatusOf maps an error to a HTTP status code.
+func StatusOf(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	if e, ok := err.(*Error); ok {
+		return e.Status
+	}
+	switch api.CodeOf(err) {
+	case api.ERR_INDEX_NOT_FOUND:
+		return http.StatusNotFound
+	case api.ERR_DUPLICATE_INDEX:
+		return http.StatusConflict
+	case api.ERR_BAD_REQUEST, api.ERR_SCAN_NOT_SUPPORTED:
+		return http.StatusBadRequest
+	case api.ERR_NOT_READY, api.ERR_QUEUE_FULL:
+		return http.StatusServiceUnavailable
+	case api.ERR_TIMEOUT:
+		return http.StatusGatewayTimeout
+	case api.ERR_UNAUTHENTICATED:
+		return http.StatusUnauthorized
+	case api.ERR_FORBIDDEN:
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// Decode reads the whole request body and unmarshals it into `v`. An empty
+// body leaves `v` unchanged.
+func Decode(r *http.Request, v interface{}) error {
+	if r.Body == nil {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MAX_REQUEST_SIZE+1))
+	if err != nil {
+		return BadRequest("Error reading request: %v", err)
+	}
+	if len(body) > MAX_REQUEST_SIZE {
+		return NewError(http.StatusRequestEntityTooLarge, api.ERR_BAD_REQUEST,
+			"Request larger than %v bytes", MAX_REQUEST_SIZE)
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	if err = json.Unmarshal(body, v); err != nil {
+		return BadRequest("Invalid request: %v", err)
+	}
+	return nil
+}
+
+// Send writes `v` as JSON with HTTP status `status`.
+func Send(w http.ResponseWriter, status int, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		buf, _ = json.Marshal(errorResponse(err))
+	}
+	w.Header()["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(status)
+	w.Write(buf)
+}
+
+// SendError writes the error body of v1 responses with a status mapped from
+// `err`.
+func SendError(w http.ResponseWriter, err error) {
+	Send(w, StatusOf(err), errorResponse(err))
+}
+
+func errorResponse(err error) api.IndexMetaResponse {
+	return api.IndexMetaResponse{
+		Status: api.ERROR,
+		Errors: []api.IndexError{api.IndexErrorOf(err)},
+	}
+}
+
+// HandlerFunc handles a matched route, `params` holds path parameters.
+type HandlerFunc func(w http.ResponseWriter, r *http.Request, params map[string]string)
+
+type route struct {
+	method   string
+	segments []string
+	handler  HandlerFunc
+}
+
+type Router struct {
+	prefix string
+	routes []route
+}
+
+func NewRouter(prefix string) *Router {
+	return &Router{prefix: strings.TrimRight(prefix, "/")}
+}
+
+// Handle adds a route, `pattern` is relative to the router prefix.
+func (router *Router) Handle(method, pattern string, handler HandlerFunc) {
+	router.routes = append(router.routes, route{
+		method:   method,
+		segments: split(pattern),
+		handler:  handler,
+	})
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, router.prefix+"/") {
+		SendError(w, NotFound("No route for %v", r.URL.Path))
+		return
+	}
+	segments := split(strings.TrimPrefix(r.URL.Path, router.prefix))
+
+	allowed := make([]string, 0)
+	for _, rt := range router.routes {
+		params, ok := rt.match(segments)
+		if !ok {
+			continue
+		}
+		if rt.method == r.Method {
+			rt.handler(w, r, params)
+			return
+		}
+		allowed = append(allowed, rt.method)
+	}
+	if len(allowed) > 0 {
+		w.Header()["Allow"] = []string{strings.Join(allowed, ", ")}
+		SendError(w, NewError(http.StatusMethodNotAllowed, api.ERR_BAD_REQUEST,
+			"Method %v not allowed on %v", r.Method, r.URL.Path))
+		return
+	}
+	SendError(w, NotFound("No route for %v", r.URL.Path))
+}
+
+func (rt *route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(rt.segments) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, s := range rt.segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			params[s[1:len(s)-1]] = segments[i]
+		} else if s != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func split(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
@@ -0,0 +1,103 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/couchbaselabs/indexing/api"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func serve(router *Router, method, url, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestRouter(t *testing.T) {
+	var got map[string]string
+	handler := func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		got = params
+		Send(w, http.StatusOK, params)
+	}
+	router := NewRouter("/v2")
+	router.Handle("GET", "/indexes/{name}", handler)
+	router.Handle("DELETE", "/indexes/{name}", handler)
+	router.Handle("POST", "/indexes/{id}/scan", handler)
+
+	if w := serve(router, "GET", "/v2/indexes/age", ""); w.Code != http.StatusOK {
+		t.Errorf("Unexpected status %v", w.Code)
+	} else if got["name"] != "age" {
+		t.Errorf("Unexpected params %v", got)
+	}
+	if w := serve(router, "POST", "/v2/indexes/1234/scan", ""); w.Code != http.StatusOK {
+		t.Errorf("Unexpected status %v", w.Code)
+	} else if got["id"] != "1234" {
+		t.Errorf("Unexpected params %v", got)
+	}
+	w := serve(router, "PUT", "/v2/indexes/age/scan", "")
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %v", w.Code)
+	}
+	if w := serve(router, "PUT", "/v2/indexes/age", ""); w.Header().Get("Allow") != "GET, DELETE" {
+		t.Errorf("Unexpected Allow header %v", w.Header().Get("Allow"))
+	}
+	if w := serve(router, "GET", "/v2/nosuch", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %v", w.Code)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	var q api.QueryParams
+
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(`{"scanType":"count","limit":10}`))
+	if err := Decode(req, &q); err != nil {
+		t.Fatal(err)
+	} else if q.ScanType != api.COUNT || q.Limit != 10 {
+		t.Errorf("Unexpected decode %v", q)
+	}
+
+	req, _ = http.NewRequest("POST", "/", strings.NewReader(`{"scanType":`))
+	if err := Decode(req, &q); StatusOf(err) != http.StatusBadRequest {
+		t.Errorf("Expected bad request, got %v", err)
+	}
+
+	big := bytes.Repeat([]byte{' '}, MAX_REQUEST_SIZE+1)
+	req, _ = http.NewRequest("POST", "/", bytes.NewReader(big))
+	if err := Decode(req, &q); StatusOf(err) != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected entity too large, got %v", err)
+	}
+}
+
+func TestSendError(t *testing.T) {
+	w := httptest.NewRecorder()
+	SendError(w, api.NoSuchIndex)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %v", w.Code)
+	}
+	var res api.IndexMetaResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != api.ERROR || res.Errors[0].Err() != api.NoSuchIndex {
+		t.Errorf("Unexpected error body %v", res)
+	}
+	if StatusOf(api.DuplicateIndex) != http.StatusConflict {
+		t.Error("Expected conflict")
+	}
+	if StatusOf(api.NewError(api.ERR_NOT_READY, "x")) != http.StatusServiceUnavailable {
+		t.Error("Expected service unavailable")
+	}
+}
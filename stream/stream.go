@@ -0,0 +1,476 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Binary streaming protocol for mutations from projector to indexer. It
+// shares the mutation RPC port with JSON-RPC, a connection speaks the
+// stream protocol if its first byte is FRAME_HELLO, JSON-RPC otherwise.
+//
+// Every message is a frame, integers are big endian,
+//
+//   frame    := type:uint8 length:uint32 payload
+//   HELLO    := "IDXS" version:uint16              client, first frame
+//   WELCOME  := version:uint16 credits:uint32      server, agreed version
+//   BATCH    := id:uint64 vbucket:uint16 count:uint32 mutation*
+//   mutation := type:string docid:string seqno:uint64 vbuuid:uint64 count:uint16 entry*
+//   entry    := indexid:string count:uint16 key:bytes*
+//   ACK      := id:uint64 vbucket:uint16 seqno:uint64 credits:uint32
+//   NACK     := id:uint64 code:string msg:string credits:uint32
+//   string   := bytes := length:uint32 data
+//
+// A batch holds mutations of a single vbucket in seqno order, a mutation
+// carries one entry per index of the bucket, with the secondary key of the
+// document for that index. The server replies to every batch with an ACK
+// carrying the highest seqno of the batch once it is queued, or with a
+// NACK. A server that does not know the stream protocol, or the client's
+// version of it, closes the connection on HELLO, clients then fall back to
+// JSON-RPC.
+//
+// Flow control is credit based. WELCOME, ACK and NACK carry the number of
+// index entries the server can take without blocking, a mutation takes a
+// credit per entry, and clients send batches of mutations whose entries fit
+// in that many credits. A batch that does not fit is rejected with
+// ERR_QUEUE_FULL, clients then back off and send it again.
+
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/couchbaselabs/indexing/api"
+	"io"
+	"net"
+	"time"
+)
+
+const VERSION = 2 //2 adds the vbuuid of mutations
+
+const (
+	FRAME_HELLO   byte = 0x01
+	FRAME_WELCOME byte = 0x02
+	FRAME_BATCH   byte = 0x03
+	FRAME_ACK     byte = 0x04
+	FRAME_NACK    byte = 0x05
+)
+
+const MAGIC = "IDXS"
+const MAX_FRAME_SIZE = 64 * 1024 * 1024 //bytes
+const HELLO_TIMEOUT = 10 * time.Second
+
+var ErrProtocol = errors.New("Stream protocol error")
+
+// Entry is the part of a mutation for one index.
+type Entry struct {
+	Indexid      string
+	SecondaryKey [][]byte
+}
+
+type Mutation struct {
+	Type    api.UprEventName
+	Docid   string
+	Vbucket uint16
+	Seqno   uint64
+	Vbuuid  uint64
+	Entries []Entry
+}
+
+// Split returns a mutation per index, as processed by the indexer.
+func (m *Mutation) Split() []*api.Mutation {
+	muts := make([]*api.Mutation, 0, len(m.Entries))
+	for _, e := range m.Entries {
+		muts = append(muts, &api.Mutation{
+			Type:         m.Type,
+			Indexid:      e.Indexid,
+			SecondaryKey: e.SecondaryKey,
+			Docid:        m.Docid,
+			Vbucket:      m.Vbucket,
+			Seqno:        m.Seqno,
+			Vbuuid:       m.Vbuuid,
+		})
+	}
+	return muts
+}
+
+// Fit returns how many of the leading `muts` fit in `credits`.
+func Fit(muts []Mutation, credits int) int {
+	for n, m := range muts {
+		if credits -= len(m.Entries); credits < 0 {
+			return n
+		}
+	}
+	return len(muts)
+}
+
+type Batch struct {
+	Id        uint64
+	Vbucket   uint16
+	Mutations []Mutation
+}
+
+// HighSeqno is the seqno acknowledged for the batch.
+func (b *Batch) HighSeqno() uint64 {
+	var seqno uint64
+	for _, m := range b.Mutations {
+		if m.Seqno > seqno {
+			seqno = m.Seqno
+		}
+	}
+	return seqno
+}
+
+//---- frames
+
+func WriteFrame(w io.Writer, typ byte, payload []byte) error {
+	var hdr [5]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(payload)))
+	if _, err := w.Write(append(hdr[:], payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func ReadFrame(r io.Reader) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(hdr[1:])
+	if length > MAX_FRAME_SIZE {
+		return 0, nil, fmt.Errorf("%v: frame of %v bytes", ErrProtocol, length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], payload, nil
+}
+
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) uint16(v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	e.Write(b[:])
+}
+
+func (e *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.Write(b[:])
+}
+
+func (e *encoder) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.Write(b[:])
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.uint32(uint32(len(v)))
+	e.Write(v)
+}
+
+// decoder remembers the first error, values read after it are zero.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.buf) < n {
+		d.err = fmt.Errorf("%v: truncated frame", ErrProtocol)
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	if b := d.next(int(n)); b != nil {
+		v := make([]byte, n)
+		copy(v, b)
+		return v
+	}
+	return nil
+}
+
+func (b *Batch) MarshalBinary() ([]byte, error) {
+	var e encoder
+	e.uint64(b.Id)
+	e.uint16(b.Vbucket)
+	e.uint32(uint32(len(b.Mutations)))
+	for _, m := range b.Mutations {
+		if m.Vbucket != b.Vbucket {
+			return nil, fmt.Errorf("Mutation of vbucket %v in batch of vbucket %v",
+				m.Vbucket, b.Vbucket)
+		}
+		e.bytes([]byte(m.Type))
+		e.bytes([]byte(m.Docid))
+		e.uint64(m.Seqno)
+		e.uint64(m.Vbuuid)
+		e.uint16(uint16(len(m.Entries)))
+		for _, entry := range m.Entries {
+			e.bytes([]byte(entry.Indexid))
+			e.uint16(uint16(len(entry.SecondaryKey)))
+			for _, key := range entry.SecondaryKey {
+				e.bytes(key)
+			}
+		}
+	}
+	return e.Bytes(), nil
+}
+
+func (b *Batch) UnmarshalBinary(data []byte) error {
+	d := &decoder{buf: data}
+	b.Id = d.uint64()
+	b.Vbucket = d.uint16()
+	count := d.uint32()
+	b.Mutations = make([]Mutation, 0)
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		m := Mutation{
+			Type:    api.UprEventName(d.bytes()),
+			Docid:   string(d.bytes()),
+			Vbucket: b.Vbucket,
+			Seqno:   d.uint64(),
+			Vbuuid:  d.uint64(),
+		}
+		nentries := d.uint16()
+		m.Entries = make([]Entry, 0, nentries)
+		for j := uint16(0); j < nentries && d.err == nil; j++ {
+			entry := Entry{Indexid: string(d.bytes())}
+			nkeys := d.uint16()
+			if nkeys > 0 {
+				entry.SecondaryKey = make([][]byte, 0, nkeys)
+			}
+			for k := uint16(0); k < nkeys && d.err == nil; k++ {
+				entry.SecondaryKey = append(entry.SecondaryKey, d.bytes())
+			}
+			m.Entries = append(m.Entries, entry)
+		}
+		b.Mutations = append(b.Mutations, m)
+	}
+	if d.err == nil && len(d.buf) > 0 {
+		d.err = fmt.Errorf("%v: %v trailing bytes in batch", ErrProtocol, len(d.buf))
+	}
+	return d.err
+}
+
+//---- client
+
+// Client sends batches and waits for their acknowledgement.
+type Client struct {
+	conn    net.Conn
+	w       *bufio.Writer
+	nextId  uint64
+	credits int
+}
+
+// Hello negotiates the stream protocol on a new connection. On error the
+// connection is closed and the caller falls back to JSON-RPC.
+func Hello(conn net.Conn) (*Client, error) {
+	var e encoder
+	e.WriteString(MAGIC)
+	e.uint16(VERSION)
+
+	conn.SetDeadline(time.Now().Add(HELLO_TIMEOUT))
+	err := WriteFrame(conn, FRAME_HELLO, e.Bytes())
+	var typ byte
+	var payload []byte
+	if err == nil {
+		typ, payload, err = ReadFrame(conn)
+	}
+	if err == nil && (typ != FRAME_WELCOME || len(payload) != 6) {
+		err = fmt.Errorf("%v: expected welcome", ErrProtocol)
+	}
+	var credits int
+	if err == nil {
+		d := &decoder{buf: payload}
+		if v := d.uint16(); v != VERSION {
+			err = fmt.Errorf("%v: unsupported version %v", ErrProtocol, v)
+		}
+		credits = int(d.uint32())
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &Client{conn: conn, w: bufio.NewWriter(conn), credits: credits}, nil
+}
+
+// Credits returns the number of index entries the server can take, as of
+// its last reply.
+func (c *Client) Credits() int {
+	return c.credits
+}
+
+// Send sends the mutations of a vbucket as one batch, returns the seqno
+// acknowledged by the server. Batches that do not Fit() in Credits() are
+// likely to be rejected with ERR_QUEUE_FULL.
+func (c *Client) Send(vbucket uint16, muts []Mutation) (uint64, error) {
+	c.nextId++
+	batch := &Batch{Id: c.nextId, Vbucket: vbucket, Mutations: muts}
+	payload, err := batch.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	if err = WriteFrame(c.w, FRAME_BATCH, payload); err != nil {
+		return 0, err
+	}
+	if err = c.w.Flush(); err != nil {
+		return 0, err
+	}
+
+	typ, payload, err := ReadFrame(c.conn)
+	if err != nil {
+		return 0, err
+	}
+	d := &decoder{buf: payload}
+	id := d.uint64()
+	switch typ {
+	case FRAME_ACK:
+		d.uint16()
+		seqno := d.uint64()
+		c.credits = int(d.uint32())
+		if d.err == nil && id != batch.Id {
+			d.err = fmt.Errorf("%v: ack for batch %v, expected %v", ErrProtocol, id, batch.Id)
+		}
+		return seqno, d.err
+	case FRAME_NACK:
+		indexerr := api.IndexError{Code: string(d.bytes()), Msg: string(d.bytes())}
+		c.credits = int(d.uint32())
+		if d.err != nil {
+			return 0, d.err
+		}
+		return 0, indexerr.Err()
+	}
+	return 0, fmt.Errorf("%v: unexpected frame %v", ErrProtocol, typ)
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+//---- server
+
+// IsHello tells whether a connection starting with `b` speaks the stream
+// protocol.
+func IsHello(b byte) bool {
+	return b == FRAME_HELLO
+}
+
+// ServerConn is the server side of a stream connection.
+type ServerConn struct {
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// Accept reads the client's HELLO and replies with the agreed version and
+// the client's initial credits.
+func Accept(r *bufio.Reader, w io.Writer, credits int) (*ServerConn, error) {
+	typ, payload, err := ReadFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	d := &decoder{buf: payload}
+	magic := string(d.next(len(MAGIC)))
+	version := d.uint16()
+	if typ != FRAME_HELLO || d.err != nil || magic != MAGIC {
+		return nil, fmt.Errorf("%v: invalid hello", ErrProtocol)
+	}
+	if version < VERSION {
+		return nil, fmt.Errorf("%v: unsupported version %v", ErrProtocol, version)
+	}
+	if version > VERSION {
+		version = VERSION
+	}
+	var e encoder
+	e.uint16(version)
+	e.uint32(uint32(credits))
+	if err = WriteFrame(w, FRAME_WELCOME, e.Bytes()); err != nil {
+		return nil, err
+	}
+	return &ServerConn{r: r, w: bufio.NewWriter(w)}, nil
+}
+
+// Next reads the next batch.
+func (s *ServerConn) Next() (*Batch, error) {
+	typ, payload, err := ReadFrame(s.r)
+	if err != nil {
+		return nil, err
+	}
+	if typ != FRAME_BATCH {
+		return nil, fmt.Errorf("%v: unexpected frame %v", ErrProtocol, typ)
+	}
+	batch := new(Batch)
+	if err = batch.UnmarshalBinary(payload); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// Ack acknowledges a batch up to its highest seqno.
+func (s *ServerConn) Ack(batch *Batch, credits int) error {
+	var e encoder
+	e.uint64(batch.Id)
+	e.uint16(batch.Vbucket)
+	e.uint64(batch.HighSeqno())
+	e.uint32(uint32(credits))
+	return s.send(FRAME_ACK, e.Bytes())
+}
+
+// Reject replies to a batch with an error, the client must not assume any
+// of its mutations were applied.
+func (s *ServerConn) Reject(batch *Batch, err error, credits int) error {
+	indexerr := api.IndexErrorOf(err)
+	var e encoder
+	e.uint64(batch.Id)
+	e.bytes([]byte(indexerr.Code))
+	e.bytes([]byte(indexerr.Msg))
+	e.uint32(uint32(credits))
+	return s.send(FRAME_NACK, e.Bytes())
+}
+
+func (s *ServerConn) send(typ byte, payload []byte) error {
+	if err := WriteFrame(s.w, typ, payload); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
@@ -0,0 +1,239 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/couchbaselabs/indexing/api"
+	"net"
+	"reflect"
+	"testing"
+)
+
+var testMutations = []Mutation{
+	{
+		Type: api.INSERT, Docid: "doc1", Vbucket: 7, Seqno: 10, Vbuuid: 0xbeef,
+		Entries: []Entry{
+			{Indexid: "idx1", SecondaryKey: [][]byte{[]byte(`"a"`), []byte(`1`)}},
+			{Indexid: "idx2", SecondaryKey: [][]byte{[]byte("doc1")}},
+		},
+	},
+	{
+		Type: api.DELETE, Docid: "doc2", Vbucket: 7, Seqno: 12, Vbuuid: 0xbeef,
+		Entries: []Entry{{Indexid: "idx1"}, {Indexid: "idx2"}},
+	},
+}
+
+func TestBatchEncoding(t *testing.T) {
+	batch := &Batch{Id: 3, Vbucket: 7, Mutations: testMutations}
+	data, err := batch.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Batch
+	if err = decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*batch, decoded) {
+		t.Errorf("Expected %v, got %v", *batch, decoded)
+	}
+	if decoded.HighSeqno() != 12 {
+		t.Errorf("Expected high seqno 12, got %v", decoded.HighSeqno())
+	}
+
+	if err = decoded.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Error("Expected truncated batch to fail")
+	}
+	other := &Batch{Id: 4, Vbucket: 8, Mutations: testMutations}
+	if _, err = other.MarshalBinary(); err == nil {
+		t.Error("Expected mutation of another vbucket to fail")
+	}
+}
+
+func TestSplit(t *testing.T) {
+	muts := testMutations[0].Split()
+	if len(muts) != 2 {
+		t.Fatalf("Expected a mutation per index, got %v", len(muts))
+	}
+	for i, m := range muts {
+		entry := testMutations[0].Entries[i]
+		if m.Indexid != entry.Indexid || m.Docid != "doc1" || m.Seqno != 10 || m.Vbuuid != 0xbeef ||
+			m.Vbucket != 7 || !reflect.DeepEqual(m.SecondaryKey, entry.SecondaryKey) {
+			t.Errorf("Unexpected mutation %v", m)
+		}
+	}
+}
+
+// serve runs a stream server that acks batches, or rejects them with
+// `reject` if set, and sends received batches on the returned channel. It
+// grants `credits` index entries and rejects larger batches as a full queue.
+func serve(t *testing.T, reject error, credits int) (string, chan *Batch) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan *Batch, 10)
+	go func() {
+		conn, err := l.Accept()
+		l.Close()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if b, err := r.Peek(1); err != nil || !IsHello(b[0]) {
+			return //not a stream client, like a JSON-RPC server would
+		}
+		s, err := Accept(r, conn, credits)
+		if err != nil {
+			return
+		}
+		for {
+			batch, err := s.Next()
+			if err != nil {
+				return
+			}
+			if Fit(batch.Mutations, credits) < len(batch.Mutations) {
+				s.Reject(batch, api.NewError(api.ERR_QUEUE_FULL, "full"), credits)
+				continue
+			}
+			ch <- batch
+			if reject != nil {
+				s.Reject(batch, reject, credits)
+			} else {
+				for _, m := range batch.Mutations {
+					credits -= len(m.Entries)
+				}
+				s.Ack(batch, credits)
+			}
+		}
+	}()
+	return l.Addr().String(), ch
+}
+
+func TestSend(t *testing.T) {
+	addr, ch := serve(t, nil, 100)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Hello(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Credits() != 100 {
+		t.Errorf("Expected 100 credits, got %v", c.Credits())
+	}
+
+	for i := 0; i < 2; i++ {
+		seqno, err := c.Send(7, testMutations)
+		if err != nil || seqno != 12 {
+			t.Fatalf("Expected ack of seqno 12, got %v %v", seqno, err)
+		}
+		batch := <-ch
+		if batch.Id != uint64(i+1) || !reflect.DeepEqual(batch.Mutations, testMutations) {
+			t.Errorf("Unexpected batch %v", batch)
+		}
+	}
+	if c.Credits() != 92 {
+		t.Errorf("Expected 92 credits, got %v", c.Credits())
+	}
+}
+
+func TestReject(t *testing.T) {
+	addr, _ := serve(t, api.NoSuchIndex, 100)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Hello(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err = c.Send(7, testMutations); err != api.NoSuchIndex {
+		t.Errorf("Expected %v, got %v", api.NoSuchIndex, err)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	addr, ch := serve(t, nil, 3)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Hello(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.Send(7, testMutations)
+	if api.CodeOf(err) != api.ERR_QUEUE_FULL || c.Credits() != 3 {
+		t.Errorf("Expected queue full with 3 credits, got %v %v", err, c.Credits())
+	}
+	//what fits is accepted
+	n := Fit(testMutations, c.Credits())
+	if n != 1 {
+		t.Fatalf("Expected 1 mutation of 2 entries to fit, got %v", n)
+	}
+	if _, err = c.Send(7, testMutations[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if batch := <-ch; len(batch.Mutations) != 1 || c.Credits() != 1 {
+		t.Errorf("Unexpected batch %v, %v credits", batch, c.Credits())
+	}
+}
+
+func TestHelloRefused(t *testing.T) {
+	//a server that does not know the protocol closes the connection
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Hello(conn); err == nil {
+		t.Error("Expected hello to fail")
+	}
+}
+
+func TestOldVersion(t *testing.T) {
+	//clients of an older version fall back to JSON-RPC
+	var hello, welcome bytes.Buffer
+	hello.Write([]byte{FRAME_HELLO, 0, 0, 0, 6})
+	hello.WriteString(MAGIC)
+	hello.Write([]byte{0, VERSION - 1})
+	if _, err := Accept(bufio.NewReader(&hello), &welcome, 10); err == nil || welcome.Len() > 0 {
+		t.Errorf("Expected older version to be refused, got %v", err)
+	}
+}
+
+func TestFrameSize(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{FRAME_BATCH, 0xff, 0xff, 0xff, 0xff})
+	if _, _, err := ReadFrame(&buf); err == nil {
+		t.Error("Expected oversized frame to fail")
+	}
+	if IsHello('{') {
+		t.Error("JSON-RPC must not be taken for the stream protocol")
+	}
+}
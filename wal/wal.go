@@ -0,0 +1,345 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Append only log of records, numbered by log sequence numbers (LSN)
+// starting from 1. The log is kept in segment files named after the LSN of
+// their first record,
+//   <dir>/<first lsn, 16 hex digits>.wal
+// each record being
+//   length uint32 | crc32 of lsn and payload uint32 | lsn uint64 | payload
+// in big endian. A new segment is started once the current one reaches the
+// segment size, and segments are removed whole once every record in them
+// is truncated.
+//
+// A record torn by a crash while appending can only be the last one, it is
+// cut off when the log is opened. Damage anywhere else fails Open with
+// ErrCorrupt.
+
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const SEGMENT_EXT = ".wal"
+const HEADER_SIZE = 16
+const MAX_RECORD_SIZE = 256 * 1024 * 1024
+const DEFAULT_SEGMENT_SIZE = 64 * 1024 * 1024
+
+var ErrClosed = errors.New("wal: log is closed")
+var ErrCorrupt = errors.New("wal: corrupt record")
+var errTorn = errors.New("wal: torn record")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type Options struct {
+	SegmentSize int64 //bytes after which a new segment is started
+	Sync        bool  //fsync every append before returning
+}
+
+type segment struct {
+	path  string
+	first uint64 //lsn of the first record
+}
+
+// Log is safe for concurrent use.
+type Log struct {
+	sync.Mutex
+	dir      string
+	opts     Options
+	segments []segment //oldest first, the last one is appended to
+	file     *os.File
+	size     int64
+	next     uint64 //lsn of the next record
+	closed   bool
+}
+
+// Open opens the log in `dir`, creating it if needed.
+func Open(dir string, opts Options) (*Log, error) {
+
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DEFAULT_SEGMENT_SIZE
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir, opts: opts, next: 1}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	if len(l.segments) == 0 {
+		if err := l.startSegment(); err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+
+	//validate every segment, the last one may end with a torn record
+	for i, seg := range l.segments {
+		last := i == len(l.segments)-1
+		//segments before the first were truncated
+		if i > 0 && seg.first != l.next {
+			return nil, fmt.Errorf("wal: segment %v starts at lsn %v, expected %v", seg.path, seg.first, l.next)
+		}
+		l.next = seg.first
+		end, err := scanSegment(seg, func(lsn uint64, payload []byte) error {
+			if lsn != l.next {
+				return ErrCorrupt
+			}
+			l.next = lsn + 1
+			return nil
+		})
+		if err == errTorn && last {
+			if err = os.Truncate(seg.path, end); err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, fmt.Errorf("wal: segment %v: %v", seg.path, err)
+		}
+		if last {
+			if l.file, err = os.OpenFile(seg.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+				return nil, err
+			}
+			l.size = end
+		}
+	}
+	return l, nil
+}
+
+// load lists the segments in the log directory.
+func (l *Log) load() error {
+
+	entries, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, SEGMENT_EXT) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, SEGMENT_EXT), 16, 64)
+		if err != nil {
+			continue
+		}
+		l.segments = append(l.segments, segment{filepath.Join(l.dir, name), first})
+	}
+	sort.Sort(byFirst(l.segments))
+	return nil
+}
+
+type byFirst []segment
+
+func (s byFirst) Len() int           { return len(s) }
+func (s byFirst) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byFirst) Less(i, j int) bool { return s[i].first < s[j].first }
+
+// scanSegment calls `fn` for every record of a segment, and returns the
+// offset past the last valid record. A last record that cannot be read
+// whole or fails its checksum returns errTorn, any other record failing
+// its checksum ErrCorrupt.
+func scanSegment(seg segment, fn func(lsn uint64, payload []byte) error) (int64, error) {
+
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	var offset int64
+	header := make([]byte, HEADER_SIZE)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, errTorn
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		sum := binary.BigEndian.Uint32(header[4:8])
+		lsn := binary.BigEndian.Uint64(header[8:16])
+		if length > MAX_RECORD_SIZE {
+			return offset, ErrCorrupt
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return offset, errTorn
+		}
+		if checksum(header[8:16], payload) != sum {
+			if _, err := r.Peek(1); err == io.EOF {
+				return offset, errTorn
+			}
+			return offset, ErrCorrupt
+		}
+		if err := fn(lsn, payload); err != nil {
+			return offset, err
+		}
+		offset += HEADER_SIZE + int64(length)
+	}
+}
+
+func checksum(lsn, payload []byte) uint32 {
+	return crc32.Update(crc32.Checksum(lsn, crcTable), crcTable, payload)
+}
+
+// startSegment starts a new segment at the next lsn.
+func (l *Log) startSegment() error {
+
+	if l.file != nil {
+		if err := l.file.Sync(); err != nil {
+			return err
+		}
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+		l.file = nil
+	}
+	path := filepath.Join(l.dir, fmt.Sprintf("%016x%s", l.next, SEGMENT_EXT))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	l.file, l.size = file, 0
+	l.segments = append(l.segments, segment{path, l.next})
+	return nil
+}
+
+// Append writes a record and returns its lsn. With Options.Sync the record
+// is on disk when Append returns.
+func (l *Log) Append(payload []byte) (uint64, error) {
+
+	if len(payload) > MAX_RECORD_SIZE {
+		return 0, fmt.Errorf("wal: record of %v bytes exceeds %v", len(payload), MAX_RECORD_SIZE)
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
+	if l.size >= l.opts.SegmentSize {
+		if err := l.startSegment(); err != nil {
+			return 0, err
+		}
+	}
+
+	lsn := l.next
+	record := make([]byte, HEADER_SIZE+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint64(record[8:16], lsn)
+	binary.BigEndian.PutUint32(record[4:8], checksum(record[8:16], payload))
+	copy(record[HEADER_SIZE:], payload)
+	_, err := l.file.Write(record)
+	if err == nil && l.opts.Sync {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		//cut off what was written, the record was not appended
+		l.file.Truncate(l.size)
+		return 0, err
+	}
+	l.size += int64(len(record))
+	l.next++
+	return lsn, nil
+}
+
+// Replay calls `fn` for every record from lsn `from` on, in lsn order.
+// Records appended while replaying may not be seen.
+func (l *Log) Replay(from uint64, fn func(lsn uint64, payload []byte) error) error {
+
+	l.Lock()
+	if l.closed {
+		l.Unlock()
+		return ErrClosed
+	}
+	segments := make([]segment, len(l.segments))
+	copy(segments, l.segments)
+	l.Unlock()
+
+	for i, seg := range segments {
+		if i+1 < len(segments) && segments[i+1].first <= from {
+			continue
+		}
+		_, err := scanSegment(seg, func(lsn uint64, payload []byte) error {
+			if lsn < from {
+				return nil
+			}
+			return fn(lsn, payload)
+		})
+		//a record being appended to the last segment is not complete yet
+		if err == errTorn && i == len(segments)-1 {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Truncate removes the segments whose records all have an lsn at or below
+// `upto`. The segment being appended to is kept.
+func (l *Log) Truncate(upto uint64) error {
+
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	n := 0
+	for n+1 < len(l.segments) && l.segments[n+1].first <= upto+1 {
+		if err := os.Remove(l.segments[n].path); err != nil && !os.IsNotExist(err) {
+			l.segments = l.segments[n:]
+			return err
+		}
+		n++
+	}
+	l.segments = l.segments[n:]
+	return nil
+}
+
+// Next returns the lsn the next record will get.
+func (l *Log) Next() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.next
+}
+
+// Segments returns the number of segment files.
+func (l *Log) Segments() int {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.segments)
+}
+
+// Close syncs and closes the log.
+func (l *Log) Close() error {
+
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
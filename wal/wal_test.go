@@ -0,0 +1,129 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func replayAll(t *testing.T, l *Log, from uint64) []string {
+	var records []string
+	err := l.Replay(from, func(lsn uint64, payload []byte) error {
+		records = append(records, fmt.Sprintf("%v:%s", lsn, payload))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestAppendReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := Open(dir, Options{SegmentSize: 40, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if lsn, err := l.Append([]byte(fmt.Sprintf("rec%d", i))); err != nil || lsn != uint64(i) {
+			t.Fatalf("Expected lsn %v, got %v %v", i, lsn, err)
+		}
+	}
+	//two 20 byte records per segment
+	if n := l.Segments(); n != 3 {
+		t.Errorf("Expected 3 segments, got %v", n)
+	}
+	if records := replayAll(t, l, 4); fmt.Sprint(records) != "[4:rec4 5:rec5]" {
+		t.Errorf("Unexpected records %v", records)
+	}
+	l.Close()
+
+	//reopening continues the lsn sequence
+	if l, err = Open(dir, Options{SegmentSize: 40}); err != nil {
+		t.Fatal(err)
+	}
+	if lsn, err := l.Append([]byte("rec6")); err != nil || lsn != 6 {
+		t.Errorf("Expected lsn 6, got %v %v", lsn, err)
+	}
+
+	//segments are removed whole, the one appended to is kept
+	if err = l.Truncate(3); err != nil {
+		t.Fatal(err)
+	}
+	if n := l.Segments(); n != 2 {
+		t.Errorf("Expected 2 segments left, got %v", n)
+	}
+	if records := replayAll(t, l, 1); fmt.Sprint(records) != "[3:rec3 4:rec4 5:rec5 6:rec6]" {
+		t.Errorf("Unexpected records %v", records)
+	}
+	if err = l.Truncate(6); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	if l, err = Open(dir, Options{SegmentSize: 40}); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if records := replayAll(t, l, 1); fmt.Sprint(records) != "[5:rec5 6:rec6]" {
+		t.Errorf("Unexpected records %v", records)
+	}
+	if next := l.Next(); next != 7 {
+		t.Errorf("Expected next lsn 7, got %v", next)
+	}
+}
+
+func TestTornRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Append([]byte("whole"))
+	l.Append([]byte("torn"))
+	l.Close()
+
+	path := l.segments[0].path
+	info, _ := os.Stat(path)
+	if err = os.Truncate(path, info.Size()-2); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = Open(dir, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if records := replayAll(t, l, 1); fmt.Sprint(records) != "[1:whole]" {
+		t.Errorf("Expected torn record cut off, got %v", records)
+	}
+	if lsn, err := l.Append([]byte("next")); err != nil || lsn != 2 {
+		t.Errorf("Expected lsn 2, got %v %v", lsn, err)
+	}
+	l.Close()
+
+	//damage before the last record fails
+	data, _ := ioutil.ReadFile(path)
+	data[HEADER_SIZE] ^= 0xff
+	ioutil.WriteFile(path, data, 0644)
+	if _, err = Open(dir, Options{}); err == nil {
+		t.Error("Expected corrupt record to fail")
+	}
+}